@@ -25,6 +25,7 @@ type controller struct {
 type instance struct {
 	*trace.Instance
 	sceneName        string
+	integrator       trace.Integrator
 	created          time.Time
 	dim              xmath.Dimensions
 	requestedWorkers int
@@ -32,6 +33,7 @@ type instance struct {
 
 type render struct {
 	Scene            string    `json:"scene"`
+	Integrator       string    `json:"integrator"`
 	PxWide           int       `json:"px_wide"`
 	PxHigh           int       `json:"px_high"`
 	LoadState        string    `json:"load_state"`
@@ -52,6 +54,7 @@ func (c *controller) getRenders() []render {
 		stats := inst.GetStats()
 		renders = append(renders, render{
 			Scene:            inst.sceneName,
+			Integrator:       string(inst.integrator),
 			PxWide:           inst.dim.Wide,
 			PxHigh:           inst.dim.High,
 			LoadState:        stats.LoadState,
@@ -72,6 +75,7 @@ func (c *controller) newRender(
 	accumFilename string,
 	created time.Time,
 	sceneName string,
+	integrator trace.Integrator,
 	dim xmath.Dimensions,
 ) error {
 	c.mu.Lock()
@@ -80,10 +84,17 @@ func (c *controller) newRender(
 	if !ok {
 		return fmt.Errorf("unknown scene name: %v", sceneName)
 	}
+	if integrator == "" {
+		integrator = trace.PathTracing
+	}
+	if !integrator.Valid() {
+		return fmt.Errorf("unknown integrator: %v", integrator)
+	}
 
 	inst := &instance{
-		Instance:         trace.NewInstance(dim, sceneFn, accumFilename),
+		Instance:         trace.NewInstance(dim, sceneFn, integrator, accumFilename),
 		sceneName:        sceneName,
+		integrator:       integrator,
 		created:          created,
 		dim:              dim,
 		requestedWorkers: 0,
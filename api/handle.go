@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/peterstace/grayt/scene/library"
+	"github.com/peterstace/grayt/trace"
 	"github.com/peterstace/grayt/xmath"
 )
 
@@ -44,9 +45,10 @@ func (s *Server) handleGetRenders(w http.ResponseWriter) {
 
 func (s *Server) handlePostRenders(w http.ResponseWriter, req *http.Request) {
 	var form struct {
-		Scene  string `json:"scene"`
-		PxWide int    `json:"px_wide"`
-		PxHigh int    `json:"px_high"`
+		Scene      string           `json:"scene"`
+		Integrator trace.Integrator `json:"integrator"`
+		PxWide     int              `json:"px_wide"`
+		PxHigh     int              `json:"px_high"`
 	}
 	if err := json.NewDecoder(req.Body).Decode(&form); err != nil {
 		http.Error(w, "decoding form: "+err.Error(), http.StatusBadRequest)
@@ -56,18 +58,25 @@ func (s *Server) handlePostRenders(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "px_wide or px_high not set", http.StatusBadRequest)
 		return
 	}
+	if form.Integrator == "" {
+		form.Integrator = trace.PathTracing
+	}
+	if !form.Integrator.Valid() {
+		http.Error(w, "unknown integrator: "+string(form.Integrator), http.StatusBadRequest)
+		return
+	}
 
 	id := generateID()
 	accumFilename := filepath.Join(s.dataDir, id+".data")
 	now := time.Now()
 	dim := xmath.Dimensions{form.PxWide, form.PxHigh}
 	metadataFilename := filepath.Join(s.dataDir, id+".json")
-	if err := saveMetadata(metadata{form.Scene, now, dim}, metadataFilename); err != nil {
+	if err := saveMetadata(metadata{form.Scene, form.Integrator, now, dim}, metadataFilename); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := s.ctrl.newRender(id, accumFilename, now, form.Scene, dim); err != nil {
+	if err := s.ctrl.newRender(id, accumFilename, now, form.Scene, form.Integrator, dim); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -9,13 +9,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/peterstace/grayt/trace"
 	"github.com/peterstace/grayt/xmath"
 )
 
 type metadata struct {
-	SceneName string           `json:"scene_name"`
-	Created   time.Time        `json:"created"`
-	Dim       xmath.Dimensions `json:"dim"`
+	SceneName  string           `json:"scene_name"`
+	Integrator trace.Integrator `json:"integrator,omitempty"`
+	Created    time.Time        `json:"created"`
+	Dim        xmath.Dimensions `json:"dim"`
 }
 
 func saveMetadata(m metadata, filename string) error {
@@ -49,7 +51,7 @@ func (s *Server) loadRenders() error {
 		id := strings.TrimSuffix(filepath.Base(fname), ".json")
 		accumFilename := filepath.Join(filepath.Dir(fname), id+".data")
 		if err := s.ctrl.newRender(
-			id, accumFilename, m.Created, m.SceneName, m.Dim,
+			id, accumFilename, m.Created, m.SceneName, m.Integrator, m.Dim,
 		); err != nil {
 			return fmt.Errorf("could not create render: %v", err)
 		}
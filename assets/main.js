@@ -9,6 +9,7 @@ function updateStatus() {
       <table>
         <tr>
           <td>scene name</td>
+          <td>integrator</td>
           <td>dimensions</td>
           <td>load state</td>
           <td>passes</td>
@@ -22,6 +23,7 @@ function updateStatus() {
       statusTxt += `
         <tr>
           <td>${obj[i].scene}</td>
+          <td>${obj[i].integrator}</td>
           <td>${obj[i].px_wide}x${obj[i].px_high}</td>
           <td>${obj[i].load_state}</td>
           <td>${obj[i].passes}</td>
@@ -129,6 +131,7 @@ function handleAddResource() {
   const dim = document.getElementById('resolutions').value.split("x");
   xhr.send(JSON.stringify({
     scene: document.getElementById('scene-selection').value,
+    integrator: document.getElementById('integrator-selection').value,
     px_wide: Number(dim[0]),
     px_high: Number(dim[1]),
   }));
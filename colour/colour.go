@@ -137,3 +137,25 @@ func float64ToUint8(f float64) uint8 {
 		return uint8(f * 0x100)
 	}
 }
+
+// DecodeSRGB converts a colour from the non-linear sRGB encoding (as used by
+// most image files) to linear intensities.
+func (c Colour) DecodeSRGB() Colour {
+	return Colour{
+		decodeSRGB(c.R),
+		decodeSRGB(c.G),
+		decodeSRGB(c.B),
+	}
+}
+
+func decodeSRGB(f float64) float64 {
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// Luminance gives the perceived brightness of a (linear) colour.
+func (c Colour) Luminance() float64 {
+	return 0.2126*c.R + 0.7152*c.G + 0.0722*c.B
+}
@@ -0,0 +1,170 @@
+package colour
+
+import "math"
+
+// Wavelengths are in nanometres. Spectral rendering only considers the
+// visible range.
+const (
+	MinWavelength = 360.0
+	MaxWavelength = 830.0
+)
+
+// XYZ is a colour in the CIE 1931 XYZ colour space.
+type XYZ struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (c XYZ) Add(rhs XYZ) XYZ {
+	return XYZ{c.X + rhs.X, c.Y + rhs.Y, c.Z + rhs.Z}
+}
+
+func (c XYZ) Scale(f float64) XYZ {
+	return XYZ{c.X * f, c.Y * f, c.Z * f}
+}
+
+// MatchingFunctions gives the CIE 1931 2° standard observer colour matching
+// functions at a wavelength. It uses the multi-lobe Gaussian fit by Wyman,
+// Sloan and Shirley (2013), which is accurate to within the variability
+// between human observers.
+func MatchingFunctions(lambda float64) XYZ {
+	g := func(mu, sigma1, sigma2 float64) float64 {
+		sigma := sigma2
+		if lambda < mu {
+			sigma = sigma1
+		}
+		t := (lambda - mu) / sigma
+		return math.Exp(-0.5 * t * t)
+	}
+	return XYZ{
+		X: 1.056*g(599.8, 37.9, 31.0) + 0.362*g(442.0, 16.0, 26.7) - 0.065*g(501.1, 20.4, 26.2),
+		Y: 0.821*g(568.8, 46.9, 40.5) + 0.286*g(530.9, 16.3, 31.1),
+		Z: 1.217*g(437.0, 11.8, 36.0) + 0.681*g(459.0, 26.0, 13.8),
+	}
+}
+
+// equalEnergyWhite is the linear sRGB colour (before white balancing) of the
+// spectrum that is 1 at all wavelengths.
+var equalEnergyWhite = func() Colour {
+	var sum XYZ
+	for lambda := MinWavelength; lambda < MaxWavelength; lambda++ {
+		sum = sum.Add(MatchingFunctions(lambda + 0.5))
+	}
+	return sum.toLinearSRGB()
+}()
+
+func (c XYZ) toLinearSRGB() Colour {
+	return Colour{
+		R: 3.2404542*c.X - 1.5371385*c.Y - 0.4985314*c.Z,
+		G: -0.9692660*c.X + 1.8760108*c.Y + 0.0415560*c.Z,
+		B: 0.0556434*c.X - 0.2040259*c.Y + 1.0572252*c.Z,
+	}
+}
+
+// ToLinearSRGB converts an XYZ colour (integrated over wavelengths in
+// nanometres) to linear sRGB. It's white balanced so that a spectrum of 1 at
+// all wavelengths converts to RGB white.
+func (c XYZ) ToLinearSRGB() Colour {
+	return c.toLinearSRGB().Div(equalEnergyWhite)
+}
+
+// Basis spectra for upsampling RGB colours, from "An RGB to Spectrum
+// Conversion for Reflectances" by Brian Smits (1999). Each has 10 bins evenly
+// spanning 380nm to 720nm.
+const (
+	smitsMinWavelength = 380.0
+	smitsMaxWavelength = 720.0
+)
+
+var (
+	smitsWhite   = [10]float64{1.0000, 1.0000, 0.9999, 0.9993, 0.9992, 0.9998, 1.0000, 1.0000, 1.0000, 1.0000}
+	smitsCyan    = [10]float64{0.9710, 0.9426, 1.0007, 1.0007, 1.0007, 1.0007, 0.1564, 0.0000, 0.0000, 0.0000}
+	smitsMagenta = [10]float64{1.0000, 1.0000, 0.9685, 0.2229, 0.0000, 0.0458, 0.8369, 1.0000, 1.0000, 0.9959}
+	smitsYellow  = [10]float64{0.0001, 0.0000, 0.1088, 0.6651, 1.0000, 1.0000, 0.9996, 0.9586, 0.9685, 0.9840}
+	smitsRed     = [10]float64{0.1012, 0.0515, 0.0000, 0.0000, 0.0000, 0.0000, 0.8325, 1.0149, 1.0149, 1.0149}
+	smitsGreen   = [10]float64{0.0000, 0.0000, 0.0273, 0.7937, 1.0000, 0.9418, 0.1719, 0.0000, 0.0000, 0.0025}
+	smitsBlue    = [10]float64{1.0000, 1.0000, 0.8916, 0.3323, 0.0000, 0.0000, 0.0003, 0.0369, 0.0483, 0.0496}
+)
+
+// SpectrumAt upsamples an RGB colour to a smooth spectrum (using Smits'
+// method), and evaluates it at a wavelength. The colour is treated as a
+// reflectance, but scaled colours (e.g. for emitters) upsample to scaled
+// spectra.
+func (c Colour) SpectrumAt(lambda float64) float64 {
+	bin := int((lambda - smitsMinWavelength) / (smitsMaxWavelength - smitsMinWavelength) * 10)
+	if bin < 0 {
+		bin = 0
+	}
+	if bin > 9 {
+		bin = 9
+	}
+
+	// The smallest component is made up of white, the middle component of
+	// the secondary colour containing both the middle and largest components,
+	// and the remainder of the largest component's primary colour.
+	r, g, b := c.R, c.G, c.B
+	switch {
+	case r <= g && r <= b:
+		s := r * smitsWhite[bin]
+		if g <= b {
+			return s + (g-r)*smitsCyan[bin] + (b-g)*smitsBlue[bin]
+		}
+		return s + (b-r)*smitsCyan[bin] + (g-b)*smitsGreen[bin]
+	case g <= r && g <= b:
+		s := g * smitsWhite[bin]
+		if r <= b {
+			return s + (r-g)*smitsMagenta[bin] + (b-r)*smitsBlue[bin]
+		}
+		return s + (b-g)*smitsMagenta[bin] + (r-b)*smitsRed[bin]
+	default:
+		s := b * smitsWhite[bin]
+		if r <= g {
+			return s + (r-b)*smitsYellow[bin] + (g-r)*smitsGreen[bin]
+		}
+		return s + (g-b)*smitsYellow[bin] + (r-g)*smitsRed[bin]
+	}
+}
+
+// FromSpectrum converts a spectrum (a function of wavelength in nanometres)
+// to linear sRGB.
+func FromSpectrum(s func(lambda float64) float64) Colour {
+	var sum XYZ
+	for lambda := MinWavelength; lambda < MaxWavelength; lambda++ {
+		sum = sum.Add(MatchingFunctions(lambda + 0.5).Scale(s(lambda + 0.5)))
+	}
+	return sum.ToLinearSRGB()
+}
+
+// Planck gives the spectral radiance of a blackbody at a temperature (in
+// Kelvin) and wavelength (in nanometres), in W/(sr·m²·nm).
+func Planck(kelvin, lambda float64) float64 {
+	const (
+		h = 6.62607015e-34 // Planck constant.
+		c = 299792458      // Speed of light.
+		k = 1.380649e-23   // Boltzmann constant.
+	)
+	l := lambda * 1e-9
+	return 2 * h * c * c / (l * l * l * l * l) / (math.Exp(h*c/(l*k*kelvin)) - 1) * 1e-9
+}
+
+// BlackbodySpectrum gives the spectrum of a blackbody at a temperature (in
+// Kelvin), normalised to have a luminance of 1.
+func BlackbodySpectrum(kelvin float64) func(lambda float64) float64 {
+	planck := func(lambda float64) float64 { return Planck(kelvin, lambda) }
+	scale := 1 / FromSpectrum(planck).Luminance()
+	return func(lambda float64) float64 {
+		return scale * planck(lambda)
+	}
+}
+
+// Blackbody gives the colour of a blackbody at a temperature (in Kelvin),
+// normalised to have a luminance of 1. Colours are white balanced in the same
+// way as ToLinearSRGB, so a blackbody looks close to white at around 5500K.
+// Tungsten lights (around 2700K) look orange, and daylight lamps (around
+// 6500K) look slightly blue. Very low temperatures are outside of the sRGB
+// gamut, so negative components are clamped to zero.
+func Blackbody(kelvin float64) Colour {
+	c := FromSpectrum(BlackbodySpectrum(kelvin))
+	return Colour{math.Max(0, c.R), math.Max(0, c.G), math.Max(0, c.B)}
+}
@@ -0,0 +1,44 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// CSG shows a sphere with a rotated box cut out of it (left), and a lens
+// formed by the intersection of two spheres (right).
+func CSG() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					Difference(
+						Sphere(Vect(0.3, 0.2, -0.5), 0.2),
+						OrientedBox(Vect(0.3, 0.35, -0.35), Vect(0.25, 0.25, 0.25), Vect(1, 1, 0), 0.5),
+					),
+					Intersection(
+						Sphere(Vect(0.72, 0.2, -0.65), 0.3),
+						Sphere(Vect(0.72, 0.2, -0.2), 0.3),
+					),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+		},
+	}
+}
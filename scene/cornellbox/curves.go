@@ -0,0 +1,81 @@
+package cornellbox
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Curves shows off the curve primitive with a patch of grass and a wire helix.
+func Curves() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: colour.Colour{R: 0.3, G: 0.6, B: 0.15}},
+				Surface:  grass(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: colour.Colour{R: 0.9, G: 0.6, B: 0.2}},
+				Surface:  helix(Vect(0.7, 0, -0.6), 0.12, 0.5, 4),
+			},
+		},
+	}
+}
+
+func grass() scene.Surface {
+	rng := rand.New(rand.NewSource(1))
+	var blades []scene.Surface
+	for i := 0; i < 1000; i++ {
+		base := Vect(0.1+0.4*rng.Float64(), 0, -0.2-0.6*rng.Float64())
+		height := 0.15 + 0.15*rng.Float64()
+		bend := rng.Float64() * 2 * math.Pi
+		lean := Vect(math.Cos(bend), 0, math.Sin(bend)).Scale(0.12 * rng.Float64())
+		var pts []xmath.Vector
+		for j := -1; j <= 4; j++ {
+			f := float64(j) / 3
+			pts = append(pts, base.Add(Vect(0, f*height, 0)).Add(lean.Scale(f*f)))
+		}
+		blades = append(blades, BSplineCurve(pts, 0.003, 0.0005))
+	}
+	return MergeSurfaces(blades...)
+}
+
+func helix(base xmath.Vector, radius, height, turns float64) scene.Surface {
+	const segsPerTurn = 8
+	var pts []xmath.Vector
+	n := int(turns * segsPerTurn)
+	for i := -1; i <= n+1; i++ {
+		a := float64(i) / segsPerTurn * 2 * math.Pi
+		pts = append(pts, base.Add(Vect(
+			radius*math.Cos(a),
+			height*float64(i)/float64(n),
+			radius*math.Sin(a),
+		)))
+	}
+	return BSplineCurve(pts, 0.01, 0.01)
+}
@@ -0,0 +1,49 @@
+package cornellbox
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// Cutaway views the box from outside of its left wall, which is one-sided so
+// that it's invisible from outside but still reflects red light inside. The
+// box is lit by a ceiling panel that only emits downwards.
+func Cutaway() scene.Scene {
+	const d = 1.3
+	cam := DefaultCamera()
+	cam.Location = Vect(-d, 0.5, -0.5)
+	cam.LookingAt = Vect(0.5, 0.5, -0.5)
+	cam.FieldOfViewInRadians = 2 * math.Asin(0.5/math.Sqrt(0.25+d*d))
+
+	return scene.Scene{
+		Camera: cam,
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					CornellShortBlock(),
+					CornellTallBlock(),
+				),
+			},
+			scene.Object{
+				// The left wall's normal points into the box.
+				Material: scene.Material{Colour: Red, OneSided: true},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				// The panel's normal points up, into the ceiling.
+				Material: scene.Material{Colour: White, Emittance: 5, EmitSide: scene.SideBack},
+				Surface:  AlignedSquare(Vect(0.1, 0.999, -0.1), Vect(0.9, 0.999, -0.9)),
+			},
+		},
+	}
+}
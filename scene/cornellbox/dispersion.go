@@ -0,0 +1,68 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Dispersion is rendered spectrally, and shows a prism of dense flint glass
+// (which splits light into its colours) and a diamond sphere.
+func Dispersion() scene.Scene {
+	flint := &scene.Dielectric{Sellmeier: &scene.Sellmeier{
+		B: [3]float64{1.73759695, 0.313747346, 1.89878101},
+		C: [3]float64{0.013188707, 0.0623068142, 155.23629},
+	}}
+	diamond := &scene.Dielectric{Cauchy: &scene.Cauchy{A: 2.385, B: 0.0117}}
+	return scene.Scene{
+		Camera:   CornellCam(1.3),
+		Spectral: true,
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				Material: scene.Material{Dielectric: flint},
+				Surface:  prism(Vect(0.35, 0, -0.75), Vect(0.65, 0, -0.75), 0.25, 0.4),
+			},
+			scene.Object{
+				Material: scene.Material{Dielectric: diamond},
+				Surface:  Sphere(Vect(0.7, 0.12, -0.3), 0.12),
+			},
+		},
+	}
+}
+
+// prism creates a triangular prism, with its base from a to b, and extending
+// depth along -Z. The triangle's apex is height above the middle of the base.
+func prism(a, b xmath.Vector, height, depth float64) scene.Surface {
+	apex := a.Add(b).Scale(0.5).Add(Vect(0, height, 0))
+	back := Vect(0, 0, -depth)
+	cross := [3]xmath.Vector{a, b, apex}
+	surf := scene.Surface{Triangles: []scene.Triangle{
+		{A: a, B: b, C: apex},
+		{A: a.Add(back), B: apex.Add(back), C: b.Add(back)},
+	}}
+	for i := range cross {
+		p, q := cross[i], cross[(i+1)%3]
+		surf = MergeSurfaces(surf, Square(p.Add(back), q.Add(back), q, p))
+	}
+	return surf
+}
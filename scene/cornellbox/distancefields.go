@@ -0,0 +1,57 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/scene/sdf"
+)
+
+// DistanceFields shows surfaces defined by signed distance functions: two spheres
+// smoothly blended together (left), a twisted box (right), and a row of
+// repeated tori along the back wall.
+func DistanceFields() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					SDF(
+						sdf.SmoothUnion(
+							sdf.Sphere(Vect(0.25, 0.15, -0.55), 0.15),
+							sdf.Sphere(Vect(0.3, 0.35, -0.5), 0.1),
+							0.1,
+						),
+						Vect(0.05, 0, -0.75), Vect(0.45, 0.5, -0.35),
+					),
+					SDF(
+						sdf.Translate(
+							sdf.Twist(sdf.Box(Vect(0, 0.25, 0), Vect(0.08, 0.25, 0.08)), 3),
+							Vect(0.72, 0, -0.5),
+						),
+						Vect(0.55, 0, -0.7), Vect(0.9, 0.5, -0.3),
+					),
+					SDF(
+						sdf.Repeat(sdf.Torus(Vect(0, 0.85, -0.95), 0.05, 0.015), Vect(0.15, 0, 0)),
+						Vect(0, 0.78, -1), Vect(1, 0.92, -0.9),
+					),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+		},
+	}
+}
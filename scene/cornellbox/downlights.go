@@ -0,0 +1,49 @@
+package cornellbox
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Downlights lights the box with a row of recessed downlights near the back
+// wall, which throw scalloped patterns of light onto it.
+func Downlights() scene.Scene {
+	objs := []scene.Object{
+		scene.Object{
+			Material: scene.Material{Colour: White},
+			Surface: MergeSurfaces(
+				CornellFloor,
+				CornellCeiling,
+				CornellBackWall,
+				CornellShortBlock(),
+				CornellTallBlock(),
+			),
+		},
+		scene.Object{
+			Material: scene.Material{Colour: Red},
+			Surface:  CornellLeftWall,
+		},
+		scene.Object{
+			Material: scene.Material{Colour: Green},
+			Surface:  CornellRightWall,
+		},
+	}
+	for _, x := range []float64{0.2, 0.5, 0.8} {
+		objs = append(objs, scene.Object{
+			Material: scene.Material{
+				Colour:    White,
+				Emittance: 60,
+				Profile:   SpotEmission(Vect(0, -1, -0.15), 15*math.Pi/180, 35*math.Pi/180),
+			},
+			Surface: scene.Surface{Discs: []scene.Disc{{
+				Center:   Vect(x, 0.999, -0.85),
+				Radius:   0.03,
+				UnitNorm: xmath.Vect(0, -1, 0),
+			}}},
+		})
+	}
+	return scene.Scene{Camera: CornellCam(1.3), Objects: objs}
+}
@@ -0,0 +1,51 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// Keyhole divides the box with a partition, and lights it only from behind
+// the partition. All of the light in the front of the box comes through a
+// keyhole cut into the partition, which is hard for path tracing (and a good
+// case for the Metropolis integrator).
+func Keyhole() scene.Scene {
+	const z = -0.6 // Front of the partition.
+	keyhole := Union(
+		Cylinder(Vect(0.5, 0.5, z+0.1), Vect(0.5, 0.5, z-0.2), 0.04),
+		OrientedBox(Vect(0.5, 0.42, z-0.05), Vect(0.04, 0.14, 0.3), Vect(0, 1, 0), 0),
+	)
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					CornellShortBlock(),
+					// The partition overlaps the walls, so that no light
+					// leaks around its edges.
+					Difference(
+						OrientedBox(Vect(0.5, 0.5, z-0.02), Vect(1.02, 1.02, 0.04), Vect(0, 1, 0), 0),
+						keyhole,
+					),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				// The panel's normal points up, into the ceiling.
+				Material: scene.Material{Colour: White, Emittance: 20, EmitSide: scene.SideBack},
+				Surface:  AlignedSquare(Vect(0.1, 0.999, z-0.1), Vect(0.9, 0.999, -0.9)),
+			},
+		},
+	}
+}
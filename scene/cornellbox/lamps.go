@@ -0,0 +1,44 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Lamps lights the box with a warm tungsten lamp (2700K) on the left, and a
+// cool daylight lamp (6500K, which is slightly blue relative to the white
+// point) on the right.
+func Lamps() scene.Scene {
+	lamp := func(x float64) scene.Surface {
+		return scene.Surface{AlignedBoxes: []scene.AlignedBox{{
+			CornerA: xmath.Vect(x-0.1, 1.0, -0.6),
+			CornerB: xmath.Vect(x+0.1, 0.999, -0.4),
+		}}}
+	}
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: Blackbody(2700, 5),
+				Surface:  lamp(0.25),
+			},
+			scene.Object{
+				Material: Blackbody(6500, 5),
+				Surface:  lamp(0.75),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					CornellLeftWall,
+					CornellRightWall,
+					CornellShortBlock(),
+					CornellTallBlock(),
+				),
+			},
+		},
+	}
+}
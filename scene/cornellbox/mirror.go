@@ -87,3 +87,11 @@ func Mirror() scene.Scene {
 		},
 	}
 }
+
+// MirrorFog is the Mirror scene filled with fog, so that the light can be
+// seen scattering through the box and the openings in the walls.
+func MirrorFog() scene.Scene {
+	s := Mirror()
+	s.Medium = Fog(0.25)
+	return s
+}
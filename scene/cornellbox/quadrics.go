@@ -0,0 +1,39 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// Quadrics shows off the cone, cylinder, torus and ellipsoid primitives.
+func Quadrics() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					Cone(Vect(0.25, 0, -0.7), Vect(0.25, 0.45, -0.7), 0.15, 0),
+					Cylinder(Vect(0.75, 0, -0.7), Vect(0.75, 0.3, -0.7), 0.12),
+					Torus(Vect(0.35, 0.08, -0.3), Vect(0.3, 1, 0.2), 0.12, 0.05),
+					Ellipsoid(Vect(0.7, 0.12, -0.3), Vect(0.15, 0.12, 0.08)),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package cornellbox
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Smooth compares a faceted low polygon sphere (left) with the same mesh
+// using interpolated vertex normals (right).
+func Smooth() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					lowPolySphere(Vect(0.27, 0.2, -0.55), 0.2, false),
+					lowPolySphere(Vect(0.73, 0.2, -0.55), 0.2, true),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+		},
+	}
+}
+
+func lowPolySphere(center xmath.Vector, radius float64, smooth bool) scene.Surface {
+	const (
+		rings    = 8
+		segments = 12
+	)
+	vertex := func(ring, seg int) xmath.Vector {
+		theta := math.Pi * float64(ring) / rings
+		phi := 2 * math.Pi * float64(seg) / segments
+		return Vect(
+			math.Sin(theta)*math.Cos(phi),
+			math.Cos(theta),
+			math.Sin(theta)*math.Sin(phi),
+		)
+	}
+	tri := func(a, b, c xmath.Vector) scene.Surface {
+		pa := center.Add(a.Scale(radius))
+		pb := center.Add(b.Scale(radius))
+		pc := center.Add(c.Scale(radius))
+		if smooth {
+			return SmoothTriangle(pa, pb, pc, a, b, c)
+		}
+		return scene.Surface{Triangles: []scene.Triangle{{A: pa, B: pb, C: pc}}}
+	}
+
+	var surfs []scene.Surface
+	for ring := 0; ring < rings; ring++ {
+		for seg := 0; seg < segments; seg++ {
+			a := vertex(ring, seg)
+			b := vertex(ring, seg+1)
+			c := vertex(ring+1, seg+1)
+			d := vertex(ring+1, seg)
+			if ring != 0 {
+				surfs = append(surfs, tri(a, b, c))
+			}
+			if ring != rings-1 {
+				surfs = append(surfs, tri(c, d, a))
+			}
+		}
+	}
+	return MergeSurfaces(surfs...)
+}
@@ -0,0 +1,42 @@
+package cornellbox
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// Spotlight lights the box with a spot light on the blocks and a dim point
+// light near the ceiling. The box is filled with a thin fog, so that the
+// cone of the spot light is visible.
+func Spotlight() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+					CornellShortBlock(),
+					CornellTallBlock(),
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+		},
+		Lights: []scene.Light{
+			SpotLight(Vect(0.2, 0.95, -0.1), Vect(0.6, 0, -0.5), White, 3, 10*math.Pi/180, 20*math.Pi/180),
+			PointLight(Vect(0.5, 0.7, -0.5), White, 0.05),
+		},
+		Medium: Fog(0.1),
+	}
+}
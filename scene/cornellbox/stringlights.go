@@ -0,0 +1,50 @@
+package cornellbox
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// StringLights lights the box with strings of small coloured bulbs hanging
+// across it, rather than a ceiling light.
+func StringLights() scene.Scene {
+	objs := []scene.Object{
+		scene.Object{
+			Material: scene.Material{Colour: White},
+			Surface: MergeSurfaces(
+				CornellFloor,
+				CornellCeiling,
+				CornellBackWall,
+				CornellLeftWall,
+				CornellRightWall,
+				CornellShortBlock(),
+				CornellTallBlock(),
+			),
+		},
+	}
+
+	bulbColours := []colour.Colour{Hex(0xff4040), Hex(0x40ff40), Hex(0x4080ff), Hex(0xffd040)}
+	const (
+		rows  = 6
+		bulbs = 60
+	)
+	for i := 0; i < rows; i++ {
+		z := -0.1 - 0.8*float64(i)/(rows-1)
+		for j := 0; j < bulbs; j++ {
+			// Each string sags in the middle.
+			x := (float64(j) + 0.5) / bulbs
+			y := 0.95 - 0.25*math.Sin(math.Pi*x) + 0.02*float64(i%2)
+			objs = append(objs, scene.Object{
+				Material: scene.Material{
+					Colour:    bulbColours[(i+j)%len(bulbColours)],
+					Emittance: 40,
+				},
+				Surface: Sphere(Vect(x, y, z), 0.004),
+			})
+		}
+	}
+	return scene.Scene{Camera: CornellCam(1.3), Objects: objs}
+}
@@ -0,0 +1,53 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+// Subsurface shows translucent spheres, with a mean free path that increases
+// from left to right. The last sphere has a skin-like mean free path, which
+// is longer for red light.
+func Subsurface() scene.Scene {
+	translucent := func(mfp colour.Colour, albedo colour.Colour) scene.Material {
+		return scene.Material{Subsurface: &scene.Subsurface{MeanFreePath: mfp, Albedo: albedo}}
+	}
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface: MergeSurfaces(
+					CornellFloor,
+					CornellCeiling,
+					CornellBackWall,
+				),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				Material: translucent(White.Scale(0.005), White.Scale(0.99)),
+				Surface:  Sphere(Vect(0.2, 0.13, -0.45), 0.13),
+			},
+			scene.Object{
+				Material: translucent(White.Scale(0.05), Hex(0xfff0c0)),
+				Surface:  Sphere(Vect(0.5, 0.13, -0.6), 0.13),
+			},
+			scene.Object{
+				Material: translucent(colour.Colour{R: 0.12, G: 0.05, B: 0.03}, colour.Colour{R: 0.99, G: 0.92, B: 0.85}),
+				Surface:  Sphere(Vect(0.8, 0.13, -0.45), 0.13),
+			},
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package cornellbox
+
+import (
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+)
+
+func Textured() scene.Scene {
+	return scene.Scene{
+		Camera: CornellCam(1.3),
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  CornellCeilingLight(),
+			},
+			scene.Object{
+				Material: scene.Material{
+					Texture: Checker(Solid(White), Solid(Hex(0x404040)), 8),
+				},
+				Surface: CornellFloor,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface:  CornellCeiling,
+			},
+			scene.Object{
+				Material: scene.Material{
+					Colour:    White,
+					BumpMap:   Noise(Solid(Black), Solid(White), 12),
+					BumpScale: 0.01,
+				},
+				Surface: CornellBackWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Red},
+				Surface:  CornellLeftWall,
+			},
+			scene.Object{
+				Material: scene.Material{Colour: Green},
+				Surface:  CornellRightWall,
+			},
+			scene.Object{
+				Material: scene.Material{
+					Texture: ObjectSpace(Marble(Solid(Hex(0xf0ece4)), Solid(Hex(0x4a5560)), 8)),
+				},
+				Surface: Sphere(Vect(0.3, 0.2, -0.6), 0.2),
+			},
+			scene.Object{
+				Material: scene.Material{
+					Texture: ObjectSpace(Wood(Solid(Hex(0xc08850)), Solid(Hex(0x6b3e1c)), 30)),
+				},
+				Surface: CornellShortBlock(),
+			},
+		},
+	}
+}
@@ -5,10 +5,12 @@ import (
 
 	"github.com/peterstace/grayt/colour"
 	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/scene/sdf"
 	"github.com/peterstace/grayt/xmath"
 )
 
 var (
+	Black = colour.Colour{0, 0, 0}
 	White = colour.Colour{1, 1, 1}
 	Red   = colour.Colour{1, 0, 0}
 	Green = colour.Colour{0, 1, 0}
@@ -52,6 +54,17 @@ func MergeSurfaces(surfs ...scene.Surface) scene.Surface {
 		all.AlignZSquares = append(all.AlignZSquares, s.AlignZSquares...)
 		all.Discs = append(all.Discs, s.Discs...)
 		all.Pipes = append(all.Pipes, s.Pipes...)
+		all.Cones = append(all.Cones, s.Cones...)
+		all.Cylinders = append(all.Cylinders, s.Cylinders...)
+		all.Tori = append(all.Tori, s.Tori...)
+		all.Ellipsoids = append(all.Ellipsoids, s.Ellipsoids...)
+		all.Parallelograms = append(all.Parallelograms, s.Parallelograms...)
+		all.OrientedBoxes = append(all.OrientedBoxes, s.OrientedBoxes...)
+		all.CSGs = append(all.CSGs, s.CSGs...)
+		all.SDFs = append(all.SDFs, s.SDFs...)
+		all.Heightfields = append(all.Heightfields, s.Heightfields...)
+		all.Voxels = append(all.Voxels, s.Voxels...)
+		all.Curves = append(all.Curves, s.Curves...)
 	}
 	return all
 }
@@ -69,12 +82,30 @@ func MergeObjectLists(lists ...ObjectList) ObjectList {
 func Square(a, b, c, d xmath.Vector) scene.Surface {
 	return scene.Surface{
 		Triangles: []scene.Triangle{
-			{a, b, c},
-			{c, d, a},
+			{A: a, B: b, C: c},
+			{A: c, B: d, C: a},
 		},
 	}
 }
 
+// Parallelogram creates a parallelogram with a corner at corner, and edges
+// along edgeU and edgeV. Unlike Square, the corners don't need to be known,
+// and the result is a single primitive rather than a pair of triangles.
+func Parallelogram(corner, edgeU, edgeV xmath.Vector) scene.Surface {
+	return scene.Surface{Parallelograms: []scene.Parallelogram{{corner, edgeU, edgeV}}}
+}
+
+// SmoothTriangle creates a triangle with a normal at each vertex. The normals
+// are interpolated across the triangle when shading.
+func SmoothTriangle(a, b, c, na, nb, nc xmath.Vector) scene.Surface {
+	return scene.Surface{
+		Triangles: []scene.Triangle{{
+			A: a, B: b, C: c,
+			NormalA: &na, NormalB: &nb, NormalC: &nc,
+		}},
+	}
+}
+
 func AlignedSquare(a, b xmath.Vector) scene.Surface {
 	same := func(a, b float64) int {
 		if a == b {
@@ -104,3 +135,175 @@ func AlignedSquare(a, b xmath.Vector) scene.Surface {
 func Sphere(center xmath.Vector, radius float64) scene.Surface {
 	return scene.Surface{Spheres: []scene.Sphere{{center, radius}}}
 }
+
+// OrientedBox creates a box with the given center and size, that's rotated
+// about its center.
+func OrientedBox(center, size, rotationAxis xmath.Vector, rads float64) scene.Surface {
+	return scene.Surface{OrientedBoxes: []scene.OrientedBox{{
+		Center:        center,
+		HalfExtents:   size.Scale(0.5),
+		RotationAxis:  rotationAxis,
+		RotationAngle: rads,
+	}}}
+}
+
+// Cone creates a closed cone with radius ra at a and rb at b. Either radius may
+// be zero.
+func Cone(a, b xmath.Vector, ra, rb float64) scene.Surface {
+	return scene.Surface{Cones: []scene.Cone{{a, b, ra, rb}}}
+}
+
+// Cylinder creates a closed cylinder between a and b.
+func Cylinder(a, b xmath.Vector, radius float64) scene.Surface {
+	return scene.Surface{Cylinders: []scene.Cylinder{{a, b, radius}}}
+}
+
+func Torus(center, axis xmath.Vector, major, minor float64) scene.Surface {
+	return scene.Surface{Tori: []scene.Torus{{center, axis, major, minor}}}
+}
+
+func Ellipsoid(center, radii xmath.Vector) scene.Surface {
+	return scene.Surface{Ellipsoids: []scene.Ellipsoid{{center, radii}}}
+}
+
+// SDF creates a surface from a signed distance function, which is only
+// evaluated inside the bounding box between min and max.
+func SDF(f sdf.Func, min, max xmath.Vector) scene.Surface {
+	return scene.Surface{SDFs: []scene.SDF{{Func: f, Min: min, Max: max}}}
+}
+
+// Heightfield creates terrain from a grayscale image. See scene.Heightfield.
+func Heightfield(filename string, corner, size xmath.Vector) scene.Surface {
+	return scene.Surface{Heightfields: []scene.Heightfield{{filename, corner, size}}}
+}
+
+// Voxels loads a voxel grid from a MagicaVoxel .vox file or raw voxel file.
+// See scene.Voxels.
+func Voxels(filename string, corner xmath.Vector, voxelSize float64) scene.Surface {
+	return scene.Surface{Voxels: []scene.Voxels{{filename, corner, voxelSize}}}
+}
+
+// Union combines closed shapes using CSG. See scene.CSG for the shapes that
+// can be used.
+func Union(a, b scene.Surface) scene.Surface {
+	return scene.Surface{CSGs: []scene.CSG{{Op: scene.CSGUnion, A: &a, B: &b}}}
+}
+
+func Intersection(a, b scene.Surface) scene.Surface {
+	return scene.Surface{CSGs: []scene.CSG{{Op: scene.CSGIntersection, A: &a, B: &b}}}
+}
+
+// Difference removes b from a.
+func Difference(a, b scene.Surface) scene.Surface {
+	return scene.Surface{CSGs: []scene.CSG{{Op: scene.CSGDifference, A: &a, B: &b}}}
+}
+
+func Solid(c colour.Colour) *scene.Texture {
+	return &scene.Texture{Solid: &c}
+}
+
+func Image(filename string) *scene.Texture {
+	return &scene.Texture{Image: &scene.ImageTexture{Filename: filename}}
+}
+
+// NormalMap loads a tangent space normal map, which isn't sRGB encoded.
+func NormalMap(filename string) *scene.Texture {
+	return &scene.Texture{Image: &scene.ImageTexture{Filename: filename, Linear: true}}
+}
+
+func ClampedImage(filename string) *scene.Texture {
+	return &scene.Texture{Image: &scene.ImageTexture{Filename: filename, Wrap: scene.WrapClamp}}
+}
+
+// ObjectSpace evaluates a texture using the 3D coordinates of hit points
+// rather than UVs.
+func ObjectSpace(t *scene.Texture) *scene.Texture {
+	t.Space = scene.SpaceObject
+	return t
+}
+
+func Checker(a, b *scene.Texture, scale float64) *scene.Texture {
+	return &scene.Texture{Scale: scale, Checker: &scene.CheckerTexture{A: a, B: b}}
+}
+
+func Gradient(a, b *scene.Texture, axis xmath.Vector) *scene.Texture {
+	return &scene.Texture{Gradient: &scene.GradientTexture{A: a, B: b, Axis: axis}}
+}
+
+func Noise(a, b *scene.Texture, scale float64) *scene.Texture {
+	return &scene.Texture{Scale: scale, Noise: &scene.NoiseTexture{A: a, B: b, Octaves: 4}}
+}
+
+func Marble(a, b *scene.Texture, scale float64) *scene.Texture {
+	return &scene.Texture{Scale: scale, Marble: &scene.MarbleTexture{A: a, B: b, Turbulence: 5, Octaves: 6}}
+}
+
+func Wood(a, b *scene.Texture, scale float64) *scene.Texture {
+	return &scene.Texture{Scale: scale, Wood: &scene.WoodTexture{A: a, B: b, Turbulence: 0.1, Octaves: 4}}
+}
+
+// BezierCurve creates a tube that follows a piecewise cubic Bézier curve. See
+// scene.Curve.
+func BezierCurve(controlPoints []xmath.Vector, radiusA, radiusB float64) scene.Surface {
+	return scene.Surface{Curves: []scene.Curve{{controlPoints, scene.CurveBezier, radiusA, radiusB}}}
+}
+
+// BSplineCurve creates a tube that follows a uniform cubic B-spline. See
+// scene.Curve.
+func BSplineCurve(controlPoints []xmath.Vector, radiusA, radiusB float64) scene.Surface {
+	return scene.Surface{Curves: []scene.Curve{{controlPoints, scene.CurveBSpline, radiusA, radiusB}}}
+}
+
+// Fog creates a grey medium that only scatters light (so it doesn't absorb
+// any). Density is the fraction of light scattered per unit distance. Real
+// fog scatters mostly forwards, so the medium is slightly anisotropic.
+func Fog(density float64) *scene.Medium {
+	return &scene.Medium{
+		Scattering: White.Scale(density),
+		Asymmetry:  0.3,
+	}
+}
+
+// Blackbody creates an emissive material with the colour of a blackbody at a
+// temperature (in Kelvin). See colour.Blackbody for how temperatures look.
+// The material reflects light as if it were white.
+func Blackbody(kelvin, emittance float64) scene.Material {
+	return scene.Material{Colour: White, Temperature: kelvin, Emittance: emittance}
+}
+
+// PointLight creates a light that emits equally in all directions. See
+// scene.PointLight.
+func PointLight(position xmath.Vector, c colour.Colour, intensity float64) scene.Light {
+	return scene.Light{Point: &scene.PointLight{Position: position, Colour: c, Intensity: intensity}}
+}
+
+// SpotLight creates a light at position that shines towards target, in a
+// cone that fades out between the inner and outer angles (in radians).
+func SpotLight(position, target xmath.Vector, c colour.Colour, intensity, inner, outer float64) scene.Light {
+	return scene.Light{Spot: &scene.SpotLight{
+		Position:   position,
+		Direction:  target.Sub(position),
+		Colour:     c,
+		Intensity:  intensity,
+		InnerAngle: inner,
+		OuterAngle: outer,
+	}}
+}
+
+// DirectionalLight creates a light that's infinitely far away, with its light
+// travelling in direction dir.
+func DirectionalLight(dir xmath.Vector, c colour.Colour, irradiance float64) scene.Light {
+	return scene.Light{Directional: &scene.DirectionalLight{Direction: dir, Colour: c, Irradiance: irradiance}}
+}
+
+// SpotEmission makes an emissive material emit in a cone around axis, that
+// fades out between the inner and outer angles (in radians).
+func SpotEmission(axis xmath.Vector, inner, outer float64) *scene.EmissionProfile {
+	return &scene.EmissionProfile{Axis: axis, Spot: &scene.SpotCone{InnerAngle: inner, OuterAngle: outer}}
+}
+
+// IESEmission makes an emissive material emit according to an IES
+// photometric file, with the luminaire pointing along axis.
+func IESEmission(filename string, axis xmath.Vector) *scene.EmissionProfile {
+	return &scene.EmissionProfile{Axis: axis, IESFile: filename}
+}
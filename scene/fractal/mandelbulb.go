@@ -0,0 +1,44 @@
+// Package fractal contains scenes made from fractal distance estimators.
+package fractal
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	. "github.com/peterstace/grayt/scene/dsl"
+	"github.com/peterstace/grayt/scene/sdf"
+)
+
+// Mandelbulb is a power 8 Mandelbulb resting on a floor, lit by a large
+// overhead light.
+func Mandelbulb() scene.Scene {
+	cam := DefaultCamera()
+	cam.Location = Vect(2.8, 1.8, 3.3)
+	cam.LookingAt = Vect(0, 0, 0)
+	cam.FieldOfViewInRadians = 40 * math.Pi / 180
+
+	const size = 1.2
+	return scene.Scene{
+		Camera: cam,
+		Objects: []scene.Object{
+			scene.Object{
+				Material: scene.Material{Colour: White, Emittance: 5},
+				Surface:  AlignedSquare(Vect(-2, 4, -2), Vect(2, 4, 2)),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: White},
+				Surface:  AlignedSquare(Vect(-20, -size, -20), Vect(20, -size, 20)),
+			},
+			scene.Object{
+				Material: scene.Material{Colour: colour.Colour{0.8, 0.5, 0.3}},
+				Surface: scene.Surface{SDFs: []scene.SDF{{
+					Func:    sdf.Mandelbulb(8, 10),
+					Min:     Vect(-size, -size, -size),
+					Max:     Vect(+size, +size, +size),
+					Epsilon: 5e-4,
+				}}},
+			},
+		},
+	}
+}
@@ -5,16 +5,33 @@ import (
 
 	"github.com/peterstace/grayt/scene"
 	"github.com/peterstace/grayt/scene/cornellbox"
+	"github.com/peterstace/grayt/scene/fractal"
 )
 
 var registry map[string]func() scene.Scene
 
 func init() {
 	registry = map[string]func() scene.Scene{
-		"cornellbox_classic":    cornellbox.Classic,
-		"cornellbox_splitbox":   cornellbox.Splitbox,
-		"cornellbox_mirror":     cornellbox.Mirror,
-		"cornellbox_spheretree": cornellbox.SphereTree,
+		"cornellbox_classic":      cornellbox.Classic,
+		"cornellbox_splitbox":     cornellbox.Splitbox,
+		"cornellbox_mirror":       cornellbox.Mirror,
+		"cornellbox_mirror_fog":   cornellbox.MirrorFog,
+		"cornellbox_spheretree":   cornellbox.SphereTree,
+		"cornellbox_smooth":       cornellbox.Smooth,
+		"cornellbox_textured":     cornellbox.Textured,
+		"cornellbox_quadrics":     cornellbox.Quadrics,
+		"cornellbox_csg":          cornellbox.CSG,
+		"cornellbox_sdf":          cornellbox.DistanceFields,
+		"cornellbox_curves":       cornellbox.Curves,
+		"cornellbox_subsurface":   cornellbox.Subsurface,
+		"cornellbox_dispersion":   cornellbox.Dispersion,
+		"cornellbox_blackbody":    cornellbox.Lamps,
+		"cornellbox_downlights":   cornellbox.Downlights,
+		"cornellbox_cutaway":      cornellbox.Cutaway,
+		"cornellbox_keyhole":      cornellbox.Keyhole,
+		"cornellbox_spotlight":    cornellbox.Spotlight,
+		"cornellbox_stringlights": cornellbox.StringLights,
+		"fractal_mandelbulb":      fractal.Mandelbulb,
 	}
 }
 
@@ -2,12 +2,64 @@ package scene
 
 import (
 	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene/sdf"
 	"github.com/peterstace/grayt/xmath"
 )
 
 type Scene struct {
 	Camera  Camera
 	Objects []Object
+
+	// Lights are light sources in addition to emissive objects.
+	Lights []Light `json:"lights,omitempty"`
+
+	// Medium fills all space that isn't inside an object's medium (e.g. for
+	// fog). When nil, that space is a vacuum.
+	Medium *Medium `json:"medium,omitempty"`
+
+	// Spectral renders using wavelengths rather than RGB, so that
+	// dispersive dielectrics can split light into its colours. It's slower
+	// to converge.
+	Spectral bool `json:"spectral,omitempty"`
+}
+
+// Light is a light source with no area, so it can't be seen directly or in
+// mirrors. It only lights diffuse surfaces and media. Exactly one of the
+// light type fields should be set.
+type Light struct {
+	Point       *PointLight       `json:"point,omitempty"`
+	Spot        *SpotLight        `json:"spot,omitempty"`
+	Directional *DirectionalLight `json:"directional,omitempty"`
+}
+
+// PointLight emits equally in all directions. The irradiance it produces is
+// Colour multiplied by Intensity, divided by the squared distance to the
+// light.
+type PointLight struct {
+	Position  xmath.Vector  `json:"position"`
+	Colour    colour.Colour `json:"colour"`
+	Intensity float64       `json:"intensity"`
+}
+
+// SpotLight is a point light that only emits in a cone around Direction. It
+// emits fully within InnerAngle of Direction, and falls off smoothly to
+// nothing at OuterAngle (both in radians).
+type SpotLight struct {
+	Position   xmath.Vector  `json:"position"`
+	Direction  xmath.Vector  `json:"direction"`
+	Colour     colour.Colour `json:"colour"`
+	Intensity  float64       `json:"intensity"`
+	InnerAngle float64       `json:"inner_angle"`
+	OuterAngle float64       `json:"outer_angle"`
+}
+
+// DirectionalLight is infinitely far away (e.g. the sun). Direction is the
+// direction that the light travels, and the irradiance it produces (on a
+// surface facing it) is Colour multiplied by Irradiance.
+type DirectionalLight struct {
+	Direction  xmath.Vector  `json:"direction"`
+	Colour     colour.Colour `json:"colour"`
+	Irradiance float64       `json:"irradiance"`
 }
 
 type Camera struct {
@@ -24,6 +76,45 @@ type Camera struct {
 type Object struct {
 	Surface  Surface  `json:"surface"`
 	Material Material `json:"material"`
+
+	// Medium fills the inside of the object, which must be closed. The
+	// object's surface is then just the boundary of the medium, so its
+	// material is ignored. Objects with media must not overlap.
+	Medium *Medium `json:"medium,omitempty"`
+}
+
+// Medium is a participating medium. Absorption and Scattering are the
+// fraction of light absorbed or scattered per unit distance, for each colour
+// channel. Scattered light is distributed according to the Henyey-Greenstein
+// phase function, where Asymmetry is between -1 (light scatters backwards)
+// and 1 (light scatters forwards), and 0 is isotropic.
+//
+// The medium is homogeneous unless Density is set, in which case Absorption
+// and Scattering are multiplied by the density at each point.
+type Medium struct {
+	Absorption colour.Colour `json:"absorption"`
+	Scattering colour.Colour `json:"scattering"`
+	Asymmetry  float64       `json:"asymmetry,omitempty"`
+	Density    *DensityGrid  `json:"density,omitempty"`
+}
+
+// DensityGrid is a 3D grid of densities (e.g. for smoke or clouds) that
+// covers the box from Corner to Corner+Size. Densities are interpolated
+// between the centers of the grid cells, and are zero outside of the box.
+//
+// Filename is either a raw file, with a .raw extension, or has a header. Raw
+// files are just the densities, as little endian float32s with X varying
+// fastest, and need Resolution to be set. Otherwise, the file is in this
+// format (with little endian integers):
+//
+//	magic   [4]byte        "GDEN"
+//	size    [3]uint32      X, Y, Z
+//	data    [X*Y*Z]float32 densities, X fastest
+type DensityGrid struct {
+	Filename   string       `json:"filename"`
+	Resolution [3]int       `json:"resolution,omitempty"`
+	Corner     xmath.Vector `json:"corner"`
+	Size       xmath.Vector `json:"size"`
 }
 
 type Surface struct {
@@ -35,18 +126,228 @@ type Surface struct {
 	AlignZSquares []AlignZSquare `json:"align_z_squares,omitempty"`
 	Discs         []Disc         `json:"discs,omitempty"`
 	Pipes         []Pipe         `json:"pipes,omitempty"`
+	Cones         []Cone         `json:"cones,omitempty"`
+	Cylinders     []Cylinder     `json:"cylinders,omitempty"`
+	Tori          []Torus        `json:"tori,omitempty"`
+	Ellipsoids    []Ellipsoid    `json:"ellipsoids,omitempty"`
+
+	Parallelograms []Parallelogram `json:"parallelograms,omitempty"`
+	OrientedBoxes  []OrientedBox   `json:"oriented_boxes,omitempty"`
+	CSGs           []CSG           `json:"csgs,omitempty"`
+	SDFs           []SDF           `json:"sdfs,omitempty"`
+	Heightfields   []Heightfield   `json:"heightfields,omitempty"`
+	Voxels         []Voxels        `json:"voxels,omitempty"`
+	Curves         []Curve         `json:"curves,omitempty"`
 }
 
 type Material struct {
 	Colour    colour.Colour `json:"colour"`
 	Emittance float64       `json:"emittance"`
 	Mirror    bool          `json:"mirror"`
+
+	// Temperature (in Kelvin) makes the material emit the colour of a
+	// blackbody at that temperature, rather than Colour or Texture (which
+	// still give the reflected colour). Emittance scales the luminance.
+	Temperature float64 `json:"temperature,omitempty"`
+
+	// Texture overrides Colour when set.
+	Texture *Texture `json:"texture,omitempty"`
+
+	// Profile makes an emissive material emit more light in some directions
+	// than others (e.g. for luminaires), rather than equally in all
+	// directions.
+	Profile *EmissionProfile `json:"profile,omitempty"`
+
+	// EmitSide restricts emission to one side of the surface (relative to
+	// its normals, which point outwards for closed surfaces such as boxes
+	// and spheres). The other side reflects light like a non-emissive
+	// material. Defaults to both sides.
+	EmitSide Side `json:"emit_side,omitempty"`
+
+	// OneSided culls the back of the surface (the side its normals point
+	// away from), so that rays pass straight through it from behind. It's
+	// only for opaque materials.
+	OneSided bool `json:"one_sided,omitempty"`
+
+	// NormalMap perturbs the surface normal using a tangent space normal map
+	// (usually an image texture with Linear set). Alternatively, BumpMap
+	// displaces the surface along its normal by BumpScale multiplied by the
+	// luminance of the texture. At most one should be set.
+	NormalMap *Texture `json:"normal_map,omitempty"`
+	BumpMap   *Texture `json:"bump_map,omitempty"`
+	BumpScale float64  `json:"bump_scale,omitempty"`
+
+	// Subsurface makes the material translucent (e.g. for marble, skin or
+	// wax), in which case Colour is ignored. The object must be closed.
+	Subsurface *Subsurface `json:"subsurface,omitempty"`
+
+	// Dielectric makes the material smooth and transparent (e.g. glass or
+	// water), in which case Colour is ignored. The object must be closed.
+	Dielectric *Dielectric `json:"dielectric,omitempty"`
+}
+
+// Side is a side of a surface, relative to its normals.
+type Side string
+
+const (
+	SideBoth  Side = "both" // Default.
+	SideFront Side = "front"
+	SideBack  Side = "back"
+)
+
+// EmissionProfile scales the light emitted in each direction, relative to the
+// material's emittance. Directions are measured from Axis, which defaults to
+// straight down. Exactly one of IESFile or Spot should be set.
+//
+// IESFile is an IES LM-63 photometric file (with type C photometry). Its
+// vertical angles are measured from Axis, and its horizontal angles are
+// measured around Axis starting from the direction closest to +X (or +Z when
+// Axis is close to the X axis). Its candela values give the intensity emitted
+// by each unit of the surface's area, and the material's emittance is the
+// intensity emitted in the brightest direction.
+type EmissionProfile struct {
+	Axis    xmath.Vector `json:"axis"`
+	IESFile string       `json:"ies_file,omitempty"`
+	Spot    *SpotCone    `json:"spot,omitempty"`
+}
+
+// SpotCone emits fully within InnerAngle of the axis, and falls off smoothly
+// to nothing at OuterAngle (both in radians).
+type SpotCone struct {
+	InnerAngle float64 `json:"inner_angle"`
+	OuterAngle float64 `json:"outer_angle"`
+}
+
+// Dielectric materials reflect and refract light. IOR is the refractive
+// index, unless one of Cauchy or Sellmeier is set, in which case the
+// refractive index varies with wavelength (which is only visible when the
+// scene is rendered spectrally).
+type Dielectric struct {
+	IOR       float64    `json:"ior,omitempty"`
+	Cauchy    *Cauchy    `json:"cauchy,omitempty"`
+	Sellmeier *Sellmeier `json:"sellmeier,omitempty"`
+}
+
+// Cauchy gives the refractive index as A + B/λ², where λ is the wavelength
+// in micrometres.
+type Cauchy struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+// Sellmeier gives the refractive index as the square root of
+// 1 + Σ B[i]λ²/(λ² - C[i]), where λ is the wavelength in micrometres.
+type Sellmeier struct {
+	B [3]float64 `json:"b"`
+	C [3]float64 `json:"c"`
+}
+
+// Subsurface scattering is simulated as a random walk inside the object.
+// Light enters and leaves through diffuse interfaces, and scatters
+// isotropically in between. MeanFreePath is the average distance between
+// scattering events (for each colour channel), and Albedo is the fraction of
+// light that survives each scattering event.
+type Subsurface struct {
+	MeanFreePath colour.Colour `json:"mean_free_path"`
+	Albedo       colour.Colour `json:"albedo"`
+}
+
+// Texture varies a colour over a surface. Exactly one of the texture type
+// fields should be set.
+type Texture struct {
+	// Texture coordinates are taken from Space, and are then multiplied by
+	// Scale (a zero Scale is treated as 1).
+	Space TextureSpace `json:"space,omitempty"`
+	Scale float64      `json:"scale,omitempty"`
+
+	Solid    *colour.Colour   `json:"solid,omitempty"`
+	Image    *ImageTexture    `json:"image,omitempty"`
+	Checker  *CheckerTexture  `json:"checker,omitempty"`
+	Gradient *GradientTexture `json:"gradient,omitempty"`
+	Noise    *NoiseTexture    `json:"noise,omitempty"`
+	Marble   *MarbleTexture   `json:"marble,omitempty"`
+	Wood     *WoodTexture     `json:"wood,omitempty"`
+}
+
+type TextureSpace string
+
+const (
+	// SpaceUV uses the surface's UV parameterisation (default).
+	SpaceUV TextureSpace = "uv"
+
+	// SpaceObject uses the 3D coordinates of the hit point. Objects don't
+	// have their own transforms, so this is the same as world space.
+	SpaceObject TextureSpace = "object"
+)
+
+type ImageTexture struct {
+	Filename string   `json:"filename"` // PNG or JPEG
+	Wrap     WrapMode `json:"wrap,omitempty"`
+
+	// Linear disables sRGB decoding, e.g. for textures that don't hold
+	// colours.
+	Linear bool `json:"linear,omitempty"`
+}
+
+// CheckerTexture alternates between A and B in a checkerboard (or 3D
+// checkered block) pattern, with unit sized checks.
+type CheckerTexture struct {
+	A *Texture `json:"a"`
+	B *Texture `json:"b"`
+}
+
+// GradientTexture blends linearly from A to B as the texture coordinates
+// dotted with Axis go from 0 to 1.
+type GradientTexture struct {
+	A    *Texture     `json:"a"`
+	B    *Texture     `json:"b"`
+	Axis xmath.Vector `json:"axis"`
+}
+
+// NoiseTexture blends between A and B using fractal Perlin noise.
+type NoiseTexture struct {
+	A       *Texture `json:"a"`
+	B       *Texture `json:"b"`
+	Octaves int      `json:"octaves"`
 }
 
+// MarbleTexture creates veins of B in A, running perpendicular to the X axis
+// and distorted by turbulence.
+type MarbleTexture struct {
+	A          *Texture `json:"a"`
+	B          *Texture `json:"b"`
+	Turbulence float64  `json:"turbulence"`
+	Octaves    int      `json:"octaves"`
+}
+
+// WoodTexture creates concentric rings around the Y axis, blending from A to
+// B across each ring. The rings are distorted by turbulence.
+type WoodTexture struct {
+	A          *Texture `json:"a"`
+	B          *Texture `json:"b"`
+	Turbulence float64  `json:"turbulence"`
+	Octaves    int      `json:"octaves"`
+}
+
+// WrapMode controls how a texture is sampled outside of the [0, 1] UV range.
+type WrapMode string
+
+const (
+	WrapRepeat WrapMode = "repeat" // Default.
+	WrapClamp  WrapMode = "clamp"
+	WrapMirror WrapMode = "mirror"
+)
+
 type Triangle struct {
 	A xmath.Vector `json:"a"`
 	B xmath.Vector `json:"b"`
 	C xmath.Vector `json:"c"`
+
+	// Optional vertex normals for smooth shading. Either all or none should
+	// be set.
+	NormalA *xmath.Vector `json:"normal_a,omitempty"`
+	NormalB *xmath.Vector `json:"normal_b,omitempty"`
+	NormalC *xmath.Vector `json:"normal_c,omitempty"`
 }
 
 type AlignedBox struct {
@@ -95,3 +396,134 @@ type Pipe struct {
 	EndpointB xmath.Vector `json:"endpoint_b"`
 	Radius    float64      `json:"radius"`
 }
+
+// Cone is closed off by discs at each end. If both radii are non-zero, then
+// it's a truncated cone.
+type Cone struct {
+	EndpointA xmath.Vector `json:"endpoint_a"`
+	EndpointB xmath.Vector `json:"endpoint_b"`
+	RadiusA   float64      `json:"radius_a"`
+	RadiusB   float64      `json:"radius_b"`
+}
+
+// Cylinder is like Pipe, but is closed off by discs at each end.
+type Cylinder struct {
+	EndpointA xmath.Vector `json:"endpoint_a"`
+	EndpointB xmath.Vector `json:"endpoint_b"`
+	Radius    float64      `json:"radius"`
+}
+
+// Torus lies in the plane perpendicular to Axis. MajorRadius is the distance
+// from Center to the middle of the tube, and MinorRadius is the radius of the
+// tube.
+type Torus struct {
+	Center      xmath.Vector `json:"center"`
+	Axis        xmath.Vector `json:"axis"`
+	MajorRadius float64      `json:"major_radius"`
+	MinorRadius float64      `json:"minor_radius"`
+}
+
+// Parallelogram has corners at Corner, Corner+EdgeU, Corner+EdgeU+EdgeV and
+// Corner+EdgeV. Its normal is EdgeU cross EdgeV, and the U and V texture
+// coordinates run along EdgeU and EdgeV.
+type Parallelogram struct {
+	Corner xmath.Vector `json:"corner"`
+	EdgeU  xmath.Vector `json:"edge_u"`
+	EdgeV  xmath.Vector `json:"edge_v"`
+}
+
+// OrientedBox is a box centered at Center, extending HalfExtents along each
+// axis. It's then rotated about its center by RotationAngle radians around
+// RotationAxis (following the right hand rule).
+type OrientedBox struct {
+	Center        xmath.Vector `json:"center"`
+	HalfExtents   xmath.Vector `json:"half_extents"`
+	RotationAxis  xmath.Vector `json:"rotation_axis,omitempty"`
+	RotationAngle float64      `json:"rotation_angle,omitempty"`
+}
+
+// CSG combines two closed shapes using a boolean operation. Each operand may
+// contain spheres, aligned boxes, oriented boxes, cones, cylinders, tori,
+// ellipsoids and other CSGs. Operands with more than one shape are treated as
+// the union of those shapes.
+type CSG struct {
+	Op CSGOp    `json:"op"`
+	A  *Surface `json:"a"`
+	B  *Surface `json:"b"`
+}
+
+type CSGOp string
+
+const (
+	CSGUnion        CSGOp = "union"
+	CSGIntersection CSGOp = "intersection"
+	CSGDifference   CSGOp = "difference" // A with B removed.
+)
+
+// SDF is the surface where a signed distance function is zero. Only the part
+// of the surface inside the bounding box between Min and Max is used. The
+// function is Go code, so can't be represented in JSON.
+type SDF struct {
+	Func sdf.Func     `json:"-"`
+	Min  xmath.Vector `json:"min"`
+	Max  xmath.Vector `json:"max"`
+
+	// Epsilon is the distance from the surface that counts as a hit. It
+	// defaults to a small fraction of the bounding box size.
+	Epsilon float64 `json:"epsilon,omitempty"`
+}
+
+// Heightfield is a terrain surface, with heights read from a grayscale image
+// (e.g. an 8 or 16 bit PNG). The image's columns run along X and its rows run
+// along Z. The surface starts at Corner and covers Size.X by Size.Z. Black
+// pixels are at the height of Corner, and white pixels are Size.Y above it.
+type Heightfield struct {
+	Filename string       `json:"filename"`
+	Corner   xmath.Vector `json:"corner"`
+	Size     xmath.Vector `json:"size"`
+}
+
+// Voxels is a grid of cubes, each VoxelSize wide, with its minimum corner at
+// Corner. The grid is loaded from Filename, which is either a MagicaVoxel .vox
+// file (where only the first model is used), or uses this raw format (with
+// little endian integers, and Y up):
+//
+//	magic   [4]byte     "GVOX"
+//	size    [3]uint32   X, Y, Z
+//	data    [X*Y*Z]byte palette index of each voxel (0 is empty), X fastest
+//	palette [255][3]byte sRGB colours for palette indices 1 to 255
+//
+// Each palette index gets its own material, which is the object's material
+// with its colour replaced by the palette colour.
+type Voxels struct {
+	Filename  string       `json:"filename"`
+	Corner    xmath.Vector `json:"corner"`
+	VoxelSize float64      `json:"voxel_size"`
+}
+
+// Curve is a thin tube (e.g. a hair, blade of grass, or wire) that follows a
+// piecewise cubic curve. For Bézier curves, each segment has 4 control
+// points, and shares its first with the previous segment's last (so there are
+// 3n+1 control points for n segments). For B-splines, each run of 4
+// consecutive control points is a segment (so there are n+3). The tube's
+// radius varies linearly from RadiusA at the start to RadiusB at the end, and
+// its ends are open.
+type Curve struct {
+	ControlPoints []xmath.Vector `json:"control_points"`
+	Basis         CurveBasis     `json:"basis,omitempty"`
+	RadiusA       float64        `json:"radius_a"`
+	RadiusB       float64        `json:"radius_b"`
+}
+
+type CurveBasis string
+
+const (
+	CurveBezier  CurveBasis = "bezier" // The default.
+	CurveBSpline CurveBasis = "bspline"
+)
+
+// Ellipsoid is axis aligned, with a (semi-axis) radius for each axis.
+type Ellipsoid struct {
+	Center xmath.Vector `json:"center"`
+	Radii  xmath.Vector `json:"radii"`
+}
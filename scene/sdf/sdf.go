@@ -0,0 +1,136 @@
+// Package sdf provides signed distance functions, and operators to combine
+// them. They are used to define scene.SDF surfaces.
+package sdf
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// Func gives the signed distance from a point to a surface (negative inside
+// of the surface). Some operators don't preserve exact distances. In that
+// case, the result must never overestimate the distance to the surface,
+// otherwise sphere tracing may step through it.
+type Func func(p xmath.Vector) float64
+
+func Sphere(center xmath.Vector, radius float64) Func {
+	return func(p xmath.Vector) float64 {
+		return p.Sub(center).Length() - radius
+	}
+}
+
+// Box is an axis aligned box, with corners at center +/- halfExtents.
+func Box(center, halfExtents xmath.Vector) Func {
+	return func(p xmath.Vector) float64 {
+		q := p.Sub(center).Abs().Sub(halfExtents)
+		outside := q.Max(xmath.Vect(0, 0, 0)).Length()
+		inside := math.Min(math.Max(q.X, math.Max(q.Y, q.Z)), 0)
+		return outside + inside
+	}
+}
+
+// Torus lies in the XZ plane.
+func Torus(center xmath.Vector, major, minor float64) Func {
+	return func(p xmath.Vector) float64 {
+		q := p.Sub(center)
+		return math.Hypot(math.Hypot(q.X, q.Z)-major, q.Y) - minor
+	}
+}
+
+func Translate(f Func, v xmath.Vector) Func {
+	return func(p xmath.Vector) float64 {
+		return f(p.Sub(v))
+	}
+}
+
+// Scale uniformly scales about the origin.
+func Scale(f Func, s float64) Func {
+	return func(p xmath.Vector) float64 {
+		return f(p.Scale(1/s)) * s
+	}
+}
+
+func Union(a, b Func) Func {
+	return func(p xmath.Vector) float64 {
+		return math.Min(a(p), b(p))
+	}
+}
+
+func Intersection(a, b Func) Func {
+	return func(p xmath.Vector) float64 {
+		return math.Max(a(p), b(p))
+	}
+}
+
+// Difference removes b from a.
+func Difference(a, b Func) Func {
+	return func(p xmath.Vector) float64 {
+		return math.Max(a(p), -b(p))
+	}
+}
+
+// SmoothUnion blends a and b together where they are within k of each other.
+func SmoothUnion(a, b Func, k float64) Func {
+	return func(p xmath.Vector) float64 {
+		da, db := a(p), b(p)
+		h := math.Max(k-math.Abs(da-db), 0) / k
+		return math.Min(da, db) - h*h*k/4
+	}
+}
+
+// Twist rotates the XZ plane about the Y axis, by an angle of rate radians per
+// unit of Y.
+func Twist(f Func, rate float64) Func {
+	return func(p xmath.Vector) float64 {
+		s, c := math.Sincos(rate * p.Y)
+		q := xmath.Vect(c*p.X-s*p.Z, p.Y, s*p.X+c*p.Z)
+
+		// Twisting stretches space, more so further from the axis. Divide by
+		// the largest singular value of the twist's Jacobian, so that the
+		// distance isn't overestimated.
+		kr := math.Abs(rate) * math.Hypot(p.X, p.Z)
+		return f(q) / (0.5 * (kr + math.Sqrt(kr*kr+4)))
+	}
+}
+
+// Repeat tiles space with copies of f, at intervals of period along each axis
+// (0 means no repetition along that axis). The copy at the origin should fit
+// within a single period, otherwise the distance can be overestimated.
+func Repeat(f Func, period xmath.Vector) Func {
+	wrap := func(x, period float64) float64 {
+		if period == 0 {
+			return x
+		}
+		return x - period*math.Floor(x/period+0.5)
+	}
+	return func(p xmath.Vector) float64 {
+		return f(xmath.Vect(wrap(p.X, period.X), wrap(p.Y, period.Y), wrap(p.Z, period.Z)))
+	}
+}
+
+// Mandelbulb is the 3D analogue of the Mandelbrot set, centered at the origin
+// (and fitting within a radius of about 1.2). It uses the distance estimator
+// for the power N triplex formulation.
+func Mandelbulb(power float64, iterations int) Func {
+	return func(p xmath.Vector) float64 {
+		z := p
+		dr := 1.0
+		r := z.Length()
+		for i := 0; i < iterations && r > 0 && r < 2; i++ {
+			theta := math.Acos(z.Z/r) * power
+			phi := math.Atan2(z.Y, z.X) * power
+			dr = math.Pow(r, power-1)*power*dr + 1
+			sinTheta, cosTheta := math.Sincos(theta)
+			sinPhi, cosPhi := math.Sincos(phi)
+			z = xmath.Vect(sinTheta*cosPhi, sinPhi*sinTheta, cosTheta).
+				Scale(math.Pow(r, power)).
+				Add(p)
+			r = z.Length()
+		}
+		if r == 0 {
+			return 0
+		}
+		return 0.5 * math.Log(r) * r / dr
+	}
+}
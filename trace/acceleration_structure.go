@@ -17,19 +17,21 @@ type listAccelerationStructure struct {
 func (a listAccelerationStructure) closestHit(r xmath.Ray) (intersection, material, bool) {
 	var closest struct {
 		intersection intersection
-		material     material
-		hit          bool
+		obj          *object
 	}
 	for i := range a.objs {
 		intersection, hit := a.objs[i].Surface.intersect(r)
 		if !hit {
 			continue
 		}
-		if !closest.hit || intersection.distance < closest.intersection.distance {
+		if closest.obj == nil || intersection.distance < closest.intersection.distance {
 			closest.intersection = intersection
-			closest.material = a.objs[i].Material
-			closest.hit = true
+			closest.obj = &a.objs[i]
 		}
 	}
-	return closest.intersection, closest.material, closest.hit
+	if closest.obj == nil {
+		return intersection{}, material{}, false
+	}
+	x := closest.obj.complete(closest.intersection)
+	return x, closest.obj.materialAt(x), true
 }
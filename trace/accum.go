@@ -17,6 +17,11 @@ type accumulator struct {
 	dim       xmath.Dimensions
 	aggregate []colour.Colour
 	landing   []colour.Colour
+
+	// Splats are contributions that can land on any pixel (rather than the
+	// pixel being sampled), so they may be added to by many workers at once.
+	splatMu sync.Mutex
+	splats  []colour.Colour
 }
 
 func newAccumulator(dim xmath.Dimensions) *accumulator {
@@ -25,6 +30,7 @@ func newAccumulator(dim xmath.Dimensions) *accumulator {
 	n := dim.Wide * dim.High
 	acc.aggregate = make([]colour.Colour, n)
 	acc.landing = make([]colour.Colour, n)
+	acc.splats = make([]colour.Colour, n)
 	return acc
 }
 
@@ -33,12 +39,35 @@ func (a *accumulator) set(x, y int, c colour.Colour) {
 	a.landing[idx] = c
 }
 
+// setXYZ is like set, but for colours from spectral rendering. They're
+// converted to RGB, so that spectral and RGB renders are stored the same way.
+func (a *accumulator) setXYZ(x, y int, c colour.XYZ) {
+	a.set(x, y, c.ToLinearSRGB())
+}
+
+// splat adds to a pixel's value for the current pass. Unlike set, it's safe
+// to call concurrently for the same pixel.
+func (a *accumulator) splat(x, y int, c colour.Colour) {
+	idx := x + a.dim.Wide*y
+	a.splatMu.Lock()
+	a.splats[idx] = a.splats[idx].Add(c)
+	a.splatMu.Unlock()
+}
+
+// splatXYZ is like splat, but for colours from spectral rendering.
+func (a *accumulator) splatXYZ(x, y int, c colour.XYZ) {
+	a.splat(x, y, c.ToLinearSRGB())
+}
+
 func (a *accumulator) merge(depth int) {
 	a.mu.Lock()
+	a.splatMu.Lock()
 	a.passes += depth
 	for i, c := range a.landing {
-		a.aggregate[i] = a.aggregate[i].Add(c)
+		a.aggregate[i] = a.aggregate[i].Add(c).Add(a.splats[i])
+		a.splats[i] = colour.Colour{}
 	}
+	a.splatMu.Unlock()
 	a.mu.Unlock()
 }
 
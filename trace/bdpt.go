@@ -0,0 +1,808 @@
+package trace
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// maxSubpathVertices limits the length of camera and light subpaths (which
+// are otherwise terminated using Russian roulette).
+const maxSubpathVertices = 32
+
+// bidirectional is a bidirectional path tracer. For each pixel sample, it
+// traces a subpath from the camera and another from a light source, and then
+// connects each prefix of one to each prefix of the other. The different
+// ways of constructing the same path are weighted using MIS (with the power
+// heuristic). Paths with just one camera vertex (i.e. light paths connected
+// to the lens) can land on any pixel, so they're splatted onto the
+// accumulator rather than added to the pixel being sampled.
+//
+// Materials are shaded the same way as by tracePath (so that the two agree).
+// Mirrors, dielectrics and subsurface scattering have no density that can
+// be evaluated, so paths can't be connected through them.
+type bidirectional struct {
+	t       *tracer
+	cam     *camera
+	sources *lightSources // Nil when there are no light sources.
+	accum   *accumulator
+
+	// The area of the screen covered by the image (in world units, on the
+	// screen plane), and the distance from the lens to the screen.
+	screenArea float64
+	focalDist  float64
+
+	camPath, lightPath []pathVertex
+}
+
+func newBidirectional(t *tracer, scn *builtScene, accum *accumulator) *bidirectional {
+	cam := &scn.cam
+	halfWidth := cam.screen.x.Length()
+	aspect := float64(accum.dim.High) / float64(accum.dim.Wide)
+	return &bidirectional{
+		t:          t,
+		cam:        cam,
+		sources:    scn.sources,
+		accum:      accum,
+		screenArea: 4 * halfWidth * halfWidth * aspect,
+		focalDist:  cam.screen.loc.Sub(cam.eye.loc).Length(),
+		camPath:    make([]pathVertex, 0, maxSubpathVertices),
+		lightPath:  make([]pathVertex, 0, maxSubpathVertices),
+	}
+}
+
+type vertexKind int
+
+const (
+	cameraVertex vertexKind = iota
+	lightVertex             // The start of a light subpath.
+	surfaceVertex
+	mediumVertex
+)
+
+// pathVertex is a vertex on a camera or light subpath. Beta is the
+// throughput of the subpath up to the vertex (divided by the probability of
+// sampling it). pdfFwd is the probability density of the subpath sampling
+// the vertex, and pdfRev is the density of a subpath going the other way
+// sampling it (both per unit area on surfaces, or per unit volume in media).
+// Delta vertices scatter in directions that can't be sampled any other way
+// (e.g. mirror reflections), so paths can't be connected through them.
+type pathVertex struct {
+	kind  vertexKind
+	point xmath.Vector
+
+	// For surfaces and emitters. The normal is zero where light leaves an
+	// object with subsurface scattering, since the vertex then isn't
+	// treated as being on the surface.
+	x   intersection
+	mat material
+
+	med medium       // The medium the vertex is in.
+	src *lightSource // For light vertices.
+
+	beta      colour.Colour
+	pdfFwd    float64
+	pdfRev    float64
+	delta     bool
+	collapsed bool // The subpath went through a dispersive material.
+}
+
+func (v *pathVertex) onSurface() bool {
+	return (v.kind == surfaceVertex || v.kind == lightVertex) && v.x.unitNormal != (xmath.Vector{})
+}
+
+// deltaLight reports whether the vertex is on a light (rather than an
+// emitter), which can't be hit by rays.
+func (v *pathVertex) deltaLight() bool {
+	return v.kind == lightVertex && v.src.light != nil
+}
+
+func (v *pathVertex) infiniteLight() bool {
+	if !v.deltaLight() {
+		return false
+	}
+	_, ok := v.src.light.(*directionalLight)
+	return ok
+}
+
+// cosine gives the absolute cosine of the angle between a unit direction and
+// the vertex's surface normal (or 1 for vertices that aren't on surfaces).
+func (v *pathVertex) cosine(dir xmath.Vector) float64 {
+	if !v.onSurface() {
+		return 1
+	}
+	return math.Abs(v.x.unitNormal.Dot(dir))
+}
+
+// sample estimates the light arriving through a pixel along a camera ray,
+// and splats the light paths that land on other pixels.
+func (b *bidirectional) sample(pxX, pxY int, r xmath.Ray) {
+	t := b.t
+	if t.spectral {
+		t.setWavelengths(sampleWavelengths(t.rng.Float64()))
+	}
+	b.camPath = b.cameraSubpath(b.camPath[:0], r)
+	b.lightPath = b.lightSubpath(b.lightPath[:0])
+
+	var sum colour.Colour
+	for tv := 1; tv <= len(b.camPath); tv++ {
+		for sv := 0; sv <= len(b.lightPath); sv++ {
+			if sv == 1 && tv == 1 || sv+tv < 2 {
+				// Light sources that are visible to the camera are found by
+				// camera subpaths instead.
+				continue
+			}
+			c, x, y, ok := b.connect(sv, tv)
+			if !ok || c == (colour.Colour{}) {
+				continue
+			}
+			if tv == 1 {
+				if t.spectral {
+					b.accum.splatXYZ(x, y, t.toXYZ(c))
+				} else {
+					b.accum.splat(x, y, c)
+				}
+				continue
+			}
+			sum = sum.Add(c)
+		}
+	}
+	if t.spectral {
+		b.accum.setXYZ(pxX, pxY, t.toXYZ(sum))
+	} else {
+		b.accum.set(pxX, pxY, sum)
+	}
+}
+
+func (b *bidirectional) cameraSubpath(path []pathVertex, r xmath.Ray) []pathVertex {
+	v := pathVertex{
+		kind:  cameraVertex,
+		point: r.Start,
+		med:   b.t.camMedium,
+		beta:  colour.Colour{1, 1, 1},
+	}
+	path = append(path, v)
+	return b.walk(path, r, b.t.camMedium, v.beta, b.cameraPDF(r.Start, r.Dir), false)
+}
+
+func (b *bidirectional) lightSubpath(path []pathVertex) []pathVertex {
+	if b.sources == nil {
+		return path
+	}
+	t := b.t
+	idx, pmf := b.sources.sample(t.rng.Float64())
+	src := &b.sources.sources[idx]
+	v := pathVertex{kind: lightVertex, src: src, med: src.med}
+
+	var r xmath.Ray
+	var le colour.Colour
+	var pdfPos, pdfDir float64
+	cos := 1.0
+	if src.light != nil {
+		r, le, pdfPos, pdfDir = src.light.emit(b.sources.center, b.sources.radius, t.rng)
+		le = t.spectrum(le)
+		v.point = r.Start
+	} else {
+		x, ok := emitterPoint(src.obj, t.rng.Float64(), t.rng.Float64())
+		if !ok {
+			return path
+		}
+		v.point, v.x, v.mat = x.point, x, src.obj.Material
+		var dir xmath.Vector
+		dir, pdfDir = emitDirection(&v.mat, x.unitNormal, t.rng)
+		if !v.mat.emitsTowards(x, dir) {
+			return path
+		}
+		le = t.emission(v.mat, x, dir).Scale(v.mat.Emittance)
+		pdfPos = 1 / src.obj.Surface.(sampleable).area()
+		cos = v.cosine(dir)
+		r = spawnRay(x, dir)
+	}
+	if le == (colour.Colour{}) || pdfDir == 0 {
+		return path
+	}
+	v.beta = le
+	v.pdfFwd = pmf * pdfPos
+	path = append(path, v)
+	path = b.walk(path, r, src.med, le.Scale(cos/(pmf*pdfPos*pdfDir)), pdfDir, true)
+
+	// Light from directional lights arrives from infinitely far away, so the
+	// density of the first vertex it hits is given by the start point.
+	if path[0].infiniteLight() && len(path) > 1 {
+		path[1].pdfFwd = pdfPos * path[1].cosine(r.Dir)
+	}
+	return path
+}
+
+// walk extends a subpath along a ray, scattering until the path is absorbed
+// or terminated. The ray starts at the last vertex on the path, in a medium,
+// with a throughput and the probability density (per steradian) of its
+// direction. Light subpaths are traced in the direction light travels.
+func (b *bidirectional) walk(path []pathVertex, r xmath.Ray, med medium, beta colour.Colour, pdfFwd float64, fromLight bool) []pathVertex {
+	t := b.t
+	collapsed := false
+	start := maxComponent(beta)
+	for len(path) < maxSubpathVertices {
+		x, mat, hit := t.accel.closestHit(r)
+		prev := &path[len(path)-1]
+
+		if med != nil {
+			tMax := math.Inf(+1)
+			if hit {
+				tMax = x.distance
+			}
+			dist, weight, scattered := t.mediumFor(med).sampleDistance(r, tMax, t.rng)
+			beta = beta.Mul(weight)
+			if beta == (colour.Colour{}) {
+				return path
+			}
+			if scattered {
+				v := pathVertex{
+					kind:      mediumVertex,
+					point:     r.At(dist),
+					med:       med,
+					beta:      beta,
+					collapsed: collapsed,
+				}
+				v.pdfFwd = convertDensity(pdfFwd, prev, &v)
+				path = append(path, v)
+				if !b.survive(&beta, start, len(path)) {
+					return path
+				}
+				dir := sampleHenyeyGreenstein(r.Dir, med.asymmetry(), t.rng)
+				pdfFwd = henyeyGreenstein(r.Dir.Dot(dir), med.asymmetry())
+				prev.pdfRev = convertDensity(pdfFwd, &v, prev)
+				r = xmath.Ray{Start: v.point, Dir: dir}
+				continue
+			}
+		}
+		if !hit {
+			return path
+		}
+
+		// Pass through medium boundaries and the backs of one-sided
+		// surfaces, as in tracePath.
+		if mat.Medium != nil {
+			if med == mat.Medium {
+				med = t.outside
+			} else {
+				med = mat.Medium
+			}
+			r = spawnRay(x, r.Dir)
+			continue
+		}
+		if mat.culls(x, r.Dir) {
+			r = spawnRay(x, r.Dir)
+			continue
+		}
+
+		mat.perturbNormal(&x)
+		v := pathVertex{
+			kind:      surfaceVertex,
+			point:     x.point,
+			x:         x,
+			mat:       mat,
+			med:       med,
+			beta:      beta,
+			collapsed: collapsed,
+		}
+		v.pdfFwd = convertDensity(pdfFwd, prev, &v)
+		path = append(path, v)
+		vp := &path[len(path)-1]
+
+		// Camera subpaths end at emitters, which don't reflect light.
+		wPrev := r.Dir.Scale(-1)
+		if !fromLight && mat.emitsTowards(x, wPrev) {
+			return path
+		}
+
+		// Orient the normals towards the side the ray came from.
+		n, ns := x.unitNormal, x.shadingNormal
+		if n.Dot(r.Dir) > 0 {
+			n, ns = n.Scale(-1), ns.Scale(-1)
+		}
+
+		var dir xmath.Vector
+		var pdfRev float64
+		weight := colour.Colour{1, 1, 1}
+		switch {
+		case mat.Mirror:
+			// Mirrors lose the light that tracePath's emission roulette
+			// takes, so they reflect 90% of the light here too.
+			vp.delta = true
+			dir = r.Dir.Sub(ns.Scale(2 * ns.Dot(r.Dir)))
+			if dir.Dot(n) <= 0 {
+				return path
+			}
+			weight = colour.Colour{0.9, 0.9, 0.9}
+			pdfFwd = 0
+
+		case mat.Subsurface != nil:
+			// The light leaves the object somewhere else, which becomes
+			// another (delta) vertex.
+			vp.delta = true
+			entry := x
+			entry.unitNormal, entry.shadingNormal = n, ns
+			exit, w, ok := randomWalk(t.accel, entry, t.mediumFor(mat.Subsurface), t.rng)
+			if !ok || len(path) == maxSubpathVertices {
+				return path
+			}
+			beta = beta.Mul(w)
+			path = append(path, pathVertex{
+				kind:      surfaceVertex,
+				point:     exit.Start,
+				x:         intersection{point: exit.Start},
+				mat:       mat,
+				med:       med,
+				beta:      beta,
+				delta:     true,
+				collapsed: collapsed,
+			})
+			if !b.survive(&beta, start, len(path)) {
+				return path
+			}
+			r, pdfFwd = exit, 0
+			continue
+
+		case mat.Dielectric != nil:
+			vp.delta = true
+			lambda := referenceWavelength
+			if t.spectral {
+				lambda = t.lambdas[0]
+				if mat.Dielectric.dispersive() && !collapsed {
+					collapsed = true
+					weight = colour.Colour{3, 0, 0}
+				}
+			}
+			ior := mat.Dielectric.iorAt(lambda)
+			if x.unitNormal.Dot(r.Dir) > 0 {
+				ior = 1 / ior
+			}
+			dir = scatterDielectric(r.Dir, ns, ior, t.rng)
+			if (dir.Dot(ns) > 0) != (dir.Dot(n) > 0) {
+				return path
+			}
+			pdfFwd = 0
+
+		default:
+			dir = uniformCone(ns, 0, t.rng)
+			if dir.Dot(n) <= 0 {
+				return path
+			}
+			pdfFwd = 1 / (2 * math.Pi)
+			pdfRev = diffusePDF(x, dir, wPrev)
+			var f colour.Colour
+			if fromLight {
+				f = b.f(vp, dir, wPrev)
+			} else {
+				f = b.f(vp, wPrev, dir)
+			}
+			weight = f.Scale(math.Abs(dir.Dot(n)) / pdfFwd)
+		}
+
+		// Light can't be reflected towards where an emitter emits.
+		if fromLight && mat.emitsTowards(x, dir) {
+			return path
+		}
+		beta = beta.Mul(weight)
+		if beta == (colour.Colour{}) || !b.survive(&beta, start, len(path)) {
+			return path
+		}
+		prev.pdfRev = convertDensity(pdfRev, vp, prev)
+		r = spawnRay(x, dir)
+	}
+	return path
+}
+
+// survive applies Russian roulette to a subpath once it has a few vertices,
+// based on how much its throughput has dropped since it started.
+func (b *bidirectional) survive(beta *colour.Colour, start float64, vertices int) bool {
+	if vertices < 4 {
+		return true
+	}
+	p := math.Min(1, maxComponent(*beta)/start)
+	if !(b.t.rng.Float64() < p) {
+		return false
+	}
+	*beta = beta.Scale(1 / p)
+	return true
+}
+
+// f gives the fraction of light arriving at a (non-delta) vertex from the
+// direction of the vertex on its light side that's scattered towards the
+// vertex on its camera side (both as unit directions away from the vertex).
+// For surfaces, it's in the form that goes with the geometric (rather than
+// shading) normal in geometry terms.
+func (b *bidirectional) f(v *pathVertex, wCam, wLight xmath.Vector) colour.Colour {
+	switch v.kind {
+	case mediumVertex:
+		p := henyeyGreenstein(-wCam.Dot(wLight), v.med.asymmetry())
+		return colour.Colour{p, p, p}
+	case surfaceVertex:
+		if v.delta || v.mat.emitsTowards(v.x, wCam) {
+			return colour.Colour{}
+		}
+
+		// The same BRDF as tracePath (the albedo over 2π), with the normals
+		// facing the camera side.
+		n, ns := v.x.unitNormal, v.x.shadingNormal
+		if wCam.Dot(n) < 0 {
+			n, ns = n.Scale(-1), ns.Scale(-1)
+		}
+		cosN, cosS := wLight.Dot(n), wLight.Dot(ns)
+		if cosN <= 0 || cosS <= 0 {
+			return colour.Colour{}
+		}
+		return b.t.spectrum(v.mat.colourAt(v.x)).Scale(cosS / (2 * math.Pi * cosN))
+	}
+	return colour.Colour{}
+}
+
+// diffusePDF gives the probability density (per steradian) of a diffuse
+// surface scattering light that arrived from wPrev towards wNext (both unit
+// directions away from the surface).
+func diffusePDF(x intersection, wPrev, wNext xmath.Vector) float64 {
+	ns := x.shadingNormal
+	if wPrev.Dot(x.unitNormal) < 0 {
+		ns = ns.Scale(-1)
+	}
+	if wNext.Dot(ns) <= 0 {
+		return 0
+	}
+	return 1 / (2 * math.Pi)
+}
+
+// convertDensity converts a probability density per steradian of sampling
+// the direction from one vertex to another into a density per unit area (or
+// volume) of sampling the other vertex.
+func convertDensity(pdf float64, from, to *pathVertex) float64 {
+	if to.infiniteLight() {
+		return pdf
+	}
+	w := to.point.Sub(from.point)
+	d2 := w.LengthSq()
+	if d2 == 0 {
+		return 0
+	}
+	return pdf * to.cosine(w.Scale(1/math.Sqrt(d2))) / d2
+}
+
+// cameraPDF gives the probability density (per steradian) of a camera ray
+// leaving a point on the lens in a direction.
+func (b *bidirectional) cameraPDF(lens, dir xmath.Vector) float64 {
+	_, _, cos, ok := b.raster(lens, lens.Add(dir))
+	if !ok {
+		return 0
+	}
+	return b.focalDist * b.focalDist / (b.screenArea * cos * cos * cos)
+}
+
+// raster finds the pixel that the ray from a point on the lens through p lands
+// on, and the cosine of the angle between the ray and the view direction.
+func (b *bidirectional) raster(lens, p xmath.Vector) (int, int, float64, bool) {
+	x, y, cos, ok := b.cam.project(lens, p)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	// The inverse of the mapping from pixels to screen coordinates in work.
+	wide, high := b.accum.dim.Wide, b.accum.dim.High
+	fx := math.Floor(x*float64(wide)/2) + float64(wide/2)
+	fy := math.Floor(-y*float64(wide)/2) + float64(high/2)
+	if !(fx >= 0 && fx < float64(wide) && fy >= 0 && fy < float64(high)) {
+		return 0, 0, 0, false
+	}
+	return int(fx), int(fy), cos, true
+}
+
+// pdf gives the probability density (per unit area or volume) of a vertex
+// sampling next, given that it was reached from prev (which is nil for
+// camera and light vertices).
+func (b *bidirectional) pdf(v, prev, next *pathVertex) float64 {
+	w := next.point.Sub(v.point).Unit()
+	var pdf float64
+	switch v.kind {
+	case lightVertex:
+		return b.pdfLight(v, next)
+	case cameraVertex:
+		pdf = b.cameraPDF(v.point, w)
+	case mediumVertex:
+		pdf = henyeyGreenstein(v.point.Sub(prev.point).Unit().Dot(w), v.med.asymmetry())
+	case surfaceVertex:
+		if v.delta {
+			return 0
+		}
+		pdf = diffusePDF(v.x, prev.point.Sub(v.point).Unit(), w)
+	}
+	return convertDensity(pdf, v, next)
+}
+
+// pdfLight gives the probability density (per unit area or volume) of a light
+// subpath starting at a vertex on a light source sampling the next vertex.
+func (b *bidirectional) pdfLight(v, next *pathVertex) float64 {
+	w := next.point.Sub(v.point).Unit()
+	var pdf float64
+	if v.deltaLight() {
+		pdf = v.src.light.emitPDF(w, b.sources.radius)
+		if v.infiniteLight() {
+			return pdf * next.cosine(w)
+		}
+	} else {
+		pdf = emitDirectionPDF(&v.mat, v.x.unitNormal, w)
+	}
+	return convertDensity(pdf, v, next)
+}
+
+// pdfLightOrigin gives the probability density (per unit area) of a light
+// subpath starting at a point on an emitter. It's zero for emitters that
+// can't be sampled.
+func (b *bidirectional) pdfLightOrigin(v *pathVertex) float64 {
+	if b.sources == nil {
+		return 0
+	}
+	i, ok := b.sources.byPrim[v.x.primID]
+	if !ok {
+		return 0
+	}
+	return b.sources.pmf(i) / b.sources.sources[i].obj.Surface.(sampleable).area()
+}
+
+// transmittance finds the fraction of light that travels between a vertex on
+// the camera side of a connection and a point on the light side. Rays are
+// traced from the camera side, so that one-sided surfaces are culled the
+// same way as for camera subpaths.
+func (b *bidirectional) transmittance(from *pathVertex, to xmath.Vector, infinite bool) colour.Colour {
+	var dir xmath.Vector
+	tMax := math.Inf(+1)
+	if infinite {
+		dir = to
+	} else {
+		d := to.Sub(from.point)
+		tMax = d.Length()
+		dir = d.Scale(1 / tMax)
+		tMax *= 1 - shadowEpsilon
+	}
+	r := xmath.Ray{Start: from.point, Dir: dir}
+	if from.onSurface() {
+		r = spawnRay(from.x, dir)
+	}
+	return b.t.transmittance(r, tMax, from.med)
+}
+
+// connect joins the first s vertices of the light subpath to the first t
+// vertices of the camera subpath, giving the MIS weighted contribution of the
+// resulting path. When t is 1, the light subpath is connected to a new point
+// on the lens, and the pixel it lands on is given too.
+func (b *bidirectional) connect(s, t int) (colour.Colour, int, int, bool) {
+	light, cam := b.lightPath, b.camPath
+	tr := b.t
+	var sampled pathVertex
+	var c colour.Colour
+	var pxX, pxY int
+	switch {
+	case s == 0:
+		// The camera subpath hit an emitter.
+		pt := &cam[t-1]
+		if pt.kind != surfaceVertex {
+			return c, 0, 0, false
+		}
+		wCam := cam[t-2].point.Sub(pt.point).Unit()
+		if !pt.mat.emitsTowards(pt.x, wCam) {
+			return c, 0, 0, false
+		}
+		c = pt.beta.Mul(tr.emission(pt.mat, pt.x, wCam)).Scale(pt.mat.Emittance)
+
+	case t == 1:
+		// Connect the light subpath to the lens.
+		qs := &light[s-1]
+		if qs.delta {
+			return c, 0, 0, false
+		}
+		lens := b.cam.sampleLens(tr.rng)
+		var cos float64
+		var ok bool
+		pxX, pxY, cos, ok = b.raster(lens, qs.point)
+		if !ok {
+			return c, 0, 0, false
+		}
+		sampled = pathVertex{kind: cameraVertex, point: lens, med: tr.camMedium}
+		toLens := lens.Sub(qs.point)
+		d2 := toLens.LengthSq()
+		wCam := toLens.Scale(1 / math.Sqrt(d2))
+		f := b.f(qs, wCam, light[s-2].point.Sub(qs.point).Unit())
+		if f == (colour.Colour{}) {
+			return c, 0, 0, false
+		}
+
+		// The camera's importance, times the geometry term, divided by the
+		// density of the lens point (which cancels with the lens area).
+		we := b.focalDist * b.focalDist / (b.screenArea * d2 * cos * cos * cos)
+		c = qs.beta.Mul(f).Scale(we * qs.cosine(wCam))
+		if c == (colour.Colour{}) {
+			return c, 0, 0, false
+		}
+		c = c.Mul(b.transmittance(&sampled, qs.point, false))
+
+	case s == 1:
+		// Connect the camera subpath to a new point on a light source.
+		pt := &cam[t-1]
+		if pt.delta || b.sources == nil {
+			return c, 0, 0, false
+		}
+		wCam := cam[t-2].point.Sub(pt.point).Unit()
+		idx, pmf := b.sources.sample(tr.rng.Float64())
+		src := &b.sources.sources[idx]
+		sampled = pathVertex{kind: lightVertex, src: src, med: src.med}
+		if src.light != nil {
+			dir, dist, irradiance := src.light.sample(pt.point)
+			f := b.f(pt, wCam, dir)
+			c = pt.beta.Mul(f).Mul(tr.spectrum(irradiance)).Scale(pt.cosine(dir) / pmf)
+			if c == (colour.Colour{}) {
+				return c, 0, 0, false
+			}
+			infinite := math.IsInf(dist, +1)
+			if infinite {
+				sampled.point = pt.point.Add(dir.Scale(2 * b.sources.radius))
+				sampled.pdfFwd = pmf * src.light.emitPDF(dir, b.sources.radius)
+				c = c.Mul(b.transmittance(pt, dir, true))
+			} else {
+				sampled.point = pt.point.Add(dir.Scale(dist))
+				sampled.pdfFwd = pmf
+				c = c.Mul(b.transmittance(pt, sampled.point, false))
+			}
+		} else {
+			x, ok := emitterPoint(src.obj, tr.rng.Float64(), tr.rng.Float64())
+			if !ok {
+				return c, 0, 0, false
+			}
+			sampled.point, sampled.x, sampled.mat = x.point, x, src.obj.Material
+			toLight := x.point.Sub(pt.point)
+			d2 := toLight.LengthSq()
+			dir := toLight.Scale(1 / math.Sqrt(d2))
+			if !sampled.mat.emitsTowards(x, dir.Scale(-1)) {
+				return c, 0, 0, false
+			}
+			le := tr.emission(sampled.mat, x, dir.Scale(-1)).Scale(sampled.mat.Emittance)
+			area := src.obj.Surface.(sampleable).area()
+			sampled.pdfFwd = pmf / area
+			g := pt.cosine(dir) * sampled.cosine(dir) / d2
+			c = pt.beta.Mul(b.f(pt, wCam, dir)).Mul(le).Scale(g / sampled.pdfFwd)
+			if c == (colour.Colour{}) {
+				return c, 0, 0, false
+			}
+			c = c.Mul(b.transmittance(pt, x.point, false))
+		}
+
+	default:
+		qs, pt := &light[s-1], &cam[t-1]
+		if qs.delta || pt.delta {
+			return c, 0, 0, false
+		}
+		d := qs.point.Sub(pt.point)
+		d2 := d.LengthSq()
+		dir := d.Scale(1 / math.Sqrt(d2))
+		fp := b.f(pt, cam[t-2].point.Sub(pt.point).Unit(), dir)
+		fq := b.f(qs, dir.Scale(-1), light[s-2].point.Sub(qs.point).Unit())
+		g := pt.cosine(dir) * qs.cosine(dir) / d2
+		c = qs.beta.Mul(fq).Mul(fp).Mul(pt.beta).Scale(g)
+		if c == (colour.Colour{}) {
+			return c, 0, 0, false
+		}
+		if qs.collapsed && pt.collapsed {
+			// Both subpaths were scaled up for being collapsed to the hero
+			// wavelength, but it only happened once.
+			c = c.Scale(1.0 / 3)
+		}
+		c = c.Mul(b.transmittance(pt, qs.point, false))
+	}
+	if c == (colour.Colour{}) {
+		return c, 0, 0, false
+	}
+	return c.Scale(b.misWeight(&sampled, s, t)), pxX, pxY, true
+}
+
+// misWeight gives the MIS weight for a path made by connecting the first s
+// vertices of the light subpath and the first t vertices of the camera
+// subpath, relative to all of the other ways that the path could have been
+// made. Sampled replaces the last vertex of the light or camera subpath when
+// s or t is 1.
+func (b *bidirectional) misWeight(sampled *pathVertex, s, t int) float64 {
+	if s+t == 2 {
+		return 1
+	}
+	light, cam := b.lightPath, b.camPath
+
+	// The densities are copied, so that they can be updated for this
+	// particular connection.
+	var lightFwd, lightRev, camFwd, camRev [maxSubpathVertices]float64
+	var lightDelta, camDelta [maxSubpathVertices]bool
+	for i := 0; i < s; i++ {
+		lightFwd[i], lightRev[i], lightDelta[i] = light[i].pdfFwd, light[i].pdfRev, light[i].delta
+	}
+	for i := 0; i < t; i++ {
+		camFwd[i], camRev[i], camDelta[i] = cam[i].pdfFwd, cam[i].pdfRev, cam[i].delta
+	}
+
+	var qs, pt, qsMinus, ptMinus *pathVertex
+	if s > 0 {
+		qs = &light[s-1]
+	}
+	if t > 0 {
+		pt = &cam[t-1]
+	}
+	if s > 1 {
+		qsMinus = &light[s-2]
+	}
+	if t > 1 {
+		ptMinus = &cam[t-2]
+	}
+	if s == 1 {
+		qs = sampled
+		lightFwd[0] = sampled.pdfFwd
+	} else if t == 1 {
+		pt = sampled
+		camFwd[0] = sampled.pdfFwd
+	}
+
+	// The vertices being connected aren't delta (otherwise there would be
+	// no contribution), and their densities (and those of their neighbours)
+	// in the reverse direction depend on the connection.
+	if s > 0 {
+		lightDelta[s-1] = false
+		lightRev[s-1] = b.pdf(pt, ptMinus, qs)
+	}
+	if s > 1 {
+		lightRev[s-2] = b.pdf(qs, pt, qsMinus)
+	}
+	camDelta[t-1] = false
+	if s > 0 {
+		camRev[t-1] = b.pdf(qs, qsMinus, pt)
+	} else {
+		camRev[t-1] = b.pdfLightOrigin(pt)
+		if camRev[t-1] == 0 {
+			// The emitter can only be found by hitting it.
+			return 1
+		}
+	}
+	if t > 1 {
+		if s > 0 {
+			camRev[t-2] = b.pdf(pt, qs, ptMinus)
+		} else {
+			camRev[t-2] = b.pdfLight(pt, ptMinus)
+		}
+	}
+
+	// Consider the other ways of making the path, by shifting the connection
+	// along it towards the light and then towards the camera. Each gives the
+	// ratio of its density to this way's density.
+	remap0 := func(f float64) float64 {
+		if f != 0 {
+			return f
+		}
+		return 1
+	}
+	var sum float64
+	ri := 1.0
+	for i := t - 1; i > 0; i-- {
+		ri *= remap0(camRev[i]) / remap0(camFwd[i])
+		if !camDelta[i] && !camDelta[i-1] {
+			sum += ri * ri
+		}
+	}
+	ri = 1
+	for i := s - 1; i >= 0; i-- {
+		ri *= remap0(lightRev[i]) / remap0(lightFwd[i])
+		var deltaLight bool
+		if i > 0 {
+			deltaLight = lightDelta[i-1]
+		} else if s == 1 {
+			deltaLight = sampled.deltaLight()
+		} else {
+			deltaLight = light[0].deltaLight()
+		}
+		if !lightDelta[i] && !deltaLight {
+			sum += ri * ri
+		}
+	}
+	return 1 / (1 + sum)
+}
@@ -0,0 +1,85 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestBidirectionalMatchesPathTracing(t *testing.T) {
+	// A floor and a wall lit by an emitter and a point light, viewed through
+	// a lens. Each quadrant of the image is compared, so that light paths
+	// splatted onto the wrong pixels would be noticed.
+	white := colour.Colour{R: 1, G: 1, B: 1}
+	objs := []object{
+		{Surface: &alignYSquare{X1: -2, X2: 2, Y: 0, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &alignZSquare{X1: -2, X2: 2, Y1: 0, Y2: 2, Z: -1}, Material: material{Colour: colour.Colour{R: 0.8, G: 0.4, B: 0.2}}},
+		{Surface: &alignYSquare{X1: -1, X2: 0, Y: 1.5, Z1: -0.5, Z2: 0.5}, Material: material{Colour: white, Emittance: 2}},
+	}
+	for i := range objs {
+		objs[i].ObjID = i
+		objs[i].PrimID = i
+	}
+	lights := []light{&pointLight{Position: xmath.Vect(1, 1, 0.5), Intensity: colour.Colour{R: 1, G: 1, B: 1}}}
+	scn := &builtScene{
+		cam: newCamera(scene.Camera{
+			Location:             xmath.Vect(0, 1, 3),
+			LookingAt:            xmath.Vect(0, 0.5, 0),
+			UpDirection:          xmath.Vect(0, 1, 0),
+			FieldOfViewInRadians: 0.8,
+			FocalLength:          3,
+			FocalRatio:           30,
+		}),
+		objs:     objs,
+		lights:   lights,
+		emitters: newLightBVH(objs),
+		sources:  newLightSources(objs, lights, nil),
+	}
+	accel := newListAccelerationStructure(objs)
+
+	const size = 8
+	dim := xmath.Dimensions{Wide: size, High: size}
+	passes := rayCount() / (size * size)
+	if passes < 1<<11 {
+		passes = 1 << 11
+	}
+	var quadrants [2][2][2]float64
+	for i, bidir := range []bool{false, true} {
+		rng := rand.New(rand.NewSource(1))
+		tr := newTracer(accel, scn, rng)
+		accum := newAccumulator(dim)
+		bd := newBidirectional(tr, scn, accum)
+		for p := 0; p < passes; p++ {
+			for pxY := 0; pxY < size; pxY++ {
+				for pxX := 0; pxX < size; pxX++ {
+					x := (float64(pxX-size/2) + rng.Float64()) * 2 / size
+					y := (float64(pxY-size/2) + rng.Float64()) * -2 / size
+					r := scn.cam.makeRay(x, y, rng)
+					r.Dir = r.Dir.Unit()
+					if bidir {
+						bd.sample(pxX, pxY, r)
+					} else {
+						accum.set(pxX, pxY, tr.tracePath(r))
+					}
+				}
+			}
+			accum.merge(1)
+		}
+		for j, c := range accum.aggregate {
+			q := &quadrants[i][j%size/(size/2)][j/size/(size/2)]
+			*q += (c.R + c.G + c.B) / float64(passes)
+		}
+	}
+	for qx := 0; qx < 2; qx++ {
+		for qy := 0; qy < 2; qy++ {
+			want, got := quadrants[0][qx][qy], quadrants[1][qx][qy]
+			if want == 0 || math.Abs(got-want) > 0.05*want {
+				t.Errorf("quadrant (%d, %d): path tracing gave %v, bidirectional gave %v", qx, qy, want, got)
+			}
+		}
+	}
+}
@@ -1,44 +1,398 @@
 package trace
 
-import "github.com/peterstace/grayt/scene"
+import (
+	"errors"
+	"fmt"
+	"math"
 
-func buildScene(proto scene.Scene) (camera, []object) {
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// builtScene is a scene that's ready to be traced.
+type builtScene struct {
+	cam       camera
+	objs      []object
+	lights    []light
+	emitters  *lightBVH
+	sources   *lightSources
+	outside   medium
+	camMedium medium
+	spectral  bool
+}
+
+func buildScene(proto scene.Scene) (*builtScene, error) {
 	var objs []object
-	for _, o := range proto.Objects {
-		add := func(s surface) {
+	textures := newTextureLoader()
+	for i, o := range proto.Objects {
+		mat := material{
+			Colour:    o.Material.Colour,
+			Emittance: o.Material.Emittance,
+			Mirror:    o.Material.Mirror,
+			BumpScale: o.Material.BumpScale,
+		}
+		if ss := o.Material.Subsurface; ss != nil {
+			mfp := ss.MeanFreePath
+			if !(mfp.R > 0 && mfp.G > 0 && mfp.B > 0) {
+				return nil, fmt.Errorf("object %d: mean free path must be positive", i)
+			}
+			sigmaT := colour.Colour{1 / mfp.R, 1 / mfp.G, 1 / mfp.B}
+			mat.Subsurface = &homogeneousMedium{
+				Absorption: sigmaT.Mul(colour.Colour{1, 1, 1}.Add(ss.Albedo.Scale(-1))),
+				Scattering: sigmaT.Mul(ss.Albedo),
+			}
+		}
+		if d := o.Material.Dielectric; d != nil {
+			if d.Cauchy != nil && d.Sellmeier != nil {
+				return nil, fmt.Errorf("object %d: cannot have both a Cauchy and a Sellmeier dispersion", i)
+			}
+			mat.Dielectric = &dielectric{IOR: d.IOR}
+			switch {
+			case d.Cauchy != nil:
+				mat.Dielectric.Cauchy = &[2]float64{d.Cauchy.A, d.Cauchy.B}
+			case d.Sellmeier != nil:
+				b, c := d.Sellmeier.B, d.Sellmeier.C
+				mat.Dielectric.SellmeierB = &b
+				mat.Dielectric.SellmeierC = &c
+			case !(d.IOR > 0):
+				return nil, fmt.Errorf("object %d: dielectric must have an IOR", i)
+			}
+		}
+		if o.Medium != nil {
+			var err error
+			mat.Medium, err = buildMedium(*o.Medium)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %v", i, err)
+			}
+		}
+		if o.Material.NormalMap != nil && o.Material.BumpMap != nil {
+			return nil, fmt.Errorf("object %d: cannot have both a normal map and a bump map", i)
+		}
+		for _, tex := range []struct {
+			proto *scene.Texture
+			dst   *texture
+		}{
+			{o.Material.Texture, &mat.Texture},
+			{o.Material.NormalMap, &mat.NormalMap},
+			{o.Material.BumpMap, &mat.BumpMap},
+		} {
+			if tex.proto == nil {
+				continue
+			}
+			var err error
+			*tex.dst, err = textures.load(tex.proto)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %v", i, err)
+			}
+		}
+		if p := o.Material.Profile; p != nil {
+			var err error
+			mat.Profile, err = buildProfile(*p)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %v", i, err)
+			}
+		}
+		switch o.Material.EmitSide {
+		case "", scene.SideBoth:
+		case scene.SideFront:
+			mat.EmitSide = frontSide
+		case scene.SideBack:
+			mat.EmitSide = backSide
+		default:
+			return nil, fmt.Errorf("object %d: unknown emit side %q", i, o.Material.EmitSide)
+		}
+		if o.Material.OneSided {
+			if mat.Subsurface != nil || mat.Dielectric != nil || mat.Medium != nil {
+				return nil, fmt.Errorf("object %d: only opaque materials can be one-sided", i)
+			}
+			mat.OneSided = true
+		}
+		if o.Material.Temperature > 0 {
+			c := colour.Blackbody(o.Material.Temperature)
+			mat.EmissionColour = &c
+			mat.Spectrum = colour.BlackbodySpectrum(o.Material.Temperature)
+		}
+		surfs, err := buildSurfaces(o.Surface)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %v", i, err)
+		}
+		for _, s := range surfs {
 			objs = append(objs, object{
-				Surface: s,
-				Material: material{
-					Colour:    o.Material.Colour,
-					Emittance: o.Material.Emittance,
-					Mirror:    o.Material.Mirror,
-				},
+				ObjID:    i,
+				PrimID:   len(objs),
+				Surface:  s,
+				Material: mat,
 			})
 		}
-		for _, x := range o.Surface.Triangles {
+		for _, x := range o.Surface.Voxels {
+			grid, err := loadVoxelGrid(x.Filename)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %v", i, err)
+			}
+			objs = append(objs, object{
+				ObjID:    i,
+				PrimID:   len(objs),
+				Surface:  newVoxels(grid, x.Corner, x.VoxelSize),
+				Material: mat,
+				Palette:  &grid.Palette,
+			})
+		}
+	}
+
+	var lights []light
+	for i, l := range proto.Lights {
+		built, err := buildLight(l)
+		if err != nil {
+			return nil, fmt.Errorf("light %d: %v", i, err)
+		}
+		lights = append(lights, built)
+	}
+
+	var outside medium
+	if proto.Medium != nil {
+		var err error
+		outside, err = buildMedium(*proto.Medium)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cam := newCamera(proto.Camera)
+	return &builtScene{
+		cam:       cam,
+		objs:      objs,
+		lights:    lights,
+		emitters:  newLightBVH(objs),
+		sources:   newLightSources(objs, lights, outside),
+		outside:   outside,
+		camMedium: mediumAt(cam.eye.loc, objs, outside),
+		spectral:  proto.Spectral,
+	}, nil
+}
+
+func buildProfile(proto scene.EmissionProfile) (emissionProfile, error) {
+	axis := xmath.Vect(0, -1, 0)
+	if proto.Axis != (xmath.Vector{}) {
+		axis = proto.Axis.Unit()
+	}
+	switch {
+	case proto.IESFile != "":
+		return loadIESProfile(proto.IESFile, axis)
+	case proto.Spot != nil:
+		s := proto.Spot
+		if !(s.InnerAngle >= 0 && s.InnerAngle <= s.OuterAngle && s.OuterAngle <= math.Pi) {
+			return nil, errors.New("spot cone must have 0 <= inner angle <= outer angle <= pi")
+		}
+		return &spotProfile{
+			Axis:     axis,
+			CosInner: math.Cos(s.InnerAngle),
+			CosOuter: math.Cos(s.OuterAngle),
+		}, nil
+	default:
+		return nil, errors.New("emission profile has no type")
+	}
+}
+
+func buildLight(proto scene.Light) (light, error) {
+	switch {
+	case proto.Point != nil:
+		p := proto.Point
+		return &pointLight{
+			Position:  p.Position,
+			Intensity: p.Colour.Scale(p.Intensity),
+		}, nil
+	case proto.Spot != nil:
+		s := proto.Spot
+		if !(s.InnerAngle >= 0 && s.InnerAngle <= s.OuterAngle && s.OuterAngle <= math.Pi) {
+			return nil, errors.New("spot light must have 0 <= inner angle <= outer angle <= pi")
+		}
+		if s.Direction.LengthSq() == 0 {
+			return nil, errors.New("spot light must have a direction")
+		}
+		return &spotLight{
+			Position:  s.Position,
+			Direction: s.Direction.Unit(),
+			Intensity: s.Colour.Scale(s.Intensity),
+			CosInner:  math.Cos(s.InnerAngle),
+			CosOuter:  math.Cos(s.OuterAngle),
+		}, nil
+	case proto.Directional != nil:
+		d := proto.Directional
+		if d.Direction.LengthSq() == 0 {
+			return nil, errors.New("directional light must have a direction")
+		}
+		return &directionalLight{
+			Direction:  d.Direction.Unit(),
+			Irradiance: d.Colour.Scale(d.Irradiance),
+		}, nil
+	default:
+		return nil, errors.New("light has no type")
+	}
+}
+
+func buildMedium(proto scene.Medium) (medium, error) {
+	if proto.Density == nil {
+		return &homogeneousMedium{
+			Absorption: proto.Absorption,
+			Scattering: proto.Scattering,
+			Asymmetry:  proto.Asymmetry,
+		}, nil
+	}
+	grid, err := loadDensityGrid(proto.Density.Filename, proto.Density.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	return newGridMedium(proto, grid), nil
+}
+
+func buildSurfaces(proto scene.Surface) ([]surface, error) {
+	var surfs []surface
+	add := func(s surface) {
+		surfs = append(surfs, s)
+	}
+	for _, x := range proto.Triangles {
+		switch {
+		case x.NormalA == nil && x.NormalB == nil && x.NormalC == nil:
 			add(newTriangle(x.A, x.B, x.C))
+		case x.NormalA != nil && x.NormalB != nil && x.NormalC != nil:
+			add(newSmoothTriangle(x.A, x.B, x.C, *x.NormalA, *x.NormalB, *x.NormalC))
+		default:
+			return nil, errors.New("triangle must have all or no vertex normals")
+		}
+	}
+	for _, x := range proto.AlignedBoxes {
+		add(newAlignedBox(x.CornerA, x.CornerB))
+	}
+	for _, x := range proto.Spheres {
+		add(&sphere{Center: x.Center, Radius: x.Radius})
+	}
+	for _, x := range proto.AlignXSquares {
+		add(&alignXSquare{x.X, x.Y1, x.Y2, x.Z1, x.Z2})
+	}
+	for _, x := range proto.AlignYSquares {
+		add(&alignYSquare{x.X1, x.X2, x.Y, x.Z1, x.Z2})
+	}
+	for _, x := range proto.AlignZSquares {
+		add(&alignZSquare{x.X1, x.X2, x.Y1, x.Y2, x.Z})
+	}
+	for _, x := range proto.Discs {
+		add(&disc{Center: x.Center, RadiusSq: x.Radius * x.Radius, UnitNorm: x.UnitNorm})
+	}
+	for _, x := range proto.Pipes {
+		add(&pipe{C1: x.EndpointA, C2: x.EndpointB, R: x.Radius})
+	}
+	for _, x := range proto.Cones {
+		add(&cone{C1: x.EndpointA, C2: x.EndpointB, R1: x.RadiusA, R2: x.RadiusB})
+	}
+	for _, x := range proto.Cylinders {
+		add(&cone{C1: x.EndpointA, C2: x.EndpointB, R1: x.Radius, R2: x.Radius})
+	}
+	for _, x := range proto.Tori {
+		add(&torus{Center: x.Center, Axis: x.Axis.Unit(), Major: x.MajorRadius, Minor: x.MinorRadius})
+	}
+	for _, x := range proto.Ellipsoids {
+		add(newEllipsoid(x.Center, x.Radii))
+	}
+	for _, x := range proto.Parallelograms {
+		if x.EdgeU.Cross(x.EdgeV).LengthSq() == 0 {
+			return nil, errors.New("parallelogram must have a nonzero area")
 		}
-		for _, x := range o.Surface.AlignedBoxes {
-			add(newAlignedBox(x.CornerA, x.CornerB))
+		add(newParallelogram(x.Corner, x.EdgeU, x.EdgeV))
+	}
+	for _, x := range proto.OrientedBoxes {
+		b := newOrientedBox(x.Center, x.HalfExtents)
+		if x.RotationAngle != 0 {
+			b.spin(x.RotationAxis.Unit(), x.RotationAngle)
 		}
-		for _, x := range o.Surface.Spheres {
-			add(&sphere{Center: x.Center, Radius: x.Radius})
+		add(b)
+	}
+	for _, x := range proto.SDFs {
+		if x.Func == nil {
+			return nil, errors.New("SDF must have a distance function")
 		}
-		for _, x := range o.Surface.AlignXSquares {
-			add(&alignXSquare{x.X, x.Y1, x.Y2, x.Z1, x.Z2})
+		add(newSDFSurface(x.Func, x.Min, x.Max, x.Epsilon))
+	}
+	for _, x := range proto.Heightfields {
+		h, err := loadHeightfield(x.Filename, x.Corner, x.Size)
+		if err != nil {
+			return nil, err
 		}
-		for _, x := range o.Surface.AlignYSquares {
-			add(&alignYSquare{x.X1, x.X2, x.Y, x.Z1, x.Z2})
+		add(h)
+	}
+	for _, x := range proto.Curves {
+		segs, err := newCurveSegments(x)
+		if err != nil {
+			return nil, err
 		}
-		for _, x := range o.Surface.AlignZSquares {
-			add(&alignZSquare{x.X1, x.X2, x.Y1, x.Y2, x.Z})
+		for _, c := range segs {
+			add(c)
 		}
-		for _, x := range o.Surface.Discs {
-			add(&disc{Center: x.Center, RadiusSq: x.Radius * x.Radius, UnitNorm: x.UnitNorm})
+	}
+	for _, x := range proto.CSGs {
+		c, err := buildCSG(x)
+		if err != nil {
+			return nil, err
+		}
+		add(c)
+	}
+	return surfs, nil
+}
+
+func buildCSG(proto scene.CSG) (*csg, error) {
+	var op csgOp
+	switch proto.Op {
+	case scene.CSGUnion:
+		op = csgUnion
+	case scene.CSGIntersection:
+		op = csgIntersection
+	case scene.CSGDifference:
+		op = csgDifference
+	default:
+		return nil, fmt.Errorf("unknown CSG op: %q", proto.Op)
+	}
+	if proto.A == nil || proto.B == nil {
+		return nil, errors.New("CSG must have 2 operands")
+	}
+	a, err := buildOperand(*proto.A)
+	if err != nil {
+		return nil, err
+	}
+	b, err := buildOperand(*proto.B)
+	if err != nil {
+		return nil, err
+	}
+	return &csg{Op: op, A: a, B: b}, nil
+}
+
+// buildOperand builds one side of a CSG operation. When there are multiple
+// primitives, the operand is their union.
+func buildOperand(proto scene.Surface) (solid, error) {
+	if len(proto.Voxels) > 0 {
+		return nil, errors.New("CSG operands cannot contain voxels")
+	}
+	surfs, err := buildSurfaces(proto)
+	if err != nil {
+		return nil, err
+	}
+	var operand solid
+	for _, s := range surfs {
+		var sol solid
+		switch s := s.(type) {
+		case *csg:
+			sol = s
+		case *sphere, *alignedBox, *orientedBox, *cone, *torus, *ellipsoid:
+			sol = &closedSurface{s}
+		default:
+			return nil, fmt.Errorf("CSG operands must be closed: %v", s)
 		}
-		for _, x := range o.Surface.Pipes {
-			add(&pipe{C1: x.EndpointA, C2: x.EndpointB, R: x.Radius})
+		if operand == nil {
+			operand = sol
+		} else {
+			operand = &csg{Op: csgUnion, A: operand, B: sol}
 		}
 	}
-	return newCamera(proto.Camera), objs
+	if operand == nil {
+		return nil, errors.New("CSG operand is empty")
+	}
+	return operand, nil
 }
@@ -51,3 +51,27 @@ func (c *camera) makeRay(x, y float64, rng *rand.Rand) xmath.Ray {
 		Dir:   end.Sub(start),
 	}
 }
+
+// sampleLens chooses a point uniformly on the lens (the same way as
+// makeRay). Pinhole cameras always give the center of the lens.
+func (c *camera) sampleLens(rng *rand.Rand) xmath.Vector {
+	return c.eye.loc.
+		Add(c.eye.x.Scale(2*rng.Float64() - 1.0)).
+		Add(c.eye.y.Scale(2*rng.Float64() - 1.0))
+}
+
+// project finds the screen coordinates (as passed to makeRay) of the ray
+// from a point on the lens through p, and the cosine of the angle between the
+// ray and the view direction. It fails if p isn't in front of the lens.
+func (c *camera) project(lens, p xmath.Vector) (float64, float64, float64, bool) {
+	view := c.screen.loc.Sub(c.eye.loc)
+	d := p.Sub(lens)
+	along := d.Dot(view)
+	if along <= 0 {
+		return 0, 0, 0, false
+	}
+	rel := lens.Add(d.Scale(view.LengthSq() / along)).Sub(c.screen.loc)
+	x := rel.Dot(c.screen.x) / c.screen.x.LengthSq()
+	y := rel.Dot(c.screen.y) / c.screen.y.LengthSq()
+	return x, y, along / (d.Length() * view.Length()), true
+}
@@ -0,0 +1,186 @@
+package trace
+
+import (
+	"fmt"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// solid is a closed surface, so has a well defined inside and outside.
+type solid interface {
+	surface
+
+	// crossings finds everywhere that a ray crosses the boundary of the
+	// solid, ordered by distance. Because the solid is closed, the ray starts
+	// inside the solid if and only if the first crossing is an exit.
+	crossings(r xmath.Ray) crossingList
+}
+
+type crossing struct {
+	x        intersection
+	entering bool
+}
+
+// maxCrossings limits the number of times a ray may cross the boundary of a
+// single solid. It's only there to guard against pathological cases, the
+// most complex primitive (the torus) only has 4 crossings.
+const maxCrossings = 16
+
+// crossingList holds the crossings of a solid in a fixed size array, so that
+// finding them doesn't allocate. Crossings past maxCrossings are dropped.
+type crossingList struct {
+	n     int
+	items [maxCrossings]crossing
+}
+
+func (l *crossingList) add(c crossing) {
+	if l.n < maxCrossings {
+		l.items[l.n] = c
+		l.n++
+	}
+}
+
+// insideAtStart tells if a ray starts inside a solid, given its crossings.
+func (l *crossingList) insideAtStart() bool {
+	return l.n > 0 && !l.items[0].entering
+}
+
+// closedSurface turns a surface into a solid. The caller is responsible for
+// ensuring that the surface is closed.
+type closedSurface struct {
+	surface
+}
+
+// crossings finds successive hits with the surface. The direction of the
+// normal at each hit tells whether the ray is entering or exiting.
+func (c *closedSurface) crossings(r xmath.Ray) crossingList {
+	var crossings crossingList
+	walk := r
+	for crossings.n < maxCrossings {
+		x, hit := c.intersect(walk)
+		if !hit {
+			break
+		}
+		x.distance = x.point.Sub(r.Start).Dot(r.Dir) / r.Dir.LengthSq()
+		crossings.add(crossing{x, x.unitNormal.Dot(r.Dir) < 0})
+		walk = spawnRay(x, r.Dir)
+	}
+	return crossings
+}
+
+type csgOp int
+
+const (
+	csgUnion csgOp = iota
+	csgIntersection
+	csgDifference
+)
+
+func (o csgOp) inside(inA, inB bool) bool {
+	switch o {
+	case csgUnion:
+		return inA || inB
+	case csgIntersection:
+		return inA && inB
+	default:
+		return inA && !inB
+	}
+}
+
+func (o csgOp) String() string {
+	return [...]string{"union", "intersection", "difference"}[o]
+}
+
+// csg combines two solids using a boolean operation. For differences, B is
+// subtracted from A.
+//
+// The part field of intersections records the path taken through the CSG
+// tree to reach the primitive that was hit. Each level shifts the part left
+// by one bit, and then stores 0 (for A) or 1 (for B) in the lowest bit.
+type csg struct {
+	Op csgOp `json:"op"`
+	A  solid `json:"a"`
+	B  solid `json:"b"`
+}
+
+func (c *csg) String() string {
+	return fmt.Sprintf("Type=csg Op=%v A={%v} B={%v}", c.Op, c.A, c.B)
+}
+
+func (c *csg) intersect(r xmath.Ray) (intersection, bool) {
+	crossings := c.crossings(r)
+	if crossings.n == 0 {
+		return intersection{}, false
+	}
+	return crossings.items[0].x, true
+}
+
+// crossings merges the crossings of each operand, keeping those where the
+// ray goes from outside of the combined solid to inside of it (or vice versa).
+func (c *csg) crossings(r xmath.Ray) crossingList {
+	as, bs := c.A.crossings(r), c.B.crossings(r)
+	inA, inB := as.insideAtStart(), bs.insideAtStart()
+	var merged crossingList
+	i, j := 0, 0
+	for (i < as.n || j < bs.n) && merged.n < maxCrossings {
+		before := c.Op.inside(inA, inB)
+		var cr crossing
+		if j == bs.n || (i < as.n && as.items[i].x.distance <= bs.items[j].x.distance) {
+			cr = as.items[i]
+			i++
+			inA = cr.entering
+			cr.x.part = cr.x.part << 1
+		} else {
+			cr = bs.items[j]
+			j++
+			inB = cr.entering
+			cr.x.part = cr.x.part<<1 | 1
+			if c.Op == csgDifference {
+				// The subtracted solid's boundary is inside out.
+				cr.x.unitNormal = cr.x.unitNormal.Scale(-1)
+			}
+		}
+		if after := c.Op.inside(inA, inB); after != before {
+			cr.entering = after
+			merged.add(cr)
+		}
+	}
+	return merged
+}
+
+func (c *csg) parameterise(x *intersection) {
+	child := c.A
+	if x.part&1 == 1 {
+		child = c.B
+	}
+	x.part >>= 1
+	child.parameterise(x)
+}
+
+func (c *csg) bound() (xmath.Vector, xmath.Vector) {
+	minA, maxA := c.A.bound()
+	minB, maxB := c.B.bound()
+	switch c.Op {
+	case csgUnion:
+		return minA.Min(minB), maxA.Max(maxB)
+	case csgIntersection:
+		return minA.Max(minB), maxA.Min(maxB)
+	default:
+		return minA, maxA
+	}
+}
+
+func (c *csg) translate(v xmath.Vector) {
+	c.A.translate(v)
+	c.B.translate(v)
+}
+
+func (c *csg) rotate(v xmath.Vector, rads float64) {
+	c.A.rotate(v, rads)
+	c.B.rotate(v, rads)
+}
+
+func (c *csg) scale(f float64) {
+	c.A.scale(f)
+	c.B.scale(f)
+}
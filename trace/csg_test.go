@@ -0,0 +1,109 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestCSGOps(t *testing.T) {
+	// Two overlapping unit spheres, centered at x=0 and x=1. The ray travels
+	// along the x axis.
+	sphereA := &closedSurface{&sphere{Center: xmath.Vect(0, 0, 0), Radius: 1}}
+	sphereB := &closedSurface{&sphere{Center: xmath.Vect(1, 0, 0), Radius: 1}}
+	for _, tc := range []struct {
+		op    csgOp
+		start float64
+		hit   bool
+		dist  float64
+		normX float64
+	}{
+		{csgUnion, -5, true, 4, -1},
+		{csgUnion, 0.5, true, 1.5, +1},
+		{csgIntersection, -5, true, 5, -1},
+		{csgIntersection, 0.5, true, 0.5, +1},
+		{csgDifference, -5, true, 4, -1},
+		{csgDifference, -0.5, true, 0.5, +1},
+		{csgDifference, 0.5, false, 0, 0}, // Starts in the removed part.
+	} {
+		c := &csg{Op: tc.op, A: sphereA, B: sphereB}
+		r := xmath.Ray{Start: xmath.Vect(tc.start, 0, 0), Dir: xmath.Vect(1, 0, 0)}
+		x, hit := c.intersect(r)
+		if hit != tc.hit {
+			t.Errorf("%v from %v: want hit=%v got hit=%v", tc.op, tc.start, tc.hit, hit)
+			continue
+		}
+		if hit && (math.Abs(x.distance-tc.dist) > 1e-9 || math.Abs(x.unitNormal.X-tc.normX) > 1e-9) {
+			t.Errorf("%v from %v: want dist=%v norm.x=%v, got dist=%v norm=%v",
+				tc.op, tc.start, tc.dist, tc.normX, x.distance, x.unitNormal)
+		}
+	}
+
+	// Nested operations find their crossings without allocating.
+	c := &csg{Op: csgDifference, A: &csg{Op: csgUnion, A: sphereA, B: sphereB}, B: sphereB}
+	r := xmath.Ray{Start: xmath.Vect(-5, 0.1, 0), Dir: xmath.Vect(1, 0, 0)}
+	if allocs := testing.AllocsPerRun(100, func() { c.intersect(r) }); allocs != 0 {
+		t.Errorf("intersecting allocated %v times", allocs)
+	}
+}
+
+func TestCSGSpawnedRaysDontSelfIntersect(t *testing.T) {
+	box := &closedSurface{newOrientedBox(xmath.Vect(0.5, 0.5, 0.5), xmath.Vect(0.5, 0.5, 0.5))}
+	for _, tc := range []struct {
+		name   string
+		surf   *csg
+		inside xmath.Vector
+	}{
+		{
+			name: "sphere minus box",
+			surf: &csg{
+				Op: csgDifference,
+				A:  &closedSurface{&sphere{Center: xmath.Vect(0, 0, 0), Radius: 1}},
+				B:  box,
+			},
+			inside: xmath.Vect(-0.2, -0.2, -0.2),
+		},
+		{
+			name: "lens",
+			surf: &csg{
+				Op: csgIntersection,
+				A:  &closedSurface{&sphere{Center: xmath.Vect(0, 0, -0.8), Radius: 1}},
+				B:  &closedSurface{&sphere{Center: xmath.Vect(0, 0, 0.8), Radius: 1}},
+			},
+			inside: xmath.Vect(0, 0, 0),
+		},
+		{
+			name: "torus union cylinder",
+			surf: &csg{
+				Op: csgUnion,
+				A:  &closedSurface{&torus{Center: xmath.Vect(0, 0, 0), Axis: xmath.Vect(0, 1, 0), Major: 1, Minor: 0.3}},
+				B:  &closedSurface{&cone{C1: xmath.Vect(-1, 0, 0), C2: xmath.Vect(1, 0, 0), R1: 0.2, R2: 0.2}},
+			},
+			inside: xmath.Vect(0, 0, 0),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			n := rayCount() / 64
+			for i := 0; i < n; i++ {
+				r := xmath.Ray{Start: tc.inside, Dir: randomUnit(rng)}
+				x, hit := tc.surf.intersect(r)
+				if !hit {
+					t.Fatalf("ray leaked: %v", r)
+				}
+
+				// Leave the surface on the outside.
+				dir := randomUnit(rng)
+				if dir.Dot(x.unitNormal) < 0 {
+					dir = dir.Scale(-1)
+				}
+				spawned := spawnRay(x, dir)
+				if x2, hit := tc.surf.intersect(spawned); hit && x2.distance < 1e-6 {
+					t.Fatalf("spawned ray re-intersected at distance %v: %v", x2.distance, spawned)
+				}
+			}
+		})
+	}
+}
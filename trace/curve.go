@@ -0,0 +1,286 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// curve is a tube that follows a cubic Bézier curve. Its cross section is
+// circular, and the radius varies linearly from R0 to R1 along the curve.
+// The ends of the tube are open.
+//
+// The intersection test (based on the one in PBRT) transforms the curve into
+// a coordinate system where the ray travels along +Z from the origin. The
+// curve is then recursively split until each piece is approximately straight,
+// and pieces whose 2D bounds (expanded by the radius) don't include the
+// origin are culled.
+type curve struct {
+	P  [4]xmath.Vector `json:"p"`
+	R0 float64         `json:"r0"`
+	R1 float64         `json:"r1"`
+}
+
+func (c *curve) String() string {
+	return fmt.Sprintf("Type=curve P=%v R0=%v R1=%v", c.P, c.R0, c.R1)
+}
+
+// newCurveSegments splits a curve into its cubic Bézier segments. Each
+// segment is a separate surface so that the acceleration structure can cull
+// them individually.
+func newCurveSegments(proto scene.Curve) ([]*curve, error) {
+	pts := proto.ControlPoints
+	var segs [][4]xmath.Vector
+	switch proto.Basis {
+	case scene.CurveBezier, "":
+		if len(pts) < 4 || (len(pts)-1)%3 != 0 {
+			return nil, fmt.Errorf("bezier curve must have 3n+1 control points: %d", len(pts))
+		}
+		for i := 0; i+3 < len(pts); i += 3 {
+			segs = append(segs, [4]xmath.Vector{pts[i], pts[i+1], pts[i+2], pts[i+3]})
+		}
+	case scene.CurveBSpline:
+		if len(pts) < 4 {
+			return nil, fmt.Errorf("b-spline curve must have at least 4 control points: %d", len(pts))
+		}
+		for i := 0; i+3 < len(pts); i++ {
+			segs = append(segs, bsplineToBezier([4]xmath.Vector{pts[i], pts[i+1], pts[i+2], pts[i+3]}))
+		}
+	default:
+		return nil, fmt.Errorf("unknown curve basis: %q", proto.Basis)
+	}
+
+	curves := make([]*curve, len(segs))
+	n := float64(len(segs))
+	for i, p := range segs {
+		curves[i] = &curve{
+			P:  p,
+			R0: proto.RadiusA + (proto.RadiusB-proto.RadiusA)*float64(i)/n,
+			R1: proto.RadiusA + (proto.RadiusB-proto.RadiusA)*float64(i+1)/n,
+		}
+	}
+	return curves, nil
+}
+
+// bsplineToBezier converts the control points of a uniform cubic B-spline
+// segment to those of the equivalent cubic Bézier segment.
+func bsplineToBezier(p [4]xmath.Vector) [4]xmath.Vector {
+	third := 1.0 / 3
+	return [4]xmath.Vector{
+		p[0].Add(p[1].Scale(4)).Add(p[2]).Scale(1.0 / 6),
+		p[1].Scale(2 * third).Add(p[2].Scale(third)),
+		p[1].Scale(third).Add(p[2].Scale(2 * third)),
+		p[1].Add(p[2].Scale(4)).Add(p[3]).Scale(1.0 / 6),
+	}
+}
+
+func bezierEval(p [4]xmath.Vector, u float64) xmath.Vector {
+	s := 1 - u
+	return p[0].Scale(s * s * s).
+		Add(p[1].Scale(3 * s * s * u)).
+		Add(p[2].Scale(3 * s * u * u)).
+		Add(p[3].Scale(u * u * u))
+}
+
+func bezierDeriv(p [4]xmath.Vector, u float64) xmath.Vector {
+	s := 1 - u
+	return p[1].Sub(p[0]).Scale(3 * s * s).
+		Add(p[2].Sub(p[1]).Scale(6 * s * u)).
+		Add(p[3].Sub(p[2]).Scale(3 * u * u))
+}
+
+// bezierSplit splits a curve in half using de Casteljau's algorithm.
+func bezierSplit(p [4]xmath.Vector) ([4]xmath.Vector, [4]xmath.Vector) {
+	mid := func(a, b xmath.Vector) xmath.Vector { return a.Add(b).Scale(0.5) }
+	p01, p12, p23 := mid(p[0], p[1]), mid(p[1], p[2]), mid(p[2], p[3])
+	p012, p123 := mid(p01, p12), mid(p12, p23)
+	p0123 := mid(p012, p123)
+	return [4]xmath.Vector{p[0], p01, p012, p0123}, [4]xmath.Vector{p0123, p123, p23, p[3]}
+}
+
+func (c *curve) radius(u float64) float64 {
+	return c.R0 + (c.R1-c.R0)*u
+}
+
+// curveHit tracks the closest hit found so far during the recursive
+// intersection test.
+type curveHit struct {
+	t, u, v float64
+	hit     bool
+}
+
+func (c *curve) intersect(r xmath.Ray) (intersection, bool) {
+	dirLen := r.Dir.Length()
+	w := r.Dir.Scale(1 / dirLen)
+	s, t := orthonormalBasis(w)
+	var cp [4]xmath.Vector
+	for i, p := range c.P {
+		rel := p.Sub(r.Start)
+		cp[i] = xmath.Vect(rel.Dot(s), rel.Dot(t), rel.Dot(w))
+	}
+
+	// Split until the pieces are flat relative to the radius.
+	var flatness float64
+	for i := 0; i < 2; i++ {
+		d := cp[i].Sub(cp[i+1].Scale(2)).Add(cp[i+2]).Abs()
+		flatness = math.Max(flatness, math.Max(d.X, math.Max(d.Y, d.Z)))
+	}
+	eps := 0.05 * math.Max(c.R0, c.R1)
+	depth := 0
+	if flatness > 0 && eps > 0 {
+		depth = int(math.Round(math.Log(math.Sqrt2*6*flatness/(8*eps)) / math.Log(4)))
+		depth = xmath.IntMax(0, xmath.IntMin(10, depth))
+	}
+
+	var best curveHit
+	c.recursiveIntersect(cp, 0, 1, depth, &best)
+	if !best.hit {
+		return intersection{}, false
+	}
+
+	// Make the normal perpendicular to the curve, pointing from the center of
+	// the tube to the hit point.
+	tHit := best.t / dirLen
+	p := r.At(tHit)
+	tangent := bezierDeriv(c.P, best.u)
+	n := p.Sub(bezierEval(c.P, best.u))
+	if tangent.LengthSq() > 0 {
+		n = n.Rej(tangent.Unit())
+	}
+	if n.LengthSq() == 0 {
+		n = w.Scale(-1)
+	}
+
+	// The tube is only approximated by the flattened pieces, so the error in
+	// the hit point is relative to the radius.
+	e := 0.1 * c.radius(best.u)
+	return intersection{
+		unitNormal: n.Unit(),
+		distance:   tHit,
+		point:      p,
+		pointErr:   rayHitError(r, tHit).Add(xmath.Vect(e, e, e)),
+		u:          best.u,
+		v:          best.v,
+	}, true
+}
+
+func (c *curve) recursiveIntersect(cp [4]xmath.Vector, u0, u1 float64, depth int, best *curveHit) {
+	// Cull using the bounds of the control points, expanded by the radius.
+	maxR := math.Max(c.radius(u0), c.radius(u1))
+	lo, hi := cp[0], cp[0]
+	for _, p := range cp[1:] {
+		lo, hi = lo.Min(p), hi.Max(p)
+	}
+	if lo.X > maxR || hi.X < -maxR || lo.Y > maxR || hi.Y < -maxR || hi.Z < -maxR {
+		return
+	}
+	if best.hit && lo.Z-maxR > best.t {
+		return
+	}
+
+	if depth > 0 {
+		a, b := bezierSplit(cp)
+		mid := 0.5 * (u0 + u1)
+		c.recursiveIntersect(a, u0, mid, depth-1, best)
+		c.recursiveIntersect(b, mid, u1, depth-1, best)
+		return
+	}
+
+	// The origin must be between the lines perpendicular to the piece's end
+	// tangents. Otherwise it's closer to a neighbouring piece, or beyond
+	// the end of the curve.
+	if (cp[1].Y-cp[0].Y)*-cp[0].Y+cp[0].X*(cp[0].X-cp[1].X) < 0 {
+		return
+	}
+	if (cp[2].Y-cp[3].Y)*-cp[3].Y+cp[3].X*(cp[3].X-cp[2].X) < 0 {
+		return
+	}
+
+	// Find the closest point to the origin along the (approximately straight)
+	// piece.
+	seg := xmath.Vect(cp[3].X-cp[0].X, cp[3].Y-cp[0].Y, 0)
+	if seg.LengthSq() == 0 {
+		return
+	}
+	frac := clamp(-(cp[0].X*seg.X+cp[0].Y*seg.Y)/seg.LengthSq(), 0, 1)
+
+	// The curve's parameterisation isn't uniform along the piece, so refine
+	// the closest point with a couple of Newton iterations.
+	pc := bezierEval(cp, frac)
+	for i := 0; i < 2; i++ {
+		d := bezierDeriv(cp, frac)
+		dd := d.X*d.X + d.Y*d.Y
+		if dd == 0 {
+			break
+		}
+		frac = clamp(frac-(pc.X*d.X+pc.Y*d.Y)/dd, 0, 1)
+		pc = bezierEval(cp, frac)
+	}
+	u := u0 + (u1-u0)*frac
+	rad := c.radius(u)
+	distSq := pc.X*pc.X + pc.Y*pc.Y
+	if distSq > rad*rad {
+		return
+	}
+
+	// The tube is locally a cylinder, so the ray enters it before reaching
+	// its closest approach to the center of the curve. The closer the ray is
+	// to parallel with the curve, the earlier it enters.
+	d := bezierDeriv(cp, frac)
+	sinTheta := math.Sqrt((d.X*d.X + d.Y*d.Y) / d.LengthSq())
+	if !(sinTheta > 0) {
+		return
+	}
+	t := pc.Z - math.Sqrt(rad*rad-distSq)/sinTheta
+	if t <= 0 || (best.hit && t >= best.t) {
+		return
+	}
+
+	// V goes across the tube, from one side to the other (as seen along the
+	// ray).
+	side := d.X*pc.Y - d.Y*pc.X
+	v := 0.5 + 0.5*math.Copysign(math.Sqrt(distSq)/rad, side)
+	*best = curveHit{t: t, u: u, v: v, hit: true}
+}
+
+func (c *curve) parameterise(x *intersection) {
+	// U and V are set by intersect.
+	tangent := bezierDeriv(c.P, x.u)
+	x.dpdu = tangent.Rej(x.unitNormal)
+	x.dpdv = x.unitNormal.Cross(tangent).Unit().Scale(2 * c.radius(x.u))
+	if x.dpdu.LengthSq() == 0 || x.dpdv.LengthSq() == 0 {
+		x.dpdu, x.dpdv = orthonormalBasis(x.unitNormal)
+	}
+}
+
+func (c *curve) bound() (xmath.Vector, xmath.Vector) {
+	lo, hi := c.P[0], c.P[0]
+	for _, p := range c.P[1:] {
+		lo, hi = lo.Min(p), hi.Max(p)
+	}
+	r := math.Max(c.R0, c.R1)
+	off := xmath.Vect(r, r, r)
+	return lo.Sub(off).AddULPs(-ulpFudgeFactor), hi.Add(off).AddULPs(ulpFudgeFactor)
+}
+
+func (c *curve) translate(v xmath.Vector) {
+	for i := range c.P {
+		c.P[i] = c.P[i].Add(v)
+	}
+}
+
+func (c *curve) rotate(v xmath.Vector, rads float64) {
+	for i := range c.P {
+		c.P[i] = c.P[i].Rotate(v, rads)
+	}
+}
+
+func (c *curve) scale(f float64) {
+	for i := range c.P {
+		c.P[i] = c.P[i].Scale(f)
+	}
+	c.R0 *= f
+	c.R1 *= f
+}
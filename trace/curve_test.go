@@ -0,0 +1,146 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestStraightCurveMatchesCylinder(t *testing.T) {
+	crv := &curve{
+		P: [4]xmath.Vector{
+			xmath.Vect(-1, 0, 0),
+			xmath.Vect(-0.2, 0, 0), // Uneven spacing, so the curve isn't uniformly parameterised.
+			xmath.Vect(0.5, 0, 0),
+			xmath.Vect(1, 0, 0),
+		},
+		R0: 0.2,
+		R1: 0.2,
+	}
+	cyl := &cone{C1: xmath.Vect(-1, 0, 0), C2: xmath.Vect(1, 0, 0), R1: 0.2, R2: 0.2}
+
+	// Keep away from the ends, since the cylinder is capped but the curve
+	// isn't.
+	rng := rand.New(rand.NewSource(1))
+	n := rayCount() / 16
+	for i := 0; i < n; i++ {
+		a := rng.Float64() * 2 * math.Pi
+		start := xmath.Vect(rng.Float64()-0.5, 3*math.Cos(a), 3*math.Sin(a))
+		target := xmath.Vect(rng.Float64()-0.5, 0.6*rng.Float64()-0.3, 0.6*rng.Float64()-0.3)
+		r := xmath.Ray{Start: start, Dir: target.Sub(start).Unit()}
+
+		want, wantHit := cyl.intersect(r)
+		got, gotHit := crv.intersect(r)
+		if wantHit != gotHit {
+			// Grazing hits may disagree due to the approximation.
+			if wantHit && math.Abs(want.unitNormal.Dot(r.Dir)) < 0.05 {
+				continue
+			}
+			if gotHit && math.Abs(got.unitNormal.Dot(r.Dir)) < 0.05 {
+				continue
+			}
+			t.Fatalf("ray %v: want hit=%v got hit=%v", r, wantHit, gotHit)
+		}
+		if !wantHit {
+			continue
+		}
+		if math.Abs(want.distance-got.distance) > 1e-3 {
+			t.Fatalf("ray %v: want distance=%v got distance=%v", r, want.distance, got.distance)
+		}
+		if want.unitNormal.Sub(got.unitNormal).Length() > 1e-2 {
+			t.Fatalf("ray %v: want normal=%v got normal=%v", r, want.unitNormal, got.unitNormal)
+		}
+	}
+}
+
+func TestCurveSpawnedRaysDontSelfIntersect(t *testing.T) {
+	crv := &curve{
+		P: [4]xmath.Vector{
+			xmath.Vect(-1, -1, 0),
+			xmath.Vect(-0.5, 1, 0.5),
+			xmath.Vect(0.5, -1, -0.5),
+			xmath.Vect(1, 1, 0),
+		},
+		R0: 0.1,
+		R1: 0.01,
+	}
+	rng := rand.New(rand.NewSource(1))
+	n := rayCount() / 16
+	for i := 0; i < n; i++ {
+		target := bezierEval(crv.P, rng.Float64())
+		start := target.Add(randomUnit(rng).Scale(3))
+		x, hit := crv.intersect(xmath.Ray{Start: start, Dir: target.Sub(start).Unit()})
+		if !hit {
+			continue
+		}
+		dir := randomUnit(rng)
+		if dir.Dot(x.unitNormal) < 0 {
+			dir = dir.Scale(-1)
+		}
+		spawned := spawnRay(x, dir)
+		if x2, hit := crv.intersect(spawned); hit && x2.distance < 1e-6 {
+			t.Fatalf("spawned ray re-intersected at distance %v: %v", x2.distance, spawned)
+		}
+	}
+}
+
+func TestCurveSegments(t *testing.T) {
+	pts := []xmath.Vector{
+		xmath.Vect(0, 0, 0),
+		xmath.Vect(1, 2, 0),
+		xmath.Vect(2, 0, 1),
+		xmath.Vect(3, 1, 0),
+		xmath.Vect(4, 0, 2),
+		xmath.Vect(5, 3, 0),
+		xmath.Vect(6, 0, 0),
+	}
+	for _, tc := range []struct {
+		basis  scene.CurveBasis
+		segs   int
+		smooth bool
+	}{
+		{scene.CurveBezier, 2, false},
+		{scene.CurveBSpline, 4, true},
+	} {
+		t.Run(string(tc.basis), func(t *testing.T) {
+			segs, err := newCurveSegments(scene.Curve{
+				ControlPoints: pts,
+				Basis:         tc.basis,
+				RadiusA:       1,
+				RadiusB:       0,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != tc.segs {
+				t.Fatalf("want %d segments, got %d", tc.segs, len(segs))
+			}
+			if segs[0].R0 != 1 || segs[len(segs)-1].R1 != 0 {
+				t.Errorf("radius doesn't span curve: %v to %v", segs[0].R0, segs[len(segs)-1].R1)
+			}
+
+			// Segments must join with continuous radius. B-splines must also
+			// have a continuous tangent.
+			for i := 1; i < len(segs); i++ {
+				a, b := segs[i-1], segs[i]
+				if a.P[3].Sub(b.P[0]).Length() > 1e-12 {
+					t.Errorf("segment %d: gap between %v and %v", i, a.P[3], b.P[0])
+				}
+				if a.R1 != b.R0 {
+					t.Errorf("segment %d: radius jumps from %v to %v", i, a.R1, b.R0)
+				}
+				ta, tb := bezierDeriv(a.P, 1).Unit(), bezierDeriv(b.P, 0).Unit()
+				if tc.smooth && ta.Sub(tb).Length() > 1e-12 {
+					t.Errorf("segment %d: tangent changes from %v to %v", i, ta, tb)
+				}
+			}
+		})
+	}
+
+	if _, err := newCurveSegments(scene.Curve{ControlPoints: pts[:5]}); err == nil {
+		t.Error("expected error for wrong number of bezier control points")
+	}
+}
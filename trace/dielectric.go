@@ -0,0 +1,78 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// referenceWavelength is where refractive indices are usually quoted (the
+// Fraunhofer d line). It's used when rendering without spectra.
+const referenceWavelength = 587.6
+
+// dielectric is a smooth transparent material (such as glass) that reflects
+// and refracts. The refractive index is IOR, unless a dispersion formula is
+// given.
+type dielectric struct {
+	IOR float64 `json:"ior"`
+
+	// Cauchy's equation: n = A + B/λ², where λ is in micrometres.
+	Cauchy *[2]float64 `json:"cauchy"`
+
+	// The Sellmeier equation: n² = 1 + Σ Bᵢλ²/(λ² - Cᵢ), where λ is in
+	// micrometres.
+	SellmeierB *[3]float64 `json:"sellmeier_b"`
+	SellmeierC *[3]float64 `json:"sellmeier_c"`
+}
+
+// dispersive is true if the refractive index varies with wavelength.
+func (d *dielectric) dispersive() bool {
+	return d.Cauchy != nil || d.SellmeierB != nil
+}
+
+// iorAt gives the refractive index at a wavelength (in nanometres).
+func (d *dielectric) iorAt(lambda float64) float64 {
+	um := lambda / 1000
+	switch {
+	case d.Cauchy != nil:
+		return d.Cauchy[0] + d.Cauchy[1]/(um*um)
+	case d.SellmeierB != nil:
+		n2 := 1.0
+		for i := range d.SellmeierB {
+			n2 += d.SellmeierB[i] * um * um / (um*um - d.SellmeierC[i])
+		}
+		return math.Sqrt(n2)
+	default:
+		return d.IOR
+	}
+}
+
+// scatterDielectric chooses between reflecting and refracting a ray that hits
+// a dielectric surface, in proportion to the Fresnel reflectance. The unit
+// normal must face the side the ray came from, and ior is the ratio of the
+// refractive index on the far side of the surface to that on the near side.
+// No weight is needed, since the choice is made using the reflectance.
+func scatterDielectric(dir, n xmath.Vector, ior float64, rng *rand.Rand) xmath.Vector {
+	cosI := -dir.Dot(n)
+	eta := 1 / ior
+	sin2T := eta * eta * math.Max(0, 1-cosI*cosI)
+	reflected := dir.Add(n.Scale(2 * cosI))
+	if sin2T >= 1 {
+		return reflected // Total internal reflection.
+	}
+	cosT := math.Sqrt(1 - sin2T)
+	if rng.Float64() < fresnelDielectric(cosI, cosT, eta) {
+		return reflected
+	}
+	return dir.Scale(eta).Add(n.Scale(eta*cosI - cosT)).Unit()
+}
+
+// fresnelDielectric gives the reflectance of unpolarised light at a
+// dielectric interface, where eta is the ratio of the refractive index on
+// the incident side to that on the transmitted side.
+func fresnelDielectric(cosI, cosT, eta float64) float64 {
+	rs := (eta*cosI - cosT) / (eta*cosI + cosT)
+	rp := (cosI - eta*cosT) / (cosI + eta*cosT)
+	return 0.5 * (rs*rs + rp*rp)
+}
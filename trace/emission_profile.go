@@ -0,0 +1,415 @@
+package trace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// emissionProfile varies the light emitted by a material with direction.
+type emissionProfile interface {
+	// at gives the profile's value in a unit direction (pointing away from
+	// the emitter).
+	at(dir xmath.Vector) float64
+
+	// radiance gives the fraction of the material's emittance that's emitted
+	// as radiance in a unit direction, from a surface with unit normal n.
+	radiance(n, dir xmath.Vector) float64
+
+	// flux gives the light emitted per unit area (over all directions),
+	// relative to the material's emittance. It's approximate for surfaces
+	// that aren't facing along the profile's axis.
+	flux() float64
+
+	// cone bounds the directions with nonzero emission, as a unit axis and
+	// the cosine of the half angle around it.
+	cone() (xmath.Vector, float64)
+
+	// sample chooses a direction to emit light in, giving its probability
+	// density (per steradian). pdf gives the density for any direction.
+	sample(rng *rand.Rand) (xmath.Vector, float64)
+	pdf(dir xmath.Vector) float64
+}
+
+// spotProfile emits within a cone around Axis, falling off smoothly between
+// the inner and outer cone angles (given as cosines).
+type spotProfile struct {
+	Axis     xmath.Vector `json:"axis"`
+	CosInner float64      `json:"cos_inner"`
+	CosOuter float64      `json:"cos_outer"`
+}
+
+func (p *spotProfile) at(dir xmath.Vector) float64 {
+	return smoothFalloff(dir.Dot(p.Axis), p.CosInner, p.CosOuter)
+}
+
+// radiance treats the spot cone as a scale on the emitted radiance.
+func (p *spotProfile) radiance(_, dir xmath.Vector) float64 {
+	return p.at(dir)
+}
+
+// flux approximates the falloff between the inner and outer cones as
+// linear in the cosine.
+func (p *spotProfile) flux() float64 {
+	return 2 * math.Pi * (1 - (p.CosInner+p.CosOuter)/2)
+}
+
+func (p *spotProfile) cone() (xmath.Vector, float64) {
+	return p.Axis, p.CosOuter
+}
+
+// sample chooses directions uniformly within the outer cone.
+func (p *spotProfile) sample(rng *rand.Rand) (xmath.Vector, float64) {
+	dir := uniformCone(p.Axis, p.CosOuter, rng)
+	return dir, p.pdf(dir)
+}
+
+func (p *spotProfile) pdf(dir xmath.Vector) float64 {
+	if dir.Dot(p.Axis) < p.CosOuter || p.CosOuter >= 1 {
+		return 0
+	}
+	return 1 / (2 * math.Pi * (1 - p.CosOuter))
+}
+
+// smoothFalloff is 1 within the inner cone and 0 outside of the outer cone,
+// and varies smoothly in between.
+func smoothFalloff(cosTheta, cosInner, cosOuter float64) float64 {
+	if cosTheta >= cosInner {
+		return 1
+	}
+	if cosTheta <= cosOuter {
+		return 0
+	}
+	x := (cosTheta - cosOuter) / (cosInner - cosOuter)
+	return x * x * (3 - 2*x)
+}
+
+// iesProfile is a type C photometric profile from an IES LM-63 file.
+// Vertical angles are measured from Axis, and horizontal angles are measured
+// around Axis starting from Ref (both in degrees). The candela values are
+// indexed by horizontal and then vertical angle, and are normalised so that
+// the largest is 1.
+//
+// The candela values give the intensity emitted by each unit of area, so
+// the radiance is divided by the cosine between the direction and the
+// surface normal (which would otherwise dim the profile towards the
+// horizon). Directions are sampled using the intensity of each band of
+// vertical angles (averaged around the axis).
+type iesProfile struct {
+	Axis       xmath.Vector `json:"axis"`
+	Ref        xmath.Vector `json:"ref"`
+	Vertical   []float64    `json:"vertical"`
+	Horizontal []float64    `json:"horizontal"`
+	Candela    [][]float64  `json:"candela"`
+
+	// The cumulative intensity of each band (integrated over its solid
+	// angle), set by prepare.
+	bandCDF []float64
+}
+
+// iesMinCos limits the radiance of IES emitters at grazing angles, where the
+// intensity comes from a vanishingly small projected area.
+const iesMinCos = 1e-2
+
+// prepare finds the intensity of each band of vertical angles, for sampling.
+func (p *iesProfile) prepare() {
+	p.bandCDF = make([]float64, len(p.Vertical)-1)
+	var total float64
+	for j := range p.bandCDF {
+		var mean float64
+		for _, row := range p.Candela {
+			mean += (row[j] + row[j+1]) / 2
+		}
+		mean /= float64(len(p.Candela))
+		total += mean * p.bandSolidAngle(j)
+		p.bandCDF[j] = total
+	}
+}
+
+func (p *iesProfile) bandSolidAngle(j int) float64 {
+	lo, hi := p.Vertical[j]*math.Pi/180, p.Vertical[j+1]*math.Pi/180
+	return 2 * math.Pi * (math.Cos(lo) - math.Cos(hi))
+}
+
+func (p *iesProfile) radiance(n, dir xmath.Vector) float64 {
+	return p.at(dir) / math.Max(math.Abs(n.Dot(dir)), iesMinCos)
+}
+
+func (p *iesProfile) flux() float64 {
+	if len(p.bandCDF) == 0 {
+		return 0
+	}
+	return p.bandCDF[len(p.bandCDF)-1]
+}
+
+func (p *iesProfile) sample(rng *rand.Rand) (xmath.Vector, float64) {
+	total := p.flux()
+	if total == 0 {
+		return p.Axis, 0
+	}
+	j := sort.SearchFloat64s(p.bandCDF, rng.Float64()*total)
+	if j >= len(p.bandCDF) {
+		j = len(p.bandCDF) - 1
+	}
+	lo, hi := math.Cos(p.Vertical[j]*math.Pi/180), math.Cos(p.Vertical[j+1]*math.Pi/180)
+	cosTheta := hi + rng.Float64()*(lo-hi)
+	sinTheta := math.Sqrt(math.Max(0, 1-cosTheta*cosTheta))
+	phi := 2 * math.Pi * rng.Float64()
+	side := p.Axis.Cross(p.Ref)
+	dir := p.Ref.Scale(sinTheta * math.Cos(phi)).
+		Add(side.Scale(sinTheta * math.Sin(phi))).
+		Add(p.Axis.Scale(cosTheta)).
+		Unit()
+	return dir, p.pdf(dir)
+}
+
+func (p *iesProfile) pdf(dir xmath.Vector) float64 {
+	total := p.flux()
+	theta := math.Acos(clamp(dir.Dot(p.Axis), -1, 1)) * 180 / math.Pi
+	if total == 0 || theta < p.Vertical[0] || theta > p.Vertical[len(p.Vertical)-1] {
+		return 0
+	}
+	j, _ := bracket(p.Vertical, theta)
+	w := p.bandCDF[j]
+	if j > 0 {
+		w -= p.bandCDF[j-1]
+	}
+	if w == 0 {
+		return 0
+	}
+	return w / (total * p.bandSolidAngle(j))
+}
+
+func (p *iesProfile) at(dir xmath.Vector) float64 {
+	theta := math.Acos(clamp(dir.Dot(p.Axis), -1, 1)) * 180 / math.Pi
+	if theta < p.Vertical[0] || theta > p.Vertical[len(p.Vertical)-1] {
+		return 0
+	}
+	if len(p.Horizontal) == 1 {
+		return interpolate(p.Vertical, p.Candela[0], theta)
+	}
+	side := p.Axis.Cross(p.Ref)
+	phi := math.Atan2(dir.Dot(side), dir.Dot(p.Ref)) * 180 / math.Pi
+	if phi < 0 {
+		phi += 360
+	}
+	phi = p.foldHorizontal(phi)
+
+	i, f := bracket(p.Horizontal, phi)
+	lo := interpolate(p.Vertical, p.Candela[i], theta)
+	if f == 0 {
+		return lo
+	}
+	hi := interpolate(p.Vertical, p.Candela[i+1], theta)
+	return lo + f*(hi-lo)
+}
+
+// foldHorizontal maps a horizontal angle in [0, 360) into the range covered
+// by the profile, using the symmetry implied by that range.
+func (p *iesProfile) foldHorizontal(phi float64) float64 {
+	first, last := p.Horizontal[0], p.Horizontal[len(p.Horizontal)-1]
+	switch {
+	case first == 0 && last == 90:
+		// Symmetric in each quadrant.
+		if phi > 180 {
+			phi = 360 - phi
+		}
+		if phi > 90 {
+			phi = 180 - phi
+		}
+	case first == 0 && last == 180:
+		// Symmetric about the 0-180 degree plane.
+		if phi > 180 {
+			phi = 360 - phi
+		}
+	case first == 90 && last == 270:
+		// Symmetric about the 90-270 degree plane.
+		if phi < 90 {
+			phi = 180 - phi
+		} else if phi > 270 {
+			phi = 540 - phi
+		}
+	}
+	return clamp(phi, first, last)
+}
+
+func (p *iesProfile) cone() (xmath.Vector, float64) {
+	// Emission is interpolated, so it's nonzero up to the vertical angle
+	// after the last nonzero value.
+	last := 0
+	for _, row := range p.Candela {
+		for i, c := range row {
+			if c > 0 && i > last {
+				last = i
+			}
+		}
+	}
+	if last+1 < len(p.Vertical) {
+		last++
+	}
+	return p.Axis, math.Cos(p.Vertical[last] * math.Pi / 180)
+}
+
+// bracket finds the interval of a sorted slice containing x, giving the
+// index of the start of the interval and how far x is along it.
+func bracket(xs []float64, x float64) (int, float64) {
+	if len(xs) == 1 {
+		return 0, 0
+	}
+	i := sort.SearchFloat64s(xs, x) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i > len(xs)-2 {
+		i = len(xs) - 2
+	}
+	f := (x - xs[i]) / (xs[i+1] - xs[i])
+	return i, clamp(f, 0, 1)
+}
+
+func interpolate(xs, ys []float64, x float64) float64 {
+	i, f := bracket(xs, x)
+	if f == 0 {
+		return ys[i]
+	}
+	return ys[i] + f*(ys[i+1]-ys[i])
+}
+
+func loadIESProfile(filename string, axis xmath.Vector) (*iesProfile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open IES file: %v", err)
+	}
+	defer f.Close()
+	p, err := decodeIES(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode IES file %v: %v", filename, err)
+	}
+	p.Axis = axis
+	p.Ref = xmath.Vect(1, 0, 0)
+	if math.Abs(axis.X) > 0.9 {
+		p.Ref = xmath.Vect(0, 0, 1)
+	}
+	p.Ref = p.Ref.Rej(axis).Unit()
+	return p, nil
+}
+
+// decodeIES reads an IES LM-63 photometric file. Only type C photometry
+// (used by almost all architectural luminaires) is supported. The header
+// keywords and any tilt data are ignored.
+func decodeIES(r io.Reader) (*iesProfile, error) {
+	// Everything after the TILT line is a sequence of numbers, which can be
+	// split over lines arbitrarily.
+	sc := bufio.NewScanner(r)
+	var tilt string
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "TILT=") {
+			tilt = strings.TrimPrefix(line, "TILT=")
+			break
+		}
+	}
+	if tilt == "" {
+		return nil, errors.New("missing TILT line")
+	}
+	var nums []float64
+	for sc.Scan() {
+		for _, tok := range strings.FieldsFunc(sc.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			v, err := strconv.ParseFloat(tok, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number: %q", tok)
+			}
+			nums = append(nums, v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	next := func(n int) ([]float64, error) {
+		if n < 0 || len(nums) < n {
+			return nil, errors.New("unexpected end of data")
+		}
+		vs := nums[:n]
+		nums = nums[n:]
+		return vs, nil
+	}
+
+	if tilt == "INCLUDE" {
+		// Lamp to luminaire geometry, then the number of tilt angles, the
+		// angles, and the multiplying factors.
+		vs, err := next(2)
+		if err != nil {
+			return nil, err
+		}
+		if vs[1] < 0 || vs[1] > float64(len(nums)) {
+			return nil, fmt.Errorf("bad number of tilt angles: %v", vs[1])
+		}
+		if _, err := next(2 * int(vs[1])); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := next(13)
+	if err != nil {
+		return nil, err
+	}
+	// The angle counts are checked before converting them, since huge or
+	// negative counts would otherwise be used to slice the data.
+	for _, n := range header[3:5] {
+		if n < 1 || n > float64(len(nums)) {
+			return nil, fmt.Errorf("bad number of angles: %v", n)
+		}
+	}
+	nv, nh, photometricType := int(header[3]), int(header[4]), int(header[5])
+	if photometricType != 1 {
+		return nil, fmt.Errorf("unsupported photometric type %d (only type C is supported)", photometricType)
+	}
+	p := new(iesProfile)
+	if p.Vertical, err = next(nv); err != nil {
+		return nil, err
+	}
+	if p.Horizontal, err = next(nh); err != nil {
+		return nil, err
+	}
+	for _, angles := range [][]float64{p.Vertical, p.Horizontal} {
+		if !sort.Float64sAreSorted(angles) {
+			return nil, errors.New("angles must be in ascending order")
+		}
+	}
+	if p.Vertical[0] < 0 || p.Vertical[nv-1] > 180 {
+		return nil, errors.New("vertical angles must be between 0 and 180")
+	}
+
+	var max float64
+	for i := 0; i < nh; i++ {
+		row, err := next(nv)
+		if err != nil {
+			return nil, err
+		}
+		p.Candela = append(p.Candela, row)
+		for _, c := range row {
+			max = math.Max(max, c)
+		}
+	}
+	if max <= 0 {
+		return nil, errors.New("all candela values are zero")
+	}
+	for _, row := range p.Candela {
+		for i := range row {
+			row[i] /= max
+		}
+	}
+	p.prepare()
+	return p, nil
+}
@@ -0,0 +1,222 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// dirAt gives the direction at vertical angle theta from straight down, and
+// horizontal angle phi around from +X (both in degrees).
+func dirAt(theta, phi float64) xmath.Vector {
+	t, p := theta*math.Pi/180, phi*math.Pi/180
+	return xmath.Vect(math.Sin(t)*math.Cos(p), -math.Cos(t), math.Sin(t)*math.Sin(p))
+}
+
+func TestDecodeIESSymmetric(t *testing.T) {
+	const ies = `IESNA:LM-63-2002
+[TEST] symmetric downlight
+[MANUFAC] nobody
+TILT=NONE
+1 1000 1 5 1 1 2 0.1 0.1 0
+1 1 50
+0 30 60
+90 180
+0
+200 150 100, 0
+0
+`
+	p, err := decodeIES(strings.NewReader(ies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Axis, p.Ref = xmath.Vect(0, -1, 0), xmath.Vect(1, 0, 0)
+	for _, tc := range []struct {
+		theta, want float64
+	}{
+		{0, 1},
+		{15, 0.875},
+		{60, 0.5},
+		{75, 0.25},
+		{120, 0},
+	} {
+		for _, phi := range []float64{0, 45, 200} {
+			if got := p.at(dirAt(tc.theta, phi)); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("theta=%v phi=%v: want %v, got %v", tc.theta, phi, tc.want, got)
+			}
+		}
+	}
+	if _, cosTheta := p.cone(); math.Abs(cosTheta-0) > 1e-9 {
+		t.Errorf("want cone to 90 degrees, got cos=%v", cosTheta)
+	}
+}
+
+func TestDecodeIESQuadrantSymmetry(t *testing.T) {
+	const ies = `IESNA91
+TILT=INCLUDE
+1
+3
+0 45 90
+1 0.9 0.8
+1 1000 1 2 3 1 2 0 0 0
+1 1 50
+0 90
+0 45 90
+100 100 100 50 100 0
+`
+	p, err := decodeIES(strings.NewReader(ies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Axis, p.Ref = xmath.Vect(0, -1, 0), xmath.Vect(1, 0, 0)
+
+	// At the horizon, the emission falls from 1 at phi=0 to 0 at phi=90,
+	// and is symmetric in each quadrant.
+	for _, tc := range []struct {
+		phi, want float64
+	}{
+		{0, 1},
+		{22.5, 0.75},
+		{45, 0.5},
+		{90, 0},
+		{135, 0.5},
+		{180, 1},
+		{292.5, 0.25},
+	} {
+		if got := p.at(dirAt(90, tc.phi)); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("phi=%v: want %v, got %v", tc.phi, tc.want, got)
+		}
+	}
+	// The side of Ref that increasing phi is on depends on the handedness
+	// of the basis, so just check for symmetry.
+	for _, phi := range []float64{10, 60, 100} {
+		if a, b := p.at(dirAt(90, phi)), p.at(dirAt(90, 360-phi)); math.Abs(a-b) > 1e-9 {
+			t.Errorf("asymmetric at phi=%v: %v vs %v", phi, a, b)
+		}
+	}
+}
+
+func TestIESIntensity(t *testing.T) {
+	const ies = `TILT=NONE
+1 1000 1 5 1 1 2 0.1 0.1 0
+1 1 50
+0 30 60 90 180
+0
+200 150 100 0 0
+`
+	p, err := decodeIES(strings.NewReader(ies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Axis, p.Ref = xmath.Vect(0, -1, 0), xmath.Vect(1, 0, 0)
+	n := p.Axis
+
+	// The intensity (radiance times projected area) matches the table.
+	for _, tc := range []struct {
+		theta, want float64
+	}{
+		{0, 1},
+		{30, 0.75},
+		{60, 0.5},
+		{80, 1.0 / 6},
+	} {
+		dir := dirAt(tc.theta, 70)
+		if got := p.radiance(n, dir) * math.Abs(n.Dot(dir)); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("theta=%v: want intensity %v, got %v", tc.theta, tc.want, got)
+		}
+	}
+
+	// Integrating the intensity over sampled directions gives the integral
+	// of the table over the sphere.
+	var want float64
+	const steps = 1 << 16
+	for i := 0; i < steps; i++ {
+		theta := (float64(i) + 0.5) / steps * 180
+		want += p.at(dirAt(theta, 0)) * 2 * math.Pi * math.Sin(theta*math.Pi/180) * math.Pi / steps
+	}
+	rng := rand.New(rand.NewSource(1))
+	var got float64
+	count := rayCount()
+	for i := 0; i < count; i++ {
+		dir, pdf := p.sample(rng)
+		if math.Abs(pdf-p.pdf(dir)) > 1e-9*pdf {
+			t.Fatalf("sample gave pdf %v, but pdf gives %v", pdf, p.pdf(dir))
+		}
+		got += p.radiance(n, dir) * math.Abs(n.Dot(dir)) / pdf
+	}
+	got /= float64(count)
+	if math.Abs(got-want) > 0.01*want {
+		t.Errorf("want integrated intensity %v, got %v", want, got)
+	}
+	if f := p.flux(); math.Abs(f-want) > 0.05*want {
+		t.Errorf("want flux %v, got %v", want, f)
+	}
+}
+
+func TestDecodeIESErrors(t *testing.T) {
+	for _, ies := range []string{
+		"IESNA91\n1 2 3\n",
+		"TILT=NONE\n1 1000 1 2 1 1 2 0 0 0\n1 1 50\n0 90\n0\n100\n",
+		"TILT=NONE\n1 1000 1 2 1 2 2 0 0 0\n1 1 50\n0 90\n0\n100 50\n",
+		"TILT=NONE\n1 1000 1 2 1 1 2 0 0 0\n1 1 50\n90 0\n0\n100 50\n",
+		"TILT=NONE\n1 1000 1 2 1 1 2 0 0 0\n1 1 50\n0 90\n0\n0 0\n",
+		"TILT=INCLUDE\n1 -1\n1 1000 1 2 1 1 2 0 0 0\n1 1 50\n0 90\n0\n100 50\n",
+		"TILT=INCLUDE\n1 1e30\n1 1000 1 2 1 1 2 0 0 0\n1 1 50\n0 90\n0\n100 50\n",
+		"TILT=NONE\n1 1000 1 -2 1 1 2 0 0 0\n1 1 50\n0 90\n0\n100 50\n",
+		"TILT=NONE\n1 1000 1 2 1e30 1 2 0 0 0\n1 1 50\n0 90\n0\n100 50\n",
+	} {
+		if _, err := decodeIES(strings.NewReader(ies)); err == nil {
+			t.Errorf("expected error decoding %q", ies)
+		}
+	}
+}
+
+func TestProfiledEmitter(t *testing.T) {
+	// A small downlight with a spot cone above a floor. Points on the floor
+	// inside of the cone are lit, and points outside aren't. The result
+	// should be the same whether or not the emitter is sampled directly.
+	objs := []object{
+		{
+			Surface:  &alignYSquare{X1: -5, X2: 5, Y: 0, Z1: -5, Z2: 5},
+			Material: material{Colour: colour.Colour{R: 1, G: 1, B: 1}},
+		},
+		{
+			Surface: &disc{Center: xmath.Vect(0, 1, 0), RadiusSq: 0.04, UnitNorm: xmath.Vect(0, 1, 0)},
+			Material: material{
+				Colour:    colour.Colour{R: 1, G: 1, B: 1},
+				Emittance: 5,
+				Profile: &spotProfile{
+					Axis:     xmath.Vect(0, -1, 0),
+					CosInner: math.Cos(0.3),
+					CosOuter: math.Cos(0.4),
+				},
+			},
+		},
+	}
+	for i := range objs {
+		objs[i].PrimID = i
+	}
+	for _, x := range []float64{0, 1} {
+		var means, errs [2]float64
+		for i, emitters := range []*lightBVH{nil, newLightBVH(objs)} {
+			rng := rand.New(rand.NewSource(1))
+			tr := newTracer(newListAccelerationStructure(objs), &builtScene{emitters: emitters}, rng)
+			r := xmath.Ray{Start: xmath.Vect(x, 0.1, 0.1), Dir: xmath.Vect(0, -1, -1).Unit()}
+			means[i], errs[i] = traceMean(tr, r, rayCount())
+		}
+		if x == 1 {
+			if means[0] != 0 || means[1] != 0 {
+				t.Errorf("outside of cone: want 0, got %v and %v", means[0], means[1])
+			}
+			continue
+		}
+		if means[0] == 0 || math.Abs(means[0]-means[1]) > 6*math.Hypot(errs[0], errs[1]) {
+			t.Errorf("inside of cone: without emitter sampling %v±%v, with %v±%v",
+				means[0], errs[0], means[1], errs[1])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// sampleable surfaces can have points chosen on them, so that emitters with
+// those surfaces can be sampled directly. Emitters with other surfaces still
+// emit, but are only found by rays that happen to hit them.
+type sampleable interface {
+	surface
+
+	area() float64
+
+	// sample maps a pair of uniform random numbers in [0, 1) to a point on
+	// the surface, uniformly distributed by area. It gives the point and the
+	// unit geometric normal there.
+	sample(u, v float64) (xmath.Vector, xmath.Vector)
+}
+
+func (t *triangle) area() float64 {
+	return 0.5 * t.B.Sub(t.A).Cross(t.C.Sub(t.A)).Length()
+}
+
+func (t *triangle) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	su := math.Sqrt(u)
+	b1, b2 := 1-su, v*su
+	return t.A.Add(t.B.Sub(t.A).Scale(b1)).Add(t.C.Sub(t.A).Scale(b2)), t.UnitNorm
+}
+
+func (s *sphere) area() float64 {
+	return 4 * math.Pi * s.Radius * s.Radius
+}
+
+func (s *sphere) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	z := 1 - 2*u
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * v
+	n := xmath.Vect(r*math.Cos(phi), r*math.Sin(phi), z)
+	return s.Center.Add(n.Scale(s.Radius)), n
+}
+
+func (s *alignXSquare) area() float64 {
+	return (s.Y2 - s.Y1) * (s.Z2 - s.Z1)
+}
+
+func (s *alignXSquare) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	return xmath.Vect(s.X, s.Y1+u*(s.Y2-s.Y1), s.Z1+v*(s.Z2-s.Z1)), xmath.Vect(1, 0, 0)
+}
+
+func (s *alignYSquare) area() float64 {
+	return (s.X2 - s.X1) * (s.Z2 - s.Z1)
+}
+
+func (s *alignYSquare) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	return xmath.Vect(s.X1+u*(s.X2-s.X1), s.Y, s.Z1+v*(s.Z2-s.Z1)), xmath.Vect(0, 1, 0)
+}
+
+func (s *alignZSquare) area() float64 {
+	return (s.X2 - s.X1) * (s.Y2 - s.Y1)
+}
+
+func (s *alignZSquare) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	return xmath.Vect(s.X1+u*(s.X2-s.X1), s.Y1+v*(s.Y2-s.Y1), s.Z), xmath.Vect(0, 0, 1)
+}
+
+func (d *disc) area() float64 {
+	return math.Pi * d.RadiusSq
+}
+
+func (d *disc) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	r := math.Sqrt(u * d.RadiusSq)
+	phi := 2 * math.Pi * v
+	s, t := orthonormalBasis(d.UnitNorm)
+	return d.Center.Add(s.Scale(r * math.Cos(phi))).Add(t.Scale(r * math.Sin(phi))), d.UnitNorm
+}
+
+func (b *alignedBox) area() float64 {
+	d := b.Min.Sub(b.Max).Abs()
+	return 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+// sample uses u to choose a face (with probability proportional to its area),
+// and then reuses what's left of u to choose the point on the face.
+func (b *alignedBox) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	lo, hi := b.Max.Min(b.Min), b.Max.Max(b.Min)
+	d := hi.Sub(lo)
+	faces := [6]float64{d.Y * d.Z, d.Y * d.Z, d.Z * d.X, d.Z * d.X, d.X * d.Y, d.X * d.Y}
+	u *= faces[0] + faces[1] + faces[2] + faces[3] + faces[4] + faces[5]
+	f := 0
+	for f < len(faces)-1 && u >= faces[f] {
+		u -= faces[f]
+		f++
+	}
+	u = math.Min(u/faces[f], 1)
+
+	var p, n xmath.Vector
+	switch f / 2 {
+	case 0:
+		p = xmath.Vect(lo.X, lo.Y+u*d.Y, lo.Z+v*d.Z)
+		n = xmath.Vect(-1, 0, 0)
+	case 1:
+		p = xmath.Vect(lo.X+u*d.X, lo.Y, lo.Z+v*d.Z)
+		n = xmath.Vect(0, -1, 0)
+	default:
+		p = xmath.Vect(lo.X+u*d.X, lo.Y+v*d.Y, lo.Z)
+		n = xmath.Vect(0, 0, -1)
+	}
+	if f%2 == 1 {
+		// The upper face along the axis.
+		p = p.Add(d.Mul(n).Abs())
+		n = n.Scale(-1)
+	}
+	return p, n
+}
+
+// emitterPoint chooses a point uniformly on an emitter (which must be
+// sampleable), giving the completed intersection there.
+func emitterPoint(o *object, u, v float64) (intersection, bool) {
+	s := o.Surface.(sampleable)
+	p, n := s.sample(u, v)
+
+	// Intersecting the surface from just off of it gives the parameterisation
+	// and error bounds at the point.
+	lo, hi := s.bound()
+	eps := 1e-3 * hi.Sub(lo).Length()
+	x, hit := s.intersect(xmath.Ray{Start: p.Add(n.Scale(eps)), Dir: n.Scale(-1)})
+	if !hit {
+		return intersection{}, false
+	}
+	return o.complete(x), true
+}
+
+// emitDirection chooses a direction for light leaving an emitter at a point
+// with normal n, giving the probability density of choosing it (per
+// steradian). Directions are cosine distributed on the emitting sides, or
+// chosen by the emission profile.
+func emitDirection(m *material, n xmath.Vector, rng *rand.Rand) (xmath.Vector, float64) {
+	if m.Profile != nil {
+		return m.Profile.sample(rng)
+	}
+	side := n
+	if m.EmitSide == backSide || m.EmitSide == bothSides && rng.Float64() < 0.5 {
+		side = side.Scale(-1)
+	}
+	dir := cosineHemisphere(side, rng)
+	return dir, emitDirectionPDF(m, n, dir)
+}
+
+// emitDirectionPDF gives the probability density of emitDirection choosing a
+// direction.
+func emitDirectionPDF(m *material, n, dir xmath.Vector) float64 {
+	if m.Profile != nil {
+		return m.Profile.pdf(dir)
+	}
+	cos := dir.Dot(n)
+	switch m.EmitSide {
+	case frontSide:
+		return math.Max(0, cos) / math.Pi
+	case backSide:
+		return math.Max(0, -cos) / math.Pi
+	}
+	return math.Abs(cos) / (2 * math.Pi)
+}
@@ -0,0 +1,64 @@
+package trace
+
+import (
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// machineEpsilon is half the distance between 1 and the next float64, i.e.
+// the maximum relative error introduced by a single rounded operation.
+const machineEpsilon = 0.5 * 0x1p-52
+
+// gamma gives a conservative bound on the relative error accumulated by n
+// successive rounded floating point operations.
+func gamma(n int) float64 {
+	return float64(n) * machineEpsilon / (1 - float64(n)*machineEpsilon)
+}
+
+// differenceOfProducts calculates a*b - c*d. It uses FMA to recover the
+// rounding error in c*d, so the result is accurate to within a couple of ULPs
+// (and in particular, always has the correct sign).
+func differenceOfProducts(a, b, c, d float64) float64 {
+	cd := c * d
+	err := math.FMA(-c, d, cd)
+	dop := math.FMA(a, b, -cd)
+	return dop + err
+}
+
+// offsetRayOrigin offsets a point on a surface just far enough along the
+// surface normal that a ray leaving the surface in direction dir cannot
+// re-intersect the surface due to floating point error. The pErr vector is a
+// conservative bound on the absolute error in each component of p.
+func offsetRayOrigin(p, pErr, n, dir xmath.Vector) xmath.Vector {
+	d := n.Abs().Dot(pErr)
+	offset := n.Scale(d)
+	if dir.Dot(n) < 0 {
+		offset = offset.Scale(-1)
+	}
+	po := p.Add(offset)
+
+	// Round away from p, so that the offset is at least as large as d.
+	po.X = roundAway(po.X, offset.X)
+	po.Y = roundAway(po.Y, offset.Y)
+	po.Z = roundAway(po.Z, offset.Z)
+	return po
+}
+
+func roundAway(f, offset float64) float64 {
+	switch {
+	case offset > 0:
+		return xmath.AddULPs(f, +1)
+	case offset < 0:
+		return xmath.AddULPs(f, -1)
+	default:
+		return f
+	}
+}
+
+// rayHitError gives a bound on the error of a point calculated as r.At(t).
+// It doesn't account for any error in t itself, so is only appropriate when
+// the point is subsequently reprojected onto the surface.
+func rayHitError(r xmath.Ray, t float64) xmath.Vector {
+	return r.Start.Abs().Add(r.Dir.Scale(t).Abs()).Scale(gamma(3))
+}
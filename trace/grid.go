@@ -88,8 +88,9 @@ func (g *grid) closestHit(r xmath.Ray) (intersection, material, bool) {
 
 		nextHitDistance := pos.Sub(initialPos).AsVector().Abs().Mul(delta).Add(initialNextHitDistance)
 
-		if intersection, material, hit := g.findHitInCell(pos, nextHitDistance, r); hit {
-			return intersection, material, true
+		if intersection, obj, hit := g.findHitInCell(pos, nextHitDistance, r); hit {
+			intersection = obj.complete(intersection)
+			return intersection, obj.materialAt(intersection), true
 		}
 
 		var exitGrid bool
@@ -187,12 +188,11 @@ func (g *grid) dataIndex(pos xmath.Triple) int {
 	return pos.X + g.resolution.X*pos.Y + g.resolution.X*g.resolution.Y*pos.Z
 }
 
-func (g *grid) findHitInCell(pos xmath.Triple, next xmath.Vector, r xmath.Ray) (intersection, material, bool) {
+func (g *grid) findHitInCell(pos xmath.Triple, next xmath.Vector, r xmath.Ray) (intersection, *object, bool) {
 
 	var closest struct {
 		intersection intersection
-		material     material
-		hit          bool
+		obj          *object
 	}
 
 	for link := g.data[g.dataIndex(pos)]; link != nil; link = link.next {
@@ -204,14 +204,13 @@ func (g *grid) findHitInCell(pos xmath.Triple, next xmath.Vector, r xmath.Ray) (
 		if intersection.distance > nextCell {
 			continue
 		}
-		if !closest.hit || intersection.distance < closest.intersection.distance {
+		if closest.obj == nil || intersection.distance < closest.intersection.distance {
 			closest.intersection = intersection
-			closest.material = link.obj.Material
-			closest.hit = true
+			closest.obj = &link.obj
 		}
 	}
 
-	return closest.intersection, closest.material, closest.hit
+	return closest.intersection, closest.obj, closest.obj != nil
 }
 
 type link struct {
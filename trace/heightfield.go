@@ -0,0 +1,248 @@
+package trace
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// heightfield is a grid of height samples spanning the XZ plane, starting at
+// Corner and covering Size.X by Size.Z. Each cell between 4 samples is split
+// into 2 triangles. Rather than storing the triangles individually, they are
+// generated on the fly while traversing the cells that a ray passes over.
+type heightfield struct {
+	Corner xmath.Vector `json:"corner"`
+	Size   xmath.Vector `json:"size"`
+
+	// Samples along X (wide) and Z (deep). Heights are relative to Corner.Y,
+	// and are stored with X varying fastest.
+	Wide    int            `json:"wide"`
+	Deep    int            `json:"deep"`
+	Heights []float64      `json:"-"`
+	Normals []xmath.Vector `json:"-"`
+
+	// The range of heights within each cell, so that cells can be skipped
+	// when the ray passes entirely above or below them.
+	CellMin []float64 `json:"-"`
+	CellMax []float64 `json:"-"`
+}
+
+// loadHeightfield reads heights from an image. Colour images are converted to
+// grayscale, and white corresponds to a height of size.Y.
+func loadHeightfield(filename string, corner, size xmath.Vector) (*heightfield, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open heightfield: %v", err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode heightfield %v: %v", filename, err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() < 2 || bounds.Dy() < 2 {
+		return nil, fmt.Errorf("heightfield %v must be at least 2x2", filename)
+	}
+	heights := make([]float64, bounds.Dx()*bounds.Dy())
+	for z := 0; z < bounds.Dy(); z++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray := color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+z)).(color.Gray16)
+			heights[x+z*bounds.Dx()] = float64(gray.Y) / 0xffff * size.Y
+		}
+	}
+	return newHeightfield(corner, size, bounds.Dx(), bounds.Dy(), heights), nil
+}
+
+func newHeightfield(corner, size xmath.Vector, wide, deep int, heights []float64) *heightfield {
+	h := &heightfield{
+		Corner:  corner,
+		Size:    size,
+		Wide:    wide,
+		Deep:    deep,
+		Heights: heights,
+	}
+	h.updateDerived()
+	return h
+}
+
+// updateDerived calculates the normals and the per cell height ranges.
+func (h *heightfield) updateDerived() {
+	dx, dz := h.cellSize()
+	h.Normals = make([]xmath.Vector, len(h.Heights))
+	for z := 0; z < h.Deep; z++ {
+		for x := 0; x < h.Wide; x++ {
+			// Central differences (or one sided at the edges).
+			x0, x1 := xmath.IntMax(x-1, 0), xmath.IntMin(x+1, h.Wide-1)
+			z0, z1 := xmath.IntMax(z-1, 0), xmath.IntMin(z+1, h.Deep-1)
+			slopeX := (h.height(x1, z) - h.height(x0, z)) / (float64(x1-x0) * dx)
+			slopeZ := (h.height(x, z1) - h.height(x, z0)) / (float64(z1-z0) * dz)
+			h.Normals[x+z*h.Wide] = xmath.Vect(-slopeX, 1, -slopeZ).Unit()
+		}
+	}
+
+	cells := (h.Wide - 1) * (h.Deep - 1)
+	h.CellMin = make([]float64, cells)
+	h.CellMax = make([]float64, cells)
+	for z := 0; z+1 < h.Deep; z++ {
+		for x := 0; x+1 < h.Wide; x++ {
+			a, b := h.height(x, z), h.height(x+1, z)
+			c, d := h.height(x, z+1), h.height(x+1, z+1)
+			h.CellMin[h.cellIndex(x, z)] = math.Min(math.Min(a, b), math.Min(c, d))
+			h.CellMax[h.cellIndex(x, z)] = math.Max(math.Max(a, b), math.Max(c, d))
+		}
+	}
+}
+
+func (h *heightfield) String() string {
+	return fmt.Sprintf("Type=heightfield Corner=%v Size=%v Samples=%vx%v", h.Corner, h.Size, h.Wide, h.Deep)
+}
+
+func (h *heightfield) cellSize() (float64, float64) {
+	return h.Size.X / float64(h.Wide-1), h.Size.Z / float64(h.Deep-1)
+}
+
+func (h *heightfield) cellIndex(x, z int) int {
+	return x + z*(h.Wide-1)
+}
+
+func (h *heightfield) height(x, z int) float64 {
+	return h.Heights[x+z*h.Wide]
+}
+
+func (h *heightfield) vertex(x, z int) xmath.Vector {
+	dx, dz := h.cellSize()
+	return h.Corner.Add(xmath.Vect(float64(x)*dx, h.height(x, z), float64(z)*dz))
+}
+
+// cellTriangles gives the vertices of the two triangles making up a cell,
+// wound so that their normals face +Y. The corresponding indices into
+// Heights and Normals are also given.
+func (h *heightfield) cellTriangles(x, z int) ([2][3]xmath.Vector, [2][3]int) {
+	i00, i10 := x+z*h.Wide, x+1+z*h.Wide
+	i01, i11 := x+(z+1)*h.Wide, x+1+(z+1)*h.Wide
+	p00, p10 := h.vertex(x, z), h.vertex(x+1, z)
+	p01, p11 := h.vertex(x, z+1), h.vertex(x+1, z+1)
+	return [2][3]xmath.Vector{{p00, p01, p11}, {p00, p11, p10}},
+		[2][3]int{{i00, i01, i11}, {i00, i11, i10}}
+}
+
+// intersect traverses the cells under the ray's path (in the XZ plane) in
+// order, in the same way that the grid acceleration structure does in 3D.
+func (h *heightfield) intersect(r xmath.Ray) (intersection, bool) {
+	t, tFar, ok := rayBoxInterval(r, h.Corner, h.Corner.Add(h.Size))
+	if !ok || tFar <= 0 {
+		return intersection{}, false
+	}
+	t = math.Max(t, 0)
+
+	dx, dz := h.cellSize()
+	start := r.At(t).Sub(h.Corner)
+	cx := xmath.IntMax(0, xmath.IntMin(h.Wide-2, int(start.X/dx)))
+	cz := xmath.IntMax(0, xmath.IntMin(h.Deep-2, int(start.Z/dz)))
+
+	// For each axis, the step direction, the distance along the ray between
+	// cell boundaries, and the distance to the next boundary.
+	axis := func(c int, size, start, dir float64) (int, float64, float64) {
+		switch {
+		case dir > 0:
+			return +1, size / dir, (float64(c+1)*size - start) / dir
+		case dir < 0:
+			return -1, -size / dir, (float64(c)*size - start) / dir
+		default:
+			return 0, math.Inf(+1), math.Inf(+1)
+		}
+	}
+	rel := r.Start.Sub(h.Corner)
+	stepX, deltaX, nextX := axis(cx, dx, rel.X, r.Dir.X)
+	stepZ, deltaZ, nextZ := axis(cz, dz, rel.Z, r.Dir.Z)
+
+	for {
+		tExit := math.Min(tFar, math.Min(nextX, nextZ))
+		if x, hit := h.intersectCell(r, cx, cz, t, tExit); hit {
+			return x, true
+		}
+		if tExit >= tFar {
+			return intersection{}, false
+		}
+		if nextX < nextZ {
+			cx += stepX
+			t, nextX = nextX, nextX+deltaX
+		} else {
+			cz += stepZ
+			t, nextZ = nextZ, nextZ+deltaZ
+		}
+		if cx < 0 || cx >= h.Wide-1 || cz < 0 || cz >= h.Deep-1 {
+			return intersection{}, false
+		}
+	}
+}
+
+// intersectCell finds the closest hit with the triangles in a cell. The ray
+// is over the cell between tEnter and tExit.
+func (h *heightfield) intersectCell(r xmath.Ray, cx, cz int, tEnter, tExit float64) (intersection, bool) {
+	y0 := r.Start.Y + r.Dir.Y*tEnter - h.Corner.Y
+	y1 := r.Start.Y + r.Dir.Y*tExit - h.Corner.Y
+	idx := h.cellIndex(cx, cz)
+	lo, hi := xmath.AddULPs(h.CellMin[idx], -ulpFudgeFactor), xmath.AddULPs(h.CellMax[idx], ulpFudgeFactor)
+	if math.Min(y0, y1) > hi || math.Max(y0, y1) < lo {
+		return intersection{}, false
+	}
+
+	var closest intersection
+	var hit bool
+	tris, _ := h.cellTriangles(cx, cz)
+	for i, tri := range tris {
+		x, ok := intersectTriangle(r, tri[0], tri[1], tri[2])
+		if ok && (!hit || x.distance < closest.distance) {
+			x.part = 2*idx + i
+			closest, hit = x, true
+		}
+	}
+	if hit {
+		tri := tris[closest.part%2]
+		closest.unitNormal = tri[1].Sub(tri[0]).Cross(tri[2].Sub(tri[0])).Unit()
+	}
+	return closest, hit
+}
+
+// parameterise maps the whole heightfield to the unit square (U along X, and
+// V along Z). The shading normal is interpolated from the vertex normals.
+func (h *heightfield) parameterise(x *intersection) {
+	idx, i := x.part/2, x.part%2
+	_, indices := h.cellTriangles(idx%(h.Wide-1), idx/(h.Wide-1))
+	vs := indices[i]
+	interpolateNormals(x, [3]xmath.Vector{h.Normals[vs[0]], h.Normals[vs[1]], h.Normals[vs[2]]}, x.unitNormal)
+
+	// Derivatives are along the plane of the triangle that was hit.
+	n := x.unitNormal
+	x.u = (x.point.X - h.Corner.X) / h.Size.X
+	x.v = (x.point.Z - h.Corner.Z) / h.Size.Z
+	x.dpdu = xmath.Vect(h.Size.X, -n.X/n.Y*h.Size.X, 0)
+	x.dpdv = xmath.Vect(0, -n.Z/n.Y*h.Size.Z, h.Size.Z)
+}
+
+func (h *heightfield) bound() (xmath.Vector, xmath.Vector) {
+	return h.Corner.AddULPs(-ulpFudgeFactor), h.Corner.Add(h.Size).AddULPs(ulpFudgeFactor)
+}
+
+func (h *heightfield) translate(v xmath.Vector) {
+	h.Corner = h.Corner.Add(v)
+}
+
+func (h *heightfield) rotate(xmath.Vector, float64) {
+	panic("cannot rotate heightfield")
+}
+
+func (h *heightfield) scale(f float64) {
+	h.Corner = h.Corner.Scale(f)
+	h.Size = h.Size.Scale(f)
+	for i := range h.Heights {
+		h.Heights[i] *= f
+	}
+	h.updateDerived()
+}
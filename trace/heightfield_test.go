@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestHeightfieldLoad(t *testing.T) {
+	img16 := image.NewGray16(image.Rect(0, 0, 2, 2))
+	img16.SetGray16(1, 0, color.Gray16{0xffff})
+	img16.SetGray16(0, 1, color.Gray16{0x8000})
+	img8 := image.NewGray(image.Rect(0, 0, 2, 2))
+	img8.SetGray(1, 0, color.Gray{0xff})
+	img8.SetGray(0, 1, color.Gray{0x80})
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		want []float64
+	}{
+		{"16 bit", img16, []float64{0, 2, 2 * float64(0x8000) / 0xffff, 0}},
+		{"8 bit", img8, []float64{0, 2, 2 * float64(0x80) / 0xff, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := loadHeightfield(writeTestPNG(t, tc.img), xmath.Vect(0, 0, 0), xmath.Vect(1, 2, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tc.want {
+				if math.Abs(h.Heights[i]-tc.want[i]) > 1e-12 {
+					t.Errorf("wrong height %d: want=%v got=%v", i, tc.want[i], h.Heights[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHeightfieldMatchesTriangles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const wide, deep = 9, 7
+	heights := make([]float64, wide*deep)
+	for i := range heights {
+		heights[i] = rng.Float64() * 0.5
+	}
+	h := newHeightfield(xmath.Vect(-1, 2, 3), xmath.Vect(2, 0.5, 1.5), wide, deep, heights)
+	var tris []*triangle
+	for z := 0; z+1 < deep; z++ {
+		for x := 0; x+1 < wide; x++ {
+			cell, _ := h.cellTriangles(x, z)
+			for _, v := range cell {
+				tris = append(tris, newTriangle(v[0], v[1], v[2]))
+			}
+		}
+	}
+
+	center := xmath.Vect(0, 2.25, 3.75)
+	for i := 0; i < 10000; i++ {
+		r := xmath.Ray{
+			Start: center.Add(randomUnit(rng).Scale(3 * rng.Float64())),
+			Dir:   randomUnit(rng),
+		}
+		var want intersection
+		var wantHit bool
+		for _, tri := range tris {
+			if x, hit := tri.intersect(r); hit && (!wantHit || x.distance < want.distance) {
+				want, wantHit = x, true
+			}
+		}
+		got, gotHit := h.intersect(r)
+		if gotHit != wantHit {
+			t.Fatalf("hit mismatch: want=%v got=%v ray=%v", wantHit, gotHit, r)
+		}
+		if wantHit && (got.distance != want.distance || got.unitNormal != want.unitNormal) {
+			t.Errorf("wrong hit: want=(%v,%v) got=(%v,%v)",
+				want.distance, want.unitNormal, got.distance, got.unitNormal)
+		}
+		if gotHit {
+			obj := object{Surface: h}
+			x := obj.complete(got)
+			if x.shadingNormal.Dot(x.unitNormal) <= 0 || math.Abs(x.dpdu.Dot(x.unitNormal)) > 1e-9 {
+				t.Errorf("bad parameterisation: %+v", x)
+			}
+		}
+	}
+
+	// Cells are intersected without allocating.
+	r := xmath.Ray{Start: xmath.Vect(-1.5, 3, 3.1), Dir: xmath.Vect(1, -0.3, 0.5).Unit()}
+	if allocs := testing.AllocsPerRun(100, func() {
+		if x, hit := h.intersect(r); hit {
+			h.parameterise(&x)
+		}
+	}); allocs != 0 {
+		t.Errorf("intersecting allocated %v times", allocs)
+	}
+}
@@ -0,0 +1,149 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// light is a light source with no area (either a point, or infinitely far
+// away). Rays can't hit lights by chance, so they only contribute light when
+// they're sampled explicitly.
+type light interface {
+	// sample gives the unit direction from a point towards the light, the
+	// distance to the light (infinite for directional lights), and the
+	// irradiance from the light on a surface at the point that faces it.
+	sample(p xmath.Vector) (dir xmath.Vector, dist float64, irradiance colour.Colour)
+
+	// emit samples a ray of light leaving the light, for tracing paths from
+	// lights. It gives the light's intensity in the ray's direction (or
+	// irradiance, for directional lights), and the probability densities of
+	// the ray's start point and direction. Point and spot lights always
+	// start from the same point, so their start point density is 1.
+	// Directional lights emit from a disc big enough to cover the scene's
+	// bounding sphere, and always in the same direction, so their direction
+	// density is 1.
+	emit(center xmath.Vector, radius float64, rng *rand.Rand) (r xmath.Ray, c colour.Colour, pdfPos, pdfDir float64)
+
+	// emitPDF gives the density of emit choosing a direction (or, for
+	// directional lights, a start point).
+	emitPDF(dir xmath.Vector, radius float64) float64
+
+	// power approximates the total power emitted by the light (into the
+	// scene's bounding sphere, for directional lights).
+	power(radius float64) float64
+}
+
+// pointLight emits equally in all directions. Intensity is per steradian.
+type pointLight struct {
+	Position  xmath.Vector  `json:"position"`
+	Intensity colour.Colour `json:"intensity"`
+}
+
+func (l *pointLight) sample(p xmath.Vector) (xmath.Vector, float64, colour.Colour) {
+	d := l.Position.Sub(p)
+	dist := d.Length()
+	return d.Scale(1 / dist), dist, l.Intensity.Scale(1 / (dist * dist))
+}
+
+func (l *pointLight) emit(_ xmath.Vector, _ float64, rng *rand.Rand) (xmath.Ray, colour.Colour, float64, float64) {
+	dir := uniformCone(xmath.Vect(0, 0, 1), -1, rng)
+	return xmath.Ray{Start: l.Position, Dir: dir}, l.Intensity, 1, 1 / (4 * math.Pi)
+}
+
+func (l *pointLight) emitPDF(xmath.Vector, float64) float64 {
+	return 1 / (4 * math.Pi)
+}
+
+func (l *pointLight) power(float64) float64 {
+	return 4 * math.Pi * maxComponent(l.Intensity)
+}
+
+// spotLight is a point light that only emits in a cone around Direction. The
+// intensity falls off smoothly between the inner and outer cone angles
+// (given as cosines).
+type spotLight struct {
+	Position  xmath.Vector  `json:"position"`
+	Direction xmath.Vector  `json:"direction"` // Unit.
+	Intensity colour.Colour `json:"intensity"`
+	CosInner  float64       `json:"cos_inner"`
+	CosOuter  float64       `json:"cos_outer"`
+}
+
+func (l *spotLight) sample(p xmath.Vector) (xmath.Vector, float64, colour.Colour) {
+	d := l.Position.Sub(p)
+	dist := d.Length()
+	dir := d.Scale(1 / dist)
+	falloff := smoothFalloff(-dir.Dot(l.Direction), l.CosInner, l.CosOuter)
+	return dir, dist, l.Intensity.Scale(falloff / (dist * dist))
+}
+
+// emit samples directions uniformly within the outer cone.
+func (l *spotLight) emit(_ xmath.Vector, _ float64, rng *rand.Rand) (xmath.Ray, colour.Colour, float64, float64) {
+	dir := uniformCone(l.Direction, l.CosOuter, rng)
+	falloff := smoothFalloff(dir.Dot(l.Direction), l.CosInner, l.CosOuter)
+	return xmath.Ray{Start: l.Position, Dir: dir}, l.Intensity.Scale(falloff), 1, l.emitPDF(dir, 0)
+}
+
+func (l *spotLight) emitPDF(dir xmath.Vector, _ float64) float64 {
+	if dir.Dot(l.Direction) < l.CosOuter || l.CosOuter >= 1 {
+		return 0
+	}
+	return 1 / (2 * math.Pi * (1 - l.CosOuter))
+}
+
+func (l *spotLight) power(float64) float64 {
+	// The falloff between the cones is approximately linear in the cosine.
+	return 2 * math.Pi * (1 - (l.CosInner+l.CosOuter)/2) * maxComponent(l.Intensity)
+}
+
+// directionalLight is infinitely far away (e.g. the sun), so all of its light
+// travels in the same direction and doesn't fall off with distance.
+type directionalLight struct {
+	Direction  xmath.Vector  `json:"direction"` // Unit, in the direction light travels.
+	Irradiance colour.Colour `json:"irradiance"`
+}
+
+func (l *directionalLight) sample(xmath.Vector) (xmath.Vector, float64, colour.Colour) {
+	return l.Direction.Scale(-1), math.Inf(+1), l.Irradiance
+}
+
+func (l *directionalLight) emit(center xmath.Vector, radius float64, rng *rand.Rand) (xmath.Ray, colour.Colour, float64, float64) {
+	// Choose a point on the disc facing the light that's just outside of
+	// the bounding sphere.
+	r := radius * math.Sqrt(rng.Float64())
+	phi := 2 * math.Pi * rng.Float64()
+	s, t := orthonormalBasis(l.Direction)
+	start := center.
+		Sub(l.Direction.Scale(radius)).
+		Add(s.Scale(r * math.Cos(phi))).
+		Add(t.Scale(r * math.Sin(phi)))
+	return xmath.Ray{Start: start, Dir: l.Direction}, l.Irradiance, l.emitPDF(l.Direction, radius), 1
+}
+
+func (l *directionalLight) emitPDF(_ xmath.Vector, radius float64) float64 {
+	return 1 / (math.Pi * radius * radius)
+}
+
+func (l *directionalLight) power(radius float64) float64 {
+	return math.Pi * radius * radius * maxComponent(l.Irradiance)
+}
+
+// uniformCone samples a direction uniformly within a cone around a unit
+// axis, given the cosine of the cone's half angle.
+func uniformCone(axis xmath.Vector, cosMax float64, rng *rand.Rand) xmath.Vector {
+	cosTheta := 1 - rng.Float64()*(1-cosMax)
+	sinTheta := math.Sqrt(math.Max(0, 1-cosTheta*cosTheta))
+	phi := 2 * math.Pi * rng.Float64()
+	s, t := orthonormalBasis(axis)
+	return s.Scale(sinTheta * math.Cos(phi)).
+		Add(t.Scale(sinTheta * math.Sin(phi))).
+		Add(axis.Scale(cosTheta)).
+		Unit()
+}
+
+func maxComponent(c colour.Colour) float64 {
+	return math.Max(c.R, math.Max(c.G, c.B))
+}
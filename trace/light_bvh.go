@@ -0,0 +1,414 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// lightBounds bounds the light emitted by a group of emitters: where it's
+// emitted from, how much is emitted, and in which directions. The surface
+// normals of the emitters are within a cone around W (with cosine of its
+// half angle CosThetaO), and light is emitted within CosThetaE of those
+// normals.
+//
+// This is the representation described by Conty Estevez and Kulla in
+// "Importance Sampling of Many Lights with Adaptive Tree Splitting".
+type lightBounds struct {
+	Min, Max  xmath.Vector
+	Phi       float64 // Total power.
+	W         xmath.Vector
+	CosThetaO float64
+	CosThetaE float64
+	TwoSided  bool
+}
+
+// emitterBounds gives the bounds of an emitting object, or false if the
+// object can't be sampled.
+func emitterBounds(o *object) (lightBounds, bool) {
+	s, ok := o.Surface.(sampleable)
+	if !ok || o.Material.Emittance <= 0 {
+		return lightBounds{}, false
+	}
+
+	// Textures can vary, so the brightest colour is assumed.
+	c := o.Material.Colour
+	maxC := math.Max(c.R, math.Max(c.G, c.B))
+	if ec := o.Material.EmissionColour; ec != nil {
+		maxC = math.Max(ec.R, math.Max(ec.G, ec.B))
+	} else if o.Material.Texture != nil {
+		maxC = 1
+	}
+
+	b := lightBounds{
+		Phi:       o.Material.Emittance * maxC * s.area() * math.Pi * 2,
+		W:         xmath.Vect(0, 0, 1),
+		CosThetaO: -1,
+		CosThetaE: 0,
+		TwoSided:  true,
+	}
+	b.Min, b.Max = s.bound()
+	switch s := s.(type) {
+	case *triangle:
+		b.W, b.CosThetaO = s.UnitNorm, 1
+	case *parallelogram:
+		b.W, b.CosThetaO = s.UnitNorm, 1
+	case *disc:
+		b.W, b.CosThetaO = s.UnitNorm, 1
+	case *alignXSquare:
+		b.W, b.CosThetaO = xmath.Vect(1, 0, 0), 1
+	case *alignYSquare:
+		b.W, b.CosThetaO = xmath.Vect(0, 1, 0), 1
+	case *alignZSquare:
+		b.W, b.CosThetaO = xmath.Vect(0, 0, 1), 1
+	}
+
+	// One-sided emitters only emit half as much light, on the side their
+	// normals point towards (or away from, for the back).
+	switch o.Material.EmitSide {
+	case frontSide:
+		b.Phi /= 2
+		b.TwoSided = false
+	case backSide:
+		b.Phi /= 2
+		b.TwoSided = false
+		b.W = b.W.Scale(-1)
+	}
+
+	// Profiles bound the emitted light more tightly than the surface normals
+	// do, and determine how much is emitted.
+	if p := o.Material.Profile; p != nil {
+		b.Phi = o.Material.Emittance * maxC * s.area() * p.flux()
+		b.W, b.CosThetaE = p.cone()
+		b.CosThetaO = 1
+		b.TwoSided = false
+	}
+	return b, b.Phi > 0
+}
+
+func (b lightBounds) union(o lightBounds) lightBounds {
+	if b.Phi == 0 {
+		return o
+	}
+	if o.Phi == 0 {
+		return b
+	}
+	w, cosThetaO := coneUnion(b.W, b.CosThetaO, o.W, o.CosThetaO)
+	return lightBounds{
+		Min:       b.Min.Min(o.Min),
+		Max:       b.Max.Max(o.Max),
+		Phi:       b.Phi + o.Phi,
+		W:         w,
+		CosThetaO: cosThetaO,
+		CosThetaE: math.Min(b.CosThetaE, o.CosThetaE),
+		TwoSided:  b.TwoSided || o.TwoSided,
+	}
+}
+
+func (b lightBounds) centroid() xmath.Vector {
+	return b.Min.Add(b.Max).Scale(0.5)
+}
+
+// importance estimates the light that the emitters contribute at a point p.
+// When p is on a surface, n is its normal. Otherwise, n is zero. The
+// estimate is conservative (it's zero only if the emitters definitely don't
+// contribute).
+func (b lightBounds) importance(p, n xmath.Vector) float64 {
+	pc := b.centroid()
+	d2 := p.Sub(pc).LengthSq()
+	d2 = math.Max(d2, b.Max.Sub(b.Min).Length()/2)
+
+	wi := p.Sub(pc).Unit()
+	cosThetaW := b.W.Dot(wi)
+	if b.TwoSided {
+		cosThetaW = math.Abs(cosThetaW)
+	}
+	sinThetaW := safeSqrt(1 - cosThetaW*cosThetaW)
+
+	// The angle subtended by the bounds, as seen from p.
+	cosThetaB := -1.0
+	radiusSq := b.Max.Sub(pc).LengthSq()
+	if distSq := p.Sub(pc).LengthSq(); distSq > radiusSq {
+		cosThetaB = safeSqrt(1 - radiusSq/distSq)
+	}
+	sinThetaB := safeSqrt(1 - cosThetaB*cosThetaB)
+
+	// The minimum angle between the emission direction and p, accounting for
+	// the spread of the normals and the size of the bounds.
+	sinThetaO := safeSqrt(1 - b.CosThetaO*b.CosThetaO)
+	cosThetaX := cosSubClamped(sinThetaW, cosThetaW, sinThetaO, b.CosThetaO)
+	sinThetaX := sinSubClamped(sinThetaW, cosThetaW, sinThetaO, b.CosThetaO)
+	cosThetaP := cosSubClamped(sinThetaX, cosThetaX, sinThetaB, cosThetaB)
+	if cosThetaP <= b.CosThetaE {
+		return 0
+	}
+
+	importance := b.Phi * cosThetaP / d2
+	if n != (xmath.Vector{}) {
+		cosThetaI := math.Abs(wi.Dot(n))
+		sinThetaI := safeSqrt(1 - cosThetaI*cosThetaI)
+		importance *= cosSubClamped(sinThetaI, cosThetaI, sinThetaB, cosThetaB)
+	}
+	return math.Max(importance, 0)
+}
+
+// cosSubClamped gives cos(max(0, a-b)), given the sines and cosines of a and
+// b.
+func cosSubClamped(sinA, cosA, sinB, cosB float64) float64 {
+	if cosA > cosB {
+		return 1
+	}
+	return cosA*cosB + sinA*sinB
+}
+
+// sinSubClamped gives sin(max(0, a-b)), given the sines and cosines of a and
+// b.
+func sinSubClamped(sinA, cosA, sinB, cosB float64) float64 {
+	if cosA > cosB {
+		return 0
+	}
+	return sinA*cosB - cosA*sinB
+}
+
+func safeSqrt(x float64) float64 {
+	return math.Sqrt(math.Max(0, x))
+}
+
+// coneUnion finds a cone of directions that contains two other cones. Cones
+// are given by their unit axis and the cosine of their half angle.
+func coneUnion(wa xmath.Vector, cosA float64, wb xmath.Vector, cosB float64) (xmath.Vector, float64) {
+	thetaA := math.Acos(clamp(cosA, -1, 1))
+	thetaB := math.Acos(clamp(cosB, -1, 1))
+	thetaD := math.Acos(clamp(wa.Dot(wb), -1, 1))
+	if math.Min(thetaD+thetaB, math.Pi) <= thetaA {
+		return wa, cosA
+	}
+	if math.Min(thetaD+thetaA, math.Pi) <= thetaB {
+		return wb, cosB
+	}
+	thetaO := (thetaA + thetaD + thetaB) / 2
+	if thetaO >= math.Pi {
+		return wa, -1
+	}
+	axis := wa.Cross(wb)
+	if axis.LengthSq() == 0 {
+		return wa, -1
+	}
+	return wa.Rotate(axis.Unit(), thetaO-thetaA).Unit(), math.Cos(thetaO)
+}
+
+// lightBVH is a bounding volume hierarchy over the emitters in a scene. It's
+// used to choose emitters with probability roughly proportional to their
+// contribution at a point, so that scenes with many emitters (most of which
+// contribute very little at any given point) converge quickly.
+type lightBVH struct {
+	emitters []object
+	nodes    []lightNode
+	leaves   map[int]int // Leaf node index for each emitter's PrimID.
+}
+
+// lightNode is a node of a lightBVH, where the nodes are stored in depth
+// first order. An interior node's first child immediately follows it.
+type lightNode struct {
+	bounds lightBounds
+	parent int // -1 for the root.
+
+	// For interior nodes, the index of the second child. For leaves, the
+	// index of the emitter.
+	index int
+	leaf  bool
+}
+
+// newLightBVH builds a hierarchy over the objects that are sampleable
+// emitters. It gives nil if there aren't any.
+func newLightBVH(objs []object) *lightBVH {
+	bvh := &lightBVH{leaves: make(map[int]int)}
+	var items []int
+	var bounds []lightBounds
+	for _, o := range objs {
+		b, ok := emitterBounds(&o)
+		if !ok {
+			continue
+		}
+		items = append(items, len(bvh.emitters))
+		bounds = append(bounds, b)
+		bvh.emitters = append(bvh.emitters, o)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	bvh.build(items, bounds, -1)
+	return bvh
+}
+
+// lightBVHBuckets is the number of candidate split positions considered
+// along each axis when building a lightBVH.
+const lightBVHBuckets = 12
+
+func (b *lightBVH) build(items []int, bounds []lightBounds, parent int) {
+	idx := len(b.nodes)
+	b.nodes = append(b.nodes, lightNode{parent: parent})
+	if len(items) == 1 {
+		e := items[0]
+		b.nodes[idx].bounds = bounds[e]
+		b.nodes[idx].index = e
+		b.nodes[idx].leaf = true
+		b.leaves[b.emitters[e].PrimID] = idx
+		return
+	}
+
+	var all lightBounds
+	cmin := bounds[items[0]].centroid()
+	cmax := cmin
+	for _, e := range items {
+		all = all.union(bounds[e])
+		c := bounds[e].centroid()
+		cmin, cmax = cmin.Min(c), cmax.Max(c)
+	}
+
+	// Choose the split with the lowest cost, considering a number of
+	// evenly spaced positions along each axis.
+	bestCost := math.Inf(+1)
+	bestDim, bestBucket := -1, 0
+	for dim := 0; dim < 3; dim++ {
+		lo, hi := component(cmin, dim), component(cmax, dim)
+		if hi == lo {
+			continue
+		}
+		var buckets [lightBVHBuckets]lightBounds
+		for _, e := range items {
+			k := bucketFor(bounds[e], dim, lo, hi)
+			buckets[k] = buckets[k].union(bounds[e])
+		}
+		for split := 1; split < lightBVHBuckets; split++ {
+			var below, above lightBounds
+			for i := 0; i < split; i++ {
+				below = below.union(buckets[i])
+			}
+			for i := split; i < lightBVHBuckets; i++ {
+				above = above.union(buckets[i])
+			}
+			if below.Phi == 0 || above.Phi == 0 {
+				continue
+			}
+			cost := splitCost(below, all, dim) + splitCost(above, all, dim)
+			if cost < bestCost {
+				bestCost, bestDim, bestBucket = cost, dim, split
+			}
+		}
+	}
+
+	var mid int
+	if bestDim >= 0 {
+		lo, hi := component(cmin, bestDim), component(cmax, bestDim)
+		sort.SliceStable(items, func(i, j int) bool {
+			return bucketFor(bounds[items[i]], bestDim, lo, hi) < bucketFor(bounds[items[j]], bestDim, lo, hi)
+		})
+		mid = sort.Search(len(items), func(i int) bool {
+			return bucketFor(bounds[items[i]], bestDim, lo, hi) >= bestBucket
+		})
+	}
+	if mid == 0 || mid == len(items) {
+		// All of the emitters are in one place, so just split them evenly.
+		mid = len(items) / 2
+	}
+
+	b.build(items[:mid], bounds, idx)
+	b.nodes[idx].index = len(b.nodes)
+	b.build(items[mid:], bounds, idx)
+	b.nodes[idx].bounds = all
+}
+
+func bucketFor(b lightBounds, dim int, lo, hi float64) int {
+	i := int(lightBVHBuckets * (component(b.centroid(), dim) - lo) / (hi - lo))
+	if i >= lightBVHBuckets {
+		i = lightBVHBuckets - 1
+	}
+	return i
+}
+
+// splitCost is the surface area orientation heuristic. It favours groups
+// that are small, emit little power, and emit in a narrow range of
+// directions. Groups that are thin along the split axis are penalised, since
+// splitting along a short axis is less useful.
+func splitCost(b, parent lightBounds, dim int) float64 {
+	thetaO := math.Acos(clamp(b.CosThetaO, -1, 1))
+	thetaE := math.Acos(clamp(b.CosThetaE, -1, 1))
+	thetaW := math.Min(thetaO+thetaE, math.Pi)
+	sinThetaO := safeSqrt(1 - b.CosThetaO*b.CosThetaO)
+	mOmega := 2*math.Pi*(1-b.CosThetaO) +
+		math.Pi/2*(2*thetaW*sinThetaO-math.Cos(thetaO-2*thetaW)-2*thetaO*sinThetaO+b.CosThetaO)
+
+	diag := parent.Max.Sub(parent.Min)
+	kr := math.Max(diag.X, math.Max(diag.Y, diag.Z)) / math.Max(component(diag, dim), 1e-12)
+
+	d := b.Max.Sub(b.Min)
+	area := 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+	return b.Phi * mOmega * kr * math.Max(area, 1e-12)
+}
+
+func component(v xmath.Vector, dim int) float64 {
+	switch dim {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	default:
+		return v.Z
+	}
+}
+
+// sample chooses an emitter for a point p (with surface normal n, or zero
+// in media). It gives the emitter and the probability of choosing it, or
+// false if no emitters can contribute at p.
+func (b *lightBVH) sample(p, n xmath.Vector, rng *rand.Rand) (*object, float64, bool) {
+	pmf := 1.0
+	idx := 0
+	for !b.nodes[idx].leaf {
+		i0 := b.nodes[idx+1].bounds.importance(p, n)
+		i1 := b.nodes[b.nodes[idx].index].bounds.importance(p, n)
+		if i0 == 0 && i1 == 0 {
+			return nil, 0, false
+		}
+		p0 := i0 / (i0 + i1)
+		if rng.Float64() < p0 {
+			idx++
+			pmf *= p0
+		} else {
+			idx = b.nodes[idx].index
+			pmf *= 1 - p0
+		}
+	}
+	if b.nodes[idx].bounds.importance(p, n) == 0 {
+		return nil, 0, false
+	}
+	return &b.emitters[b.nodes[idx].index], pmf, true
+}
+
+// pmf gives the probability that sample chooses an emitter (identified by
+// its PrimID) for a point p with normal n. The emitter's area is also
+// returned.
+func (b *lightBVH) pmf(p, n xmath.Vector, primID int) (float64, float64) {
+	idx, ok := b.leaves[primID]
+	if !ok || b.nodes[idx].bounds.importance(p, n) == 0 {
+		return 0, 0
+	}
+	area := b.emitters[b.nodes[idx].index].Surface.(sampleable).area()
+	pmf := 1.0
+	for child := idx; b.nodes[child].parent >= 0; child = b.nodes[child].parent {
+		parent := b.nodes[child].parent
+		i0 := b.nodes[parent+1].bounds.importance(p, n)
+		i1 := b.nodes[b.nodes[parent].index].bounds.importance(p, n)
+		ic := i0
+		if child != parent+1 {
+			ic = i1
+		}
+		if ic == 0 {
+			return 0, 0
+		}
+		pmf *= ic / (i0 + i1)
+	}
+	return pmf, area
+}
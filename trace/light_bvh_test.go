@@ -0,0 +1,171 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestSampleableSurfaces(t *testing.T) {
+	for _, s := range []sampleable{
+		newTriangle(xmath.Vect(0, 0, 0), xmath.Vect(1, 0.5, 0), xmath.Vect(0.2, 1, 0.3)),
+		&sphere{Center: xmath.Vect(1, 2, 3), Radius: 0.5},
+		&alignXSquare{X: 1, Y1: 0, Y2: 2, Z1: -1, Z2: 0},
+		&alignYSquare{X1: 0, X2: 2, Y: 1, Z1: -1, Z2: 0},
+		&alignZSquare{X1: 0, X2: 2, Y1: -1, Y2: 0, Z: 1},
+		&disc{Center: xmath.Vect(0, 1, 0), RadiusSq: 0.25, UnitNorm: xmath.Vect(1, 1, 0).Unit()},
+		newAlignedBox(xmath.Vect(0, 0, 0), xmath.Vect(1, 0.01, 2)).(*alignedBox),
+	} {
+		// Sampled points should be on the surface, with the normal there.
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			p, n := s.sample(rng.Float64(), rng.Float64())
+			const eps = 1e-3
+			x, hit := s.intersect(xmath.Ray{Start: p.Add(n.Scale(eps)), Dir: n.Scale(-1)})
+			if !hit || math.Abs(x.distance-eps) > 1e-9 {
+				t.Fatalf("%v: sampled point %v is not on the surface", s, p)
+			}
+			if math.Abs(math.Abs(x.unitNormal.Dot(n))-1) > 1e-9 {
+				t.Fatalf("%v: wrong normal %v at %v", s, n, p)
+			}
+		}
+	}
+}
+
+func TestLightBVHSamplingMatchesPMF(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var objs []object
+	for i := 0; i < 50; i++ {
+		c := xmath.Vect(rng.Float64(), rng.Float64(), rng.Float64()).Scale(4)
+		var s surface
+		switch i % 3 {
+		case 0:
+			s = &sphere{Center: c, Radius: 0.1}
+		case 1:
+			s = newTriangle(c, c.Add(randomUnit(rng).Scale(0.2)), c.Add(randomUnit(rng).Scale(0.2)))
+		case 2:
+			s = &alignYSquare{X1: c.X, X2: c.X + 0.1, Y: c.Y, Z1: c.Z, Z2: c.Z + 0.3}
+		}
+		objs = append(objs, object{
+			Surface:  s,
+			Material: material{Colour: colour.Colour{R: 1, G: 1, B: 1}, Emittance: 1 + rng.Float64()},
+			PrimID:   len(objs),
+		})
+	}
+	bvh := newLightBVH(objs)
+
+	for _, tc := range []struct{ p, n xmath.Vector }{
+		{xmath.Vect(2, 2, 2), xmath.Vector{}},
+		{xmath.Vect(0, 0, 0), xmath.Vect(0, 1, 0)},
+		{xmath.Vect(5, 1, 2), xmath.Vect(-1, 0, 0)},
+	} {
+		counts := make(map[int]int)
+		n := rayCount() / 16
+		for i := 0; i < n; i++ {
+			o, pmf, ok := bvh.sample(tc.p, tc.n, rng)
+			if !ok {
+				t.Fatal("no emitter sampled")
+			}
+			if got, _ := bvh.pmf(tc.p, tc.n, o.PrimID); math.Abs(got-pmf) > 1e-9 {
+				t.Fatalf("sample gave pmf %v, but pmf gave %v", pmf, got)
+			}
+			counts[o.PrimID]++
+		}
+		var sum float64
+		for _, o := range objs {
+			pmf, _ := bvh.pmf(tc.p, tc.n, o.PrimID)
+			sum += pmf
+			freq := float64(counts[o.PrimID]) / float64(n)
+			if math.Abs(freq-pmf) > 4*math.Sqrt(pmf/float64(n))+1e-3 {
+				t.Errorf("emitter %d: pmf %v, but sampled with frequency %v", o.PrimID, pmf, freq)
+			}
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("pmfs sum to %v", sum)
+		}
+	}
+}
+
+// traceMean traces paths along a ray, giving the mean of their red channel
+// and its standard error.
+func traceMean(tr *tracer, r xmath.Ray, n int) (float64, float64) {
+	var sum, sumSq float64
+	for i := 0; i < n; i++ {
+		v := tr.tracePath(r).R
+		sum += v
+		sumSq += v * v
+	}
+	mean := sum / float64(n)
+	variance := math.Max(0, sumSq/float64(n)-mean*mean)
+	return mean, math.Sqrt(variance / float64(n))
+}
+
+func TestEmitterSamplingIsUnbiased(t *testing.T) {
+	// A floor lit by a variety of emitters (each of which is sampleable),
+	// optionally in fog. The results should be the same whether or not the
+	// emitters are sampled directly.
+	white := colour.Colour{R: 1, G: 1, B: 1}
+	objs := []object{
+		{Surface: &alignYSquare{X1: -2, X2: 2, Y: 0, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &sphere{Center: xmath.Vect(-0.5, 0.6, 0), Radius: 0.3}, Material: material{Colour: white, Emittance: 2}},
+		{Surface: newAlignedBox(xmath.Vect(0.2, 0.8, -0.4), xmath.Vect(0.8, 0.9, 0.2)), Material: material{Colour: colour.Colour{R: 1, G: 0.5, B: 0.2}, Emittance: 3}},
+		{Surface: &disc{Center: xmath.Vect(0, 1.2, 0.5), RadiusSq: 0.1, UnitNorm: xmath.Vect(0, -1, 0.3).Unit()}, Material: material{Colour: white, Emittance: 4}},
+	}
+	for i := range objs {
+		objs[i].PrimID = i
+	}
+	for _, fog := range []medium{nil, &homogeneousMedium{Scattering: colour.Colour{R: 0.5, G: 0.5, B: 0.5}}} {
+		// The tolerance comes from the standard errors, since the result
+		// without emitter sampling is noisy.
+		var means, errs [2]float64
+		for i, emitters := range []*lightBVH{nil, newLightBVH(objs)} {
+			rng := rand.New(rand.NewSource(1))
+			scn := &builtScene{emitters: emitters, outside: fog, camMedium: fog}
+			tr := newTracer(newListAccelerationStructure(objs), scn, rng)
+			r := xmath.Ray{Start: xmath.Vect(0, 0.3, 1), Dir: xmath.Vect(0, -0.3, -1).Unit()}
+			means[i], errs[i] = traceMean(tr, r, rayCount()/32)
+		}
+		if math.Abs(means[0]-means[1]) > 6*math.Hypot(errs[0], errs[1]) {
+			t.Errorf("fog=%v: without emitter sampling %v±%v, with %v±%v",
+				fog != nil, means[0], errs[0], means[1], errs[1])
+		}
+	}
+}
+
+func TestOneSidedSurfaces(t *testing.T) {
+	// A floor lit by a square emitter above it, with a one-sided occluder in
+	// between. The occluder faces upwards, so rays traced up from the floor
+	// hit its back and pass through it. The emitter's normal also faces
+	// upwards, so only emission from its back reaches the floor.
+	white := colour.Colour{R: 1, G: 1, B: 1}
+	for _, tc := range []struct {
+		emitSide side
+		lit      bool
+	}{
+		{bothSides, true},
+		{frontSide, false},
+		{backSide, true},
+	} {
+		objs := []object{
+			{Surface: &alignYSquare{X1: -2, X2: 2, Y: 0, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+			{Surface: &alignYSquare{X1: -1, X2: 1, Y: 0.5, Z1: -1, Z2: 1}, Material: material{Colour: white, OneSided: true}},
+			{Surface: &alignYSquare{X1: -0.5, X2: 0.5, Y: 1, Z1: -0.5, Z2: 0.5}, Material: material{Colour: white, Emittance: 2, EmitSide: tc.emitSide}},
+		}
+		for i := range objs {
+			objs[i].PrimID = i
+		}
+		// Only whether the floor is lit matters (emitter sampling is
+		// checked for bias elsewhere), so few paths are needed.
+		for _, emitters := range []*lightBVH{nil, newLightBVH(objs)} {
+			rng := rand.New(rand.NewSource(1))
+			tr := newTracer(newListAccelerationStructure(objs), &builtScene{emitters: emitters}, rng)
+			r := xmath.Ray{Start: xmath.Vect(0, 0.3, 0.1), Dir: xmath.Vect(0, -1, -0.2).Unit()}
+			if got, _ := traceMean(tr, r, rayCount()/16); (got > 0) != tc.lit {
+				t.Errorf("side=%v sampled=%v: want lit=%v, got %v", tc.emitSide, emitters != nil, tc.lit, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package trace
+
+import (
+	"math"
+	"sort"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// lightSource is somewhere that light paths can start from: either a light,
+// or a sampleable emitter.
+type lightSource struct {
+	light light   // Nil for emitters.
+	obj   *object // Nil for lights.
+	med   medium  // The medium around the source.
+}
+
+// lightSources chooses light sources in proportion to their (approximate)
+// power. Unlike the light BVH, the choice doesn't depend on the point being
+// lit, so it's suitable for starting light paths.
+type lightSources struct {
+	sources []lightSource
+	cdf     []float64
+	byPrim  map[int]int // Index of the source for each emitter's PrimID.
+
+	// A bounding sphere of the scene, for directional lights.
+	center xmath.Vector
+	radius float64
+}
+
+// newLightSources finds the light sources in a scene. It gives nil if there
+// aren't any.
+func newLightSources(objs []object, lights []light, outside medium) *lightSources {
+	ls := &lightSources{byPrim: make(map[int]int)}
+
+	// Only objects with finite bounds contribute to the bounding sphere (for
+	// example, the camera can be inside of a huge sphere).
+	lo := xmath.Vect(math.Inf(+1), math.Inf(+1), math.Inf(+1))
+	hi := lo.Scale(-1)
+	for _, o := range objs {
+		oLo, oHi := o.Surface.bound()
+		finite := true
+		for _, f := range []float64{oLo.X, oLo.Y, oLo.Z, oHi.X, oHi.Y, oHi.Z} {
+			finite = finite && !math.IsInf(f, 0) && !math.IsNaN(f)
+		}
+		if finite {
+			lo, hi = lo.Min(oLo), hi.Max(oHi)
+		}
+	}
+	if lo.X > hi.X {
+		lo, hi = xmath.Vect(-1, -1, -1), xmath.Vect(1, 1, 1)
+	}
+	ls.center = lo.Add(hi).Scale(0.5)
+	ls.radius = math.Max(hi.Sub(lo).Length()/2, 1e-3)
+
+	var powers []float64
+	mediumOfObj := make(map[int]medium)
+	for i := range objs {
+		o := &objs[i]
+		b, ok := emitterBounds(o)
+		if !ok {
+			continue
+		}
+		// Emitters don't straddle medium boundaries, so the medium is the
+		// same for each part of an object.
+		med, ok := mediumOfObj[o.ObjID]
+		if !ok {
+			med = mediumAt(b.Min.Add(b.Max).Scale(0.5), objs, outside)
+			mediumOfObj[o.ObjID] = med
+		}
+		ls.byPrim[o.PrimID] = len(ls.sources)
+		ls.sources = append(ls.sources, lightSource{obj: o, med: med})
+		powers = append(powers, b.Phi)
+	}
+	for _, l := range lights {
+		med := outside
+		switch l := l.(type) {
+		case *pointLight:
+			med = mediumAt(l.Position, objs, outside)
+		case *spotLight:
+			med = mediumAt(l.Position, objs, outside)
+		}
+		ls.sources = append(ls.sources, lightSource{light: l, med: med})
+		powers = append(powers, l.power(ls.radius))
+	}
+
+	var total float64
+	for _, p := range powers {
+		total += p
+		ls.cdf = append(ls.cdf, total)
+	}
+	if !(total > 0) {
+		return nil
+	}
+	for i := range ls.cdf {
+		ls.cdf[i] /= total
+	}
+	return ls
+}
+
+// sample chooses a light source using a uniform random number in [0, 1),
+// giving its index and the probability of choosing it.
+func (ls *lightSources) sample(u float64) (int, float64) {
+	i := sort.SearchFloat64s(ls.cdf, u)
+	for i < len(ls.cdf)-1 && ls.pmf(i) == 0 {
+		i++
+	}
+	if i >= len(ls.cdf) {
+		i = len(ls.cdf) - 1
+	}
+	return i, ls.pmf(i)
+}
+
+func (ls *lightSources) pmf(i int) float64 {
+	if i == 0 {
+		return ls.cdf[0]
+	}
+	return ls.cdf[i] - ls.cdf[i-1]
+}
@@ -0,0 +1,170 @@
+package trace
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestPointLightInverseSquare(t *testing.T) {
+	l := &pointLight{Position: xmath.Vect(1, 2, 3), Intensity: colour.Colour{R: 2, G: 4, B: 8}}
+	for _, dist := range []float64{0.5, 1, 3} {
+		p := l.Position.Sub(xmath.Vect(2, 3, 6).Unit().Scale(dist))
+		dir, d, irradiance := l.sample(p)
+		if math.Abs(d-dist) > 1e-9 {
+			t.Errorf("want distance %v, got %v", dist, d)
+		}
+		if dir.Sub(xmath.Vect(2, 3, 6).Unit()).Length() > 1e-9 {
+			t.Errorf("wrong direction: %v", dir)
+		}
+		if want := 8 / (dist * dist); math.Abs(irradiance.B-want) > 1e-9 {
+			t.Errorf("distance %v: want irradiance %v, got %v", dist, want, irradiance.B)
+		}
+	}
+}
+
+func TestSpotLightCone(t *testing.T) {
+	l := &spotLight{
+		Position:  xmath.Vect(0, 1, 0),
+		Direction: xmath.Vect(0, -1, 0),
+		Intensity: colour.Colour{R: 1, G: 1, B: 1},
+		CosInner:  math.Cos(0.2),
+		CosOuter:  math.Cos(0.4),
+	}
+	irradianceAt := func(angle float64) float64 {
+		p := xmath.Vect(math.Sin(angle), 1-math.Cos(angle), 0)
+		_, _, irradiance := l.sample(p)
+		return irradiance.R
+	}
+	if got := irradianceAt(0.1); math.Abs(got-1) > 1e-9 {
+		t.Errorf("inside inner cone: want 1, got %v", got)
+	}
+	if got := irradianceAt(0.5); got != 0 {
+		t.Errorf("outside outer cone: want 0, got %v", got)
+	}
+	last := 1.0
+	for angle := 0.2; angle <= 0.4; angle += 0.02 {
+		got := irradianceAt(angle)
+		if got > last {
+			t.Errorf("falloff increases at angle %v", angle)
+		}
+		last = got
+	}
+}
+
+func TestLitDiffuseFloor(t *testing.T) {
+	// A white floor, lit by a light directly above the point where the
+	// camera ray hits. Some of the lights are blocked by a sphere, and one
+	// is behind a medium boundary.
+	const h = 2.0
+	fog := &homogeneousMedium{Absorption: colour.Colour{R: 0.5, G: 0.5, B: 0.5}}
+	objs := []object{
+		{
+			Surface:  &alignYSquare{X1: -10, X2: 10, Y: 0, Z1: -10, Z2: 10},
+			Material: material{Colour: colour.Colour{R: 1, G: 1, B: 1}},
+		},
+		{
+			Surface:  &sphere{Center: xmath.Vect(5, 1, 0), Radius: 0.5},
+			Material: material{Colour: colour.Colour{}},
+		},
+		{
+			Surface:  &sphere{Center: xmath.Vect(-5, 1, 0), Radius: 0.5},
+			Material: material{Medium: fog},
+		},
+	}
+	for _, tc := range []struct {
+		name  string
+		light light
+		x     float64
+		want  float64
+	}{
+		{
+			name:  "point",
+			light: &pointLight{Position: xmath.Vect(0, h, 0), Intensity: colour.Colour{R: 1, G: 1, B: 1}},
+			want:  1 / (h * h),
+		},
+		{
+			name:  "directional",
+			light: &directionalLight{Direction: xmath.Vect(0, -1, 1).Unit(), Irradiance: colour.Colour{R: 1, G: 1, B: 1}},
+			want:  math.Sqrt(0.5),
+		},
+		{
+			name:  "occluded",
+			light: &pointLight{Position: xmath.Vect(5, h, 0), Intensity: colour.Colour{R: 1, G: 1, B: 1}},
+			x:     5,
+			want:  0,
+		},
+		{
+			name:  "medium",
+			light: &pointLight{Position: xmath.Vect(-5, h, 0), Intensity: colour.Colour{R: 1, G: 1, B: 1}},
+			x:     -5,
+			want:  math.Exp(-0.5) / (h * h),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			tr := newTracer(newListAccelerationStructure(objs), &builtScene{lights: []light{tc.light}}, rng)
+			r := xmath.Ray{Start: xmath.Vect(tc.x, 0.2, 0.1), Dir: xmath.Vect(0, -1, -0.5).Unit()}
+
+			// The occluding sphere is black, so no light bounces back to
+			// the floor, and the result is just the direct light scaled by
+			// the diffuse BRDF. The light is sampled directly, so few paths
+			// are needed.
+			var sum float64
+			n := rayCount() / 16
+			for i := 0; i < n; i++ {
+				sum += tr.tracePath(r).R
+			}
+			got := sum / float64(n)
+			want := tc.want / (2 * math.Pi)
+			if math.Abs(got-want) > 0.05*want+1e-3 {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestBuildLightsFromJSON(t *testing.T) {
+	const js = `{
+		"lights": [
+			{"point": {"position": {"x": 1, "y": 2, "z": 3}, "colour": {"r": 1, "g": 1, "b": 1}, "intensity": 2}},
+			{"spot": {"direction": {"x": 0, "y": -2, "z": 0}, "colour": {"r": 1, "g": 1, "b": 1}, "intensity": 1, "inner_angle": 0.1, "outer_angle": 0.2}},
+			{"directional": {"direction": {"x": 0, "y": 0, "z": -3}, "colour": {"r": 1, "g": 0, "b": 0}, "irradiance": 4}}
+		]
+	}`
+	var proto scene.Scene
+	if err := json.Unmarshal([]byte(js), &proto); err != nil {
+		t.Fatal(err)
+	}
+	scn, err := buildScene(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scn.lights) != 3 {
+		t.Fatalf("want 3 lights, got %d", len(scn.lights))
+	}
+	if p := scn.lights[0].(*pointLight); p.Position != xmath.Vect(1, 2, 3) || p.Intensity.G != 2 {
+		t.Errorf("wrong point light: %+v", p)
+	}
+	if s := scn.lights[1].(*spotLight); s.Direction != xmath.Vect(0, -1, 0) || s.CosOuter != math.Cos(0.2) {
+		t.Errorf("wrong spot light: %+v", s)
+	}
+	if d := scn.lights[2].(*directionalLight); d.Direction != xmath.Vect(0, 0, -1) || d.Irradiance.R != 4 {
+		t.Errorf("wrong directional light: %+v", d)
+	}
+
+	for _, l := range []scene.Light{
+		{},
+		{Spot: &scene.SpotLight{OuterAngle: 0.2}},
+		{Directional: &scene.DirectionalLight{}},
+	} {
+		if _, err := buildLight(l); err == nil {
+			t.Errorf("expected error for light %+v", l)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package trace
+
+import (
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+type material struct {
+	Colour    colour.Colour `json:"colour"`
+	Emittance float64       `json:"emittance"`
+	Mirror    bool          `json:"mirror"`
+	Texture   texture       `json:"texture"`
+
+	// EmissionColour overrides Colour (and Texture) for emitted light, e.g.
+	// for blackbody emitters (whose colour isn't a valid albedo). Spectrum
+	// overrides both when rendering spectrally.
+	EmissionColour *colour.Colour               `json:"emission_colour"`
+	Spectrum       func(lambda float64) float64 `json:"-"`
+
+	// Profile varies the emitted light with direction. When nil, it's the
+	// same in all directions.
+	Profile emissionProfile `json:"profile"`
+
+	// EmitSide is the side of the surface that emits light (the other side
+	// is shaded as if the material wasn't emissive). OneSided surfaces are
+	// invisible from behind.
+	EmitSide side `json:"emit_side"`
+	OneSided bool `json:"one_sided"`
+
+	// At most one of NormalMap and BumpMap is set.
+	NormalMap texture `json:"normal_map"`
+	BumpMap   texture `json:"bump_map"`
+	BumpScale float64 `json:"bump_scale"`
+
+	// Medium is set for objects that bound a participating medium. Their
+	// surfaces aren't visible, and rays pass straight through them.
+	Medium medium `json:"medium"`
+
+	// Subsurface is the medium inside of objects with subsurface
+	// scattering.
+	Subsurface *homogeneousMedium `json:"subsurface"`
+
+	Dielectric *dielectric `json:"dielectric"`
+}
+
+// side is a side of a surface, relative to its geometric normal.
+type side int
+
+const (
+	bothSides side = iota
+	frontSide
+	backSide
+)
+
+// emitsTowards reports whether the material emits light in a direction away
+// from a surface.
+func (m *material) emitsTowards(x intersection, dir xmath.Vector) bool {
+	if m.Emittance == 0 {
+		return false
+	}
+	switch m.EmitSide {
+	case frontSide:
+		return dir.Dot(x.unitNormal) > 0
+	case backSide:
+		return dir.Dot(x.unitNormal) < 0
+	}
+	return true
+}
+
+// culls reports whether a ray travelling in a direction passes straight
+// through the surface, because it hits the back of a one-sided surface.
+func (m *material) culls(x intersection, dir xmath.Vector) bool {
+	return m.OneSided && dir.Dot(x.unitNormal) > 0
+}
+
+func (m *material) colourAt(x intersection) colour.Colour {
+	if m.Texture == nil {
+		return m.Colour
+	}
+	return m.Texture.at(x)
+}
+
+// perturbNormal applies the material's normal or bump map (if it has one) to
+// the shading normal of an intersection.
+func (m *material) perturbNormal(x *intersection) {
+	var n xmath.Vector
+	switch {
+	case m.NormalMap != nil:
+		n = m.normalMapped(x)
+	case m.BumpMap != nil:
+		n = m.bumpMapped(x)
+	default:
+		return
+	}
+
+	// Degenerate tangent frames can give garbage normals, in which case it's
+	// better to not perturb at all.
+	if n.X != n.X || n.Y != n.Y || n.Z != n.Z || n.LengthSq() == 0 {
+		return
+	}
+	x.shadingNormal = n
+}
+
+// normalMapped reads a tangent space normal from the normal map, and
+// transforms it into world space.
+func (m *material) normalMapped(x *intersection) xmath.Vector {
+	c := m.NormalMap.at(*x)
+	ts := xmath.Vect(2*c.R-1, 2*c.G-1, 2*c.B-1)
+
+	n := x.shadingNormal
+	t := x.dpdu.Rej(n).Unit()
+	b := n.Cross(t)
+	if b.Dot(x.dpdv) < 0 {
+		b = b.Scale(-1)
+	}
+	return t.Scale(ts.X).Add(b.Scale(ts.Y)).Add(n.Scale(ts.Z)).Unit()
+}
+
+// bumpMapped treats the bump map as a displacement along the shading normal,
+// and finds the normal of the displaced surface using finite differences.
+func (m *material) bumpMapped(x *intersection) xmath.Vector {
+	const delta = 1.0 / 1024
+	n := x.shadingNormal
+
+	height := func(du, dv float64) float64 {
+		shifted := *x
+		shifted.u += du
+		shifted.v += dv
+		shifted.point = x.point.Add(x.dpdu.Scale(du)).Add(x.dpdv.Scale(dv))
+		return m.BumpScale * m.BumpMap.at(shifted).Luminance()
+	}
+	h := height(0, 0)
+	dhdu := (height(delta, 0) - h) / delta
+	dhdv := (height(0, delta) - h) / delta
+
+	dpdu := x.dpdu.Add(n.Scale(dhdu))
+	dpdv := x.dpdv.Add(n.Scale(dhdv))
+	bumped := dpdu.Cross(dpdv).Unit()
+	if bumped.Dot(n) < 0 {
+		bumped = bumped.Scale(-1)
+	}
+	return bumped
+}
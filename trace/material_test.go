@@ -0,0 +1,71 @@
+package trace
+
+import (
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestPerturbNormal(t *testing.T) {
+	x := intersection{
+		unitNormal:    xmath.Vect(0, 0, 1),
+		shadingNormal: xmath.Vect(0, 0, 1),
+		dpdu:          xmath.Vect(2, 0, 0),
+		dpdv:          xmath.Vect(0, -3, 0),
+	}
+	for _, tc := range []struct {
+		name string
+		mat  material
+		want xmath.Vector
+	}{
+		{
+			name: "flat normal map",
+			mat:  material{NormalMap: solidTexture{0.5, 0.5, 1}},
+			want: xmath.Vect(0, 0, 1),
+		},
+		{
+			name: "tilted towards u",
+			mat:  material{NormalMap: solidTexture{1, 0.5, 0.5}},
+			want: xmath.Vect(1, 0, 0),
+		},
+		{
+			name: "tilted towards v",
+			mat:  material{NormalMap: solidTexture{0.5, 1, 0.5}},
+			want: xmath.Vect(0, -1, 0),
+		},
+		{
+			name: "constant bump map",
+			mat:  material{BumpMap: solidTexture{1, 1, 1}, BumpScale: 1},
+			want: xmath.Vect(0, 0, 1),
+		},
+		{
+			name: "bump map increasing along u",
+			mat: material{
+				BumpMap:   &patternTexture{mapping{scale: 1}, solidTexture{}, solidTexture{1, 1, 1}, func(p xmath.Vector) float64 { return p.X }},
+				BumpScale: 2 / (colour.Colour{1, 1, 1}).Luminance(),
+			},
+			want: xmath.Vect(-1, 0, 1).Unit(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := x
+			tc.mat.perturbNormal(&got)
+			if got.shadingNormal.Sub(tc.want).Length() > 1e-6 {
+				t.Errorf("want=%v got=%v", tc.want, got.shadingNormal)
+			}
+			if got.unitNormal != x.unitNormal {
+				t.Errorf("geometric normal should be unchanged")
+			}
+		})
+	}
+}
+
+func TestPerturbNormalIgnoresDegenerateFrame(t *testing.T) {
+	x := intersection{shadingNormal: xmath.Vect(0, 1, 0)}
+	m := material{NormalMap: solidTexture{1, 0.5, 0.5}}
+	m.perturbNormal(&x)
+	if x.shadingNormal != xmath.Vect(0, 1, 0) {
+		t.Errorf("unexpected normal: %v", x.shadingNormal)
+	}
+}
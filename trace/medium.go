@@ -0,0 +1,168 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// medium is a participating medium that rays travel through.
+type medium interface {
+	// sampleDistance samples the distance to the next scattering event along
+	// a ray, given that the ray hits a surface at tMax (which may be
+	// infinite). When no scattering event is sampled before tMax, the ray
+	// reaches the surface instead. The returned weight is the transmittance
+	// (and for scattering events, the scattering coefficient) divided by the
+	// sampling probability density. A black weight means the ray was
+	// absorbed.
+	sampleDistance(r xmath.Ray, tMax float64, rng *rand.Rand) (dist float64, weight colour.Colour, scattered bool)
+
+	// transmittance estimates the fraction of light that passes through the
+	// medium along a ray, up to tMax.
+	transmittance(r xmath.Ray, tMax float64, rng *rand.Rand) colour.Colour
+
+	// asymmetry is the Henyey-Greenstein g parameter of the medium's phase
+	// function.
+	asymmetry() float64
+
+	// convert gives a copy of the medium with its coefficients converted by
+	// f (e.g. from RGB to spectral values).
+	convert(f func(colour.Colour) colour.Colour) medium
+}
+
+// homogeneousMedium has the same coefficients everywhere. Coefficients are
+// per unit distance.
+type homogeneousMedium struct {
+	Absorption colour.Colour `json:"absorption"`
+	Scattering colour.Colour `json:"scattering"`
+	Asymmetry  float64       `json:"asymmetry"` // Henyey-Greenstein g.
+}
+
+func (m *homogeneousMedium) extinction() colour.Colour {
+	return m.Absorption.Add(m.Scattering)
+}
+
+func (m *homogeneousMedium) asymmetry() float64 {
+	return m.Asymmetry
+}
+
+func (m *homogeneousMedium) convert(f func(colour.Colour) colour.Colour) medium {
+	return &homogeneousMedium{
+		Absorption: f(m.Absorption),
+		Scattering: f(m.Scattering),
+		Asymmetry:  m.Asymmetry,
+	}
+}
+
+// sampleDistance samples an exponential distribution. The extinction
+// coefficient varies with wavelength, so a colour channel is chosen at random
+// to sample the distance with. The probability density is then the average
+// over all channels (i.e. single sample MIS).
+func (m *homogeneousMedium) sampleDistance(_ xmath.Ray, tMax float64, rng *rand.Rand) (dist float64, weight colour.Colour, scattered bool) {
+	sigmaT := m.extinction()
+	var st float64
+	switch rng.Intn(3) {
+	case 0:
+		st = sigmaT.R
+	case 1:
+		st = sigmaT.G
+	case 2:
+		st = sigmaT.B
+	}
+	dist = math.Inf(+1)
+	if st > 0 {
+		dist = -math.Log(1-rng.Float64()) / st
+	}
+
+	if dist < tMax {
+		tr := transmittance(sigmaT, dist)
+		density := tr.Mul(sigmaT)
+		pdf := (density.R + density.G + density.B) / 3
+		return dist, tr.Mul(m.Scattering).Scale(1 / pdf), true
+	}
+	tr := transmittance(sigmaT, tMax)
+	pdf := (tr.R + tr.G + tr.B) / 3
+	if pdf == 0 {
+		return tMax, colour.Colour{}, false
+	}
+	return tMax, tr.Scale(1 / pdf), false
+}
+
+func (m *homogeneousMedium) transmittance(_ xmath.Ray, tMax float64, _ *rand.Rand) colour.Colour {
+	return transmittance(m.extinction(), tMax)
+}
+
+func transmittance(sigmaT colour.Colour, dist float64) colour.Colour {
+	tr := func(st float64) float64 {
+		if st == 0 {
+			return 1 // Even when dist is infinite.
+		}
+		return math.Exp(-st * dist)
+	}
+	return colour.Colour{R: tr(sigmaT.R), G: tr(sigmaT.G), B: tr(sigmaT.B)}
+}
+
+// henyeyGreenstein evaluates the Henyey-Greenstein phase function (per
+// steradian), where cosTheta is the cosine of the angle between the
+// directions before and after scattering.
+func henyeyGreenstein(cosTheta, g float64) float64 {
+	denom := 1 + g*g - 2*g*cosTheta
+	return (1 - g*g) / (4 * math.Pi * denom * math.Sqrt(denom))
+}
+
+// sampleHenyeyGreenstein samples a new direction for a ray travelling in
+// direction dir that scatters in a medium with asymmetry g. Positive g
+// favours forward scattering, and negative g favours back scattering. The
+// sampling probability density is exactly the phase function, so no weight
+// is needed.
+func sampleHenyeyGreenstein(dir xmath.Vector, g float64, rng *rand.Rand) xmath.Vector {
+	var cosTheta float64
+	u := rng.Float64()
+	if math.Abs(g) < 1e-3 {
+		cosTheta = 1 - 2*u
+	} else {
+		sq := (1 - g*g) / (1 + g - 2*g*u)
+		cosTheta = (1 + g*g - sq*sq) / (2 * g)
+	}
+	cosTheta = clamp(cosTheta, -1, 1)
+	sinTheta := math.Sqrt(1 - cosTheta*cosTheta)
+	phi := 2 * math.Pi * rng.Float64()
+	s, t := orthonormalBasis(dir)
+	return s.Scale(sinTheta * math.Cos(phi)).
+		Add(t.Scale(sinTheta * math.Sin(phi))).
+		Add(dir.Scale(cosTheta)).
+		Unit()
+}
+
+// mediumAt finds the medium containing a point. Media bounded by objects
+// don't nest, so the point is inside a bounded medium if a ray from the point
+// crosses that medium's boundary an odd number of times. Otherwise, it's in
+// the outside medium.
+func mediumAt(p xmath.Vector, objs []object, outside medium) medium {
+	var boundaries []object
+	for _, o := range objs {
+		if o.Material.Medium != nil {
+			boundaries = append(boundaries, o)
+		}
+	}
+	accel := newListAccelerationStructure(boundaries)
+
+	crossings := make(map[medium]int)
+	r := xmath.Ray{Start: p, Dir: xmath.Vect(0.36, 0.48, 0.8)}
+	for i := 0; i < 1000; i++ {
+		x, mat, hit := accel.closestHit(r)
+		if !hit {
+			break
+		}
+		crossings[mat.Medium]++
+		r = spawnRay(x, r.Dir)
+	}
+	for m, n := range crossings {
+		if n%2 == 1 {
+			return m
+		}
+	}
+	return outside
+}
@@ -0,0 +1,103 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestMediumDistanceSamplingIsUnbiased(t *testing.T) {
+	m := &homogeneousMedium{
+		Absorption: colour.Colour{R: 0.1, G: 0.5, B: 0},
+		Scattering: colour.Colour{R: 0.4, G: 0.5, B: 2},
+	}
+	const tMax = 1.5
+	rng := rand.New(rand.NewSource(1))
+	n := rayCount()
+
+	// The weights of paths reaching the surface should average to the
+	// transmittance, and the weights of scattering events should average to
+	// the probability of scattering before the surface.
+	var surface, scatter colour.Colour
+	for i := 0; i < n; i++ {
+		dist, weight, scattered := m.sampleDistance(xmath.Ray{}, tMax, rng)
+		if scattered {
+			if dist >= tMax {
+				t.Fatalf("scattered beyond surface: %v", dist)
+			}
+			scatter = scatter.Add(weight)
+		} else {
+			surface = surface.Add(weight)
+		}
+	}
+	surface = surface.Scale(1 / float64(n))
+	scatter = scatter.Scale(1 / float64(n))
+
+	sigmaT := m.extinction()
+	for _, ch := range []struct {
+		name                          string
+		sigmaS, sigmaT, surface, scat float64
+	}{
+		{"R", m.Scattering.R, sigmaT.R, surface.R, scatter.R},
+		{"G", m.Scattering.G, sigmaT.G, surface.G, scatter.G},
+		{"B", m.Scattering.B, sigmaT.B, surface.B, scatter.B},
+	} {
+		tr := math.Exp(-ch.sigmaT * tMax)
+		if math.Abs(ch.surface-tr) > 0.02 {
+			t.Errorf("%s: want transmittance %v, got %v", ch.name, tr, ch.surface)
+		}
+		wantScat := ch.sigmaS / ch.sigmaT * (1 - tr)
+		if math.Abs(ch.scat-wantScat) > 0.02 {
+			t.Errorf("%s: want scattering %v, got %v", ch.name, wantScat, ch.scat)
+		}
+	}
+}
+
+func TestHenyeyGreensteinMeanCosine(t *testing.T) {
+	dir := xmath.Vect(1, 2, 3).Unit()
+	for _, g := range []float64{-0.8, -0.3, 0, 0.5, 0.9} {
+		rng := rand.New(rand.NewSource(1))
+		n := rayCount()
+		var sum float64
+		for i := 0; i < n; i++ {
+			sum += sampleHenyeyGreenstein(dir, g, rng).Dot(dir)
+		}
+		if mean := sum / float64(n); math.Abs(mean-g) > 0.02 {
+			t.Errorf("g=%v: mean cosine is %v", g, mean)
+		}
+	}
+}
+
+func TestMediumAt(t *testing.T) {
+	fog := &homogeneousMedium{Scattering: colour.Colour{R: 1, G: 1, B: 1}}
+	smoke := &homogeneousMedium{Absorption: colour.Colour{R: 1, G: 1, B: 1}}
+	var objs []object
+	for _, s := range []surface{
+		&alignXSquare{0, 0, 1, 0, 1},
+		&alignXSquare{1, 0, 1, 0, 1},
+		&alignYSquare{0, 1, 0, 0, 1},
+		&alignYSquare{0, 1, 1, 0, 1},
+		&alignZSquare{0, 1, 0, 1, 0},
+		&alignZSquare{0, 1, 0, 1, 1},
+	} {
+		objs = append(objs, object{Surface: s, Material: material{Medium: smoke}})
+	}
+	objs = append(objs, object{Surface: &sphere{Center: xmath.Vect(5, 0, 0), Radius: 1}})
+
+	for _, tc := range []struct {
+		p    xmath.Vector
+		want medium
+	}{
+		{xmath.Vect(0.5, 0.5, 0.5), smoke},
+		{xmath.Vect(0.1, 0.9, 0.2), smoke},
+		{xmath.Vect(-1, 0.5, 0.5), fog},
+		{xmath.Vect(5, 0, 0), fog},
+	} {
+		if got := mediumAt(tc.p, objs, fog); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.p, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/peterstace/grayt/colour"
+)
+
+// Parameters for Metropolis light transport.
+const (
+	mltBootstrapSamples = 1 << 16
+	mltLargeStepProb    = 0.3
+	mltSigma            = 0.01 // Standard deviation of small mutations.
+)
+
+// metropolis renders using primary sample space Metropolis light transport
+// (Kelemen et al. 2002). Paths are traced by tracePath as usual, except that
+// the random numbers it consumes come from a Markov chain rather than being
+// independent. Each step of the chain mutates the random numbers, either
+// slightly (to explore paths near the current one, which is what makes hard
+// to find paths such as light through a keyhole cheap once found), or by
+// replacing them entirely. Chains visit paths in proportion to their
+// luminance, so each step splats its path onto the pixel it went through
+// divided by its luminance, and scaled by the image's mean luminance (which
+// is estimated up front).
+//
+// Each step splats once, so a pass is as many steps as there are pixels.
+// Chains are kept between passes, so that they aren't restarted too often.
+type metropolis struct {
+	accel accelerationStructure
+	scene *builtScene
+	accum *accumulator
+
+	// The mean luminance of the image, and the cumulative luminance of the
+	// bootstrap paths (used to choose where new chains start). Bootstrap
+	// path i is traced using random numbers seeded with seed+i.
+	b    float64
+	cdf  []float64
+	seed int64
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	idle []*mltChain
+}
+
+// newMetropolis estimates the mean luminance of the image, by tracing
+// independent paths.
+func newMetropolis(accel accelerationStructure, scn *builtScene, accum *accumulator, seed int64) *metropolis {
+	m := &metropolis{
+		accel: accel,
+		scene: scn,
+		accum: accum,
+		cdf:   make([]float64, mltBootstrapSamples),
+		seed:  seed,
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+	var sum float64
+	for i := range m.cdf {
+		s := newMLTSampler(seed + int64(i))
+		_, _, _, f := m.evaluate(newTracer(accel, scn, rand.New(s)))
+		sum += f
+		m.cdf[i] = sum
+	}
+	m.b = sum / mltBootstrapSamples
+	return m
+}
+
+// mltChain is a Markov chain over the random numbers used to trace paths.
+type mltChain struct {
+	m       *metropolis
+	sampler *mltSampler
+	tracer  *tracer
+
+	// The path at the current state of the chain.
+	pxX, pxY int
+	c        colour.Colour
+	f        float64
+}
+
+// acquire gives a chain that's not in use, starting a new one if needed. It
+// gives nil if nothing in the scene is visible.
+func (m *metropolis) acquire() *mltChain {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.idle); n > 0 {
+		ch := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		return ch
+	}
+	if m.b == 0 {
+		return nil
+	}
+
+	// Start from a bootstrap path chosen in proportion to its luminance, so
+	// that the chain is already distributed the way it would be after
+	// running for a long time. The bootstrap path is traced again by
+	// replaying its random numbers.
+	total := m.cdf[len(m.cdf)-1]
+	i := sort.SearchFloat64s(m.cdf, m.rng.Float64()*total)
+	for i < len(m.cdf)-1 && m.cdf[i] == 0 {
+		i++
+	}
+	s := newMLTSampler(m.seed + int64(i))
+	ch := &mltChain{m: m, sampler: s, tracer: newTracer(m.accel, m.scene, rand.New(s))}
+	ch.pxX, ch.pxY, ch.c, ch.f = m.evaluate(ch.tracer)
+
+	// Chains starting from the same path must still mutate differently.
+	s.rng.Seed(m.rng.Int63())
+	return ch
+}
+
+// release returns a chain acquired from acquire, so that it can be continued
+// later.
+func (m *metropolis) release(ch *mltChain) {
+	m.mu.Lock()
+	m.idle = append(m.idle, ch)
+	m.mu.Unlock()
+}
+
+// evaluate traces a path using a tracer's random numbers. It gives the pixel
+// the path goes through, its colour (in linear RGB), and its luminance.
+func (m *metropolis) evaluate(tr *tracer) (int, int, colour.Colour, float64) {
+	wide, high := m.accum.dim.Wide, m.accum.dim.High
+	fx := tr.rng.Float64() * float64(wide)
+	fy := tr.rng.Float64() * float64(high)
+	pxX, pxY := int(fx), int(fy)
+	pxPitch := 2.0 / float64(wide)
+	x := (float64(pxX-wide/2) + fx - float64(pxX)) * pxPitch
+	y := (float64(pxY-high/2) + fy - float64(pxY)) * pxPitch * -1.0
+	cr := m.scene.cam.makeRay(x, y, tr.rng)
+	cr.Dir = cr.Dir.Unit()
+
+	var c colour.Colour
+	if m.scene.spectral {
+		c = tr.traceSpectral(cr).ToLinearSRGB()
+	} else {
+		c = tr.tracePath(cr)
+	}
+	// Spectral colours can be out of gamut, giving negative luminance.
+	return pxX, pxY, c, math.Abs(c.Luminance())
+}
+
+// step mutates the chain's random numbers, and splats the proposed and
+// current paths weighted by the probability of accepting the proposal
+// (rather than just splatting the path the chain ends up at, which would be
+// noisier).
+func (ch *mltChain) step() {
+	s := ch.sampler
+	s.startIteration()
+	pxX, pxY, c, f := ch.m.evaluate(ch.tracer)
+	accept := math.Min(1, f/ch.f)
+	if accept > 0 {
+		ch.m.accum.splat(pxX, pxY, c.Scale(accept*ch.m.b/f))
+	}
+	if accept < 1 {
+		ch.m.accum.splat(ch.pxX, ch.pxY, ch.c.Scale((1-accept)*ch.m.b/ch.f))
+	}
+	if s.rng.Float64() < accept {
+		ch.pxX, ch.pxY, ch.c, ch.f = pxX, pxY, c, f
+		s.accept()
+	} else {
+		s.reject()
+	}
+}
+
+// mltSampler is a source of random numbers for tracing paths, where the
+// numbers are a point in primary sample space that's mutated at each
+// iteration. It's used as the source for a rand.Rand, so that tracers don't
+// need to know about it. Numbers are mutated lazily (when they're next used),
+// since paths use different amounts of them.
+type mltSampler struct {
+	rng *rand.Rand // For mutations.
+
+	samples       []primarySample
+	next          int // Index of the next number to give out.
+	iteration     int
+	largeStep     bool
+	lastLargeStep int
+}
+
+type primarySample struct {
+	value        float64
+	lastModified int // The iteration that the value was last mutated.
+
+	// The value and lastModified from before the current iteration, in case
+	// the mutation is rejected.
+	backup             float64
+	lastModifiedBackup int
+}
+
+// newMLTSampler creates a sampler whose first iteration gives independent
+// random numbers determined by seed.
+func newMLTSampler(seed int64) *mltSampler {
+	return &mltSampler{
+		rng:       rand.New(rand.NewSource(seed)),
+		largeStep: true,
+	}
+}
+
+// Int63 gives the next number, as required by rand.Source. Numbers in [0, 1)
+// are mapped to integers so that rand.Rand's Float64 gives them back (to 53
+// bits of precision).
+func (s *mltSampler) Int63() int64 {
+	if s.next == len(s.samples) {
+		// Numbers that haven't been used before are as if they were chosen
+		// at the last large step.
+		s.samples = append(s.samples, primarySample{
+			value:        s.rng.Float64(),
+			lastModified: s.lastLargeStep,
+		})
+	}
+	x := &s.samples[s.next]
+	s.next++
+
+	// Catch up on the mutations missed since the number was last used.
+	if x.lastModified < s.lastLargeStep {
+		x.value = s.rng.Float64()
+		x.lastModified = s.lastLargeStep
+	}
+	x.backup, x.lastModifiedBackup = x.value, x.lastModified
+	if s.largeStep {
+		x.value = s.rng.Float64()
+	} else {
+		// Consecutive small mutations add up to a single (wider) one.
+		n := float64(s.iteration - x.lastModified)
+		x.value += s.rng.NormFloat64() * mltSigma * math.Sqrt(n)
+		x.value -= math.Floor(x.value)
+		if x.value >= 1 {
+			x.value = 0 // Wrapping a tiny negative value can round up.
+		}
+	}
+	x.lastModified = s.iteration
+	return int64(x.value*(1<<53)) << 10
+}
+
+// Seed is required by rand.Source, but the sampler can't be reseeded.
+func (s *mltSampler) Seed(int64) {
+	panic("mltSampler can't be reseeded")
+}
+
+// startIteration starts a mutation of all of the numbers.
+func (s *mltSampler) startIteration() {
+	s.iteration++
+	s.largeStep = s.rng.Float64() < mltLargeStepProb
+	s.next = 0
+}
+
+func (s *mltSampler) accept() {
+	if s.largeStep {
+		s.lastLargeStep = s.iteration
+	}
+}
+
+// reject restores the numbers to how they were before the current iteration.
+func (s *mltSampler) reject() {
+	for i := range s.samples {
+		x := &s.samples[i]
+		if x.lastModified == s.iteration {
+			x.value, x.lastModified = x.backup, x.lastModifiedBackup
+		}
+	}
+	s.iteration--
+}
@@ -0,0 +1,139 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestMLTSamplerReplaysAndRejects(t *testing.T) {
+	draw := func(rng *rand.Rand) [8]float64 {
+		var u [8]float64
+		for i := range u {
+			u[i] = rng.Float64()
+		}
+		return u
+	}
+
+	// Samplers with the same seed give the same numbers at first, and the
+	// numbers are in [0, 1).
+	s := newMLTSampler(3)
+	rng := rand.New(s)
+	first := draw(rng)
+	var values []float64
+	for _, x := range s.samples {
+		values = append(values, x.value)
+	}
+	if replay := draw(rand.New(newMLTSampler(3))); replay != first {
+		t.Fatalf("want %v, got %v on replay", first, replay)
+	}
+	for _, u := range first {
+		if u < 0 || u >= 1 {
+			t.Fatalf("out of range: %v", u)
+		}
+	}
+
+	// Rejected mutations are undone, and small mutations don't change the
+	// numbers by much.
+	for i := 0; i < 100; i++ {
+		s.startIteration()
+		mutated := draw(rng)
+		if !s.largeStep {
+			for j := range mutated {
+				d := math.Abs(mutated[j] - first[j])
+				if d := math.Min(d, 1-d); d > 0.1 {
+					t.Errorf("small step moved %v to %v", first[j], mutated[j])
+				}
+			}
+		}
+		s.reject()
+		for j, x := range s.samples {
+			if x.value != values[j] {
+				t.Fatalf("value %d not restored: want %v, got %v", j, values[j], x.value)
+			}
+		}
+	}
+}
+
+func TestMetropolisMatchesPathTracing(t *testing.T) {
+	// A floor lit through a small hole in a ceiling, with an emitter above
+	// it. Each quadrant of the image is compared.
+	white := colour.Colour{R: 1, G: 1, B: 1}
+	objs := []object{
+		{Surface: &alignYSquare{X1: -2, X2: 2, Y: 0, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &alignYSquare{X1: -2, X2: -0.2, Y: 1, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &alignYSquare{X1: 0.2, X2: 2, Y: 1, Z1: -2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &alignYSquare{X1: -0.2, X2: 0.2, Y: 1, Z1: -2, Z2: -0.2}, Material: material{Colour: white}},
+		{Surface: &alignYSquare{X1: -0.2, X2: 0.2, Y: 1, Z1: 0.2, Z2: 2}, Material: material{Colour: white}},
+		{Surface: &alignYSquare{X1: -1, X2: 1, Y: 1.5, Z1: -1, Z2: 1}, Material: material{Colour: white, Emittance: 5}},
+	}
+	for i := range objs {
+		objs[i].ObjID = i
+		objs[i].PrimID = i
+	}
+	scn := &builtScene{
+		cam: newCamera(scene.Camera{
+			Location:             xmath.Vect(0, 0.8, 1.5),
+			LookingAt:            xmath.Vect(0, 0, 0),
+			UpDirection:          xmath.Vect(0, 1, 0),
+			FieldOfViewInRadians: 1.2,
+			FocalLength:          1,
+			FocalRatio:           math.MaxFloat64,
+		}),
+		objs:     objs,
+		emitters: newLightBVH(objs),
+	}
+	accel := newListAccelerationStructure(objs)
+
+	const size = 8
+	dim := xmath.Dimensions{Wide: size, High: size}
+	passes := rayCount() / (size * size)
+	if passes < 1<<12 {
+		passes = 1 << 12 // Metropolis needs more samples, since they're correlated.
+	}
+	var quadrants [2][2][2]float64
+	for i, mlt := range []bool{false, true} {
+		rng := rand.New(rand.NewSource(1))
+		tr := newTracer(accel, scn, rng)
+		accum := newAccumulator(dim)
+		var chains []*mltChain
+		if mlt {
+			m := newMetropolis(accel, scn, accum, 1)
+			for j := 0; j < 16; j++ {
+				chains = append(chains, m.acquire())
+			}
+		}
+		for p := 0; p < passes; p++ {
+			for pxY := 0; pxY < size; pxY++ {
+				for pxX := 0; pxX < size; pxX++ {
+					if mlt {
+						chains[(pxX+pxY*size)%len(chains)].step()
+						continue
+					}
+					x := (float64(pxX-size/2) + rng.Float64()) * 2 / size
+					y := (float64(pxY-size/2) + rng.Float64()) * -2 / size
+					r := scn.cam.makeRay(x, y, rng)
+					r.Dir = r.Dir.Unit()
+					accum.set(pxX, pxY, tr.tracePath(r))
+				}
+			}
+			accum.merge(1)
+		}
+		for j, c := range accum.aggregate {
+			q := &quadrants[i][j%size/(size/2)][j/size/(size/2)]
+			*q += (c.R + c.G + c.B) / float64(passes)
+		}
+	}
+	for qx := 0; qx < 2; qx++ {
+		for qy := 0; qy < 2; qy++ {
+			want, got := quadrants[0][qx][qy], quadrants[1][qx][qy]
+			if want == 0 || math.Abs(got-want) > 0.1*want {
+				t.Errorf("quadrant (%d, %d): path tracing gave %v, metropolis gave %v", qx, qy, want, got)
+			}
+		}
+	}
+}
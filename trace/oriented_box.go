@@ -0,0 +1,146 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// orientedBox is a box that may be arbitrarily rotated. Its faces are
+// perpendicular to the orthonormal Axes, and are HalfExtents away from
+// Center along each axis.
+type orientedBox struct {
+	Center      xmath.Vector    `json:"center"`
+	Axes        [3]xmath.Vector `json:"axes"`
+	HalfExtents [3]float64      `json:"half_extents"`
+}
+
+func newOrientedBox(center, halfExtents xmath.Vector) *orientedBox {
+	return &orientedBox{
+		Center:      center,
+		Axes:        [3]xmath.Vector{xmath.Vect(1, 0, 0), xmath.Vect(0, 1, 0), xmath.Vect(0, 0, 1)},
+		HalfExtents: [3]float64{halfExtents.X, halfExtents.Y, halfExtents.Z},
+	}
+}
+
+func (b *orientedBox) String() string {
+	return fmt.Sprintf("Type=orientedBox C=%v Axes=%v E=%v", b.Center, b.Axes, b.HalfExtents)
+}
+
+// Faces are numbered 2*i and 2*i+1 for the faces on the negative and positive
+// sides of axis i.
+func faceAxis(face int) (int, float64) {
+	if face%2 == 0 {
+		return face / 2, -1
+	}
+	return face / 2, +1
+}
+
+func (b *orientedBox) intersect(r xmath.Ray) (intersection, bool) {
+	tNear, tFar, faceNear, faceFar, ok := b.slabs(r)
+	if !ok || tFar <= 0 {
+		return intersection{}, false
+	}
+	if tNear > 0 {
+		return b.faceHit(r, tNear, faceNear), true
+	}
+	return b.faceHit(r, tFar, faceFar), true
+}
+
+// slabs clips the ray against each pair of opposing faces (in the box's local
+// space). The result is the interval along the ray that's inside the box, and
+// the faces at each end of the interval.
+func (b *orientedBox) slabs(r xmath.Ray) (tNear, tFar float64, faceNear, faceFar int, ok bool) {
+	rel := r.Start.Sub(b.Center)
+	tNear, tFar = math.Inf(-1), math.Inf(+1)
+	for i, axis := range b.Axes {
+		o, d := rel.Dot(axis), r.Dir.Dot(axis)
+		t1 := (-b.HalfExtents[i] - o) / d
+		t2 := (+b.HalfExtents[i] - o) / d
+		f1, f2 := 2*i, 2*i+1
+		if t1 > t2 {
+			t1, t2 = t2, t1
+			f1, f2 = f2, f1
+		}
+
+		// When the ray is parallel to the slab and starts exactly on one
+		// of its faces, t1 or t2 is NaN and the slab is ignored.
+		if t1 > tNear {
+			tNear, faceNear = t1, f1
+		}
+		if t2 < tFar {
+			tFar, faceFar = t2, f2
+		}
+	}
+	return tNear, tFar, faceNear, faceFar, tNear <= tFar
+}
+
+func (b *orientedBox) faceHit(r xmath.Ray, t float64, face int) intersection {
+	// Snap the hit point onto the face in local space, then transform back.
+	rel := r.At(t).Sub(b.Center)
+	axis, sign := faceAxis(face)
+	var local [3]float64
+	for i := range b.Axes {
+		local[i] = rel.Dot(b.Axes[i])
+	}
+	local[axis] = sign * b.HalfExtents[axis]
+
+	p := b.Center
+	pErr := b.Center.Abs()
+	for i := range b.Axes {
+		offset := b.Axes[i].Scale(local[i])
+		p = p.Add(offset)
+		pErr = pErr.Add(offset.Abs())
+	}
+	return intersection{
+		unitNormal: b.Axes[axis].Scale(sign),
+		distance:   t,
+		point:      p,
+		pointErr:   pErr.Scale(gamma(8)),
+		part:       face,
+	}
+}
+
+// parameterise maps each face to the unit square. For a face perpendicular to
+// axis i, U is along axis i+1 and V is along axis i+2 (mod 3).
+func (b *orientedBox) parameterise(x *intersection) {
+	axis, _ := faceAxis(x.part)
+	j, k := (axis+1)%3, (axis+2)%3
+	rel := x.point.Sub(b.Center)
+	x.u = (rel.Dot(b.Axes[j]) + b.HalfExtents[j]) / (2 * b.HalfExtents[j])
+	x.v = (rel.Dot(b.Axes[k]) + b.HalfExtents[k]) / (2 * b.HalfExtents[k])
+	x.dpdu = b.Axes[j].Scale(2 * b.HalfExtents[j])
+	x.dpdv = b.Axes[k].Scale(2 * b.HalfExtents[k])
+}
+
+func (b *orientedBox) bound() (xmath.Vector, xmath.Vector) {
+	var off xmath.Vector
+	for i, axis := range b.Axes {
+		off = off.Add(axis.Abs().Scale(b.HalfExtents[i]))
+	}
+	return b.Center.Sub(off).AddULPs(-ulpFudgeFactor), b.Center.Add(off).AddULPs(ulpFudgeFactor)
+}
+
+func (b *orientedBox) translate(v xmath.Vector) {
+	b.Center = b.Center.Add(v)
+}
+
+func (b *orientedBox) rotate(v xmath.Vector, rads float64) {
+	b.Center = b.Center.Rotate(v, rads)
+	b.spin(v, rads)
+}
+
+// spin rotates the box about its own center.
+func (b *orientedBox) spin(v xmath.Vector, rads float64) {
+	for i := range b.Axes {
+		b.Axes[i] = b.Axes[i].Rotate(v, rads)
+	}
+}
+
+func (b *orientedBox) scale(f float64) {
+	b.Center = b.Center.Scale(f)
+	for i := range b.HalfExtents {
+		b.HalfExtents[i] *= f
+	}
+}
@@ -0,0 +1,112 @@
+package trace
+
+import (
+	"fmt"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// parallelogram has corners at Corner, Corner+EdgeU, Corner+EdgeU+EdgeV and
+// Corner+EdgeV. The U and V texture coordinates run along EdgeU and EdgeV.
+type parallelogram struct {
+	Corner xmath.Vector `json:"corner"`
+	EdgeU  xmath.Vector `json:"edge_u"`
+	EdgeV  xmath.Vector `json:"edge_v"`
+
+	// Derived from the edges. W is the plane normal divided by its squared
+	// length, which allows the UV coordinates of a point in the plane to be
+	// found using a pair of dot products.
+	UnitNorm xmath.Vector `json:"unit_norm"`
+	W        xmath.Vector `json:"w"`
+}
+
+func newParallelogram(corner, edgeU, edgeV xmath.Vector) *parallelogram {
+	p := &parallelogram{Corner: corner, EdgeU: edgeU, EdgeV: edgeV}
+	p.updateDerived()
+	return p
+}
+
+func (p *parallelogram) updateDerived() {
+	n := p.EdgeU.Cross(p.EdgeV)
+	p.UnitNorm = n.Unit()
+	p.W = n.Scale(1 / n.LengthSq())
+}
+
+func (p *parallelogram) String() string {
+	return fmt.Sprintf("Type=parallelogram Corner=%v U=%v V=%v", p.Corner, p.EdgeU, p.EdgeV)
+}
+
+func (p *parallelogram) intersect(r xmath.Ray) (intersection, bool) {
+	denom := p.UnitNorm.Dot(r.Dir)
+	if denom == 0 {
+		return intersection{}, false
+	}
+	t := p.UnitNorm.Dot(p.Corner.Sub(r.Start)) / denom
+	if !(t > 0) {
+		return intersection{}, false
+	}
+	rel := r.At(t).Sub(p.Corner)
+	u := p.W.Dot(rel.Cross(p.EdgeV))
+	v := p.W.Dot(p.EdgeU.Cross(rel))
+	if u < 0 || u > 1 || v < 0 || v > 1 {
+		return intersection{}, false
+	}
+
+	// Reproject onto the plane using the UV coordinates.
+	su, sv := p.EdgeU.Scale(u), p.EdgeV.Scale(v)
+	return intersection{
+		unitNormal: p.UnitNorm,
+		distance:   t,
+		point:      p.Corner.Add(su).Add(sv),
+		pointErr:   p.Corner.Abs().Add(su.Abs()).Add(sv.Abs()).Scale(gamma(6)),
+		u:          u,
+		v:          v,
+	}, true
+}
+
+func (p *parallelogram) parameterise(x *intersection) {
+	x.dpdu = p.EdgeU
+	x.dpdv = p.EdgeV
+}
+
+func (p *parallelogram) area() float64 {
+	return p.EdgeU.Cross(p.EdgeV).Length()
+}
+
+// sample maps a pair of uniform random numbers in [0, 1) to a point on the
+// parallelogram, uniformly distributed by area (i.e. with PDF 1/area). The
+// mapping is continuous, so well stratified inputs give well stratified
+// points.
+func (p *parallelogram) sample(u, v float64) (xmath.Vector, xmath.Vector) {
+	return p.Corner.Add(p.EdgeU.Scale(u)).Add(p.EdgeV.Scale(v)), p.UnitNorm
+}
+
+func (p *parallelogram) bound() (xmath.Vector, xmath.Vector) {
+	min, max := p.Corner, p.Corner
+	for _, c := range []xmath.Vector{
+		p.Corner.Add(p.EdgeU),
+		p.Corner.Add(p.EdgeV),
+		p.Corner.Add(p.EdgeU).Add(p.EdgeV),
+	} {
+		min, max = min.Min(c), max.Max(c)
+	}
+	return min.AddULPs(-ulpFudgeFactor), max.AddULPs(ulpFudgeFactor)
+}
+
+func (p *parallelogram) translate(v xmath.Vector) {
+	p.Corner = p.Corner.Add(v)
+}
+
+func (p *parallelogram) rotate(v xmath.Vector, rads float64) {
+	p.Corner = p.Corner.Rotate(v, rads)
+	p.EdgeU = p.EdgeU.Rotate(v, rads)
+	p.EdgeV = p.EdgeV.Rotate(v, rads)
+	p.updateDerived()
+}
+
+func (p *parallelogram) scale(f float64) {
+	p.Corner = p.Corner.Scale(f)
+	p.EdgeU = p.EdgeU.Scale(f)
+	p.EdgeV = p.EdgeV.Scale(f)
+	p.updateDerived()
+}
@@ -0,0 +1,259 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// cone is a cone (truncated if both radii are non-zero) that is closed off by
+// discs at each end. Capped cylinders are cones with equal radii.
+type cone struct {
+	C1 xmath.Vector `json:"c_1"` // endpoint 1
+	C2 xmath.Vector `json:"c_2"` // endpoint 2
+	R1 float64      `json:"r_1"` // radius at endpoint 1
+	R2 float64      `json:"r_2"` // radius at endpoint 2
+}
+
+const (
+	conePartSide = iota
+	conePartCap1
+	conePartCap2
+)
+
+func (c *cone) String() string {
+	return fmt.Sprintf("Type=cone c1=%v c2=%v r1=%v r2=%v", c.C1, c.C2, c.R1, c.R2)
+}
+
+func (c *cone) intersect(r xmath.Ray) (intersection, bool) {
+	h := c.C2.Sub(c.C1).Unit()
+	closest, hit := c.intersectSide(r, h)
+	for _, cap := range []struct {
+		center xmath.Vector
+		norm   xmath.Vector
+		radius float64
+		part   int
+	}{
+		{c.C1, h.Scale(-1), c.R1, conePartCap1},
+		{c.C2, h, c.R2, conePartCap2},
+	} {
+		if cap.radius == 0 {
+			continue
+		}
+		x, ok := discHit(r, cap.center, cap.norm, cap.radius*cap.radius)
+		if ok && (!hit || x.distance < closest.distance) {
+			x.part = cap.part
+			closest, hit = x, true
+		}
+	}
+	return closest, hit
+}
+
+func (c *cone) intersectSide(r xmath.Ray, h xmath.Vector) (intersection, bool) {
+	// The radius at distance s along the axis is R1 + k*s. Points on the
+	// surface satisfy |q|^2 - s^2 = (R1 + k*s)^2, where q is relative to C1.
+	length := c.C2.Sub(c.C1).Length()
+	k := (c.R2 - c.R1) / length
+	e := r.Start.Sub(c.C1)
+	dh, eh := r.Dir.Dot(h), e.Dot(h)
+	rad := c.R1 + k*eh
+	x1, x2 := solveQuadraticEqn(
+		r.Dir.LengthSq()-dh*dh*(1+k*k),
+		2*(e.Dot(r.Dir)-eh*dh-k*dh*rad),
+		e.LengthSq()-eh*eh-rad*rad,
+	)
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	for _, x := range [...]float64{x1, x2} {
+		if !(x > 0) {
+			continue
+		}
+		q := r.At(x).Sub(c.C1)
+		s := q.Dot(h)
+		if s < 0 || s > length {
+			continue
+		}
+		rs := c.R1 + k*s
+		radial := q.Sub(h.Scale(s))
+		if rs <= 0 || radial.LengthSq() == 0 {
+			continue
+		}
+
+		// Reproject onto the surface.
+		radial = radial.Unit()
+		p := c.C1.Add(h.Scale(s)).Add(radial.Scale(rs))
+		pErr := p.Abs().Add(c.C1.Abs()).Add(h.Scale(length).Abs()).Scale(gamma(8))
+
+		// The quadratic's constant term has error proportional to |q|^2,
+		// rather than to the distance from the surface. Rays leaving the
+		// surface need to start far enough away that the sign of the
+		// constant term is unambiguous. The implicit function's gradient
+		// has magnitude 2*rs*sqrt(1+k^2).
+		slack := gamma(8) * (q.LengthSq() + s*s + rs*rs) / (rs * math.Sqrt(1+k*k))
+		pErr = pErr.Add(xmath.Vect(slack, slack, slack))
+
+		return intersection{
+			unitNormal: radial.Sub(h.Scale(k)).Unit(),
+			distance:   x,
+			point:      p,
+			pointErr:   pErr,
+			part:       conePartSide,
+		}, true
+	}
+	return intersection{}, false
+}
+
+func (c *cone) parameterise(x *intersection) {
+	axis := c.C2.Sub(c.C1)
+	h := axis.Unit()
+	switch x.part {
+	case conePartCap1:
+		parameteriseDisc(x, c.C1, h.Scale(-1), c.R1)
+	case conePartCap2:
+		parameteriseDisc(x, c.C2, h, c.R2)
+	default:
+		rel := x.point.Sub(c.C1)
+		radial := rel.Rej(h)
+		s, t := orthonormalBasis(h)
+		x.u = (math.Atan2(radial.Dot(t), radial.Dot(s)) + math.Pi) / (2 * math.Pi)
+		x.v = rel.Dot(h) / axis.Length()
+		x.dpdu = t.Scale(radial.Dot(s)).Sub(s.Scale(radial.Dot(t))).Scale(2 * math.Pi)
+		x.dpdv = axis.Add(radial.Unit().Scale(c.R2 - c.R1))
+	}
+}
+
+func (c *cone) bound() (xmath.Vector, xmath.Vector) {
+	h := c.C2.Sub(c.C1).Unit()
+	off1 := discBoundOffset(h, c.R1)
+	off2 := discBoundOffset(h, c.R2)
+	min := c.C1.Sub(off1).Min(c.C2.Sub(off2))
+	max := c.C1.Add(off1).Max(c.C2.Add(off2))
+	return min.AddULPs(-ulpFudgeFactor), max.AddULPs(ulpFudgeFactor)
+}
+
+func (c *cone) translate(v xmath.Vector) {
+	c.C1 = c.C1.Add(v)
+	c.C2 = c.C2.Add(v)
+}
+
+func (c *cone) rotate(v xmath.Vector, rads float64) {
+	c.C1 = c.C1.Rotate(v, rads)
+	c.C2 = c.C2.Rotate(v, rads)
+}
+
+func (c *cone) scale(f float64) {
+	c.C1 = c.C1.Scale(f)
+	c.C2 = c.C2.Scale(f)
+	c.R1 *= f
+	c.R2 *= f
+}
+
+// ellipsoid is a unit sphere that has been scaled along three orthogonal
+// axes by Radii, and then translated to Center.
+type ellipsoid struct {
+	Center xmath.Vector    `json:"center"`
+	Axes   [3]xmath.Vector `json:"axes"` // orthonormal
+	Radii  xmath.Vector    `json:"radii"`
+}
+
+func newEllipsoid(center, radii xmath.Vector) *ellipsoid {
+	return &ellipsoid{
+		Center: center,
+		Axes:   [3]xmath.Vector{xmath.Vect(1, 0, 0), xmath.Vect(0, 1, 0), xmath.Vect(0, 0, 1)},
+		Radii:  radii,
+	}
+}
+
+func (e *ellipsoid) String() string {
+	return fmt.Sprintf("Type=ellipsoid C=%v R=%v", e.Center, e.Radii)
+}
+
+// toLocal maps a world space vector into the space where the ellipsoid is a
+// unit sphere.
+func (e *ellipsoid) toLocal(v xmath.Vector) xmath.Vector {
+	return xmath.Vect(
+		v.Dot(e.Axes[0])/e.Radii.X,
+		v.Dot(e.Axes[1])/e.Radii.Y,
+		v.Dot(e.Axes[2])/e.Radii.Z,
+	)
+}
+
+func (e *ellipsoid) fromLocal(v xmath.Vector) xmath.Vector {
+	return e.Axes[0].Scale(v.X * e.Radii.X).
+		Add(e.Axes[1].Scale(v.Y * e.Radii.Y)).
+		Add(e.Axes[2].Scale(v.Z * e.Radii.Z))
+}
+
+func (e *ellipsoid) intersect(r xmath.Ray) (intersection, bool) {
+	// The mapping to local space is linear, so distances along the ray are
+	// the same in both spaces.
+	o := e.toLocal(r.Start.Sub(e.Center))
+	d := e.toLocal(r.Dir)
+	disc := o.Dot(d)*o.Dot(d) - d.LengthSq()*(o.LengthSq()-1)
+	if disc < 0 {
+		return intersection{}, false
+	}
+	x1, x2 := solveQuadraticEqn(d.LengthSq(), 2*o.Dot(d), o.LengthSq()-1)
+	t := math.Min(x1, x2)
+	if t <= 0 {
+		t = math.Max(x1, x2)
+	}
+	if t <= 0 {
+		return intersection{}, false
+	}
+
+	// Reproject onto the surface in local space. The world space normal is
+	// the gradient of the implicit function |toLocal(p - Center)|^2 - 1.
+	local := o.Add(d.Scale(t)).Unit()
+	rel := e.fromLocal(local)
+	p := e.Center.Add(rel)
+	n := e.Axes[0].Scale(local.X / e.Radii.X).
+		Add(e.Axes[1].Scale(local.Y / e.Radii.Y)).
+		Add(e.Axes[2].Scale(local.Z / e.Radii.Z))
+	return intersection{
+		unitNormal: n.Unit(),
+		distance:   t,
+		point:      p,
+		pointErr:   rel.Abs().Scale(gamma(8)).Add(p.Abs().Scale(gamma(1))),
+	}, true
+}
+
+func (e *ellipsoid) parameterise(x *intersection) {
+	local := e.toLocal(x.point.Sub(e.Center))
+	parameteriseSphere(x, local, local.Length())
+	x.dpdu = e.fromLocal(x.dpdu)
+	x.dpdv = e.fromLocal(x.dpdv)
+}
+
+func (e *ellipsoid) bound() (xmath.Vector, xmath.Vector) {
+	extent := func(i int) float64 {
+		component := func(v xmath.Vector) float64 {
+			return [3]float64{v.X, v.Y, v.Z}[i]
+		}
+		return math.Sqrt(
+			math.Pow(e.Radii.X*component(e.Axes[0]), 2) +
+				math.Pow(e.Radii.Y*component(e.Axes[1]), 2) +
+				math.Pow(e.Radii.Z*component(e.Axes[2]), 2),
+		)
+	}
+	off := xmath.Vect(extent(0), extent(1), extent(2))
+	return e.Center.Sub(off).AddULPs(-ulpFudgeFactor), e.Center.Add(off).AddULPs(ulpFudgeFactor)
+}
+
+func (e *ellipsoid) translate(v xmath.Vector) {
+	e.Center = e.Center.Add(v)
+}
+
+func (e *ellipsoid) rotate(v xmath.Vector, rads float64) {
+	e.Center = e.Center.Rotate(v, rads)
+	for i := range e.Axes {
+		e.Axes[i] = e.Axes[i].Rotate(v, rads)
+	}
+}
+
+func (e *ellipsoid) scale(f float64) {
+	e.Center = e.Center.Scale(f)
+	e.Radii = e.Radii.Scale(f)
+}
@@ -0,0 +1,69 @@
+package trace
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestClosedQuadricsHaveNoLeaks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		surf   surface
+		inside xmath.Vector
+	}{
+		{
+			name:   "cone",
+			surf:   &cone{C1: xmath.Vect(1, 2, 3), C2: xmath.Vect(-1, 4, 2), R1: 1.5},
+			inside: xmath.Vect(0.5, 2.5, 2.75),
+		},
+		{
+			name:   "truncated cone",
+			surf:   &cone{C1: xmath.Vect(0, 0, 0), C2: xmath.Vect(0, 0, 3), R1: 0.5, R2: 2},
+			inside: xmath.Vect(0, 0.1, 1),
+		},
+		{
+			name:   "cylinder",
+			surf:   &cone{C1: xmath.Vect(0, 0, 0), C2: xmath.Vect(1, 1, 1), R1: 0.25, R2: 0.25},
+			inside: xmath.Vect(0.5, 0.5, 0.5),
+		},
+		{
+			name: "ellipsoid",
+			surf: func() surface {
+				e := newEllipsoid(xmath.Vect(1, 2, 3), xmath.Vect(0.5, 2, 1))
+				e.rotate(xmath.Vect(1, 1, 0).Unit(), 0.7)
+				return e
+			}(),
+			inside: xmath.Vect(1, 2, 3).Rotate(xmath.Vect(1, 1, 0).Unit(), 0.7),
+		},
+		{
+			name:   "torus",
+			surf:   &torus{Center: xmath.Vect(1, 2, 3), Axis: xmath.Vect(1, 2, 2).Unit(), Major: 2, Minor: 0.5},
+			inside: xmath.Vect(1, 2, 3).Add(xmath.Vect(2, -1, 0).Unit().Scale(2)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			n := rayCount() / 16
+			for i := 0; i < n; i++ {
+				r := xmath.Ray{Start: tc.inside, Dir: randomUnit(rng)}
+				x, hit := tc.surf.intersect(r)
+				if !hit {
+					t.Fatalf("ray leaked: %v", r)
+				}
+
+				// Head back through the starting point. The ray shouldn't
+				// hit the surface again until it's on the other side.
+				back := spawnRay(x, r.Dir.Scale(-1))
+				x2, hit := tc.surf.intersect(back)
+				if !hit {
+					t.Fatalf("returning ray leaked: %v", back)
+				}
+				if x2.distance < x.distance*(1-1e-6) {
+					t.Fatalf("returning ray hit too early: want>=%v got=%v", x.distance, x2.distance)
+				}
+			}
+		})
+	}
+}
@@ -32,9 +32,41 @@ const (
 	loadError
 )
 
+// Integrator selects the algorithm used to estimate the light arriving at
+// each pixel.
+type Integrator string
+
+const (
+	// PathTracing traces paths from the camera, sampling lights directly at
+	// each bounce.
+	PathTracing Integrator = "path"
+
+	// Bidirectional connects paths traced from the camera and from lights,
+	// which finds caustics (and light through small openings) much sooner.
+	Bidirectional Integrator = "bidirectional"
+
+	// Metropolis explores the paths found by path tracing using Markov
+	// chains, for very hard lighting (such as light through a keyhole).
+	Metropolis Integrator = "metropolis"
+)
+
+// Integrators lists the supported integrators.
+var Integrators = []Integrator{PathTracing, Bidirectional, Metropolis}
+
+// Valid reports whether the integrator is supported.
+func (i Integrator) Valid() bool {
+	for _, s := range Integrators {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
+
 type Instance struct {
 	// Read only variables
 	sceneFn       func() scene.Scene
+	integrator    Integrator
 	accumFilename string
 	dim           xmath.Dimensions
 
@@ -43,7 +75,8 @@ type Instance struct {
 	requestedWorkers int
 	loadState        loadState
 	accel            accelerationStructure
-	cam              camera
+	scene            *builtScene
+	mlt              *metropolis // Only for the Metropolis integrator.
 
 	// Access self controlled
 	accum *accumulator
@@ -54,9 +87,10 @@ type Instance struct {
 	traceRate     int64
 }
 
-func NewInstance(dim xmath.Dimensions, sceneFn func() scene.Scene, filename string) *Instance {
+func NewInstance(dim xmath.Dimensions, sceneFn func() scene.Scene, integrator Integrator, filename string) *Instance {
 	inst := &Instance{
 		sceneFn:       sceneFn,
+		integrator:    integrator,
 		accumFilename: filename,
 		dim:           dim,
 		cond:          sync.NewCond(new(sync.Mutex)),
@@ -75,9 +109,15 @@ func (in *Instance) loadScene() {
 	in.loadState = loading
 	in.cond.L.Unlock()
 
-	cam, objs := buildScene(in.sceneFn())
-	in.cam = cam
-	in.accel = newGrid(4, objs)
+	proto := in.sceneFn()
+	scn, err := buildScene(proto)
+	if err != nil {
+		log.Printf("could not build scene: %v", err)
+		in.setLoadState(loadError)
+		return
+	}
+	in.scene = scn
+	in.accel = newGrid(4, scn.objs)
 
 	in.accum = newAccumulator(in.dim)
 	f, err := os.Open(in.accumFilename)
@@ -85,19 +125,24 @@ func (in *Instance) loadScene() {
 		defer f.Close()
 		if _, err := in.accum.ReadFrom(f); err != nil {
 			log.Printf("could not read from accum state file: %v", err)
-			in.cond.L.Lock()
-			in.loadState = loadError
-			in.cond.Broadcast()
-			in.cond.L.Unlock()
+			in.setLoadState(loadError)
 			return
 		}
 	}
 
+	if in.integrator == Metropolis {
+		in.mlt = newMetropolis(in.accel, scn, in.accum, time.Now().UnixNano())
+	}
+
 	completed := int64(in.accum.dim.High * in.accum.dim.Wide * in.accum.getPasses())
 	atomic.StoreInt64(&in.completed, completed)
 
+	in.setLoadState(loaded)
+}
+
+func (in *Instance) setLoadState(state loadState) {
 	in.cond.L.Lock()
-	in.loadState = loaded
+	in.loadState = state
 	in.cond.Broadcast()
 	in.cond.L.Unlock()
 }
@@ -182,7 +227,15 @@ type workContext struct {
 
 func (in *Instance) work(ctx *workContext) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	tr := newTracer(in.accel, rng)
+	tr := newTracer(in.accel, in.scene, rng)
+	var bd *bidirectional
+	if in.integrator == Bidirectional {
+		bd = newBidirectional(tr, in.scene, in.accum)
+	}
+	var chain *mltChain
+	if in.mlt != nil {
+		chain = in.mlt.acquire()
+	}
 	wide := in.accum.dim.Wide
 	high := in.accum.dim.High
 	pxPitch := 2.0 / float64(wide)
@@ -191,16 +244,33 @@ func (in *Instance) work(ctx *workContext) {
 		if idx >= wide*high {
 			break
 		}
+		if in.mlt != nil {
+			// Each step lands on an arbitrary pixel. Nothing is visible if
+			// there's no chain.
+			if chain != nil {
+				chain.step()
+			}
+			atomic.AddInt64(&in.completed, 1)
+			continue
+		}
 		pxY := idx / wide
 		pxX := idx % wide
 		x := (float64(pxX-wide/2) + rng.Float64()) * pxPitch
 		y := (float64(pxY-high/2) + rng.Float64()) * pxPitch * -1.0
-		cr := in.cam.makeRay(x, y, rng)
+		cr := in.scene.cam.makeRay(x, y, rng)
 		cr.Dir = cr.Dir.Unit()
-		c := tr.tracePath(cr)
-		in.accum.set(pxX, pxY, c)
+		if bd != nil {
+			bd.sample(pxX, pxY, cr)
+		} else if in.scene.spectral {
+			in.accum.setXYZ(pxX, pxY, tr.traceSpectral(cr))
+		} else {
+			in.accum.set(pxX, pxY, tr.tracePath(cr))
+		}
 		atomic.AddInt64(&in.completed, 1)
 	}
+	if chain != nil {
+		in.mlt.release(chain)
+	}
 	ctx.wg.Done()
 }
 
@@ -0,0 +1,108 @@
+package trace
+
+import "math"
+
+// polyRoots finds the real roots of a polynomial that lie within [lo, hi].
+// The coefficients are ordered from the highest degree term to the constant
+// term. The roots are returned in ascending order.
+//
+// Rather than using a closed form solution (which for cubics and quartics is
+// notoriously unstable), the roots are isolated between the critical points
+// of the polynomial (found recursively as the roots of its derivative). The
+// polynomial is monotonic between consecutive critical points, so each of
+// those intervals contains at most one root, which can then be found reliably
+// using a safeguarded Newton iteration. Roots with even multiplicity (where
+// the polynomial touches zero without crossing) may be missed, but those
+// correspond to grazing hits.
+func polyRoots(coeffs []float64, lo, hi float64) []float64 {
+	for len(coeffs) > 0 && coeffs[0] == 0 {
+		coeffs = coeffs[1:]
+	}
+	switch len(coeffs) {
+	case 0, 1:
+		return nil
+	case 2:
+		x := -coeffs[1] / coeffs[0]
+		if x < lo || x > hi {
+			return nil
+		}
+		return []float64{x}
+	case 3:
+		x1, x2 := solveQuadraticEqn(coeffs[0], coeffs[1], coeffs[2])
+		if coeffs[1]*coeffs[1]-4*coeffs[0]*coeffs[2] < 0 {
+			return nil
+		}
+		if x1 > x2 {
+			x1, x2 = x2, x1
+		}
+		var roots []float64
+		for _, x := range [...]float64{x1, x2} {
+			if x >= lo && x <= hi {
+				roots = append(roots, x)
+			}
+		}
+		return roots
+	}
+
+	deriv := make([]float64, len(coeffs)-1)
+	degree := len(coeffs) - 1
+	for i := range deriv {
+		deriv[i] = coeffs[i] * float64(degree-i)
+	}
+	bounds := append([]float64{lo}, polyRoots(deriv, lo, hi)...)
+	bounds = append(bounds, hi)
+
+	var roots []float64
+	for i := 0; i+1 < len(bounds); i++ {
+		a, b := bounds[i], bounds[i+1]
+		fa, fb := polyEval(coeffs, a), polyEval(coeffs, b)
+		switch {
+		case fa == 0:
+			if len(roots) == 0 || roots[len(roots)-1] != a {
+				roots = append(roots, a)
+			}
+		case fb == 0:
+			roots = append(roots, b)
+		case (fa < 0) != (fb < 0):
+			roots = append(roots, bracketedRoot(coeffs, deriv, a, b, fa))
+		}
+	}
+	return roots
+}
+
+// bracketedRoot finds the root of a polynomial within [a, b], given that the
+// polynomial changes sign exactly once in that interval. Newton's method is
+// used when it stays inside the bracket, otherwise the bracket is bisected.
+func bracketedRoot(coeffs, deriv []float64, a, b, fa float64) float64 {
+	x := 0.5 * (a + b)
+	for i := 0; i < 100; i++ {
+		fx := polyEval(coeffs, x)
+		if fx == 0 {
+			return x
+		}
+		if (fx < 0) == (fa < 0) {
+			a, fa = x, fx
+		} else {
+			b = x
+		}
+		if b-a <= 4*machineEpsilon*math.Max(math.Abs(a), math.Abs(b)) {
+			break
+		}
+		next := x - fx/polyEval(deriv, x)
+		if !(next > a && next < b) {
+			next = 0.5 * (a + b)
+		} else if math.Abs(next-x) <= machineEpsilon*math.Abs(x) {
+			return next
+		}
+		x = next
+	}
+	return x
+}
+
+func polyEval(coeffs []float64, x float64) float64 {
+	var sum float64
+	for _, c := range coeffs {
+		sum = sum*x + c
+	}
+	return sum
+}
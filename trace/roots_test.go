@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestPolyRoots(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		// Construct a polynomial from known roots.
+		want := make([]float64, 1+rng.Intn(4))
+		for j := range want {
+			want[j] = rng.NormFloat64() * 10
+		}
+		sort.Float64s(want)
+		coeffs := []float64{1 + rng.Float64()}
+		for _, r := range want {
+			next := make([]float64, len(coeffs)+1)
+			for k, c := range coeffs {
+				next[k] += c
+				next[k+1] -= c * r
+			}
+			coeffs = next
+		}
+
+		// Close roots can't be distinguished.
+		distinct := true
+		for j := 1; j < len(want); j++ {
+			if want[j]-want[j-1] < 1e-3 {
+				distinct = false
+			}
+		}
+		if !distinct {
+			continue
+		}
+
+		got := polyRoots(coeffs, -100, 100)
+		if len(got) != len(want) {
+			t.Fatalf("coeffs=%v: want=%v got=%v", coeffs, want, got)
+		}
+		for j := range got {
+			if math.Abs(got[j]-want[j]) > 1e-8*math.Max(1, math.Abs(want[j])) {
+				t.Fatalf("coeffs=%v: want=%v got=%v", coeffs, want, got)
+			}
+		}
+	}
+}
+
+func TestPolyRootsRange(t *testing.T) {
+	// (x-1)(x-2)(x-3)(x-4)
+	coeffs := []float64{1, -10, 35, -50, 24}
+	got := polyRoots(coeffs, 1.5, 3.5)
+	if len(got) != 2 || math.Abs(got[0]-2) > 1e-12 || math.Abs(got[1]-3) > 1e-12 {
+		t.Errorf("got=%v", got)
+	}
+}
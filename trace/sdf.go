@@ -0,0 +1,162 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/scene/sdf"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// sdfSurface is the surface where a signed distance function is zero, inside
+// of a bounding box. It's intersected using sphere tracing.
+type sdfSurface struct {
+	Func sdf.Func     `json:"-"`
+	Min  xmath.Vector `json:"min"`
+	Max  xmath.Vector `json:"max"`
+
+	// Epsilon is how close to the surface a point must be to count as a hit.
+	// It's also the step size used to estimate normals.
+	Epsilon float64 `json:"epsilon"`
+}
+
+// maxSphereTraceSteps stops rays that graze the surface from taking forever.
+// Those rays are treated as misses.
+const maxSphereTraceSteps = 1000
+
+// defaultSDFEpsilon is relative to the size of the bounding box.
+const defaultSDFEpsilon = 1e-5
+
+func newSDFSurface(f sdf.Func, min, max xmath.Vector, epsilon float64) *sdfSurface {
+	if epsilon == 0 {
+		epsilon = defaultSDFEpsilon * max.Sub(min).Length()
+	}
+	return &sdfSurface{Func: f, Min: min, Max: max, Epsilon: epsilon}
+}
+
+func (s *sdfSurface) String() string {
+	return fmt.Sprintf("Type=sdf Min=%v Max=%v Eps=%v", s.Min, s.Max, s.Epsilon)
+}
+
+func (s *sdfSurface) intersect(r xmath.Ray) (intersection, bool) {
+	tNear, tFar, ok := rayBoxInterval(r, s.Min, s.Max)
+	if !ok || tFar <= 0 {
+		return intersection{}, false
+	}
+
+	// The distance function is in world units, but t is in units of the ray
+	// direction's length. Rays that start inside of the solid (e.g. refracted
+	// into it) march on the magnitude of the distance until they reach the
+	// surface from the inside. A ray starting on the surface doesn't hit it
+	// until it has moved away.
+	t := math.Max(tNear, 0)
+	invLen := 1 / r.Dir.Length()
+	inside := s.Func(r.At(t)) < 0
+	for i := 0; i < maxSphereTraceSteps && t <= tFar; i++ {
+		d := s.Func(r.At(t))
+		ad := math.Abs(d)
+		if (ad < s.Epsilon && t > 0) || (d < 0) != inside {
+			return s.hit(r, t), true
+		}
+		t += math.Max(ad, s.Epsilon) * invLen
+	}
+	return intersection{}, false
+}
+
+func (s *sdfSurface) hit(r xmath.Ray, t float64) intersection {
+	p := r.At(t)
+	n := s.gradient(p)
+	if n.LengthSq() == 0 {
+		n = r.Dir.Scale(-1)
+	}
+
+	// The hit point could be up to Epsilon away from the surface. Rays leaving
+	// the surface need to start far enough away that they're not immediately
+	// considered to be hits again.
+	e := 4 * s.Epsilon
+	return intersection{
+		unitNormal: n.Unit(),
+		distance:   t,
+		point:      p,
+		pointErr:   rayHitError(r, t).Add(xmath.Vect(e, e, e)),
+	}
+}
+
+// gradient is estimated using central differences at the vertices of a
+// tetrahedron (which only needs 4 evaluations of the distance function).
+func (s *sdfSurface) gradient(p xmath.Vector) xmath.Vector {
+	var g xmath.Vector
+	for _, k := range [...]xmath.Vector{
+		xmath.Vect(+1, -1, -1),
+		xmath.Vect(-1, -1, +1),
+		xmath.Vect(-1, +1, -1),
+		xmath.Vect(+1, +1, +1),
+	} {
+		g = g.Add(k.Scale(s.Func(p.Add(k.Scale(s.Epsilon)))))
+	}
+	return g
+}
+
+// parameterise doesn't give meaningful UVs, since distance functions don't
+// have a natural parameterisation. Object space textures should be used
+// instead.
+func (s *sdfSurface) parameterise(x *intersection) {
+	x.dpdu, x.dpdv = orthonormalBasis(x.unitNormal)
+}
+
+func (s *sdfSurface) bound() (xmath.Vector, xmath.Vector) {
+	return s.Min.AddULPs(-ulpFudgeFactor), s.Max.AddULPs(ulpFudgeFactor)
+}
+
+func (s *sdfSurface) translate(v xmath.Vector) {
+	f := s.Func
+	s.Func = func(p xmath.Vector) float64 {
+		return f(p.Sub(v))
+	}
+	s.Min = s.Min.Add(v)
+	s.Max = s.Max.Add(v)
+}
+
+func (s *sdfSurface) rotate(v xmath.Vector, rads float64) {
+	f := s.Func
+	s.Func = func(p xmath.Vector) float64 {
+		return f(p.Rotate(v, -rads))
+	}
+	min, max := s.Min, s.Max
+	s.Min, s.Max = xmath.Vect(math.Inf(+1), math.Inf(+1), math.Inf(+1)), xmath.Vect(math.Inf(-1), math.Inf(-1), math.Inf(-1))
+	for i := 0; i < 8; i++ {
+		corner := min
+		if i&1 != 0 {
+			corner.X = max.X
+		}
+		if i&2 != 0 {
+			corner.Y = max.Y
+		}
+		if i&4 != 0 {
+			corner.Z = max.Z
+		}
+		corner = corner.Rotate(v, rads)
+		s.Min, s.Max = s.Min.Min(corner), s.Max.Max(corner)
+	}
+}
+
+func (s *sdfSurface) scale(f float64) {
+	fn := s.Func
+	s.Func = func(p xmath.Vector) float64 {
+		return fn(p.Scale(1/f)) * f
+	}
+	s.Min = s.Min.Scale(f)
+	s.Max = s.Max.Scale(f)
+	s.Epsilon *= f
+}
+
+// rayBoxInterval finds the interval along a ray's line that's inside an axis
+// aligned box.
+func rayBoxInterval(r xmath.Ray, min, max xmath.Vector) (float64, float64, bool) {
+	tx1, tx2 := (min.X-r.Start.X)/r.Dir.X, (max.X-r.Start.X)/r.Dir.X
+	ty1, ty2 := (min.Y-r.Start.Y)/r.Dir.Y, (max.Y-r.Start.Y)/r.Dir.Y
+	tz1, tz2 := (min.Z-r.Start.Z)/r.Dir.Z, (max.Z-r.Start.Z)/r.Dir.Z
+	tmin := math.Max(math.Max(math.Min(tx1, tx2), math.Min(ty1, ty2)), math.Min(tz1, tz2))
+	tmax := math.Min(math.Min(math.Max(tx1, tx2), math.Max(ty1, ty2)), math.Max(tz1, tz2))
+	return tmin, tmax, tmin <= tmax
+}
@@ -0,0 +1,87 @@
+package trace
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/scene/sdf"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestSDFMatchesAnalyticSurface(t *testing.T) {
+	center := xmath.Vect(1, 2, 3)
+	const radius = 0.75
+	analytic := &sphere{Center: center, Radius: radius}
+	min, max := analytic.bound()
+	traced := newSDFSurface(sdf.Sphere(center, radius), min, max, 0)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		r := xmath.Ray{
+			Start: center.Add(randomUnit(rng).Scale(2)),
+			Dir:   randomUnit(rng),
+		}
+		want, wantHit := analytic.intersect(r)
+		got, gotHit := traced.intersect(r)
+		if !wantHit {
+			continue // Near misses could be hits or misses.
+		}
+		if !gotHit {
+			// Grazing rays may legitimately run out of steps.
+			if want.unitNormal.Dot(r.Dir) < -0.01 {
+				t.Fatalf("should have hit: %v", r)
+			}
+			continue
+		}
+		// Sphere tracing stops just short of the surface.
+		if d := want.distance - got.distance; d < -1e-9 || d > 2*traced.Epsilon/-want.unitNormal.Dot(r.Dir) {
+			t.Errorf("wrong distance: want=%v got=%v", want.distance, got.distance)
+		}
+		if got.unitNormal.Sub(want.unitNormal).Length() > 1e-3 {
+			t.Errorf("wrong normal: want=%v got=%v", want.unitNormal, got.unitNormal)
+		}
+
+		// Leaving the surface shouldn't hit it again (it's convex).
+		dir := randomUnit(rng)
+		if dir.Dot(got.unitNormal) < 0 {
+			dir = dir.Scale(-1)
+		}
+		if x, hit := traced.intersect(spawnRay(got, dir)); hit {
+			t.Fatalf("spawned ray re-intersected at distance %v", x.distance)
+		}
+	}
+}
+
+func TestSDFRayStartingInside(t *testing.T) {
+	center := xmath.Vect(1, 2, 3)
+	const radius = 0.75
+	analytic := &sphere{Center: center, Radius: radius}
+	min, max := analytic.bound()
+	traced := newSDFSurface(sdf.Sphere(center, radius), min, max, 0)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		r := xmath.Ray{
+			Start: center.Add(randomUnit(rng).Scale(radius * rng.Float64() * 0.9)),
+			Dir:   randomUnit(rng),
+		}
+		want, wantHit := analytic.intersect(r)
+		got, gotHit := traced.intersect(r)
+		if !wantHit || !gotHit {
+			t.Fatalf("should have hit from inside: analytic=%v traced=%v", wantHit, gotHit)
+		}
+		if d := got.distance - want.distance; d < -2*traced.Epsilon/want.unitNormal.Dot(r.Dir) || d > 1e-9 {
+			t.Errorf("wrong distance: want=%v got=%v", want.distance, got.distance)
+		}
+
+		// A ray refracted into the solid starts just inside of the surface,
+		// and should reach the far side rather than hitting immediately.
+		dir := randomUnit(rng)
+		if dir.Dot(got.unitNormal) > 0 {
+			dir = dir.Scale(-1)
+		}
+		if x, hit := traced.intersect(spawnRay(got, dir)); !hit || x.distance < 1e-3 {
+			t.Errorf("ray leaving the surface inwards should hit the far side, got hit=%v distance=%v", hit, x.distance)
+		}
+	}
+}
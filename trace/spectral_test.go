@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestSpectralRenderingPreservesColour(t *testing.T) {
+	for _, c := range []colour.Colour{
+		{R: 1, G: 1, B: 1},
+		{R: 1, G: 0, B: 0},
+		{R: 0.2, G: 0.6, B: 0.9},
+		{R: 0.5, G: 0.5, B: 0},
+	} {
+		// The camera is inside of a sphere that emits the colour.
+		objs := []object{{
+			Surface:  &sphere{Center: xmath.Vect(0, 0, 0), Radius: 1},
+			Material: material{Colour: c, Emittance: 1},
+		}}
+		rng := rand.New(rand.NewSource(1))
+		tr := newTracer(newListAccelerationStructure(objs), &builtScene{spectral: true}, rng)
+
+		// Paths are trivial, so it's cheap to use plenty of samples (even
+		// for short tests).
+		var sum colour.XYZ
+		const n = 1 << 18
+		for i := 0; i < n; i++ {
+			sum = sum.Add(tr.traceSpectral(xmath.Ray{Dir: randomUnit(rng)}))
+		}
+		got := sum.Scale(1 / float64(n)).ToLinearSRGB()
+		if math.Abs(got.R-c.R) > 0.02 || math.Abs(got.G-c.G) > 0.02 || math.Abs(got.B-c.B) > 0.02 {
+			t.Errorf("rendered %v as %v", c, got)
+		}
+	}
+}
+
+func TestSampleWavelengths(t *testing.T) {
+	for _, u := range []float64{0, 0.1, 0.5, 0.9, 0.999} {
+		lambdas := sampleWavelengths(u)
+		for i, l := range lambdas {
+			if l < colour.MinWavelength || l >= colour.MaxWavelength {
+				t.Errorf("u=%v: wavelength %d out of range: %v", u, i, l)
+			}
+		}
+		if lambdas[0] != colour.MinWavelength+u*(colour.MaxWavelength-colour.MinWavelength) {
+			t.Errorf("u=%v: wrong hero wavelength: %v", u, lambdas[0])
+		}
+	}
+}
+
+func TestSpectralMediaConvertedOncePerPath(t *testing.T) {
+	med := &homogeneousMedium{Absorption: colour.Colour{0.1, 0.2, 0.3}, Scattering: colour.Colour{1, 1, 1}}
+	tr := newTracer(newListAccelerationStructure(nil), &builtScene{spectral: true}, rand.New(rand.NewSource(1)))
+	tr.setWavelengths(sampleWavelengths(0.2))
+	first := tr.mediumFor(med)
+	if tr.mediumFor(med) != first {
+		t.Errorf("medium converted again on the same path")
+	}
+	tr.setWavelengths(sampleWavelengths(0.7))
+	second := tr.mediumFor(med).(*homogeneousMedium)
+	if second == first {
+		t.Fatalf("medium not converted for the new wavelengths")
+	}
+	if want := tr.spectrum(med.Absorption); second.Absorption != want {
+		t.Errorf("want absorption %v, got %v", want, second.Absorption)
+	}
+}
+
+func TestDielectricIOR(t *testing.T) {
+	bk7 := &dielectric{
+		SellmeierB: &[3]float64{1.03961212, 0.231792344, 1.01046945},
+		SellmeierC: &[3]float64{0.00600069867, 0.0200179144, 103.560653},
+	}
+	if n := bk7.iorAt(referenceWavelength); math.Abs(n-1.5168) > 1e-4 {
+		t.Errorf("BK7 IOR is %v", n)
+	}
+	if bk7.iorAt(450) <= bk7.iorAt(650) {
+		t.Error("expected normal dispersion")
+	}
+	cauchy := &dielectric{Cauchy: &[2]float64{1.5, 0.004}}
+	if n := cauchy.iorAt(500); math.Abs(n-1.516) > 1e-12 {
+		t.Errorf("Cauchy IOR is %v", n)
+	}
+	if n := (&dielectric{IOR: 1.33}).iorAt(400); n != 1.33 {
+		t.Errorf("constant IOR is %v", n)
+	}
+}
+
+func TestScatterDielectric(t *testing.T) {
+	n := xmath.Vect(0, 0, 1)
+	rng := rand.New(rand.NewSource(1))
+
+	// At normal incidence, the reflectance of glass is 4%.
+	var reflected int
+	count := rayCount()
+	for i := 0; i < count; i++ {
+		if scatterDielectric(xmath.Vect(0, 0, -1), n, 1.5, rng).Z > 0 {
+			reflected++
+		}
+	}
+	if f := float64(reflected) / float64(count); math.Abs(f-0.04) > 0.005 {
+		t.Errorf("reflectance at normal incidence is %v", f)
+	}
+
+	// Refracted rays obey Snell's law, and rays going into a less dense
+	// medium past the critical angle are totally internally reflected.
+	dir := xmath.Vect(math.Sin(0.5), 0, -math.Cos(0.5))
+	for i := 0; i < 100; i++ {
+		out := scatterDielectric(dir, n, 1.5, rng)
+		if out.Z < 0 && math.Abs(out.X*1.5-dir.X) > 1e-12 {
+			t.Fatalf("refraction doesn't obey Snell's law: %v", out)
+		}
+		steep := xmath.Vect(math.Sin(1), 0, -math.Cos(1))
+		if out := scatterDielectric(steep, n, 1/1.5, rng); out.Z < 0 {
+			t.Fatalf("expected total internal reflection: %v", out)
+		}
+	}
+}
+
+func TestBlackbody(t *testing.T) {
+	var last colour.Colour
+	for i, k := range []float64{1900, 2700, 4000, 6500, 10000} {
+		c := colour.Blackbody(k)
+		if l := c.Luminance(); math.Abs(l-1) > 0.01 {
+			t.Errorf("%vK: luminance is %v", k, l)
+		}
+		if i > 0 && c.B/c.R <= last.B/last.R {
+			t.Errorf("%vK isn't bluer than the previous temperature: %v vs %v", k, c, last)
+		}
+		last = c
+	}
+
+	// The white point is close to a 5500K blackbody.
+	if c := colour.Blackbody(5500); math.Abs(c.R-1) > 0.06 || math.Abs(c.G-1) > 0.06 || math.Abs(c.B-1) > 0.06 {
+		t.Errorf("5500K isn't close to white: %v", c)
+	}
+}
+
+func TestSpectralBlackbodyMatchesRGB(t *testing.T) {
+	const kelvin = 3200
+	want := colour.Blackbody(kelvin)
+	objs := []object{{
+		Surface: &sphere{Center: xmath.Vect(0, 0, 0), Radius: 1},
+		Material: material{
+			EmissionColour: &want,
+			Spectrum:       colour.BlackbodySpectrum(kelvin),
+			Emittance:      1,
+		},
+	}}
+	rng := rand.New(rand.NewSource(1))
+	tr := newTracer(newListAccelerationStructure(objs), &builtScene{spectral: true}, rng)
+
+	var sum colour.XYZ
+	const n = 1 << 18
+	for i := 0; i < n; i++ {
+		sum = sum.Add(tr.traceSpectral(xmath.Ray{Dir: randomUnit(rng)}))
+	}
+	got := sum.Scale(1 / float64(n)).ToLinearSRGB()
+	if math.Abs(got.R-want.R) > 0.02 || math.Abs(got.G-want.G) > 0.02 || math.Abs(got.B-want.B) > 0.02 {
+		t.Errorf("rendered %vK as %v, want %v", kelvin, got, want)
+	}
+}
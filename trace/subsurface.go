@@ -0,0 +1,60 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// maxWalkSteps limits the length of subsurface random walks. Walks in media
+// with a high albedo and a short mean free path can be very long, but
+// contribute little once they're deep inside of the object.
+const maxWalkSteps = 256
+
+// randomWalk simulates light entering an object with subsurface scattering
+// at an intersection (where the normal faces the side the light came from).
+// The light enters through a diffuse interface, and then scatters
+// isotropically inside the object until it reaches the surface again. It
+// then leaves through another diffuse interface. The returned ray is the
+// light leaving the object, weighted by the fraction of light that survived
+// the walk. The walk fails if the light is absorbed.
+func randomWalk(accel accelerationStructure, x intersection, interior medium, rng *rand.Rand) (xmath.Ray, colour.Colour, bool) {
+	r := spawnRay(x, cosineHemisphere(x.unitNormal.Scale(-1), rng))
+	weight := colour.Colour{1, 1, 1}
+	for i := 0; i < maxWalkSteps; i++ {
+		exit, _, hit := accel.closestHit(r)
+		if !hit {
+			// The object isn't closed.
+			return xmath.Ray{}, colour.Colour{}, false
+		}
+		dist, w, scattered := interior.sampleDistance(r, exit.distance, rng)
+		weight = weight.Mul(w)
+		if weight == (colour.Colour{}) {
+			return xmath.Ray{}, colour.Colour{}, false
+		}
+		if !scattered {
+			out := exit.unitNormal
+			if out.Dot(r.Dir) < 0 {
+				out = out.Scale(-1)
+			}
+			return spawnRay(exit, cosineHemisphere(out, rng)), weight, true
+		}
+		r = xmath.Ray{Start: r.At(dist), Dir: sampleHenyeyGreenstein(r.Dir, 0, rng)}
+	}
+	return xmath.Ray{}, colour.Colour{}, false
+}
+
+// cosineHemisphere samples a direction on the hemisphere around a unit
+// normal, with probability density proportional to the cosine of the angle
+// to the normal.
+func cosineHemisphere(n xmath.Vector, rng *rand.Rand) xmath.Vector {
+	r := math.Sqrt(rng.Float64())
+	phi := 2 * math.Pi * rng.Float64()
+	s, t := orthonormalBasis(n)
+	return s.Scale(r * math.Cos(phi)).
+		Add(t.Scale(r * math.Sin(phi))).
+		Add(n.Scale(math.Sqrt(math.Max(0, 1-r*r)))).
+		Unit()
+}
@@ -0,0 +1,54 @@
+package trace
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestRandomWalk(t *testing.T) {
+	sph := &sphere{Center: xmath.Vect(0, 0, 0), Radius: 1}
+	accel := newListAccelerationStructure([]object{{Surface: sph}})
+	entry := object{Surface: sph}
+	x, _ := sph.intersect(xmath.Ray{Start: xmath.Vect(0, 0, 5), Dir: xmath.Vect(0, 0, -1)})
+	x = entry.complete(x)
+
+	for _, tc := range []struct {
+		name       string
+		albedo     float64
+		minSurvive float64
+		maxSurvive float64
+	}{
+		{"lossless", 1, 0.97, 1.0},
+		{"absorbing", 0.5, 0.05, 0.4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			interior := &homogeneousMedium{
+				Absorption: colour.Colour{R: 1, G: 1, B: 1}.Scale(10 * (1 - tc.albedo)),
+				Scattering: colour.Colour{R: 1, G: 1, B: 1}.Scale(10 * tc.albedo),
+			}
+			rng := rand.New(rand.NewSource(1))
+			n := rayCount() / 64
+			var survived float64
+			for i := 0; i < n; i++ {
+				exit, weight, ok := randomWalk(accel, x, interior, rng)
+				if !ok {
+					continue
+				}
+				survived += weight.R
+				if d := exit.Start.Length(); math.Abs(d-1) > 1e-6 {
+					t.Fatalf("walk exited away from the surface: %v", exit.Start)
+				}
+				if exit.Dir.Dot(exit.Start) <= 0 {
+					t.Fatalf("walk exited going inwards: %v", exit)
+				}
+			}
+			if s := survived / float64(n); s < tc.minSurvive || s > tc.maxSurvive {
+				t.Errorf("fraction surviving is %v, want between %v and %v", s, tc.minSurvive, tc.maxSurvive)
+			}
+		})
+	}
+}
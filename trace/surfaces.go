@@ -8,25 +8,55 @@ import (
 	"github.com/peterstace/grayt/xmath"
 )
 
+// ulpFudgeFactor pads bounding boxes and grid cell boundaries, so that
+// rounding errors can't cause the grid to miss an object that straddles a
+// cell boundary. Self-intersection is handled separately (see
+// offsetRayOrigin).
 const ulpFudgeFactor = 50
 
 type surface interface {
 	intersect(r xmath.Ray) (intersection, bool)
+
+	// parameterise fills in the surface parameterisation of an intersection
+	// found by intersect. It's only called for the closest hit along a ray,
+	// so that the (sometimes expensive) calculation isn't wasted on hits that
+	// end up being discarded.
+	parameterise(*intersection)
+
 	bound() (xmath.Vector, xmath.Vector)
 	translate(xmath.Vector)
 	rotate(xmath.Vector, float64)
 	scale(float64)
 }
 
-type material struct {
-	Colour    colour.Colour `json:"colour"`
-	Emittance float64       `json:"emittance"`
-	Mirror    bool          `json:"mirror"`
-}
-
 type object struct {
 	Surface  surface  `json:"surface"`
 	Material material `json:"material"`
+	ObjID    int      `json:"obj_id"`  // Index of the scene object.
+	PrimID   int      `json:"prim_id"` // Unique for each surface.
+
+	// Optional colours for each palette index (see intersection), which
+	// replace the material's colour.
+	Palette *[256]colour.Colour `json:"-"`
+}
+
+// complete finishes off an intersection with the object once it's known to be
+// the closest hit.
+func (o *object) complete(x intersection) intersection {
+	x.shadingNormal = x.unitNormal
+	x.objID = o.ObjID
+	x.primID = o.PrimID
+	o.Surface.parameterise(&x)
+	return x
+}
+
+// materialAt gives the object's material at an intersection.
+func (o *object) materialAt(x intersection) material {
+	m := o.Material
+	if o.Palette != nil {
+		m.Colour = o.Palette[x.paletteIndex]
+	}
+	return m
 }
 
 func (o object) String() string {
@@ -34,103 +64,241 @@ func (o object) String() string {
 }
 
 type intersection struct {
-	unitNormal xmath.Vector
+	unitNormal xmath.Vector // Geometric normal.
 	distance   float64
+
+	// The hit location, and a conservative bound on its absolute error.
+	point    xmath.Vector
+	pointErr xmath.Vector
+
+	// Which part of a composite surface was hit (e.g. the side or an end cap
+	// of a cone). Set by intersect, for use by parameterise.
+	part int
+
+	// The palette index of the material that was hit, for surfaces made of
+	// more than one (e.g. voxels). Set by intersect.
+	paletteIndex int
+
+	// Populated by parameterise. The partial derivatives of the hit point
+	// with respect to u and v give the tangent frame.
+	u, v          float64
+	dpdu, dpdv    xmath.Vector
+	shadingNormal xmath.Vector
+	objID         int
+	primID        int
 }
 
 type triangle struct {
-	A        xmath.Vector `json:"a"` // Corner A
-	U        xmath.Vector `json:"u"` // A to B
-	V        xmath.Vector `json:"v"` // A to C
+	A        xmath.Vector `json:"a"`
+	B        xmath.Vector `json:"b"`
+	C        xmath.Vector `json:"c"`
 	UnitNorm xmath.Vector `json:"unit_norm"`
-	// Precomputed dot products:
-	DotUV float64 `json:"dot_uv"`
-	DotUU float64 `json:"dot_uu"`
-	DotVV float64 `json:"dot_vv"`
+
+	// Optional unit normals at A, B, and C, which are interpolated to give
+	// the shading normal.
+	VertexNorms *[3]xmath.Vector `json:"vertex_norms"`
 }
 
 func (t *triangle) String() string {
-	return fmt.Sprintf("Type=triangle A=%v B=%v C=%v", t.A, t.A.Add(t.U), t.A.Add(t.V))
+	return fmt.Sprintf("Type=triangle A=%v B=%v C=%v", t.A, t.B, t.C)
 }
 
 func newTriangle(a, b, c xmath.Vector) *triangle {
-	u := b.Sub(a)
-	v := c.Sub(a)
 	return &triangle{
 		A:        a,
-		U:        u,
-		V:        v,
-		UnitNorm: u.Cross(v).Unit(),
-		DotUV:    u.Dot(v),
-		DotUU:    u.Dot(u),
-		DotVV:    v.Dot(v),
+		B:        b,
+		C:        c,
+		UnitNorm: b.Sub(a).Cross(c.Sub(a)).Unit(),
 	}
 }
 
+// intersect uses the watertight ray/triangle intersection algorithm described
+// by Woop, Benthin and Wald. The triangle is transformed into a coordinate
+// system where the ray starts at the origin and points along +Z, and the hit
+// test is then a 2D point-in-triangle test using edge functions. Each edge
+// function only depends on the two vertices of its edge, so rays can't slip
+// between triangles that share an edge.
 func (t *triangle) intersect(r xmath.Ray) (intersection, bool) {
-	// Check if there's a hit with the plane.
-	h := t.UnitNorm.Dot(t.A.Sub(r.Start)) / t.UnitNorm.Dot(r.Dir)
-	if h <= 0 {
-		// Hit was behind the camera.
+	x, hit := intersectTriangle(r, t.A, t.B, t.C)
+	x.unitNormal = t.UnitNorm
+	return x, hit
+}
+
+// intersectTriangle intersects a ray with the triangle with vertices a, b,
+// and c, without needing a triangle to be allocated. The unit normal of the
+// intersection isn't set.
+func intersectTriangle(r xmath.Ray, a, b, c xmath.Vector) (intersection, bool) {
+
+	// Translate the vertices so that the ray starts at the origin.
+	p0 := a.Sub(r.Start)
+	p1 := b.Sub(r.Start)
+	p2 := c.Sub(r.Start)
+
+	// Permute the components so that Z is the dimension where the ray
+	// direction is the largest in magnitude.
+	kx, ky, kz := permutation(r.Dir)
+	d := permute(r.Dir, kx, ky, kz)
+	p0 = permute(p0, kx, ky, kz)
+	p1 = permute(p1, kx, ky, kz)
+	p2 = permute(p2, kx, ky, kz)
+
+	// Shear so that the ray direction points along +Z. Only the X and Y
+	// components are needed for the edge functions, so the shear of the Z
+	// component is deferred until we know there's a hit.
+	sx := -d.X / d.Z
+	sy := -d.Y / d.Z
+	sz := 1.0 / d.Z
+	p0.X += sx * p0.Z
+	p0.Y += sy * p0.Z
+	p1.X += sx * p1.Z
+	p1.Y += sy * p1.Z
+	p2.X += sx * p2.Z
+	p2.Y += sy * p2.Z
+
+	// Evaluate the edge functions. They're computed with enough precision
+	// that their signs are always correct, even for rays that pass exactly
+	// through an edge or vertex.
+	e0 := differenceOfProducts(p1.X, p2.Y, p1.Y, p2.X)
+	e1 := differenceOfProducts(p2.X, p0.Y, p2.Y, p0.X)
+	e2 := differenceOfProducts(p0.X, p1.Y, p0.Y, p1.X)
+	if (e0 < 0 || e1 < 0 || e2 < 0) && (e0 > 0 || e1 > 0 || e2 > 0) {
+		return intersection{}, false
+	}
+	det := e0 + e1 + e2
+	if det == 0 {
 		return intersection{}, false
 	}
 
-	// Find out if the plane hit was inside the triangle. We need to solve the
-	// equation w = alpha*u + beta*v for alpha and beta (where alpha and beta
-	// are scalars, and u and v are vectors from a to b and a to c, and w is a
-	// vector from a to the hit point).
-	//
-	// If the sum of alpha and beta is less than 1 and both alpha and beta are
-	// positive, then the hit is inside the triangle.
-	//
-	// alpha = [(u.v)(w.v) - (v.v)(w.u)] / [(u.v)^2 - (u.u)(v.v)]
-	// beta  = [(u.v)(w.u) - (u.u)(w.v)] / [(u.v)^2 - (u.u)(v.v)]
-
-	w := r.At(h).Sub(t.A)
-	dotWV := w.Dot(t.V)
-	dotWU := w.Dot(t.U)
-	alpha := t.DotUV*dotWV - t.DotVV*dotWU
-	beta := t.DotUV*dotWU - t.DotUU*dotWV
-	denom := t.DotUV*t.DotUV - t.DotUU*t.DotVV
-	alpha /= denom
-	beta /= denom
-
-	if alpha < 0 || beta < 0 || alpha+beta > 1 {
+	// Calculate the scaled hit distance, and make sure that it's in front of
+	// the ray start before paying for the division.
+	p0.Z *= sz
+	p1.Z *= sz
+	p2.Z *= sz
+	tScaled := e0*p0.Z + e1*p1.Z + e2*p2.Z
+	if det < 0 && tScaled >= 0 || det > 0 && tScaled <= 0 {
 		return intersection{}, false
 	}
+	invDet := 1 / det
+	b0 := e0 * invDet
+	b1 := e1 * invDet
+	b2 := e2 * invDet
+	dist := tScaled * invDet
+
+	// Make sure that the hit distance is conservatively greater than zero.
+	maxZ := math.Max(math.Abs(p0.Z), math.Max(math.Abs(p1.Z), math.Abs(p2.Z)))
+	maxX := math.Max(math.Abs(p0.X), math.Max(math.Abs(p1.X), math.Abs(p2.X)))
+	maxY := math.Max(math.Abs(p0.Y), math.Max(math.Abs(p1.Y), math.Abs(p2.Y)))
+	maxE := math.Max(math.Abs(e0), math.Max(math.Abs(e1), math.Abs(e2)))
+	deltaZ := gamma(3) * maxZ
+	deltaX := gamma(5) * (maxX + maxZ)
+	deltaY := gamma(5) * (maxY + maxZ)
+	deltaE := 2 * (gamma(2)*maxX*maxY + deltaY*maxX + deltaX*maxY)
+	deltaT := 3 * (gamma(3)*maxE*maxZ + deltaE*maxZ + deltaZ*maxE) * math.Abs(invDet)
+	if dist <= deltaT {
+		return intersection{}, false
+	}
+
+	// Interpolating the vertices gives a much more accurate hit point than
+	// r.At(dist) would.
+	pa := a.Scale(b0)
+	pb := b.Scale(b1)
+	pc := c.Scale(b2)
 	return intersection{
-		unitNormal: t.UnitNorm,
-		distance:   h,
+		distance: dist,
+		point:    pa.Add(pb).Add(pc),
+		pointErr: pa.Abs().Add(pb.Abs()).Add(pc.Abs()).Scale(gamma(7)),
+		u:        b1,
+		v:        b2,
 	}, true
 }
 
+func (t *triangle) parameterise(x *intersection) {
+	// The barycentric coordinates are already set by intersect.
+	x.dpdu = t.B.Sub(t.A)
+	x.dpdv = t.C.Sub(t.A)
+
+	if t.VertexNorms != nil {
+		interpolateNormals(x, *t.VertexNorms, t.UnitNorm)
+	}
+}
+
+// interpolateNormals sets the shading normal of a triangle hit by
+// interpolating the normals at its vertices (using the barycentric
+// coordinates set by intersectTriangle).
+func interpolateNormals(x *intersection, norms [3]xmath.Vector, unitNorm xmath.Vector) {
+	n := norms[0].Scale(1 - x.u - x.v).
+		Add(norms[1].Scale(x.u)).
+		Add(norms[2].Scale(x.v))
+	if n.LengthSq() == 0 {
+		return
+	}
+	n = n.Unit()
+
+	// The vertex normals may disagree with the winding order of the
+	// vertices. The shading normal should always be in the same hemisphere
+	// as the geometric normal (the tracer relies on this when orienting the
+	// normals towards the incoming ray).
+	if n.Dot(unitNorm) < 0 {
+		n = n.Scale(-1)
+	}
+	x.shadingNormal = n
+}
+
+func newSmoothTriangle(a, b, c, na, nb, nc xmath.Vector) *triangle {
+	t := newTriangle(a, b, c)
+	t.VertexNorms = &[3]xmath.Vector{na.Unit(), nb.Unit(), nc.Unit()}
+	return t
+}
+
+// permutation finds the dimensions to use as X, Y, and Z such that Z is the
+// dimension with the largest magnitude.
+func permutation(v xmath.Vector) (int, int, int) {
+	a := v.Abs()
+	kz := 2
+	switch {
+	case a.X > a.Y && a.X > a.Z:
+		kz = 0
+	case a.Y > a.Z:
+		kz = 1
+	}
+	kx := (kz + 1) % 3
+	ky := (kx + 1) % 3
+	return kx, ky, kz
+}
+
+func permute(v xmath.Vector, kx, ky, kz int) xmath.Vector {
+	c := [3]float64{v.X, v.Y, v.Z}
+	return xmath.Vect(c[kx], c[ky], c[kz])
+}
+
 func (t *triangle) bound() (xmath.Vector, xmath.Vector) {
-	b := t.A.Add(t.U)
-	c := t.A.Add(t.V)
-	min := t.A.Min(b.Min(c)).AddULPs(-ulpFudgeFactor)
-	max := t.A.Max(b.Max(c)).AddULPs(+ulpFudgeFactor)
+	min := t.A.Min(t.B.Min(t.C)).AddULPs(-ulpFudgeFactor)
+	max := t.A.Max(t.B.Max(t.C)).AddULPs(+ulpFudgeFactor)
 	return min, max
 }
 
 func (t *triangle) translate(v xmath.Vector) {
-	a := t.A.Add(v)
-	b := t.U.Add(t.A).Add(v)
-	c := t.V.Add(t.A).Add(v)
-	*t = *newTriangle(a, b, c)
+	norms := t.VertexNorms
+	*t = *newTriangle(t.A.Add(v), t.B.Add(v), t.C.Add(v))
+	t.VertexNorms = norms
 }
 
 func (t *triangle) rotate(v xmath.Vector, rads float64) {
-	a := t.A.Rotate(v, rads)
-	b := t.U.Add(t.A).Rotate(v, rads)
-	c := t.V.Add(t.A).Rotate(v, rads)
-	*t = *newTriangle(a, b, c)
+	norms := t.VertexNorms
+	*t = *newTriangle(t.A.Rotate(v, rads), t.B.Rotate(v, rads), t.C.Rotate(v, rads))
+	if norms != nil {
+		t.VertexNorms = &[3]xmath.Vector{
+			norms[0].Rotate(v, rads),
+			norms[1].Rotate(v, rads),
+			norms[2].Rotate(v, rads),
+		}
+	}
 }
 
 func (t *triangle) scale(f float64) {
-	a := t.A.Scale(f)
-	b := t.U.Add(t.A).Scale(f)
-	c := t.V.Add(t.A).Scale(f)
-	*t = *newTriangle(a, b, c)
+	norms := t.VertexNorms
+	*t = *newTriangle(t.A.Scale(f), t.B.Scale(f), t.C.Scale(f))
+	t.VertexNorms = norms
 }
 
 type alignedBox struct {
@@ -223,9 +391,52 @@ func (b *alignedBox) intersect(r xmath.Ray) (intersection, bool) {
 	}
 
 	if tmin > 0 {
-		return intersection{distance: tmin, unitNormal: nMin}, true
+		return b.faceHit(r, tmin, nMin), true
 	} else {
-		return intersection{distance: tmax, unitNormal: nMax}, true
+		return b.faceHit(r, tmax, nMax), true
+	}
+}
+
+func (b *alignedBox) faceHit(r xmath.Ray, t float64, n xmath.Vector) intersection {
+	// Snap the hit point onto the face that was hit, so that there is no
+	// error in the direction of the normal. Negative normals correspond to the
+	// faces at b.Max (see newAlignedBox).
+	p := r.At(t)
+	err := rayHitError(r, t)
+	face := b.Min
+	if n.X+n.Y+n.Z < 0 {
+		face = b.Max
+	}
+	switch {
+	case n.X != 0:
+		p.X, err.X = face.X, 0
+	case n.Y != 0:
+		p.Y, err.Y = face.Y, 0
+	default:
+		p.Z, err.Z = face.Z, 0
+	}
+	return intersection{
+		unitNormal: n,
+		distance:   t,
+		point:      p,
+		pointErr:   err,
+	}
+}
+
+func (b *alignedBox) parameterise(x *intersection) {
+	lo, hi := b.Max.Min(b.Min), b.Max.Max(b.Min)
+	rel := x.point.Sub(lo).Div(hi.Sub(lo))
+	size := hi.Sub(lo)
+	switch n := x.unitNormal; {
+	case n.X != 0:
+		x.u, x.v = rel.Z, rel.Y
+		x.dpdu, x.dpdv = xmath.Vect(0, 0, size.Z), xmath.Vect(0, size.Y, 0)
+	case n.Y != 0:
+		x.u, x.v = rel.X, rel.Z
+		x.dpdu, x.dpdv = xmath.Vect(size.X, 0, 0), xmath.Vect(0, 0, size.Z)
+	default:
+		x.u, x.v = rel.X, rel.Y
+		x.dpdu, x.dpdv = xmath.Vect(size.X, 0, 0), xmath.Vect(0, size.Y, 0)
 	}
 }
 
@@ -287,10 +498,43 @@ func (s *sphere) intersect(r xmath.Ray) (intersection, bool) {
 		t = math.Max(x1, x2)
 	}
 
+	if t <= 0 {
+		return intersection{}, false
+	}
+
+	// Reproject the hit point onto the surface of the sphere to reduce the
+	// error caused by the distance calculation.
+	rel := r.At(t).Sub(s.Center)
+	rel = rel.Scale(s.Radius / rel.Length())
 	return intersection{
-		unitNormal: r.At(t).Sub(s.Center).Unit(),
+		unitNormal: rel.Scale(1 / s.Radius),
 		distance:   t,
-	}, t > 0
+		point:      s.Center.Add(rel),
+		pointErr:   rel.Abs().Scale(gamma(5)).Add(s.Center.Add(rel).Abs().Scale(gamma(1))),
+	}, true
+}
+
+func (s *sphere) parameterise(x *intersection) {
+	parameteriseSphere(x, x.point.Sub(s.Center), s.Radius)
+}
+
+// parameteriseSphere uses spherical coordinates, with V going from the +Y
+// pole to the -Y pole. The rel vector goes from the sphere's center to the
+// hit point.
+func parameteriseSphere(x *intersection, rel xmath.Vector, radius float64) {
+	x.u = (math.Atan2(rel.Z, rel.X) + math.Pi) / (2 * math.Pi)
+	x.v = math.Acos(clamp(rel.Y/radius, -1, 1)) / math.Pi
+
+	// At the poles, the derivatives degenerate. Any direction in the tangent
+	// plane is as good as any other.
+	rho := math.Hypot(rel.X, rel.Z)
+	if rho == 0 {
+		x.dpdu, x.dpdv = orthonormalBasis(rel.Scale(1 / radius))
+		return
+	}
+	cosPhi, sinPhi := rel.X/rho, rel.Z/rho
+	x.dpdu = xmath.Vect(-rel.Z, 0, rel.X).Scale(2 * math.Pi)
+	x.dpdv = xmath.Vect(rel.Y*cosPhi, -rho, rel.Y*sinPhi).Scale(math.Pi)
 }
 
 func (s *sphere) bound() (xmath.Vector, xmath.Vector) {
@@ -328,8 +572,24 @@ func (a *alignXSquare) String() string {
 func (s *alignXSquare) intersect(r xmath.Ray) (intersection, bool) {
 	t := (s.X - r.Start.X) / r.Dir.X
 	hit := r.At(t)
-	return intersection{xmath.Vect(+1, 0, 0), t},
-		t > 0 && hit.Y > s.Y1 && hit.Y < s.Y2 && hit.Z > s.Z1 && hit.Z < s.Z2
+	if !(t > 0 && hit.Y > s.Y1 && hit.Y < s.Y2 && hit.Z > s.Z1 && hit.Z < s.Z2) {
+		return intersection{}, false
+	}
+	err := rayHitError(r, t)
+	hit.X, err.X = s.X, 0
+	return intersection{
+		unitNormal: xmath.Vect(+1, 0, 0),
+		distance:   t,
+		point:      hit,
+		pointErr:   err,
+	}, true
+}
+
+func (s *alignXSquare) parameterise(x *intersection) {
+	x.u = (x.point.Z - s.Z1) / (s.Z2 - s.Z1)
+	x.v = (x.point.Y - s.Y1) / (s.Y2 - s.Y1)
+	x.dpdu = xmath.Vect(0, 0, s.Z2-s.Z1)
+	x.dpdv = xmath.Vect(0, s.Y2-s.Y1, 0)
 }
 
 func (s *alignXSquare) bound() (xmath.Vector, xmath.Vector) {
@@ -372,8 +632,24 @@ func (a *alignYSquare) String() string {
 func (s *alignYSquare) intersect(r xmath.Ray) (intersection, bool) {
 	t := (s.Y - r.Start.Y) / r.Dir.Y
 	hit := r.At(t)
-	return intersection{xmath.Vect(0, +1, 0), t},
-		t > 0 && hit.X > s.X1 && hit.X < s.X2 && hit.Z > s.Z1 && hit.Z < s.Z2
+	if !(t > 0 && hit.X > s.X1 && hit.X < s.X2 && hit.Z > s.Z1 && hit.Z < s.Z2) {
+		return intersection{}, false
+	}
+	err := rayHitError(r, t)
+	hit.Y, err.Y = s.Y, 0
+	return intersection{
+		unitNormal: xmath.Vect(0, +1, 0),
+		distance:   t,
+		point:      hit,
+		pointErr:   err,
+	}, true
+}
+
+func (s *alignYSquare) parameterise(x *intersection) {
+	x.u = (x.point.X - s.X1) / (s.X2 - s.X1)
+	x.v = (x.point.Z - s.Z1) / (s.Z2 - s.Z1)
+	x.dpdu = xmath.Vect(s.X2-s.X1, 0, 0)
+	x.dpdv = xmath.Vect(0, 0, s.Z2-s.Z1)
 }
 
 func (s *alignYSquare) bound() (xmath.Vector, xmath.Vector) {
@@ -416,8 +692,24 @@ func (a *alignZSquare) String() string {
 func (s *alignZSquare) intersect(r xmath.Ray) (intersection, bool) {
 	t := (s.Z - r.Start.Z) / r.Dir.Z
 	hit := r.At(t)
-	return intersection{xmath.Vect(0, 0, +1), t},
-		t > 0 && hit.X > s.X1 && hit.X < s.X2 && hit.Y > s.Y1 && hit.Y < s.Y2
+	if !(t > 0 && hit.X > s.X1 && hit.X < s.X2 && hit.Y > s.Y1 && hit.Y < s.Y2) {
+		return intersection{}, false
+	}
+	err := rayHitError(r, t)
+	hit.Z, err.Z = s.Z, 0
+	return intersection{
+		unitNormal: xmath.Vect(0, 0, +1),
+		distance:   t,
+		point:      hit,
+		pointErr:   err,
+	}, true
+}
+
+func (s *alignZSquare) parameterise(x *intersection) {
+	x.u = (x.point.X - s.X1) / (s.X2 - s.X1)
+	x.v = (x.point.Y - s.Y1) / (s.Y2 - s.Y1)
+	x.dpdu = xmath.Vect(s.X2-s.X1, 0, 0)
+	x.dpdv = xmath.Vect(0, s.Y2-s.Y1, 0)
 }
 
 func (s *alignZSquare) bound() (xmath.Vector, xmath.Vector) {
@@ -451,21 +743,51 @@ type disc struct {
 }
 
 func (d *disc) intersect(r xmath.Ray) (intersection, bool) {
-	h := d.UnitNorm.Dot(d.Center.Sub(r.Start)) / d.UnitNorm.Dot(r.Dir)
+	return discHit(r, d.Center, d.UnitNorm, d.RadiusSq)
+}
+
+// discHit intersects a ray with a disc. It's shared between all surfaces
+// that have discs as (part of) their surface.
+func discHit(r xmath.Ray, center, unitNorm xmath.Vector, radiusSq float64) (intersection, bool) {
+	h := unitNorm.Dot(center.Sub(r.Start)) / unitNorm.Dot(r.Dir)
 	if h <= 0 {
 		// Hit was behind the camera.
 		return intersection{}, false
 	}
 	hitLoc := r.At(h)
-	if hitLoc.Sub(d.Center).LengthSq() > d.RadiusSq {
+	if hitLoc.Sub(center).LengthSq() > radiusSq {
 		return intersection{}, false
 	}
+
+	// Reproject onto the plane of the disc.
+	hitLoc = hitLoc.Sub(unitNorm.Scale(unitNorm.Dot(hitLoc.Sub(center))))
 	return intersection{
-		unitNormal: d.UnitNorm,
+		unitNormal: unitNorm,
 		distance:   h,
+		point:      hitLoc,
+		pointErr:   hitLoc.Abs().Add(center.Abs()).Scale(gamma(6)),
 	}, true
 }
 
+func (d *disc) parameterise(x *intersection) {
+	parameteriseDisc(x, d.Center, d.UnitNorm, math.Sqrt(d.RadiusSq))
+}
+
+// parameteriseDisc uses polar coordinates. U is the angle around the center,
+// and V is the distance from the center.
+func parameteriseDisc(x *intersection, center, unitNorm xmath.Vector, radius float64) {
+	rel := x.point.Sub(center)
+	s, t := orthonormalBasis(unitNorm)
+	x.u = (math.Atan2(rel.Dot(t), rel.Dot(s)) + math.Pi) / (2 * math.Pi)
+	x.v = rel.Length() / radius
+	x.dpdu = t.Scale(rel.Dot(s)).Sub(s.Scale(rel.Dot(t))).Scale(2 * math.Pi)
+	if x.v == 0 {
+		x.dpdv = s.Scale(radius)
+	} else {
+		x.dpdv = rel.Scale(1 / x.v)
+	}
+}
+
 func (d *disc) bound() (xmath.Vector, xmath.Vector) {
 	n := d.UnitNorm
 	offset := discBoundOffset(n, math.Sqrt(d.RadiusSq))
@@ -524,14 +846,32 @@ func (p *pipe) intersect(r xmath.Ray) (intersection, bool) {
 		if s < 0 || s*s > p.C2.Sub(p.C1).LengthSq() {
 			continue
 		}
+
+		// Reproject onto the surface of the pipe.
+		rej := hitAt.Sub(p.C1).Rej(h)
+		rej = rej.Scale(p.R / rej.Length())
+		hitAt = p.C1.Add(h.Scale(s)).Add(rej)
 		return intersection{
-			unitNormal: hitAt.Sub(p.C1).Rej(h).Unit(),
+			unitNormal: rej.Scale(1 / p.R),
 			distance:   x,
+			point:      hitAt,
+			pointErr:   hitAt.Abs().Add(p.C1.Abs()).Scale(gamma(7)),
 		}, true
 	}
 	return intersection{}, false
 }
 
+func (p *pipe) parameterise(x *intersection) {
+	axis := p.C2.Sub(p.C1)
+	h := axis.Unit()
+	rel := x.point.Sub(p.C1)
+	s, t := orthonormalBasis(h)
+	x.u = (math.Atan2(rel.Dot(t), rel.Dot(s)) + math.Pi) / (2 * math.Pi)
+	x.v = rel.Dot(h) / axis.Length()
+	x.dpdu = t.Scale(rel.Dot(s)).Sub(s.Scale(rel.Dot(t))).Scale(2 * math.Pi)
+	x.dpdv = axis
+}
+
 func (p *pipe) bound() (xmath.Vector, xmath.Vector) {
 	h := p.C2.Sub(p.C1).Unit()
 	offset := discBoundOffset(h, p.R)
@@ -565,3 +905,19 @@ func solveQuadraticEqn(a, b, c float64) (float64, float64) {
 	q := -0.5 * (b + signOfB*math.Sqrt(disc))
 	return q / a, c / q
 }
+
+// orthonormalBasis finds two unit vectors that are perpendicular to each
+// other and to unit vector n. It uses the branchless method from "Building an
+// Orthonormal Basis, Revisited" (Duff et al.).
+func orthonormalBasis(n xmath.Vector) (xmath.Vector, xmath.Vector) {
+	sign := math.Copysign(1, n.Z)
+	a := -1 / (sign + n.Z)
+	b := n.X * n.Y * a
+	s := xmath.Vect(1+sign*n.X*n.X*a, sign*b, -sign*n.X)
+	t := xmath.Vect(b, sign+n.Y*n.Y*a, -n.Y)
+	return s, t
+}
+
+func clamp(f, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, f))
+}
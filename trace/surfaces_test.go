@@ -1,8 +1,11 @@
 package trace
 
 import (
+	"math"
+	"math/rand"
 	"testing"
 
+	"github.com/peterstace/grayt/scene"
 	"github.com/peterstace/grayt/xmath"
 )
 
@@ -41,3 +44,387 @@ func BenchmarkTriangleIntersect(b *testing.B) {
 		t.intersect(r)
 	}
 }
+
+var meshCenter = xmath.Vect(0.3, -1.7, 2.9)
+
+// closedMesh creates a closed convex triangle mesh approximating an
+// ellipsoid by repeatedly subdividing an octahedron. The mesh is placed away
+// from the origin so that the vertex coordinates aren't nicely representable.
+func closedMesh(subdivisions int) []*triangle {
+	project := func(v xmath.Vector) xmath.Vector {
+		return v.Unit().Mul(xmath.Vect(1.1, 0.7, 1.3)).Add(meshCenter)
+	}
+
+	type face [3]xmath.Vector
+	faces := []face{}
+	for _, sx := range []float64{-1, 1} {
+		for _, sy := range []float64{-1, 1} {
+			for _, sz := range []float64{-1, 1} {
+				f := face{xmath.Vect(sx, 0, 0), xmath.Vect(0, sy, 0), xmath.Vect(0, 0, sz)}
+				if sx*sy*sz < 0 {
+					f[1], f[2] = f[2], f[1]
+				}
+				faces = append(faces, f)
+			}
+		}
+	}
+	for i := 0; i < subdivisions; i++ {
+		var next []face
+		for _, f := range faces {
+			ab := f[0].Add(f[1]).Unit()
+			bc := f[1].Add(f[2]).Unit()
+			ca := f[2].Add(f[0]).Unit()
+			next = append(next,
+				face{f[0], ab, ca},
+				face{ab, f[1], bc},
+				face{ca, bc, f[2]},
+				face{ab, bc, ca},
+			)
+		}
+		faces = next
+	}
+
+	var tris []*triangle
+	for _, f := range faces {
+		tris = append(tris, newTriangle(project(f[0]), project(f[1]), project(f[2])))
+	}
+	return tris
+}
+
+func rayCount() int {
+	if testing.Short() {
+		return 1 << 14
+	}
+	return 1 << 21
+}
+
+func randomUnit(rng *rand.Rand) xmath.Vector {
+	return xmath.Vect(rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()).Unit()
+}
+
+func TestTriangleWatertightAtEdgesAndVertices(t *testing.T) {
+	tris := closedMesh(2)
+
+	// Find the triangles adjacent to each vertex. Every edge's endpoints are
+	// both vertices, so aiming at points along the edge between two vertices
+	// only needs to consider triangles adjacent to either vertex.
+	adjacent := map[xmath.Vector][]*triangle{}
+	type edge struct{ a, b xmath.Vector }
+	var edges []edge
+	for _, tri := range tris {
+		for _, v := range []xmath.Vector{tri.A, tri.B, tri.C} {
+			adjacent[v] = append(adjacent[v], tri)
+		}
+		edges = append(edges, edge{tri.A, tri.B}, edge{tri.B, tri.C}, edge{tri.C, tri.A})
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	n := rayCount()
+	for i := 0; i < n; i++ {
+		e := edges[rng.Intn(len(edges))]
+		var target xmath.Vector
+		if i%8 == 0 {
+			target = e.a
+		} else {
+			f := rng.Float64()
+			target = e.a.Scale(1 - f).Add(e.b.Scale(f))
+		}
+
+		// The line from an interior point through the target crosses the
+		// (convex) mesh exactly at the target. Alternate between rays that
+		// exit and enter the mesh at the target.
+		interior := meshCenter.Add(randomUnit(rng).Scale(0.5 * rng.Float64()))
+		dir := target.Sub(interior).Unit()
+		r := xmath.Ray{Start: interior, Dir: dir}
+		if i%2 == 0 {
+			r = xmath.Ray{Start: target.Add(dir.Scale(0.1 + 5*rng.Float64())), Dir: dir.Scale(-1)}
+		}
+
+		var hit bool
+		for _, tri := range append(adjacent[e.a], adjacent[e.b]...) {
+			if _, ok := tri.intersect(r); ok {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			t.Fatalf("ray leaked through mesh: %v", r)
+		}
+	}
+}
+
+func TestClosedMeshHasNoLeaks(t *testing.T) {
+	var objs []object
+	for _, tri := range closedMesh(3) {
+		objs = append(objs, object{Surface: tri})
+	}
+	accel := newGrid(4, objs)
+
+	rng := rand.New(rand.NewSource(3))
+	n := rayCount() / 2
+	for i := 0; i < n; i++ {
+		start := meshCenter.Add(randomUnit(rng).Scale(0.6 * rng.Float64()))
+		r := xmath.Ray{Start: start, Dir: randomUnit(rng)}
+		if _, _, hit := accel.closestHit(r); !hit {
+			t.Fatalf("ray leaked out of mesh: %v", r)
+		}
+	}
+}
+
+func TestTriangleSpawnedRaysDontSelfIntersect(t *testing.T) {
+	tris := closedMesh(2)
+	rng := rand.New(rand.NewSource(4))
+	n := rayCount() / 8
+	for i := 0; i < n; i++ {
+		start := meshCenter.Add(randomUnit(rng).Scale(5))
+		r := xmath.Ray{Start: start, Dir: randomUnit(rng)}
+		for _, tri := range tris {
+			x, hit := tri.intersect(r)
+			if !hit {
+				continue
+			}
+
+			// Leave the surface in a random direction on either side, some
+			// of which are grazing.
+			dir := randomUnit(rng)
+			if i%2 == 0 {
+				dir = dir.Rej(tri.UnitNorm).Add(tri.UnitNorm.Scale(1e-6 * rng.NormFloat64())).Unit()
+			}
+			spawned := spawnRay(x, dir)
+			if x, hit := tri.intersect(spawned); hit {
+				t.Fatalf("spawned ray re-intersected its origin triangle at distance %v: %v", x.distance, spawned)
+			}
+		}
+	}
+}
+
+func TestSurfaceParameterisation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		surf surface
+		ray  xmath.Ray
+		u, v float64
+	}{
+		{
+			name: "triangle",
+			surf: newTriangle(xmath.Vect(0, 0, 0), xmath.Vect(1, 0, 0), xmath.Vect(0, 1, 0)),
+			ray:  xmath.Ray{Start: xmath.Vect(0.25, 0.5, 1), Dir: xmath.Vect(0, 0, -1)},
+			u:    0.25, v: 0.5,
+		},
+		{
+			name: "sphere",
+			surf: &sphere{Center: xmath.Vect(1, 2, 3), Radius: 2},
+			ray:  xmath.Ray{Start: xmath.Vect(1, 10, 3), Dir: xmath.Vect(0, -1, 0)},
+			u:    0.5, v: 0,
+		},
+		{
+			name: "aligned box",
+			surf: newAlignedBox(xmath.Vect(0, 0, 0), xmath.Vect(2, 4, 8)),
+			ray:  xmath.Ray{Start: xmath.Vect(1, 3, 10), Dir: xmath.Vect(0, 0, -1)},
+			u:    0.5, v: 0.75,
+		},
+		{
+			name: "align y square",
+			surf: &alignYSquare{X1: 0, X2: 2, Y: 1, Z1: -4, Z2: 0},
+			ray:  xmath.Ray{Start: xmath.Vect(0.5, 2, -1), Dir: xmath.Vect(0, -1, 0)},
+			u:    0.25, v: 0.75,
+		},
+		{
+			name: "disc",
+			surf: &disc{Center: xmath.Vect(0, 0, 0), RadiusSq: 4, UnitNorm: xmath.Vect(0, 0, 1)},
+			ray:  xmath.Ray{Start: xmath.Vect(-1, 0, 1), Dir: xmath.Vect(0, 0, -1)},
+			u:    1, v: 0.5,
+		},
+		{
+			name: "pipe",
+			surf: &pipe{C1: xmath.Vect(0, 0, 0), C2: xmath.Vect(0, 4, 0), R: 1},
+			ray:  xmath.Ray{Start: xmath.Vect(5, 1, 0), Dir: xmath.Vect(-1, 0, 0)},
+			u:    0.5, v: 0.25,
+		},
+		{
+			name: "parallelogram",
+			surf: newParallelogram(xmath.Vect(1, 0, 0), xmath.Vect(2, 0, 1), xmath.Vect(0, 4, 0)),
+			ray:  xmath.Ray{Start: xmath.Vect(2, 1, -5), Dir: xmath.Vect(0, 0, 1)},
+			u:    0.5, v: 0.25,
+		},
+		{
+			name: "oriented box",
+			surf: newOrientedBox(xmath.Vect(1, 1, 1), xmath.Vect(1, 2, 4)),
+			ray:  xmath.Ray{Start: xmath.Vect(1.5, 2, 10), Dir: xmath.Vect(0, 0, -1)},
+			u:    0.75, v: 0.75,
+		},
+		{
+			name: "csg",
+			surf: &csg{
+				Op: csgDifference,
+				A:  &closedSurface{&sphere{Center: xmath.Vect(1, 2, 3), Radius: 2}},
+				B:  &closedSurface{newOrientedBox(xmath.Vect(1, 0, 3), xmath.Vect(1, 1, 1))},
+			},
+			ray: xmath.Ray{Start: xmath.Vect(1, 10, 3), Dir: xmath.Vect(0, -1, 0)},
+			u:   0.5, v: 0,
+		},
+		{
+			name: "cone side",
+			surf: &cone{C1: xmath.Vect(0, 0, 0), C2: xmath.Vect(0, 4, 0), R1: 2, R2: 0},
+			ray:  xmath.Ray{Start: xmath.Vect(5, 1, 0), Dir: xmath.Vect(-1, 0, 0)},
+			u:    0.5, v: 0.25,
+		},
+		{
+			name: "cone cap",
+			surf: &cone{C1: xmath.Vect(0, 0, 0), C2: xmath.Vect(0, 4, 0), R1: 2, R2: 1},
+			ray:  xmath.Ray{Start: xmath.Vect(-0.5, 10, 0), Dir: xmath.Vect(0, -1, 0)},
+			u:    1, v: 0.5,
+		},
+		{
+			name: "ellipsoid",
+			surf: newEllipsoid(xmath.Vect(1, 2, 3), xmath.Vect(1, 2, 3)),
+			ray:  xmath.Ray{Start: xmath.Vect(10, 2, 3), Dir: xmath.Vect(-1, 0, 0)},
+			u:    0.5, v: 0.5,
+		},
+		{
+			name: "torus",
+			surf: &torus{Center: xmath.Vect(0, 0, 0), Axis: xmath.Vect(0, 0, 1), Major: 2, Minor: 0.5},
+			ray:  xmath.Ray{Start: xmath.Vect(2, 0, 10), Dir: xmath.Vect(0, 0, -1)},
+			u:    0.5, v: 0.75,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := []object{{Surface: tc.surf, ObjID: 3, PrimID: 7}}
+			x, _, hit := newListAccelerationStructure(objs).closestHit(tc.ray)
+			if !hit {
+				t.Fatal("should have hit")
+			}
+			const eps = 1e-9
+			if math.Abs(x.u-tc.u) > eps || math.Abs(x.v-tc.v) > eps {
+				t.Errorf("wrong uv: want=(%v,%v) got=(%v,%v)", tc.u, tc.v, x.u, x.v)
+			}
+			if x.shadingNormal != x.unitNormal {
+				t.Errorf("shading normal should match geometric normal")
+			}
+			for _, d := range []xmath.Vector{x.dpdu, x.dpdv} {
+				if d.LengthSq() == 0 || math.Abs(d.Unit().Dot(x.unitNormal)) > eps {
+					t.Errorf("tangent not perpendicular to normal: %v", d)
+				}
+			}
+			if x.objID != 3 || x.primID != 7 {
+				t.Errorf("wrong ids: obj=%v prim=%v", x.objID, x.primID)
+			}
+		})
+	}
+}
+
+func TestSmoothTriangleShadingNormal(t *testing.T) {
+	na := xmath.Vect(-1, -1, 1)
+	nb := xmath.Vect(1, 0, 1)
+	nc := xmath.Vect(0, 1, 1)
+	for _, tc := range []struct {
+		name string
+		tri  *triangle
+		want xmath.Vector
+	}{
+		{
+			name: "interpolated",
+			tri: newSmoothTriangle(
+				xmath.Vect(0, 0, 0), xmath.Vect(1, 0, 0), xmath.Vect(0, 1, 0),
+				na, nb, nc,
+			),
+			want: na.Unit().Scale(0.5).Add(nb.Unit().Scale(0.25)).Add(nc.Unit().Scale(0.25)).Unit(),
+		},
+		{
+			name: "opposite winding",
+			tri: newSmoothTriangle(
+				xmath.Vect(0, 0, 0), xmath.Vect(0, 1, 0), xmath.Vect(1, 0, 0),
+				na, nc, nb,
+			),
+			want: na.Unit().Scale(0.5).Add(nb.Unit().Scale(0.25)).Add(nc.Unit().Scale(0.25)).Unit().Scale(-1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := xmath.Ray{Start: xmath.Vect(0.25, 0.25, 1), Dir: xmath.Vect(0, 0, -1)}
+			objs := []object{{Surface: tc.tri}}
+			x, _, hit := newListAccelerationStructure(objs).closestHit(r)
+			if !hit {
+				t.Fatal("should have hit")
+			}
+			if x.shadingNormal.Sub(tc.want).Length() > 1e-9 {
+				t.Errorf("want=%v got=%v", tc.want, x.shadingNormal)
+			}
+			if x.shadingNormal.Dot(x.unitNormal) <= 0 {
+				t.Errorf("shading normal not in geometric normal's hemisphere")
+			}
+		})
+	}
+}
+
+func TestParallelogramSampling(t *testing.T) {
+	p := newParallelogram(xmath.Vect(1, 2, 3), xmath.Vect(2, 0, 1), xmath.Vect(-1, 3, 0.5))
+	if got, want := p.area(), p.EdgeU.Cross(p.EdgeV).Length(); got != want {
+		t.Errorf("wrong area: want=%v got=%v", want, got)
+	}
+
+	// Samples should be on the surface, and their mean should be the center.
+	const n = 64
+	var sum xmath.Vector
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			pt, norm := p.sample((float64(i)+0.5)/n, (float64(j)+0.5)/n)
+			if norm != p.UnitNorm {
+				t.Fatalf("wrong normal: %v", norm)
+			}
+			r := xmath.Ray{Start: pt.Add(norm), Dir: norm.Scale(-1)}
+			x, hit := p.intersect(r)
+			if !hit || x.point.Sub(pt).Length() > 1e-9 {
+				t.Fatalf("sample not on surface: %v", pt)
+			}
+			sum = sum.Add(pt)
+		}
+	}
+	center := p.Corner.Add(p.EdgeU.Scale(0.5)).Add(p.EdgeV.Scale(0.5))
+	if mean := sum.Scale(1.0 / (n * n)); mean.Sub(center).Length() > 1e-9 {
+		t.Errorf("wrong mean: want=%v got=%v", center, mean)
+	}
+
+	// Parallel edges don't make a parallelogram.
+	degenerate := scene.Parallelogram{Corner: p.Corner, EdgeU: xmath.Vect(1, 2, 3), EdgeV: xmath.Vect(2, 4, 6)}
+	if _, err := buildSurfaces(scene.Surface{Parallelograms: []scene.Parallelogram{degenerate}}); err == nil {
+		t.Error("expected error for zero area parallelogram")
+	}
+}
+
+func TestOrientedBoxMatchesAlignedBox(t *testing.T) {
+	// Rotating both the oriented box and the ray should give the same hits as
+	// the equivalent aligned box.
+	axis := xmath.Vect(1, -2, 3).Unit()
+	const rads = 1.1
+	center := xmath.Vect(1, 2, 3)
+	halfExtents := xmath.Vect(0.5, 1, 2)
+	aligned := newAlignedBox(center.Sub(halfExtents), center.Add(halfExtents))
+	oriented := newOrientedBox(center, halfExtents)
+	oriented.rotate(axis, rads)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		r := xmath.Ray{
+			Start: center.Add(randomUnit(rng).Scale(4 * rng.Float64())),
+			Dir:   randomUnit(rng),
+		}
+		want, wantHit := aligned.intersect(r)
+		rotated := xmath.Ray{Start: r.Start.Rotate(axis, rads), Dir: r.Dir.Rotate(axis, rads)}
+		got, gotHit := oriented.intersect(rotated)
+		if wantHit != gotHit {
+			t.Fatalf("hit mismatch: want=%v got=%v ray=%v", wantHit, gotHit, r)
+		}
+		if !wantHit {
+			continue
+		}
+		if math.Abs(want.distance-got.distance) > 1e-9 {
+			t.Errorf("wrong distance: want=%v got=%v", want.distance, got.distance)
+		}
+		if want.unitNormal.Rotate(axis, rads).Sub(got.unitNormal).Length() > 1e-9 {
+			t.Errorf("wrong normal: want=%v got=%v", want.unitNormal, got.unitNormal)
+		}
+		if want.point.Rotate(axis, rads).Sub(got.point).Length() > 1e-9 {
+			t.Errorf("wrong point: want=%v got=%v", want.point, got.point)
+		}
+	}
+}
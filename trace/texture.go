@@ -0,0 +1,254 @@
+package trace
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+type texture interface {
+	at(x intersection) colour.Colour
+}
+
+// texels holds decoded image data, shared between all textures that use the
+// same image file.
+type texels struct {
+	wide, high int
+	data       []colour.Colour
+}
+
+func (t *texels) at(x, y int) colour.Colour {
+	return t.data[x+y*t.wide]
+}
+
+// textureLoader makes sure that each image file is only loaded once.
+type textureLoader struct {
+	cache map[textureKey]*texels
+}
+
+type textureKey struct {
+	filename string
+	linear   bool
+}
+
+func newTextureLoader() *textureLoader {
+	return &textureLoader{cache: make(map[textureKey]*texels)}
+}
+
+func (l *textureLoader) load(proto *scene.Texture) (texture, error) {
+	if proto == nil {
+		return nil, fmt.Errorf("missing texture")
+	}
+	m := mapping{space: proto.Space, scale: proto.Scale}
+	if m.scale == 0 {
+		m.scale = 1
+	}
+	switch m.space {
+	case scene.SpaceUV, "", scene.SpaceObject:
+	default:
+		return nil, fmt.Errorf("unknown texture space: %v", m.space)
+	}
+
+	switch {
+	case proto.Solid != nil:
+		return solidTexture(*proto.Solid), nil
+	case proto.Image != nil:
+		if m.space == scene.SpaceObject {
+			return nil, fmt.Errorf("image textures must use UV space")
+		}
+		return l.loadImage(proto.Image, m.scale)
+	case proto.Checker != nil:
+		return l.loadPattern(m, proto.Checker.A, proto.Checker.B, checker)
+	case proto.Gradient != nil:
+		axis := proto.Gradient.Axis
+		return l.loadPattern(m, proto.Gradient.A, proto.Gradient.B, func(p xmath.Vector) float64 {
+			return p.Dot(axis)
+		})
+	case proto.Noise != nil:
+		octaves := proto.Noise.Octaves
+		return l.loadPattern(m, proto.Noise.A, proto.Noise.B, func(p xmath.Vector) float64 {
+			return 0.5 * (fractalNoise(p, octaves) + 1)
+		})
+	case proto.Marble != nil:
+		turb, octaves := proto.Marble.Turbulence, proto.Marble.Octaves
+		return l.loadPattern(m, proto.Marble.A, proto.Marble.B, func(p xmath.Vector) float64 {
+			return 0.5 * (1 - math.Cos(math.Pi*(p.X+turb*turbulence(p, octaves))))
+		})
+	case proto.Wood != nil:
+		turb, octaves := proto.Wood.Turbulence, proto.Wood.Octaves
+		return l.loadPattern(m, proto.Wood.A, proto.Wood.B, func(p xmath.Vector) float64 {
+			r := math.Hypot(p.X, p.Z) + turb*turbulence(p, octaves)
+			return r - math.Floor(r)
+		})
+	default:
+		return nil, fmt.Errorf("texture has no type")
+	}
+}
+
+func (l *textureLoader) loadPattern(
+	m mapping, a, b *scene.Texture, fn func(xmath.Vector) float64,
+) (texture, error) {
+	texA, err := l.load(a)
+	if err != nil {
+		return nil, err
+	}
+	texB, err := l.load(b)
+	if err != nil {
+		return nil, err
+	}
+	return &patternTexture{m, texA, texB, fn}, nil
+}
+
+func (l *textureLoader) loadImage(proto *scene.ImageTexture, scale float64) (texture, error) {
+	var wrap func(int, int) int
+	switch proto.Wrap {
+	case scene.WrapRepeat, "":
+		wrap = wrapRepeat
+	case scene.WrapClamp:
+		wrap = wrapClamp
+	case scene.WrapMirror:
+		wrap = wrapMirror
+	default:
+		return nil, fmt.Errorf("unknown wrap mode: %v", proto.Wrap)
+	}
+
+	key := textureKey{proto.Filename, proto.Linear}
+	tex, ok := l.cache[key]
+	if !ok {
+		var err error
+		tex, err = decodeTexels(proto.Filename, !proto.Linear)
+		if err != nil {
+			return nil, err
+		}
+		l.cache[key] = tex
+	}
+	return &imageTexture{tex, wrap, scale}, nil
+}
+
+func decodeTexels(filename string, srgb bool) (*texels, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open texture: %v", err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode texture %v: %v", filename, err)
+	}
+
+	bounds := img.Bounds()
+	tex := &texels{
+		wide: bounds.Dx(),
+		high: bounds.Dy(),
+		data: make([]colour.Colour, bounds.Dx()*bounds.Dy()),
+	}
+	for y := 0; y < tex.high; y++ {
+		for x := 0; x < tex.wide; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			c := colour.Colour{
+				R: float64(r) / 0xffff,
+				G: float64(g) / 0xffff,
+				B: float64(b) / 0xffff,
+			}
+			if srgb {
+				c = c.DecodeSRGB()
+			}
+			tex.data[x+y*tex.wide] = c
+		}
+	}
+	return tex, nil
+}
+
+type imageTexture struct {
+	texels *texels
+	wrap   func(i, n int) int
+	scale  float64
+}
+
+// at samples the texture using bilinear filtering. The V coordinate points
+// up the image (opposite to the image's row order).
+func (t *imageTexture) at(x intersection) colour.Colour {
+	fx := t.scale*x.u*float64(t.texels.wide) - 0.5
+	fy := (1-t.scale*x.v)*float64(t.texels.high) - 0.5
+	x0, y0 := math.Floor(fx), math.Floor(fy)
+	dx, dy := fx-x0, fy-y0
+
+	w, h := t.texels.wide, t.texels.high
+	xa, xb := t.wrap(int(x0), w), t.wrap(int(x0)+1, w)
+	ya, yb := t.wrap(int(y0), h), t.wrap(int(y0)+1, h)
+	return t.texels.at(xa, ya).Scale((1 - dx) * (1 - dy)).
+		Add(t.texels.at(xb, ya).Scale(dx * (1 - dy))).
+		Add(t.texels.at(xa, yb).Scale((1 - dx) * dy)).
+		Add(t.texels.at(xb, yb).Scale(dx * dy))
+}
+
+func wrapRepeat(i, n int) int {
+	i %= n
+	if i < 0 {
+		i += n
+	}
+	return i
+}
+
+func wrapClamp(i, n int) int {
+	return xmath.IntMax(0, xmath.IntMin(i, n-1))
+}
+
+func wrapMirror(i, n int) int {
+	i = wrapRepeat(i, 2*n)
+	if i >= n {
+		i = 2*n - 1 - i
+	}
+	return i
+}
+
+type solidTexture colour.Colour
+
+func (t solidTexture) at(intersection) colour.Colour {
+	return colour.Colour(t)
+}
+
+// mapping gives the coordinates that procedural textures are evaluated at.
+type mapping struct {
+	space scene.TextureSpace
+	scale float64
+}
+
+func (m mapping) coords(x intersection) xmath.Vector {
+	if m.space == scene.SpaceObject {
+		return x.point.Scale(m.scale)
+	}
+	return xmath.Vect(x.u, x.v, 0).Scale(m.scale)
+}
+
+// patternTexture blends between two other textures according to a scalar
+// pattern function, which is clamped to the range [0, 1].
+type patternTexture struct {
+	mapping mapping
+	a, b    texture
+	pattern func(xmath.Vector) float64
+}
+
+func (t *patternTexture) at(x intersection) colour.Colour {
+	f := clamp(t.pattern(t.mapping.coords(x)), 0, 1)
+	switch f {
+	case 0:
+		return t.a.at(x)
+	case 1:
+		return t.b.at(x)
+	default:
+		return t.a.at(x).Scale(1 - f).Add(t.b.at(x).Scale(f))
+	}
+}
+
+func checker(p xmath.Vector) float64 {
+	sum := int(math.Floor(p.X) + math.Floor(p.Y) + math.Floor(p.Z))
+	return float64(sum & 1)
+}
@@ -0,0 +1,129 @@
+package trace
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func writeTestPNG(t *testing.T, img image.Image) string {
+	filename := filepath.Join(t.TempDir(), "tex.png")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestImageTexture(t *testing.T) {
+	// Left column black, right column white.
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	img.Set(1, 0, color.White)
+	img.Set(1, 1, color.White)
+	filename := writeTestPNG(t, img)
+
+	loader := newTextureLoader()
+	load := func(wrap scene.WrapMode) *imageTexture {
+		tex, err := loader.load(&scene.Texture{Image: &scene.ImageTexture{Filename: filename, Wrap: wrap}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tex.(*imageTexture)
+	}
+	repeat := load(scene.WrapRepeat)
+	clamp := load(scene.WrapClamp)
+	if repeat.texels != clamp.texels {
+		t.Error("texels should be shared")
+	}
+
+	for _, tc := range []struct {
+		tex  *imageTexture
+		u    float64
+		want float64
+	}{
+		{repeat, 0.25, 0},  // Texel center.
+		{repeat, 0.75, 1},  // Texel center.
+		{repeat, 0.5, 0.5}, // Between texels.
+		{repeat, 0.0, 0.5}, // Wraps around to the right column.
+		{clamp, 0.0, 0},    // Clamped to the left column.
+		{repeat, 1.25, 0},  // Repeated.
+		{clamp, 1.25, 1},   // Clamped to the right column.
+		{repeat, 0.375, 0.25},
+	} {
+		got := tc.tex.at(intersection{u: tc.u, v: 0.5})
+		if got != (colour.Colour{tc.want, tc.want, tc.want}) {
+			t.Errorf("u=%v: want=%v got=%v", tc.u, tc.want, got)
+		}
+	}
+}
+
+func TestWrapMirror(t *testing.T) {
+	for i, want := range []int{2, 1, 0, 0, 1, 2, 2, 1, 0} {
+		if got := wrapMirror(i-3, 3); got != want {
+			t.Errorf("i=%d: want=%d got=%d", i-3, want, got)
+		}
+	}
+}
+
+func TestProceduralTextures(t *testing.T) {
+	white := colour.Colour{1, 1, 1}
+	black := colour.Colour{0, 0, 0}
+	proto := &scene.Texture{
+		Scale: 2,
+		Checker: &scene.CheckerTexture{
+			A: &scene.Texture{Solid: &white},
+			B: &scene.Texture{Solid: &black},
+		},
+	}
+	tex, err := newTextureLoader().load(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		u, v float64
+		want colour.Colour
+	}{
+		{0.25, 0.25, white},
+		{0.75, 0.25, black},
+		{0.25, 0.75, black},
+		{0.75, 0.75, white},
+	} {
+		if got := tex.at(intersection{u: tc.u, v: tc.v}); got != tc.want {
+			t.Errorf("u=%v v=%v: want=%v got=%v", tc.u, tc.v, tc.want, got)
+		}
+	}
+
+	proto.Space = scene.SpaceObject
+	tex, err = newTextureLoader().load(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tex.at(intersection{point: xmath.Vect(0.1, 0.1, 0.6)}); got != black {
+		t.Errorf("object space: want=%v got=%v", black, got)
+	}
+}
+
+func TestPerlinNoise(t *testing.T) {
+	if got := perlin(xmath.Vect(3, -7, 12)); got != 0 {
+		t.Errorf("noise should be zero at lattice points, got %v", got)
+	}
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		p := xmath.Vect(rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()).Scale(100)
+		if n := perlin(p); n < -1.1 || n > 1.1 {
+			t.Fatalf("noise out of range at %v: %v", p, n)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// torus is the surface swept out by a circle of radius Minor, as its center
+// travels around a circle of radius Major (centered at Center, and
+// perpendicular to Axis).
+type torus struct {
+	Center xmath.Vector `json:"center"`
+	Axis   xmath.Vector `json:"axis"` // unit
+	Major  float64      `json:"major"`
+	Minor  float64      `json:"minor"`
+}
+
+func (t *torus) String() string {
+	return fmt.Sprintf("Type=torus C=%v A=%v R=%v r=%v", t.Center, t.Axis, t.Major, t.Minor)
+}
+
+// frame gives the torus's local coordinate system, in which it lies in the XY
+// plane with its axis along Z.
+func (t *torus) frame() (xmath.Vector, xmath.Vector, xmath.Vector) {
+	s, u := orthonormalBasis(t.Axis)
+	return s, u, t.Axis
+}
+
+func toFrame(v, s, u, w xmath.Vector) xmath.Vector {
+	return xmath.Vect(v.Dot(s), v.Dot(u), v.Dot(w))
+}
+
+func fromFrame(v, s, u, w xmath.Vector) xmath.Vector {
+	return s.Scale(v.X).Add(u.Scale(v.Y)).Add(w.Scale(v.Z))
+}
+
+func (t *torus) intersect(r xmath.Ray) (intersection, bool) {
+	// Clip the ray to the bounding sphere first. As well as quickly rejecting
+	// misses, starting the ray at the sphere keeps the magnitudes of the
+	// quartic's coefficients small, which makes the roots more accurate.
+	rel := r.Start.Sub(t.Center)
+	bound := t.Major + t.Minor
+	a, b, c := r.Dir.LengthSq(), 2*rel.Dot(r.Dir), rel.LengthSq()-bound*bound
+	if b*b-4*a*c < 0 {
+		return intersection{}, false
+	}
+	t1, t2 := solveQuadraticEqn(a, b, c)
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t2 <= 0 {
+		return intersection{}, false
+	}
+	t0 := math.Max(0, t1)
+
+	s, u, w := t.frame()
+	o := toFrame(rel.Add(r.Dir.Scale(t0)), s, u, w)
+	d := toFrame(r.Dir, s, u, w)
+
+	// Points on the torus satisfy:
+	//   (|p|^2 + R^2 - r^2)^2 = 4R^2(p.x^2 + p.y^2)
+	// Substituting p = o + t*d gives a quartic in t.
+	R2 := t.Major * t.Major
+	qa := d.LengthSq()
+	qb := 2 * o.Dot(d)
+	qc := o.LengthSq() + R2 - t.Minor*t.Minor
+	coeffs := []float64{
+		qa * qa,
+		2 * qa * qb,
+		qb*qb + 2*qa*qc - 4*R2*(d.X*d.X+d.Y*d.Y),
+		2*qb*qc - 8*R2*(o.X*d.X+o.Y*d.Y),
+		qc*qc - 4*R2*(o.X*o.X+o.Y*o.Y),
+	}
+	for _, root := range polyRoots(coeffs, 0, t2-t0) {
+		dist := t0 + root
+		if dist <= 0 {
+			continue
+		}
+
+		// Reproject onto the surface, via the closest point on the torus's
+		// central circle.
+		p := toFrame(r.At(dist).Sub(t.Center), s, u, w)
+		ring := xmath.Vect(p.X, p.Y, 0)
+		if ring.LengthSq() == 0 {
+			continue
+		}
+		ring = ring.Unit().Scale(t.Major)
+		tube := p.Sub(ring).Unit()
+		p = fromFrame(ring.Add(tube.Scale(t.Minor)), s, u, w)
+		point := t.Center.Add(p)
+
+		// The surface is reconstructed via several rotations, so the error
+		// bound is generous.
+		errBound := p.Abs().Add(point.Abs()).Add(xmath.Vect(bound, bound, bound))
+		return intersection{
+			unitNormal: fromFrame(tube, s, u, w).Unit(),
+			distance:   dist,
+			point:      point,
+			pointErr:   errBound.Scale(gamma(32)),
+		}, true
+	}
+	return intersection{}, false
+}
+
+// parameterise uses U for the angle around the torus's axis, and V for the
+// angle around the tube.
+func (t *torus) parameterise(x *intersection) {
+	s, u, w := t.frame()
+	p := toFrame(x.point.Sub(t.Center), s, u, w)
+	rho := math.Hypot(p.X, p.Y)
+	x.u = (math.Atan2(p.Y, p.X) + math.Pi) / (2 * math.Pi)
+	x.v = (math.Atan2(p.Z, rho-t.Major) + math.Pi) / (2 * math.Pi)
+
+	x.dpdu = fromFrame(xmath.Vect(-p.Y, p.X, 0), s, u, w).Scale(2 * math.Pi)
+	radial := xmath.Vect(p.X, p.Y, 0).Scale(1 / rho)
+	x.dpdv = fromFrame(
+		radial.Scale(-p.Z).Add(xmath.Vect(0, 0, rho-t.Major)),
+		s, u, w,
+	).Scale(2 * math.Pi)
+}
+
+func (t *torus) bound() (xmath.Vector, xmath.Vector) {
+	off := discBoundOffset(t.Axis, t.Major).Add(xmath.Vect(t.Minor, t.Minor, t.Minor))
+	return t.Center.Sub(off).AddULPs(-ulpFudgeFactor), t.Center.Add(off).AddULPs(ulpFudgeFactor)
+}
+
+func (t *torus) translate(v xmath.Vector) {
+	t.Center = t.Center.Add(v)
+}
+
+func (t *torus) rotate(v xmath.Vector, rads float64) {
+	t.Center = t.Center.Rotate(v, rads)
+	t.Axis = t.Axis.Rotate(v, rads)
+}
+
+func (t *torus) scale(f float64) {
+	t.Center = t.Center.Scale(f)
+	t.Major *= f
+	t.Minor *= f
+}
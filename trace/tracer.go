@@ -8,62 +8,495 @@ import (
 	"github.com/peterstace/grayt/xmath"
 )
 
-func newTracer(accel accelerationStructure, rng *rand.Rand) *tracer {
-	return &tracer{accel: accel, rng: rng}
+func newTracer(accel accelerationStructure, scn *builtScene, rng *rand.Rand) *tracer {
+	return &tracer{
+		accel:     accel,
+		lights:    scn.lights,
+		emitters:  scn.emitters,
+		outside:   scn.outside,
+		camMedium: scn.camMedium,
+		spectral:  scn.spectral,
+		converted: make(map[medium]medium),
+		rng:       rng,
+	}
 }
 
 type tracer struct {
-	accel accelerationStructure
-	rng   *rand.Rand
+	accel    accelerationStructure
+	lights   []light
+	emitters *lightBVH // Nil when there are no sampleable emitters.
+
+	// The medium outside of all objects, and the medium containing the
+	// camera.
+	outside   medium
+	camMedium medium
+
+	// When rendering spectrally, colours hold the values at 3 wavelengths
+	// (sampled for each path) rather than RGB. The first is the hero
+	// wavelength. Once a path goes through a dispersive material, it's
+	// collapsed to just the hero wavelength.
+	spectral  bool
+	lambdas   [3]float64
+	collapsed bool
+
+	// Media converted to the current wavelengths, so that each is only
+	// converted once per path.
+	converted map[medium]medium
+
+	rng *rand.Rand
 }
 
 func (t *tracer) tracePath(r xmath.Ray) colour.Colour {
+	return t.trace(r, t.camMedium, nil)
+}
+
+// traceSpectral is like tracePath, but traces a random set of wavelengths,
+// and gives the result in XYZ.
+func (t *tracer) traceSpectral(r xmath.Ray) colour.XYZ {
+	t.setWavelengths(sampleWavelengths(t.rng.Float64()))
+	return t.toXYZ(t.tracePath(r))
+}
+
+// setWavelengths starts a new path at a set of wavelengths.
+func (t *tracer) setWavelengths(lambdas [3]float64) {
+	t.lambdas = lambdas
+	t.collapsed = false
+	for m := range t.converted {
+		delete(t.converted, m)
+	}
+}
+
+// toXYZ converts a colour holding the values at the current wavelengths into
+// XYZ.
+func (t *tracer) toXYZ(c colour.Colour) colour.XYZ {
+	// The wavelengths are sampled uniformly, so the XYZ estimate is the
+	// average over the wavelengths divided by the probability density.
+	var xyz colour.XYZ
+	for i, v := range [3]float64{c.R, c.G, c.B} {
+		xyz = xyz.Add(colour.MatchingFunctions(t.lambdas[i]).Scale(v))
+	}
+	return xyz.Scale((colour.MaxWavelength - colour.MinWavelength) / 3)
+}
+
+// sampleWavelengths chooses a hero wavelength uniformly over the visible
+// range, with the other wavelengths evenly spaced after it (wrapping around
+// the range).
+func sampleWavelengths(u float64) [3]float64 {
+	const span = colour.MaxWavelength - colour.MinWavelength
+	var lambdas [3]float64
+	for i := range lambdas {
+		lambdas[i] = colour.MinWavelength + math.Mod(u*span+float64(i)*span/3, span)
+	}
+	return lambdas
+}
+
+// spectrum converts an RGB colour into the representation used by the
+// current path.
+func (t *tracer) spectrum(c colour.Colour) colour.Colour {
+	if !t.spectral {
+		return c
+	}
+	return colour.Colour{
+		R: c.SpectrumAt(t.lambdas[0]),
+		G: c.SpectrumAt(t.lambdas[1]),
+		B: c.SpectrumAt(t.lambdas[2]),
+	}
+}
+
+// emission gives the colour of the light emitted by a material in a
+// direction (before scaling by its emittance), in the representation used by
+// the current path.
+func (t *tracer) emission(m material, x intersection, dir xmath.Vector) colour.Colour {
+	var c colour.Colour
+	if t.spectral && m.Spectrum != nil {
+		c = colour.Colour{
+			R: m.Spectrum(t.lambdas[0]),
+			G: m.Spectrum(t.lambdas[1]),
+			B: m.Spectrum(t.lambdas[2]),
+		}
+	} else if m.EmissionColour != nil {
+		c = t.spectrum(*m.EmissionColour)
+	} else {
+		c = t.spectrum(m.colourAt(x))
+	}
+	if m.Profile != nil {
+		c = c.Scale(m.Profile.radiance(x.unitNormal, dir))
+	}
+	return c
+}
+
+// mediumFor converts a medium's coefficients into the representation used by
+// the current path.
+func (t *tracer) mediumFor(m medium) medium {
+	if !t.spectral {
+		return m
+	}
+	c, ok := t.converted[m]
+	if !ok {
+		c = m.convert(t.spectrum)
+		t.converted[m] = c
+	}
+	return c
+}
+
+// scatterEvent describes where a ray was scattered from. If the ray hits an
+// emitter that could also have been sampled directly, it's used to weight the
+// two ways of finding the emitter using MIS.
+type scatterEvent struct {
+	point  xmath.Vector
+	normal xmath.Vector // Zero for scattering in media.
+	pdf    float64      // Probability density of the scattered direction.
+}
+
+// trace finds the light arriving along a ray that starts in a medium (nil
+// for a vacuum). The ray was scattered from a diffuse surface or medium
+// unless from is nil (e.g. camera rays, and specular reflections).
+func (t *tracer) trace(r xmath.Ray, med medium, from *scatterEvent) colour.Colour {
 	assertUnit(r.Dir)
 	intersection, material, hit := t.accel.closestHit(r)
+
+	// The ray may scatter in the medium before it reaches the surface.
+	weight := colour.Colour{1, 1, 1}
+	if med != nil {
+		tMax := math.Inf(+1)
+		if hit {
+			tMax = intersection.distance
+		}
+		var dist float64
+		var scattered bool
+		dist, weight, scattered = t.mediumFor(med).sampleDistance(r, tMax, t.rng)
+		if weight == (colour.Colour{}) {
+			return colour.Colour{0, 0, 0}
+		}
+		if scattered {
+			p := r.At(dist)
+			g := med.asymmetry()
+			direct := t.direct(xmath.Ray{Start: p}, xmath.Vector{}, med, func(dir xmath.Vector) (float64, float64) {
+				phase := henyeyGreenstein(r.Dir.Dot(dir), g)
+				return phase, phase
+			}).Mul(weight)
+
+			// Media don't emit, so paths are terminated at random to keep
+			// them finite.
+			const pTerminate = 0.1
+			if t.rng.Float64() < pTerminate {
+				return direct
+			}
+			scatteredRay := xmath.Ray{
+				Start: p,
+				Dir:   sampleHenyeyGreenstein(r.Dir, g, t.rng),
+			}
+			event := &scatterEvent{point: p, pdf: henyeyGreenstein(r.Dir.Dot(scatteredRay.Dir), g)}
+			return t.trace(scatteredRay, med, event).Mul(weight).Scale(1 / (1 - pTerminate)).Add(direct)
+		}
+	}
 	if !hit {
 		return colour.Colour{0, 0, 0}
 	}
 	assertUnit(intersection.unitNormal)
 
-	// Calculate probability of emitting.
+	// Pass through medium boundaries. Media don't nest, so crossing a
+	// boundary either enters its medium or leaves it for the outside one.
+	if material.Medium != nil {
+		next := material.Medium
+		if med == material.Medium {
+			next = t.outside
+		}
+		return t.trace(spawnRay(intersection, r.Dir), next, from).Mul(weight)
+	}
+
+	// Rays pass straight through the backs of one-sided surfaces.
+	if material.culls(intersection, r.Dir) {
+		return t.trace(spawnRay(intersection, r.Dir), med, from).Mul(weight)
+	}
+
+	return t.shade(r, intersection, material, med, from).Mul(weight)
+}
+
+// shade finds the light leaving a surface along a ray that hit it.
+func (t *tracer) shade(r xmath.Ray, intersection intersection, material material, med medium, from *scatterEvent) colour.Colour {
+	// Calculate probability of emitting. Emissive materials only emit from
+	// their emitting side, and are otherwise shaded like any other surface.
 	pEmit := 0.1
-	if material.Emittance != 0 {
+	emits := material.emitsTowards(intersection, r.Dir.Scale(-1))
+	if emits {
 		pEmit = 1.0
 	}
 
 	// Handle emit case.
 	if t.rng.Float64() < pEmit {
-		return material.Colour.Scale(material.Emittance / pEmit)
+		if !emits {
+			return colour.Colour{0, 0, 0}
+		}
+		weight := t.emitterWeight(from, intersection)
+		return t.emission(material, intersection, r.Dir.Scale(-1)).Scale(material.Emittance * weight / pEmit)
 	}
 
-	offsetScale := -math.Copysign(xmath.AddULPs(1.0, 1e5)-1.0, r.Dir.Dot(intersection.unitNormal))
-	offset := intersection.unitNormal.Scale(offsetScale)
-	hitLoc := r.At(intersection.distance).Add(offset)
+	material.perturbNormal(&intersection)
 
-	// Orient the unit normal towards the ray origin.
+	// Surfaces with insides (e.g. dielectrics) have outward facing normals.
+	entering := intersection.unitNormal.Dot(r.Dir) < 0
+
+	// Orient the unit normals towards the ray origin.
 	if intersection.unitNormal.Dot(r.Dir) > 0 {
 		intersection.unitNormal = intersection.unitNormal.Scale(-1.0)
+		intersection.shadingNormal = intersection.shadingNormal.Scale(-1.0)
 	}
 
+	// Scattering is calculated using the shading normal. When the shading
+	// normal differs from the geometric normal, the scattered ray can end up
+	// going into the surface. Those paths are terminated, otherwise light
+	// would leak through the surface.
+	shadingNormal := intersection.shadingNormal
+
 	if material.Mirror {
 
-		reflected := r.Dir.Sub(intersection.unitNormal.Scale(2 * intersection.unitNormal.Dot(r.Dir)))
-		return t.tracePath(xmath.Ray{Start: hitLoc, Dir: reflected})
+		reflected := r.Dir.Sub(shadingNormal.Scale(2 * shadingNormal.Dot(r.Dir)))
+		if reflected.Dot(intersection.unitNormal) <= 0 {
+			return colour.Colour{0, 0, 0}
+		}
+		return t.trace(spawnRay(intersection, reflected), med, nil)
+
+	} else if material.Subsurface != nil {
+
+		exit, weight, ok := randomWalk(t.accel, intersection, t.mediumFor(material.Subsurface), t.rng)
+		if !ok {
+			return colour.Colour{0, 0, 0}
+		}
+		return t.trace(exit, med, nil).Mul(weight).Scale(1 / (1 - pEmit))
+
+	} else if material.Dielectric != nil {
+
+		// Dispersive materials send each wavelength in a different
+		// direction, so only the hero wavelength can continue. It then
+		// stands in for all of the wavelengths.
+		lambda := referenceWavelength
+		weight := colour.Colour{1, 1, 1}
+		if t.spectral {
+			lambda = t.lambdas[0]
+			if material.Dielectric.dispersive() && !t.collapsed {
+				t.collapsed = true
+				weight = colour.Colour{3, 0, 0}
+			}
+		}
+		ior := material.Dielectric.iorAt(lambda)
+		if !entering {
+			ior = 1 / ior
+		}
+		dir := scatterDielectric(r.Dir, shadingNormal, ior, t.rng)
+
+		// Reflected rays must stay on the near side of the surface, and
+		// refracted rays must go to the far side.
+		reflected := dir.Dot(shadingNormal) > 0
+		if reflected != (dir.Dot(intersection.unitNormal) > 0) {
+			return colour.Colour{0, 0, 0}
+		}
+		return t.trace(spawnRay(intersection, dir), med, nil).Mul(weight).Scale(1 / (1 - pEmit))
 
 	} else {
 
-		// Create a random vector on the hemisphere towards the normal.
-		rnd := xmath.Vector{t.rng.NormFloat64(), t.rng.NormFloat64(), t.rng.NormFloat64()}
-		rnd = rnd.Unit()
-		if rnd.Dot(intersection.unitNormal) < 0 {
-			rnd = rnd.Scale(-1.0)
+		// Create a random vector on the hemisphere towards the normal. It's
+		// made from uniform random numbers, so that Metropolis mutations of
+		// the numbers move it smoothly.
+		rnd := uniformCone(shadingNormal, 0, t.rng)
+		// Rays leaving the surface on the near side all start from the same
+		// point.
+		shadowRay := spawnRay(intersection, intersection.unitNormal)
+
+		var indirect colour.Colour
+		if rnd.Dot(intersection.unitNormal) > 0 {
+			// Apply the BRDF (bidirectional reflection distribution function).
+			brdf := rnd.Dot(shadingNormal)
+			event := &scatterEvent{
+				point:  shadowRay.Start,
+				normal: intersection.unitNormal,
+				pdf:    1 / (2 * math.Pi),
+			}
+			indirect = t.trace(spawnRay(intersection, rnd), med, event).Scale(brdf)
 		}
 
-		// Apply the BRDF (bidirectional reflection distribution function).
-		brdf := rnd.Dot(intersection.unitNormal)
+		// Light is sampled directly using the same BRDF that the hemisphere
+		// sampling above amounts to (the albedo over 2π), so that the two
+		// are consistent.
+		direct := t.direct(shadowRay, intersection.unitNormal, med, func(dir xmath.Vector) (float64, float64) {
+			if dir.Dot(shadingNormal) <= 0 {
+				return 0, 0
+			}
+			if dir.Dot(intersection.unitNormal) <= 0 {
+				return 0, 1 / (2 * math.Pi)
+			}
+			return dir.Dot(shadingNormal) / (2 * math.Pi), 1 / (2 * math.Pi)
+		})
+
+		return indirect.Add(direct).
+			Scale(1 / (1 - pEmit)).
+			Mul(t.spectrum(material.colourAt(intersection)))
+	}
+}
+
+// direct estimates the light that's scattered at the start of a ray after
+// arriving directly from a light or emitter (the ray's direction is
+// ignored). The normal n is the surface normal there, or zero in media. The
+// scatter function gives the fraction of light arriving from a direction
+// that's scattered along the path, and the probability density of
+// scattering sampling that direction.
+func (t *tracer) direct(r xmath.Ray, n xmath.Vector, med medium, scatter func(xmath.Vector) (float64, float64)) colour.Colour {
+	var sum colour.Colour
+	if dir, irradiance, ok := t.sampleLight(r, med); ok {
+		f, _ := scatter(dir)
+		sum = irradiance.Scale(f)
+	}
+	if dir, radiance, pdf, ok := t.sampleEmitter(r, n, med); ok {
+		f, scatterPDF := scatter(dir)
+		sum = sum.Add(radiance.Scale(f * powerHeuristic(pdf, scatterPDF)))
+	}
+	return sum
+}
+
+// powerHeuristic gives the MIS weight for a sample taken with probability
+// density pdfA, when it could also have been taken with density pdfB.
+func powerHeuristic(pdfA, pdfB float64) float64 {
+	a, b := pdfA*pdfA, pdfB*pdfB
+	if math.IsInf(a, +1) {
+		return 1
+	}
+	return a / (a + b)
+}
+
+// sampleEmitter chooses a point on an emitter, and finds the direction to it
+// from the start of a ray, and the light arriving from it (accounting for
+// occlusion and media) divided by the probability density (per solid angle)
+// of choosing it. The density is also returned, for MIS.
+func (t *tracer) sampleEmitter(r xmath.Ray, n xmath.Vector, med medium) (xmath.Vector, colour.Colour, float64, bool) {
+	if t.emitters == nil {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	o, pmf, ok := t.emitters.sample(r.Start, n, t.rng)
+	if !ok {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	s := o.Surface.(sampleable)
+	p, _ := s.sample(t.rng.Float64(), t.rng.Float64())
+	toP := p.Sub(r.Start)
+	dist := toP.Length()
+	r.Dir = toP.Scale(1 / dist)
+
+	// The point may be hidden by the emitter itself (e.g. on the far side
+	// of a sphere).
+	x, hit := o.Surface.intersect(r)
+	if !hit || x.distance < dist*(1-shadowEpsilon) {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	x = o.complete(x)
+	if !o.Material.emitsTowards(x, r.Dir.Scale(-1)) {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	cos := math.Abs(x.unitNormal.Dot(r.Dir))
+	if cos == 0 {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	pdf := pmf * x.distance * x.distance / (cos * s.area())
+
+	tr := t.transmittance(r, x.distance*(1-shadowEpsilon), med)
+	if tr == (colour.Colour{}) {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	le := t.emission(o.Material, x, r.Dir.Scale(-1)).Scale(o.Material.Emittance)
+	if le == (colour.Colour{}) {
+		return xmath.Vector{}, colour.Colour{}, 0, false
+	}
+	return r.Dir, le.Mul(tr).Scale(1 / pdf), pdf, true
+}
+
+// shadowEpsilon is the relative distance before a sampled point on an
+// emitter that shadow rays stop at, so that they don't hit the emitter.
+const shadowEpsilon = 1e-4
+
+// emitterWeight gives the MIS weight for light from an emitter that was hit
+// by a ray scattered from a surface or medium, given that the emitter could
+// also have been sampled directly.
+func (t *tracer) emitterWeight(from *scatterEvent, x intersection) float64 {
+	if from == nil || t.emitters == nil {
+		return 1
+	}
+	pmf, area := t.emitters.pmf(from.point, from.normal, x.primID)
+	if pmf == 0 {
+		return 1
+	}
+	toX := x.point.Sub(from.point)
+	cos := math.Abs(x.unitNormal.Dot(toX.Unit()))
+	if cos == 0 {
+		return 1
+	}
+	pdf := pmf * toX.LengthSq() / (cos * area)
+	return powerHeuristic(from.pdf, pdf)
+}
+
+// sampleLight chooses one of the lights at random, and finds the direction
+// to it and the irradiance it produces at the start of a ray (accounting for
+// occlusion, media, and the probability of choosing the light). The ray's
+// direction is ignored, but its start should already be offset from any
+// surface it's on.
+func (t *tracer) sampleLight(r xmath.Ray, med medium) (xmath.Vector, colour.Colour, bool) {
+	if len(t.lights) == 0 {
+		return xmath.Vector{}, colour.Colour{}, false
+	}
+	l := t.lights[t.rng.Intn(len(t.lights))]
+	dir, dist, irradiance := l.sample(r.Start)
+	if irradiance == (colour.Colour{}) {
+		return xmath.Vector{}, colour.Colour{}, false
+	}
+	r.Dir = dir
+	tr := t.transmittance(r, dist, med)
+	if tr == (colour.Colour{}) {
+		return xmath.Vector{}, colour.Colour{}, false
+	}
+	return dir, t.spectrum(irradiance).Mul(tr).Scale(float64(len(t.lights))), true
+}
+
+// transmittance finds the fraction of light that travels along a ray up to
+// tMax without being blocked. Medium boundaries and the backs of one-sided
+// surfaces don't block light, but it's attenuated by the media it passes
+// through.
+func (t *tracer) transmittance(r xmath.Ray, tMax float64, med medium) colour.Colour {
+	tr := colour.Colour{1, 1, 1}
+	for i := 0; i < 1000; i++ {
+		x, mat, hit := t.accel.closestHit(r)
+		hit = hit && x.distance < tMax
+		dist := tMax
+		if hit {
+			dist = x.distance
+		}
+		if med != nil {
+			tr = tr.Mul(t.mediumFor(med).transmittance(r, dist, t.rng))
+		}
+		if !hit {
+			return tr
+		}
+		if tr == (colour.Colour{}) {
+			return colour.Colour{}
+		}
+		switch {
+		case mat.culls(x, r.Dir):
+			// The back of a one-sided surface doesn't block light.
+		case mat.Medium == nil:
+			return colour.Colour{}
+		case med == mat.Medium:
+			med = t.outside
+		default:
+			med = mat.Medium
+		}
+		r = spawnRay(x, r.Dir)
+		tMax -= dist
+	}
+	return colour.Colour{}
+}
 
-		return t.tracePath(xmath.Ray{Start: hitLoc, Dir: rnd}).
-			Scale(brdf / (1 - pEmit)).
-			Mul(material.Colour)
+// spawnRay creates a ray leaving an intersection. The ray start is offset
+// from the hit point by just enough to avoid re-intersecting the surface.
+func spawnRay(x intersection, dir xmath.Vector) xmath.Ray {
+	return xmath.Ray{
+		Start: offsetRayOrigin(x.point, x.pointErr, x.unitNormal, dir),
+		Dir:   dir,
 	}
 }
@@ -0,0 +1,342 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+// densityGrid is a dense 3D array of densities.
+type densityGrid struct {
+	X, Y, Z int
+	Data    []float32 // X varies fastest, then Y, then Z.
+}
+
+func (g *densityGrid) at(x, y, z int) float64 {
+	return float64(g.Data[x+g.X*(y+g.Y*z)])
+}
+
+// lookup interpolates the density at a point in grid coordinates (where each
+// cell is a unit cube). Values are at the cell centers.
+func (g *densityGrid) lookup(p xmath.Vector) float64 {
+	dims := [3]int{g.X, g.Y, g.Z}
+	coords := [3]float64{p.X, p.Y, p.Z}
+	var lo, hi [3]int
+	var frac [3]float64
+	for i, c := range coords {
+		if !(c >= 0 && c <= float64(dims[i])) {
+			return 0
+		}
+		f := c - 0.5
+		fl := math.Floor(f)
+		frac[i] = f - fl
+		lo[i] = xmath.IntMax(0, int(fl))
+		hi[i] = xmath.IntMin(dims[i]-1, int(fl)+1)
+	}
+	lerp := func(a, b, t float64) float64 { return a + (b-a)*t }
+	x00 := lerp(g.at(lo[0], lo[1], lo[2]), g.at(hi[0], lo[1], lo[2]), frac[0])
+	x10 := lerp(g.at(lo[0], hi[1], lo[2]), g.at(hi[0], hi[1], lo[2]), frac[0])
+	x01 := lerp(g.at(lo[0], lo[1], hi[2]), g.at(hi[0], lo[1], hi[2]), frac[0])
+	x11 := lerp(g.at(lo[0], hi[1], hi[2]), g.at(hi[0], hi[1], hi[2]), frac[0])
+	return lerp(lerp(x00, x10, frac[1]), lerp(x01, x11, frac[1]), frac[2])
+}
+
+// loadDensityGrid reads either a raw density file (with a .raw extension),
+// which needs its resolution to be given, or a density file with a header.
+func loadDensityGrid(filename string, resolution [3]int) (*densityGrid, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open density grid: %v", err)
+	}
+	defer f.Close()
+	var g *densityGrid
+	if strings.EqualFold(filepath.Ext(filename), ".raw") {
+		g, err = decodeRawDensities(bufio.NewReader(f), resolution)
+	} else {
+		g, err = decodeDensities(bufio.NewReader(f))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode density grid %v: %v", filename, err)
+	}
+	return g, nil
+}
+
+// decodeDensities reads the density format with a header (see
+// scene.DensityGrid).
+func decodeDensities(r io.Reader) (*densityGrid, error) {
+	var header struct {
+		Magic   [4]byte
+		X, Y, Z uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != "GDEN" {
+		return nil, errors.New("bad magic number")
+	}
+	return decodeRawDensities(r, [3]int{int(header.X), int(header.Y), int(header.Z)})
+}
+
+func decodeRawDensities(r io.Reader, resolution [3]int) (*densityGrid, error) {
+	g := &densityGrid{X: resolution[0], Y: resolution[1], Z: resolution[2]}
+	if err := checkGridSize(g.X, g.Y, g.Z); err != nil {
+		return nil, err
+	}
+	g.Data = make([]float32, g.X*g.Y*g.Z)
+	if err := binary.Read(r, binary.LittleEndian, g.Data); err != nil {
+		return nil, err
+	}
+	for _, d := range g.Data {
+		if !(d >= 0) || math.IsInf(float64(d), +1) {
+			return nil, fmt.Errorf("bad density: %v", d)
+		}
+	}
+	return g, nil
+}
+
+// majorantCellSize is the width of each majorant grid cell, in density grid
+// cells.
+const majorantCellSize = 8
+
+// majorantGrid is a coarse grid that holds an upper bound of the density
+// within each of its cells. Tracking through a medium then only needs to
+// take small steps in the cells where the density is high.
+type majorantGrid struct {
+	Res [3]int
+	Max []float64
+}
+
+func newMajorantGrid(g *densityGrid) majorantGrid {
+	dims := [3]int{g.X, g.Y, g.Z}
+	var m majorantGrid
+	for i, d := range dims {
+		m.Res[i] = (d + majorantCellSize - 1) / majorantCellSize
+	}
+	m.Max = make([]float64, m.Res[0]*m.Res[1]*m.Res[2])
+
+	// Interpolation at the edge of a cell uses the neighbouring density
+	// cells, so they're included in the bound.
+	var lo, hi [3]int
+	for mz := 0; mz < m.Res[2]; mz++ {
+		for my := 0; my < m.Res[1]; my++ {
+			for mx := 0; mx < m.Res[0]; mx++ {
+				for i, c := range [3]int{mx, my, mz} {
+					lo[i] = xmath.IntMax(0, c*majorantCellSize-1)
+					hi[i] = xmath.IntMin(dims[i]-1, (c+1)*majorantCellSize)
+				}
+				var max float64
+				for z := lo[2]; z <= hi[2]; z++ {
+					for y := lo[1]; y <= hi[1]; y++ {
+						for x := lo[0]; x <= hi[0]; x++ {
+							max = math.Max(max, g.at(x, y, z))
+						}
+					}
+				}
+				m.Max[mx+m.Res[0]*(my+m.Res[1]*mz)] = max
+			}
+		}
+	}
+	return m
+}
+
+// traverse visits the cells of the majorant grid that a ray passes through
+// (in grid coordinates) up to tMax, in order. For each cell, fn is called
+// with the interval of the ray inside the cell and the cell's majorant.
+// Traversal stops early if fn returns false.
+func (m *majorantGrid) traverse(r xmath.Ray, tMax float64, fn func(t0, t1, max float64) bool) {
+	size := float64(majorantCellSize)
+	extent := xmath.Vect(float64(m.Res[0]), float64(m.Res[1]), float64(m.Res[2])).Scale(size)
+	tNear, tFar, ok := rayBoxInterval(r, xmath.Vector{}, extent)
+	t0, tEnd := math.Max(tNear, 0), math.Min(tFar, tMax)
+	if !ok || !(t0 < tEnd) {
+		return
+	}
+
+	start := [3]float64{r.Start.X, r.Start.Y, r.Start.Z}
+	dir := [3]float64{r.Dir.X, r.Dir.Y, r.Dir.Z}
+	var cell, step [3]int
+	var tNext, tDelta [3]float64
+	for i := range cell {
+		p := start[i] + dir[i]*t0
+		cell[i] = xmath.IntMax(0, xmath.IntMin(m.Res[i]-1, int(math.Floor(p/size))))
+		switch {
+		case dir[i] > 0:
+			step[i] = 1
+			tNext[i] = (float64(cell[i]+1)*size - start[i]) / dir[i]
+			tDelta[i] = size / dir[i]
+		case dir[i] < 0:
+			step[i] = -1
+			tNext[i] = (float64(cell[i])*size - start[i]) / dir[i]
+			tDelta[i] = -size / dir[i]
+		default:
+			tNext[i], tDelta[i] = math.Inf(+1), math.Inf(+1)
+		}
+	}
+
+	for {
+		axis := 0
+		if tNext[1] < tNext[axis] {
+			axis = 1
+		}
+		if tNext[2] < tNext[axis] {
+			axis = 2
+		}
+		t1 := math.Min(tNext[axis], tEnd)
+		max := m.Max[cell[0]+m.Res[0]*(cell[1]+m.Res[1]*cell[2])]
+		if t0 < t1 && !fn(t0, t1, max) {
+			return
+		}
+		if t1 >= tEnd {
+			return
+		}
+		t0 = t1
+		cell[axis] += step[axis]
+		if cell[axis] < 0 || cell[axis] >= m.Res[axis] {
+			return
+		}
+		tNext[axis] += tDelta[axis]
+	}
+}
+
+// gridMedium is a heterogeneous medium, with its density given by a grid.
+// The coefficients are per unit density per unit distance.
+type gridMedium struct {
+	Absorption colour.Colour `json:"absorption"`
+	Scattering colour.Colour `json:"scattering"`
+	Asymmetry  float64       `json:"asymmetry"` // Henyey-Greenstein g.
+
+	Grid      *densityGrid  `json:"-"`
+	Majorants *majorantGrid `json:"-"`
+
+	// The grid covers the box from Corner to Corner+Size.
+	Corner xmath.Vector `json:"corner"`
+	Size   xmath.Vector `json:"size"`
+}
+
+func newGridMedium(proto scene.Medium, grid *densityGrid) *gridMedium {
+	majorants := newMajorantGrid(grid)
+	return &gridMedium{
+		Absorption: proto.Absorption,
+		Scattering: proto.Scattering,
+		Asymmetry:  proto.Asymmetry,
+		Grid:       grid,
+		Majorants:  &majorants,
+		Corner:     proto.Density.Corner,
+		Size:       proto.Density.Size,
+	}
+}
+
+func (m *gridMedium) asymmetry() float64 {
+	return m.Asymmetry
+}
+
+func (m *gridMedium) convert(f func(colour.Colour) colour.Colour) medium {
+	converted := *m
+	converted.Absorption = f(m.Absorption)
+	converted.Scattering = f(m.Scattering)
+	return &converted
+}
+
+// toGrid transforms a ray into grid coordinates. The transform is affine, so
+// distances along the ray are preserved.
+func (m *gridMedium) toGrid(r xmath.Ray) xmath.Ray {
+	scale := xmath.Vect(float64(m.Grid.X), float64(m.Grid.Y), float64(m.Grid.Z)).Div(m.Size)
+	return xmath.Ray{
+		Start: r.Start.Sub(m.Corner).Mul(scale),
+		Dir:   r.Dir.Mul(scale),
+	}
+}
+
+// sampleDistance uses spectral tracking (delta tracking generalised to
+// coefficients that vary with wavelength). Tentative collisions are sampled
+// using the majorant, and are then randomly classified as absorption,
+// scattering, or null (fictitious) collisions.
+func (m *gridMedium) sampleDistance(r xmath.Ray, tMax float64, rng *rand.Rand) (float64, colour.Colour, bool) {
+	sigmaT := m.Absorption.Add(m.Scattering)
+	maxSigmaT := math.Max(sigmaT.R, math.Max(sigmaT.G, sigmaT.B))
+	avg := func(c colour.Colour) float64 { return (c.R + c.G + c.B) / 3 }
+
+	gr := m.toGrid(r)
+	weight := colour.Colour{1, 1, 1}
+	dist, scattered := tMax, false
+	m.Majorants.traverse(gr, tMax, func(t0, t1, max float64) bool {
+		mu := max * maxSigmaT
+		if mu == 0 {
+			return true
+		}
+		for t := t0; ; {
+			t -= math.Log(1-rng.Float64()) / mu
+			if t >= t1 {
+				return true
+			}
+			d := m.Grid.lookup(gr.At(t))
+			sigmaA := m.Absorption.Scale(d)
+			sigmaS := m.Scattering.Scale(d)
+			sigmaN := colour.Colour{mu, mu, mu}.Add(sigmaA.Add(sigmaS).Scale(-1))
+
+			// Choose the collision type in proportion to its contribution.
+			pA, pS, pN := avg(weight.Mul(sigmaA)), avg(weight.Mul(sigmaS)), avg(weight.Mul(sigmaN))
+			sum := pA + pS + pN
+			u := rng.Float64() * sum
+			switch {
+			case u < pA:
+				dist, weight = t, colour.Colour{}
+				return false
+			case u < pA+pS:
+				dist, scattered = t, true
+				weight = weight.Mul(sigmaS).Scale(sum / (mu * pS))
+				return false
+			default:
+				weight = weight.Mul(sigmaN).Scale(sum / (mu * pN))
+			}
+		}
+	})
+	return dist, weight, scattered
+}
+
+// transmittance uses ratio tracking, where the transmittance is multiplied
+// by the probability of a null collision at each tentative collision.
+func (m *gridMedium) transmittance(r xmath.Ray, tMax float64, rng *rand.Rand) colour.Colour {
+	sigmaT := m.Absorption.Add(m.Scattering)
+	maxSigmaT := math.Max(sigmaT.R, math.Max(sigmaT.G, sigmaT.B))
+
+	gr := m.toGrid(r)
+	tr := colour.Colour{1, 1, 1}
+	m.Majorants.traverse(gr, tMax, func(t0, t1, max float64) bool {
+		mu := max * maxSigmaT
+		if mu == 0 {
+			return true
+		}
+		for t := t0; ; {
+			t -= math.Log(1-rng.Float64()) / mu
+			if t >= t1 {
+				return true
+			}
+			d := m.Grid.lookup(gr.At(t))
+			tr = tr.Mul(colour.Colour{1, 1, 1}.Add(sigmaT.Scale(-d / mu)))
+
+			// Once the transmittance is low, Russian roulette avoids the
+			// cost of continuing for little benefit.
+			if math.Max(tr.R, math.Max(tr.G, tr.B)) < 0.1 {
+				const q = 0.75
+				if rng.Float64() < q {
+					tr = colour.Colour{}
+					return false
+				}
+				tr = tr.Scale(1 / (1 - q))
+			}
+		}
+	})
+	return tr
+}
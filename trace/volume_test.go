@@ -0,0 +1,141 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/scene"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func TestLoadDensityGrid(t *testing.T) {
+	densities := []float32{0, 0.5, 1, 1.5, 2, 2.5}
+
+	var buf bytes.Buffer
+	buf.WriteString("GDEN")
+	binary.Write(&buf, binary.LittleEndian, [3]uint32{1, 2, 3})
+	binary.Write(&buf, binary.LittleEndian, densities)
+	withHeader, err := loadDensityGrid(writeTestFile(t, "grid.den", buf.Bytes()), [3]int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, densities)
+	raw, err := loadDensityGrid(writeTestFile(t, "grid.raw", buf.Bytes()), [3]int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range []*densityGrid{withHeader, raw} {
+		if g.X != 1 || g.Y != 2 || g.Z != 3 {
+			t.Fatalf("wrong size: %vx%vx%v", g.X, g.Y, g.Z)
+		}
+		if g.at(0, 1, 0) != 0.5 || g.at(0, 0, 2) != 2 {
+			t.Errorf("wrong data: %v", g.Data)
+		}
+	}
+
+	if _, err := loadDensityGrid(writeTestFile(t, "short.raw", buf.Bytes()), [3]int{2, 2, 3}); err == nil {
+		t.Error("expected error for truncated raw file")
+	}
+}
+
+func TestMajorantsBoundDensity(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	g := &densityGrid{X: 20, Y: 9, Z: 17}
+	g.Data = make([]float32, g.X*g.Y*g.Z)
+	for i := range g.Data {
+		if rng.Intn(10) == 0 {
+			g.Data[i] = rng.Float32()
+		}
+	}
+	m := newMajorantGrid(g)
+
+	// Visit the cells along random rays, and check the density at random
+	// points within each.
+	for i := 0; i < 1000; i++ {
+		r := xmath.Ray{
+			Start: xmath.Vect(rng.Float64()*20, rng.Float64()*9, rng.Float64()*17),
+			Dir:   randomUnit(rng),
+		}
+		var last float64
+		m.traverse(r, math.Inf(+1), func(t0, t1, max float64) bool {
+			if t0 < last || t1 < t0 {
+				t.Fatalf("cells out of order: [%v, %v] after %v", t0, t1, last)
+			}
+			last = t1
+			for j := 0; j < 10; j++ {
+				p := r.At(t0 + (t1-t0)*rng.Float64())
+				if d := g.lookup(p); d > max {
+					t.Fatalf("density %v at %v exceeds majorant %v", d, p, max)
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestGridMediumMatchesHomogeneous(t *testing.T) {
+	g := &densityGrid{X: 16, Y: 16, Z: 16}
+	g.Data = make([]float32, g.X*g.Y*g.Z)
+	for i := range g.Data {
+		g.Data[i] = 2
+	}
+	proto := scene.Medium{
+		Absorption: colour.Colour{R: 0.1, G: 0.5, B: 0},
+		Scattering: colour.Colour{R: 0.4, G: 0.5, B: 1},
+		Density:    &scene.DensityGrid{Corner: xmath.Vect(-1, -1, -1), Size: xmath.Vect(2, 2, 2)},
+	}
+	m := newGridMedium(proto, g)
+
+	// The ray passes through 1 unit of the box before reaching the surface.
+	r := xmath.Ray{Start: xmath.Vect(0, -2, 0), Dir: xmath.Vect(0, 1, 0)}
+	const tMax = 2
+
+	rng := rand.New(rand.NewSource(1))
+	n := rayCount()
+	var surface, scatter, ratio colour.Colour
+	for i := 0; i < n; i++ {
+		dist, weight, scattered := m.sampleDistance(r, tMax, rng)
+		if scattered {
+			if dist < 1 || dist >= tMax {
+				t.Fatalf("scattered outside of the grid: %v", dist)
+			}
+			scatter = scatter.Add(weight)
+		} else {
+			surface = surface.Add(weight)
+		}
+		ratio = ratio.Add(m.transmittance(r, tMax, rng))
+	}
+	surface = surface.Scale(1 / float64(n))
+	scatter = scatter.Scale(1 / float64(n))
+	ratio = ratio.Scale(1 / float64(n))
+
+	sigmaT := proto.Absorption.Add(proto.Scattering).Scale(2)
+	sigmaS := proto.Scattering.Scale(2)
+	for _, ch := range []struct {
+		name                                 string
+		sigmaS, sigmaT, surface, scat, ratio float64
+	}{
+		{"R", sigmaS.R, sigmaT.R, surface.R, scatter.R, ratio.R},
+		{"G", sigmaS.G, sigmaT.G, surface.G, scatter.G, ratio.G},
+		{"B", sigmaS.B, sigmaT.B, surface.B, scatter.B, ratio.B},
+	} {
+		tr := math.Exp(-ch.sigmaT)
+		if math.Abs(ch.surface-tr) > 0.02 {
+			t.Errorf("%s: want transmittance %v, got %v from delta tracking", ch.name, tr, ch.surface)
+		}
+		if math.Abs(ch.ratio-tr) > 0.02 {
+			t.Errorf("%s: want transmittance %v, got %v from ratio tracking", ch.name, tr, ch.ratio)
+		}
+		wantScat := ch.sigmaS / ch.sigmaT * (1 - tr)
+		if math.Abs(ch.scat-wantScat) > 0.02 {
+			t.Errorf("%s: want scattering %v, got %v", ch.name, wantScat, ch.scat)
+		}
+	}
+}
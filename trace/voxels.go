@@ -0,0 +1,235 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/peterstace/grayt/xmath"
+)
+
+// voxels is a grid of voxels. Hits give the palette index of the voxel in
+// the intersection, so that each index can have its own material. Only the
+// first voxel along a ray is hit, so faces between neighbouring voxels are
+// never hit.
+type voxels struct {
+	Grid   *voxelGrid   `json:"-"`
+	Corner xmath.Vector `json:"corner"`
+	Size   float64      `json:"size"` // of each voxel
+
+	// Bounds (in voxel coordinates) of the non-empty voxels. Lo is inclusive
+	// and Hi is exclusive.
+	Lo, Hi [3]int `json:"-"`
+}
+
+func newVoxels(grid *voxelGrid, corner xmath.Vector, size float64) *voxels {
+	v := &voxels{
+		Grid:   grid,
+		Corner: corner,
+		Size:   size,
+		Lo:     [3]int{grid.X, grid.Y, grid.Z},
+	}
+	for z := 0; z < grid.Z; z++ {
+		for y := 0; y < grid.Y; y++ {
+			for x := 0; x < grid.X; x++ {
+				if grid.at(x, y, z) == 0 {
+					continue
+				}
+				v.Lo = [3]int{xmath.IntMin(v.Lo[0], x), xmath.IntMin(v.Lo[1], y), xmath.IntMin(v.Lo[2], z)}
+				v.Hi = [3]int{xmath.IntMax(v.Hi[0], x+1), xmath.IntMax(v.Hi[1], y+1), xmath.IntMax(v.Hi[2], z+1)}
+			}
+		}
+	}
+	return v
+}
+
+func (v *voxels) String() string {
+	return fmt.Sprintf("Type=voxels Corner=%v Size=%v Grid=%vx%vx%v",
+		v.Corner, v.Size, v.Grid.X, v.Grid.Y, v.Grid.Z)
+}
+
+// intersect steps through the voxels along the ray, in the same way as the
+// grid acceleration structure.
+func (v *voxels) intersect(r xmath.Ray) (intersection, bool) {
+	dims := [3]int{v.Grid.X, v.Grid.Y, v.Grid.Z}
+	rel := r.Start.Sub(v.Corner)
+	start := [3]float64{rel.X, rel.Y, rel.Z}
+	dir := [3]float64{r.Dir.X, r.Dir.Y, r.Dir.Z}
+
+	tNear, tFar := math.Inf(-1), math.Inf(+1)
+	axis := 0
+	for i := range dims {
+		extent := float64(dims[i]) * v.Size
+		if dir[i] == 0 {
+			if start[i] < 0 || start[i] > extent {
+				return intersection{}, false
+			}
+			continue
+		}
+		t1, t2 := -start[i]/dir[i], (extent-start[i])/dir[i]
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+		if t1 > tNear {
+			tNear, axis = t1, i
+		}
+		tFar = math.Min(tFar, t2)
+	}
+	if tNear > tFar || tFar <= 0 {
+		return intersection{}, false
+	}
+
+	t := math.Max(tNear, 0)
+
+	var cell, step [3]int
+	var tNext, tDelta [3]float64
+	onFace := tNear > 0 // Whether the ray starts on a face of the first cell.
+	for i := range dims {
+		// Points on a cell boundary (such as the start of a ray spawned from
+		// a voxel face) are in the cell that the ray is heading into.
+		p := (start[i] + dir[i]*t) / v.Size
+		c := math.Floor(p)
+		if b := math.Round(p); math.Abs(p-b) < voxelBoundaryEpsilon {
+			switch {
+			case dir[i] > 0:
+				c = b
+			case dir[i] < 0:
+				c = b - 1
+			}
+			if dir[i] != 0 && !onFace {
+				onFace, axis = true, i
+			}
+		}
+		cell[i] = xmath.IntMax(0, xmath.IntMin(dims[i]-1, int(c)))
+		switch {
+		case dir[i] > 0:
+			step[i] = 1
+			tNext[i] = (float64(cell[i]+1)*v.Size - start[i]) / dir[i]
+			tDelta[i] = v.Size / dir[i]
+		case dir[i] < 0:
+			step[i] = -1
+			tNext[i] = (float64(cell[i])*v.Size - start[i]) / dir[i]
+			tDelta[i] = -v.Size / dir[i]
+		default:
+			tNext[i], tDelta[i] = math.Inf(+1), math.Inf(+1)
+		}
+	}
+
+	// Rays that start inside of a voxel (rather than on one of its faces) are
+	// inside of the solid, so hit the face where they leave it (like rays
+	// starting inside of a sphere).
+	var solid uint8 // The last occupied voxel, while inside of the solid.
+	if !onFace {
+		solid = v.Grid.at(cell[0], cell[1], cell[2])
+	}
+	for {
+		idx := v.Grid.at(cell[0], cell[1], cell[2])
+		switch {
+		case solid == 0 && idx != 0:
+			x := v.faceHit(r, t, axis, cell[axis], step[axis])
+			x.paletteIndex = int(idx)
+			return x, true
+		case solid != 0 && idx == 0:
+			return v.exitHit(r, t, axis, cell[axis], step[axis], solid), true
+		case idx != 0:
+			solid = idx
+		}
+
+		axis = 0
+		if tNext[1] < tNext[axis] {
+			axis = 1
+		}
+		if tNext[2] < tNext[axis] {
+			axis = 2
+		}
+		t = tNext[axis]
+		cell[axis] += step[axis]
+		if t > tFar || cell[axis] < 0 || cell[axis] >= dims[axis] {
+			if solid != 0 {
+				return v.exitHit(r, t, axis, cell[axis], step[axis], solid), true
+			}
+			return intersection{}, false
+		}
+		tNext[axis] += tDelta[axis]
+	}
+}
+
+// voxelBoundaryEpsilon is how close (in voxels) a point must be to a cell
+// boundary to count as being on it.
+const voxelBoundaryEpsilon = 1e-9
+
+// exitHit creates a hit where a ray leaves the solid from the inside, on the
+// face of the cell at coordinate c (along axis) that it's moving into.
+func (v *voxels) exitHit(r xmath.Ray, t float64, axis, c, step int, index uint8) intersection {
+	x := v.faceHit(r, t, axis, c, step)
+	x.unitNormal = x.unitNormal.Scale(-1)
+	x.paletteIndex = int(index)
+	return x
+}
+
+// faceHit creates a hit on the face of a voxel that's perpendicular to axis.
+// The ray is entering the voxel at coordinate c (along that axis).
+func (v *voxels) faceHit(r xmath.Ray, t float64, axis, c, step int) intersection {
+	// Snap the hit point onto the face.
+	face := c
+	if step < 0 {
+		face++
+	}
+	var n [3]float64
+	n[axis] = -float64(step)
+	if step == 0 {
+		// Can only happen for hits on the boundary of the grid when the ray
+		// starts exactly in the plane of the face.
+		n[axis] = 1
+	}
+	p := r.At(t)
+	err := rayHitError(r, t)
+	coord := [3]*float64{&p.X, &p.Y, &p.Z}
+	coordErr := [3]*float64{&err.X, &err.Y, &err.Z}
+	corner := [3]float64{v.Corner.X, v.Corner.Y, v.Corner.Z}
+	*coord[axis] = corner[axis] + float64(face)*v.Size
+	*coordErr[axis] = gamma(2) * (math.Abs(corner[axis]) + math.Abs(float64(face)*v.Size))
+	return intersection{
+		unitNormal: xmath.Vect(n[0], n[1], n[2]),
+		distance:   t,
+		point:      p,
+		pointErr:   err,
+		part:       axis,
+	}
+}
+
+// parameterise maps each voxel face to the unit square, using the same
+// orientations as alignedBox.
+func (v *voxels) parameterise(x *intersection) {
+	local := x.point.Sub(v.Corner).Scale(1 / v.Size)
+	frac := local.Sub(local.Floor())
+	switch x.part {
+	case 0:
+		x.u, x.v = frac.Z, frac.Y
+		x.dpdu, x.dpdv = xmath.Vect(0, 0, v.Size), xmath.Vect(0, v.Size, 0)
+	case 1:
+		x.u, x.v = frac.X, frac.Z
+		x.dpdu, x.dpdv = xmath.Vect(v.Size, 0, 0), xmath.Vect(0, 0, v.Size)
+	default:
+		x.u, x.v = frac.X, frac.Y
+		x.dpdu, x.dpdv = xmath.Vect(v.Size, 0, 0), xmath.Vect(0, v.Size, 0)
+	}
+}
+
+func (v *voxels) bound() (xmath.Vector, xmath.Vector) {
+	lo := xmath.Vect(float64(v.Lo[0]), float64(v.Lo[1]), float64(v.Lo[2])).Scale(v.Size).Add(v.Corner)
+	hi := xmath.Vect(float64(v.Hi[0]), float64(v.Hi[1]), float64(v.Hi[2])).Scale(v.Size).Add(v.Corner)
+	return lo.AddULPs(-ulpFudgeFactor), hi.AddULPs(ulpFudgeFactor)
+}
+
+func (v *voxels) translate(t xmath.Vector) {
+	v.Corner = v.Corner.Add(t)
+}
+
+func (v *voxels) rotate(xmath.Vector, float64) {
+	panic("cannot rotate voxels")
+}
+
+func (v *voxels) scale(f float64) {
+	v.Corner = v.Corner.Scale(f)
+	v.Size *= f
+}
@@ -0,0 +1,199 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterstace/grayt/colour"
+	"github.com/peterstace/grayt/xmath"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadRawVoxels(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("GVOX")
+	binary.Write(&buf, binary.LittleEndian, [3]uint32{2, 1, 3})
+	buf.Write([]byte{0, 1, 0, 0, 2, 0})
+	palette := make([]byte, 255*3)
+	copy(palette, []byte{0xff, 0, 0, 0, 0, 0xff})
+	buf.Write(palette)
+
+	g, err := loadVoxelGrid(writeTestFile(t, "grid.raw", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.X != 2 || g.Y != 1 || g.Z != 3 {
+		t.Fatalf("wrong size: %vx%vx%v", g.X, g.Y, g.Z)
+	}
+	if g.at(1, 0, 0) != 1 || g.at(0, 0, 2) != 2 || g.at(0, 0, 0) != 0 {
+		t.Errorf("wrong data: %v", g.Data)
+	}
+	if g.Palette[1] != (colour.Colour{R: 1}) || g.Palette[2] != (colour.Colour{B: 1}) {
+		t.Errorf("wrong palette: %v %v", g.Palette[1], g.Palette[2])
+	}
+}
+
+func TestLoadRawVoxelsBadSize(t *testing.T) {
+	for _, size := range [][3]uint32{
+		{0, 1, 1},
+		{1 << 21, 1 << 21, 1 << 22}, // The product overflows to 0.
+		{1<<32 - 1, 1<<32 - 1, 1<<32 - 1},
+	} {
+		var buf bytes.Buffer
+		buf.WriteString("GVOX")
+		binary.Write(&buf, binary.LittleEndian, size)
+		if _, err := loadVoxelGrid(writeTestFile(t, "grid.raw", buf.Bytes())); err == nil {
+			t.Errorf("expected error for size %v", size)
+		}
+	}
+}
+
+func TestLoadVox(t *testing.T) {
+	chunk := func(id string, content []byte) []byte {
+		var buf bytes.Buffer
+		buf.WriteString(id)
+		binary.Write(&buf, binary.LittleEndian, [2]int32{int32(len(content)), 0})
+		buf.Write(content)
+		return buf.Bytes()
+	}
+	var size, xyzi, rgba bytes.Buffer
+	binary.Write(&size, binary.LittleEndian, [3]int32{2, 3, 4}) // Z up.
+	binary.Write(&xyzi, binary.LittleEndian, int32(1))
+	xyzi.Write([]byte{1, 0, 3, 5})
+	rgba.Write(make([]byte, 256*4))
+	copy(rgba.Bytes()[4*4:], []byte{0, 0xff, 0, 0xff}) // Index 5.
+	children := append(chunk("SIZE", size.Bytes()), chunk("XYZI", xyzi.Bytes())...)
+	children = append(children, chunk("RGBA", rgba.Bytes())...)
+
+	var buf bytes.Buffer
+	buf.WriteString("VOX ")
+	binary.Write(&buf, binary.LittleEndian, int32(150))
+	buf.WriteString("MAIN")
+	binary.Write(&buf, binary.LittleEndian, [2]int32{0, int32(len(children))})
+	buf.Write(children)
+
+	g, err := loadVoxelGrid(writeTestFile(t, "model.vox", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.X != 2 || g.Y != 4 || g.Z != 3 {
+		t.Fatalf("wrong size: %vx%vx%v", g.X, g.Y, g.Z)
+	}
+	if g.at(1, 3, 2) != 5 {
+		t.Errorf("voxel not found at rotated position")
+	}
+	if g.Palette[5] != (colour.Colour{G: 1}) {
+		t.Errorf("wrong palette: %v", g.Palette[5])
+	}
+}
+
+func TestVoxelsMatchBoxes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	g := &voxelGrid{X: 5, Y: 4, Z: 6}
+	g.Data = make([]uint8, g.X*g.Y*g.Z)
+	for i := range g.Data {
+		if rng.Float64() < 0.3 {
+			g.Data[i] = uint8(1 + rng.Intn(2))
+		}
+	}
+	corner := xmath.Vect(1, -2, 0.5)
+	const size = 0.25
+	surf := newVoxels(g, corner, size)
+	var boxes []surface
+	var boxIndices []uint8
+	for z := 0; z < g.Z; z++ {
+		for y := 0; y < g.Y; y++ {
+			for x := 0; x < g.X; x++ {
+				if idx := g.at(x, y, z); idx != 0 {
+					lo := corner.Add(xmath.Vect(float64(x), float64(y), float64(z)).Scale(size))
+					boxes = append(boxes, newAlignedBox(lo, lo.Add(xmath.Vect(size, size, size))))
+					boxIndices = append(boxIndices, idx)
+				}
+			}
+		}
+	}
+
+	center := corner.Add(xmath.Vect(float64(g.X), float64(g.Y), float64(g.Z)).Scale(size / 2))
+	for i := 0; i < 10000; i++ {
+		r := xmath.Ray{
+			Start: center.Add(randomUnit(rng).Scale(2 + rng.Float64())),
+			Dir:   randomUnit(rng),
+		}
+		var want intersection
+		var wantIdx uint8
+		for j, b := range boxes {
+			if x, hit := b.intersect(r); hit && (wantIdx == 0 || x.distance < want.distance) {
+				want, wantIdx = x, boxIndices[j]
+			}
+		}
+		got, hit := surf.intersect(r)
+		gotIdx := uint8(got.paletteIndex)
+		if hit != (wantIdx != 0) {
+			t.Fatalf("want hit=%v, got hit=%v ray=%v", wantIdx != 0, hit, r)
+		}
+		if gotIdx != wantIdx {
+			t.Fatalf("wrong index: want=%v got=%v ray=%v", wantIdx, gotIdx, r)
+		}
+		if gotIdx == 0 {
+			continue
+		}
+		if math.Abs(got.distance-want.distance) > 1e-9 || got.unitNormal != want.unitNormal {
+			t.Errorf("wrong hit: want=(%v,%v) got=(%v,%v)",
+				want.distance, want.unitNormal, got.distance, got.unitNormal)
+		}
+
+		// Leaving the surface shouldn't hit the same voxel again.
+		dir := randomUnit(rng)
+		if dir.Dot(got.unitNormal) < 0 {
+			dir = dir.Scale(-1)
+		}
+		spawned := spawnRay(got, dir)
+		if x, hit := surf.intersect(spawned); hit && x.distance < 1e-9 {
+			t.Fatalf("spawned ray re-intersected at distance %v", x.distance)
+		}
+	}
+}
+
+func TestVoxelsRayStartsInsideGrid(t *testing.T) {
+	// A 3x3x3 grid with only its bottom centre voxel occupied.
+	g := &voxelGrid{X: 3, Y: 3, Z: 3}
+	g.Data = make([]uint8, g.X*g.Y*g.Z)
+	g.Data[1+g.X*g.Y] = 1
+	surf := newVoxels(g, xmath.Vect(0, 0, 0), 1)
+	down, up := xmath.Vect(0, -1, 0), xmath.Vect(0, 1, 0)
+
+	for _, tc := range []struct {
+		name   string
+		r      xmath.Ray
+		dist   float64
+		normal xmath.Vector
+	}{
+		{"empty cell", xmath.Ray{Start: xmath.Vect(1.5, 2.5, 1.5), Dir: down}, 1.5, up},
+		{"inside voxel", xmath.Ray{Start: xmath.Vect(1.5, 0.5, 1.5), Dir: up}, 0.5, up},
+		{"on grid face", xmath.Ray{Start: xmath.Vect(1.5, 0, 1.5), Dir: up}, 0, down},
+		{"on voxel face", xmath.Ray{Start: xmath.Vect(1.5, 1, 1.5), Dir: down}, 0, up},
+	} {
+		x, hit := surf.intersect(tc.r)
+		if !hit || math.Abs(x.distance-tc.dist) > 1e-9 || x.unitNormal != tc.normal {
+			t.Errorf("%s: want hit at %v with normal %v, got hit=%v at %v with normal %v",
+				tc.name, tc.dist, tc.normal, hit, x.distance, x.unitNormal)
+		}
+	}
+
+	// Leaving the top of the voxel shouldn't hit it.
+	if x, hit := surf.intersect(xmath.Ray{Start: xmath.Vect(1.5, 1, 1.5), Dir: up}); hit {
+		t.Errorf("ray leaving voxel hit at %v", x.distance)
+	}
+}
@@ -0,0 +1,218 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterstace/grayt/colour"
+)
+
+// voxelGrid is a dense 3D array of palette indices. Index 0 is empty.
+type voxelGrid struct {
+	X, Y, Z int
+	Data    []uint8 // X varies fastest, then Y, then Z.
+	Palette [256]colour.Colour
+}
+
+func (g *voxelGrid) at(x, y, z int) uint8 {
+	return g.Data[x+g.X*(y+g.Y*z)]
+}
+
+// loadVoxelGrid reads either a MagicaVoxel .vox file, or a raw voxel file
+// (any other extension).
+func loadVoxelGrid(filename string) (*voxelGrid, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open voxels: %v", err)
+	}
+	defer f.Close()
+	var g *voxelGrid
+	if strings.EqualFold(filepath.Ext(filename), ".vox") {
+		g, err = decodeVox(bufio.NewReader(f))
+	} else {
+		g, err = decodeRawVoxels(bufio.NewReader(f))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode voxels %v: %v", filename, err)
+	}
+	return g, nil
+}
+
+// decodeRawVoxels reads the raw voxel format (see scene.Voxels).
+func decodeRawVoxels(r io.Reader) (*voxelGrid, error) {
+	var header struct {
+		Magic   [4]byte
+		X, Y, Z uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != "GVOX" {
+		return nil, errors.New("bad magic number")
+	}
+	g := &voxelGrid{X: int(header.X), Y: int(header.Y), Z: int(header.Z)}
+	if err := g.checkSize(); err != nil {
+		return nil, err
+	}
+	g.Data = make([]uint8, g.X*g.Y*g.Z)
+	if _, err := io.ReadFull(r, g.Data); err != nil {
+		return nil, err
+	}
+	var palette [255][3]uint8
+	if err := binary.Read(r, binary.LittleEndian, &palette); err != nil {
+		return nil, err
+	}
+	for i, rgb := range palette {
+		g.Palette[i+1] = colour.Colour{
+			R: float64(rgb[0]) / 0xff,
+			G: float64(rgb[1]) / 0xff,
+			B: float64(rgb[2]) / 0xff,
+		}.DecodeSRGB()
+	}
+	return g, nil
+}
+
+// maxVoxelGridSize limits the memory used by corrupt files.
+const maxVoxelGridSize = 1 << 30
+
+func (g *voxelGrid) checkSize() error {
+	return checkGridSize(g.X, g.Y, g.Z)
+}
+
+// checkGridSize checks the dimensions of a grid read from a file.
+func checkGridSize(x, y, z int) error {
+	// Each dimension is checked first, so that the product can't overflow.
+	for _, n := range []int{x, y, z} {
+		if n <= 0 || n > maxVoxelGridSize {
+			return fmt.Errorf("bad size: %dx%dx%d", x, y, z)
+		}
+	}
+	if x*y > maxVoxelGridSize || x*y*z > maxVoxelGridSize {
+		return fmt.Errorf("bad size: %dx%dx%d", x, y, z)
+	}
+	return nil
+}
+
+// decodeVox reads a MagicaVoxel .vox file. Only the first model is used.
+// MagicaVoxel uses Z as up, so the model is rotated to make Y up.
+func decodeVox(r io.Reader) (*voxelGrid, error) {
+	var header struct {
+		Magic   [4]byte
+		Version int32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != "VOX " {
+		return nil, errors.New("bad magic number")
+	}
+
+	// The MAIN chunk has no content of its own. All other chunks are its
+	// children, and appear one after the other.
+	type chunkHeader struct {
+		ID           [4]byte
+		ContentSize  int32
+		ChildrenSize int32
+	}
+	var main chunkHeader
+	if err := binary.Read(r, binary.LittleEndian, &main); err != nil {
+		return nil, err
+	}
+	if string(main.ID[:]) != "MAIN" {
+		return nil, errors.New("missing MAIN chunk")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(main.ContentSize)); err != nil {
+		return nil, err
+	}
+
+	var g *voxelGrid
+	var voxels []byte // x, y, z, index tuples
+
+	// MagicaVoxel's default palette isn't included here, so models without
+	// their own palette are white.
+	var palette [256]colour.Colour
+	for i := range palette {
+		palette[i] = colour.Colour{R: 1, G: 1, B: 1}
+	}
+
+	for {
+		var ch chunkHeader
+		err := binary.Read(r, binary.LittleEndian, &ch)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ch.ContentSize < 0 || ch.ContentSize > maxVoxelGridSize {
+			return nil, fmt.Errorf("bad chunk size: %d", ch.ContentSize)
+		}
+		content := make([]byte, ch.ContentSize)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		cr := bytes.NewReader(content)
+		switch string(ch.ID[:]) {
+		case "SIZE":
+			if g != nil {
+				continue // Only the first model is used.
+			}
+			var size [3]int32
+			if err := binary.Read(cr, binary.LittleEndian, &size); err != nil {
+				return nil, err
+			}
+			g = &voxelGrid{X: int(size[0]), Y: int(size[2]), Z: int(size[1])}
+			if err := g.checkSize(); err != nil {
+				return nil, err
+			}
+		case "XYZI":
+			if voxels != nil {
+				continue
+			}
+			var n int32
+			if err := binary.Read(cr, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			if n < 0 || int(n) > cr.Len()/4 {
+				return nil, fmt.Errorf("bad voxel count: %d", n)
+			}
+			voxels = content[4 : 4+4*int(n)]
+		case "RGBA":
+			// Entry i holds the colour of palette index i+1.
+			var rgba [256][4]uint8
+			if err := binary.Read(cr, binary.LittleEndian, &rgba); err != nil {
+				return nil, err
+			}
+			for i := 0; i < 255; i++ {
+				palette[i+1] = colour.Colour{
+					R: float64(rgba[i][0]) / 0xff,
+					G: float64(rgba[i][1]) / 0xff,
+					B: float64(rgba[i][2]) / 0xff,
+				}.DecodeSRGB()
+			}
+		}
+	}
+	if g == nil || voxels == nil {
+		return nil, errors.New("missing SIZE or XYZI chunk")
+	}
+
+	// Swap Y and Z to make Y up, and mirror the new Z axis to preserve
+	// handedness.
+	g.Data = make([]uint8, g.X*g.Y*g.Z)
+	g.Palette = palette
+	for i := 0; i+4 <= len(voxels); i += 4 {
+		x, y, z := int(voxels[i]), int(voxels[i+2]), g.Z-1-int(voxels[i+1])
+		if x >= g.X || y >= g.Y || z < 0 {
+			return nil, fmt.Errorf("voxel out of bounds: %v", voxels[i:i+3])
+		}
+		g.Data[x+g.X*(y+g.Y*z)] = voxels[i+3]
+	}
+	return g, nil
+}